@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+ALARM RULES
+Rules defined over the http api, evaluated against the messages, positions and connections of the
+devices. A rule that matches raises an alert which is stored until someone acknowledges it.
+Devices report alarms in the format:
+$ALARM;[DeviceID];[time];[alarm type]<CR>
+ex: $ALARM;123456;20240817-123504;PANIC\r
+~~~~~~~~~~~~~~~
+*/
+
+// kinds of rule
+const (
+	RULE_SPEED   string = "speed"   // speed over Threshold km/h for DurationSeconds
+	RULE_OFFLINE string = "offline" // disconnected for DurationSeconds
+	RULE_ALARM   string = "alarm"   // device reported an alarm, of AlarmType if set
+	RULE_NO_FIX  string = "noFix"   // connected without a valid gps fix for DurationSeconds
+)
+
+// alert severities
+const (
+	SEVERITY_INFO     string = "info"
+	SEVERITY_WARNING  string = "warning"
+	SEVERITY_CRITICAL string = "critical"
+)
+
+// how often the rules that fire on something not happening are checked
+const RULE_TIMER_INTERVAL time.Duration = 5 * time.Second
+
+// a rule, stored in mongodb and sent to/received from API clients as is
+type AlarmRule_Schema struct {
+	Id              string   `bson:"_id" json:"id"`
+	Name            string   `bson:"name" json:"name"`
+	Type            string   `bson:"type" json:"type"`
+	Severity        string   `bson:"severity" json:"severity"`
+	Devices         []string `bson:"devices" json:"devices"`                                     // devices the rule applies to, empty for all of them
+	Threshold       float64  `bson:"threshold,omitempty" json:"threshold,omitempty"`             // speed only, km/h
+	DurationSeconds int      `bson:"durationSeconds,omitempty" json:"durationSeconds,omitempty"` // speed, offline and noFix
+	AlarmType       string   `bson:"alarmType,omitempty" json:"alarmType,omitempty"`             // alarm only, empty matches any alarm
+	Enabled         bool     `bson:"enabled" json:"enabled"`
+}
+
+// an alert raised by a rule, stored in mongodb and sent to API clients as is
+type Alert_Schema struct {
+	Id               string     `bson:"_id" json:"id"`
+	RuleId           string     `bson:"ruleId" json:"ruleId"`
+	RuleName         string     `bson:"ruleName" json:"ruleName"`
+	RuleType         string     `bson:"ruleType" json:"ruleType"`
+	DeviceId         string     `bson:"deviceId" json:"deviceId"`
+	Severity         string     `bson:"severity" json:"severity"`
+	Description      string     `bson:"description" json:"description"`
+	Time             time.Time  `bson:"time" json:"time"`
+	Acknowledged     bool       `bson:"acknowledged" json:"acknowledged"`
+	AcknowledgedBy   string     `bson:"acknowledgedBy,omitempty" json:"acknowledgedBy,omitempty"`
+	AcknowledgedTime *time.Time `bson:"acknowledgedTime,omitempty" json:"acknowledgedTime,omitempty"`
+}
+
+// check the rule is something we can evaluate
+func (r *AlarmRule_Schema) Validate() error {
+	switch r.Severity {
+	case SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_CRITICAL:
+	default:
+		return fmt.Errorf("severity must be %v, %v or %v", SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_CRITICAL)
+	}
+	switch r.Type {
+	case RULE_SPEED:
+		if r.Threshold <= 0 {
+			return fmt.Errorf("speed rule needs a positive threshold")
+		}
+		if r.DurationSeconds < 0 {
+			return fmt.Errorf("durationSeconds can't be negative")
+		}
+	case RULE_OFFLINE, RULE_NO_FIX:
+		if r.DurationSeconds <= 0 {
+			return fmt.Errorf("%v rule needs a positive durationSeconds", r.Type)
+		}
+	case RULE_ALARM:
+	default:
+		return fmt.Errorf("type must be one of %v, %v, %v or %v", RULE_SPEED, RULE_OFFLINE, RULE_ALARM, RULE_NO_FIX)
+	}
+	return nil
+}
+
+// does the rule apply to the device
+func (r *AlarmRule_Schema) AppliesTo(devId string) bool {
+	if !r.Enabled {
+		return false
+	}
+	if len(r.Devices) == 0 {
+		return true
+	}
+	for _, d := range r.Devices {
+		if d == devId {
+			return true
+		}
+	}
+	return false
+}
+
+// the rule's duration as a time.Duration
+func (r *AlarmRule_Schema) duration() time.Duration {
+	return time.Duration(r.DurationSeconds) * time.Second
+}
+
+// get the alarm type from an $ALARM message
+func parseAlarmMessage(message string) (string, error) {
+	fields := strings.Split(strings.TrimSpace(message), ";")
+	if len(fields) < 4 || fields[0] != "$ALARM" {
+		return "", fmt.Errorf("not a complete alarm message: %q", message)
+	}
+	return fields[3], nil
+}
+
+// where a device is relative to one rule
+type ruleState struct {
+	since time.Time // when the condition started being true, zero if it isn't
+	fired bool      // already raised an alert for this stretch of the condition being true
+}
+
+// what we know about a device's connection and fixes, for the rules that fire on something not happening
+type devicePresence struct {
+	connected bool
+	changed   time.Time // when it connected or disconnected
+	lastFix   time.Time // last valid fix, zero if none since connecting
+}
+
+// evaluates the rules
+type RulesEngine struct {
+	// internal
+	rules    map[string]*AlarmRule_Schema     // rule id against rule
+	states   map[string]map[string]*ruleState // rule id against device id against state
+	presence map[string]*devicePresence       // device id against presence
+	lock     sync.Mutex                       // evaluation happens on several goroutines, changes come from the http server
+
+	// injected
+	logger       *zap.Logger
+	dbc          *DBConnection
+	publishEvent PublishEventFunction // this func is meant to publish an event about a device to subscribers
+}
+
+// constructor, loads the rules already defined
+func NewRulesEngine(logger *zap.Logger, dbc *DBConnection, publishEvent PublishEventFunction) (*RulesEngine, error) {
+	re := &RulesEngine{
+		rules:        make(map[string]*AlarmRule_Schema),
+		states:       make(map[string]map[string]*ruleState),
+		presence:     make(map[string]*devicePresence),
+		logger:       logger,
+		dbc:          dbc,
+		publishEvent: publishEvent,
+	}
+	rules, err := dbc.QueryAlarmRules()
+	if err != nil {
+		return nil, fmt.Errorf("error loading alarm rules: %v", err)
+	}
+	for i := range rules {
+		re.rules[rules[i].Id] = &rules[i]
+	}
+	return re, nil
+}
+
+// check the rules that fire on something not happening, blocking until the context is done
+func (re *RulesEngine) Run(ctx context.Context) {
+	ticker := time.NewTicker(RULE_TIMER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			err := re.raise(re.evaluateTimers(now))
+			if err != nil {
+				re.logger.Error("error raising alerts", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check a position against the rules, meant to be registered as a position hook
+func (re *RulesEngine) ProcessPosition(pos *Position_Schema) error {
+	return re.raise(re.evaluatePosition(pos))
+}
+
+// check a message against the rules, meant to be registered as a message hook
+func (re *RulesEngine) ProcessMessage(msgWrap *MessageWrapper) error {
+	if getCommandFromMessage(msgWrap.message) != "ALARM" {
+		return nil
+	}
+	alarmType, err := parseAlarmMessage(msgWrap.message)
+	if err != nil {
+		return err
+	}
+	return re.raise(re.evaluateAlarm(*msgWrap.clientId, alarmType, msgWrap.recvdTime))
+}
+
+// track device connections, meant to be registered as a presence hook
+func (re *RulesEngine) ProcessPresence(devId string, connected bool, t time.Time) {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	re.presence[devId] = &devicePresence{connected: connected, changed: t}
+
+	// the offline and noFix conditions start again from here
+	for id, rule := range re.rules {
+		if rule.Type == RULE_OFFLINE || rule.Type == RULE_NO_FIX {
+			delete(re.stateMap(id), devId)
+		}
+	}
+}
+
+// get the states of a rule, creating the map if needed. Lock must be held.
+func (re *RulesEngine) stateMap(ruleId string) map[string]*ruleState {
+	if re.states[ruleId] == nil {
+		re.states[ruleId] = make(map[string]*ruleState)
+	}
+	return re.states[ruleId]
+}
+
+// get the state of a device against a rule, creating it if needed. Lock must be held.
+func (re *RulesEngine) state(ruleId string, devId string) *ruleState {
+	states := re.stateMap(ruleId)
+	if states[devId] == nil {
+		states[devId] = &ruleState{}
+	}
+	return states[devId]
+}
+
+// speed rules, and resetting noFix rules
+func (re *RulesEngine) evaluatePosition(pos *Position_Schema) []Alert_Schema {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	alerts := make([]Alert_Schema, 0)
+	if pos.Valid {
+		if p, ok := re.presence[pos.DeviceId]; ok {
+			p.lastFix = pos.FixTime
+		}
+	}
+	for id, rule := range re.rules {
+		if !rule.AppliesTo(pos.DeviceId) {
+			continue
+		}
+		switch rule.Type {
+		case RULE_SPEED:
+			state := re.state(id, pos.DeviceId)
+			if !pos.Valid || pos.Speed <= rule.Threshold {
+				*state = ruleState{}
+				continue
+			}
+			if state.since.IsZero() {
+				state.since = pos.FixTime
+			}
+			if !state.fired && pos.FixTime.Sub(state.since) >= rule.duration() {
+				state.fired = true
+				alerts = append(alerts, newAlert(rule, pos.DeviceId, pos.FixTime,
+					fmt.Sprintf("speed %.1f km/h over %.1f km/h for %v", pos.Speed, rule.Threshold, pos.FixTime.Sub(state.since))))
+			}
+		case RULE_NO_FIX:
+			if pos.Valid {
+				delete(re.stateMap(id), pos.DeviceId)
+			}
+		}
+	}
+	return alerts
+}
+
+// alarm rules
+func (re *RulesEngine) evaluateAlarm(devId string, alarmType string, t time.Time) []Alert_Schema {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	alerts := make([]Alert_Schema, 0)
+	for _, rule := range re.rules {
+		if rule.Type != RULE_ALARM || !rule.AppliesTo(devId) {
+			continue
+		}
+		if rule.AlarmType != "" && !strings.EqualFold(rule.AlarmType, alarmType) {
+			continue
+		}
+		alerts = append(alerts, newAlert(rule, devId, t, fmt.Sprintf("device reported %v alarm", alarmType)))
+	}
+	return alerts
+}
+
+// offline and noFix rules
+func (re *RulesEngine) evaluateTimers(now time.Time) []Alert_Schema {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	alerts := make([]Alert_Schema, 0)
+	for id, rule := range re.rules {
+		if rule.Type != RULE_OFFLINE && rule.Type != RULE_NO_FIX {
+			continue
+		}
+		for devId, p := range re.presence {
+			if !rule.AppliesTo(devId) {
+				continue
+			}
+			var since time.Time
+			switch {
+			case rule.Type == RULE_OFFLINE && !p.connected:
+				since = p.changed
+			case rule.Type == RULE_NO_FIX && p.connected:
+				since = p.changed
+				if p.lastFix.After(since) {
+					since = p.lastFix
+				}
+			default:
+				continue
+			}
+			state := re.state(id, devId)
+			if state.fired || now.Sub(since) < rule.duration() {
+				continue
+			}
+			state.fired = true
+			desc := fmt.Sprintf("offline since %v", since.Format(time.RFC3339))
+			if rule.Type == RULE_NO_FIX {
+				desc = fmt.Sprintf("no gps fix since %v", since.Format(time.RFC3339))
+			}
+			alerts = append(alerts, newAlert(rule, devId, now, desc))
+		}
+	}
+	return alerts
+}
+
+// create an alert for a rule
+func newAlert(rule *AlarmRule_Schema, devId string, t time.Time, description string) Alert_Schema {
+	return Alert_Schema{
+		Id:          uuid.New().String(),
+		RuleId:      rule.Id,
+		RuleName:    rule.Name,
+		RuleType:    rule.Type,
+		DeviceId:    devId,
+		Severity:    rule.Severity,
+		Description: description,
+		Time:        t,
+	}
+}
+
+// record and publish alerts
+func (re *RulesEngine) raise(alerts []Alert_Schema) error {
+	for i := range alerts {
+		err := re.dbc.RecordAlert(&alerts[i])
+		if err != nil {
+			return fmt.Errorf("error recording alert: %v", err)
+		}
+		err = re.publishEvent(&DeviceEvent{EVENT_ALERT, alerts[i].DeviceId, alerts[i].Time, &alerts[i]})
+		if err != nil {
+			return fmt.Errorf("error publishing alert: %v", err)
+		}
+	}
+	return nil
+}
+
+// add or replace a rule
+func (re *RulesEngine) PutRule(rule *AlarmRule_Schema) error {
+	err := re.dbc.UpsertAlarmRule(rule)
+	if err != nil {
+		return err
+	}
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	re.rules[rule.Id] = rule
+	delete(re.states, rule.Id)
+	return nil
+}
+
+// remove a rule, returns false if there was no such rule
+func (re *RulesEngine) DeleteRule(id string) (bool, error) {
+	deleted, err := re.dbc.DeleteAlarmRule(id)
+	if err != nil {
+		return false, err
+	}
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	delete(re.rules, id)
+	delete(re.states, id)
+	return deleted, nil
+}
+
+// list the rules
+func (re *RulesEngine) GetRules() []AlarmRule_Schema {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	rules := make([]AlarmRule_Schema, 0, len(re.rules))
+	for _, rule := range re.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// get one rule
+func (re *RulesEngine) GetRule(id string) (AlarmRule_Schema, bool) {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	rule, ok := re.rules[id]
+	if !ok {
+		return AlarmRule_Schema{}, false
+	}
+	return *rule, true
+}
+
+// add the rule and alert endpoints to the http server
+func (re *RulesEngine) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /rules", re.handleList)
+	svr.HandleFunc("POST /rules", re.handleCreate)
+	svr.HandleFunc("GET /rules/{id}", re.handleGet)
+	svr.HandleFunc("PUT /rules/{id}", re.handleUpdate)
+	svr.HandleFunc("DELETE /rules/{id}", re.handleDelete)
+	svr.HandleFunc("GET /alerts", re.handleGetAlerts)
+	svr.HandleFunc("POST /alerts/{id}/ack", re.handleAckAlert)
+}
+
+// GET /rules
+func (re *RulesEngine) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, re.GetRules())
+}
+
+// GET /rules/{id}
+func (re *RulesEngine) handleGet(w http.ResponseWriter, r *http.Request) {
+	rule, ok := re.GetRule(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such rule")
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// POST /rules
+func (re *RulesEngine) handleCreate(w http.ResponseWriter, r *http.Request) {
+	re.handlePut(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// PUT /rules/{id}
+func (re *RulesEngine) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := re.GetRule(id); !ok {
+		writeError(w, http.StatusNotFound, "no such rule")
+		return
+	}
+	re.handlePut(w, r, id, http.StatusOK)
+}
+
+// read, validate and store a rule from the request body
+func (re *RulesEngine) handlePut(w http.ResponseWriter, r *http.Request, id string, status int) {
+	// rules are enabled unless they say otherwise
+	rule := AlarmRule_Schema{Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid rule json: %v", err))
+		return
+	}
+	rule.Id = id
+	if rule.Devices == nil {
+		rule.Devices = []string{}
+	}
+	err = rule.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = re.PutRule(&rule)
+	if err != nil {
+		re.logger.Error("failed to store rule", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store rule")
+		return
+	}
+	writeJSON(w, status, rule)
+}
+
+// DELETE /rules/{id}
+func (re *RulesEngine) handleDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := re.DeleteRule(r.PathValue("id"))
+	if err != nil {
+		re.logger.Error("failed to delete rule", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to delete rule")
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "no such rule")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /alerts?device=&acknowledged=&after=&before=
+func (re *RulesEngine) handleGetAlerts(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var acknowledged *bool
+	if v := r.URL.Query().Get("acknowledged"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "acknowledged must be true or false")
+			return
+		}
+		acknowledged = &b
+	}
+	alerts, err := re.dbc.QueryAlerts(r.URL.Query().Get("device"), acknowledged, after, before)
+	if err != nil {
+		re.logger.Error("failed to query alerts", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query alerts")
+		return
+	}
+	writeJSON(w, http.StatusOK, alerts)
+}
+
+// POST /alerts/{id}/ack, body: {"by": "who acknowledged it"}
+func (re *RulesEngine) handleAckAlert(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		By string `json:"by"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	alert, err := re.dbc.AcknowledgeAlert(r.PathValue("id"), req.By, time.Now())
+	if err != nil {
+		re.logger.Error("failed to acknowledge alert", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to acknowledge alert")
+		return
+	}
+	if alert == nil {
+		writeError(w, http.StatusNotFound, "no such alert")
+		return
+	}
+	// let subscribers know it's been dealt with
+	err = re.publishEvent(&DeviceEvent{EVENT_ALERT, alert.DeviceId, *alert.AcknowledgedTime, alert})
+	if err != nil {
+		re.logger.Error("failed to publish acknowledged alert", zap.Error(err))
+	}
+	writeJSON(w, http.StatusOK, alert)
+}
+
+// get every alarm rule
+func (dbc *DBConnection) QueryAlarmRules() ([]AlarmRule_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("alarm_rules")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying alarm rules: %v", err)
+	}
+	rules := make([]AlarmRule_Schema, 0)
+	err = cursor.All(ctx, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding alarm rules: %v", err)
+	}
+	return rules, nil
+}
+
+// insert or replace an alarm rule
+func (dbc *DBConnection) UpsertAlarmRule(rule *AlarmRule_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("alarm_rules")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": rule.Id}, rule, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete an alarm rule, returns false if there was nothing to delete
+func (dbc *DBConnection) DeleteAlarmRule(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("alarm_rules")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// insert an alert
+func (dbc *DBConnection) RecordAlert(alert *Alert_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("alerts")
+	_, err := coll.InsertOne(ctx, alert)
+	return err
+}
+
+// get alerts between the two times, newest first. Empty devId means every device, nil acknowledged
+// means either state.
+func (dbc *DBConnection) QueryAlerts(devId string, acknowledged *bool, after time.Time, before time.Time) ([]Alert_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("alerts")
+
+	filter := bson.M{
+		"time": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	if devId != "" {
+		filter["deviceId"] = devId
+	}
+	if acknowledged != nil {
+		filter["acknowledged"] = *acknowledged
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying alerts: %v", err)
+	}
+	alerts := make([]Alert_Schema, 0)
+	err = cursor.All(context.Background(), &alerts)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding alerts: %v", err)
+	}
+	return alerts, nil
+}
+
+// mark an alert acknowledged, returns the updated alert or nil if there's no such alert
+func (dbc *DBConnection) AcknowledgeAlert(id string, by string, t time.Time) (*Alert_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("alerts")
+	update := bson.M{"$set": bson.M{
+		"acknowledged":     true,
+		"acknowledgedBy":   by,
+		"acknowledgedTime": t,
+	}}
+	var alert Alert_Schema
+	err := coll.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
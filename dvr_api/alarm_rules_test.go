@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRulesEngine(rules ...*AlarmRule_Schema) *RulesEngine {
+	re := &RulesEngine{
+		rules:    make(map[string]*AlarmRule_Schema),
+		states:   make(map[string]map[string]*ruleState),
+		presence: make(map[string]*devicePresence),
+	}
+	for _, rule := range rules {
+		re.rules[rule.Id] = rule
+	}
+	return re
+}
+
+func TestRulesEngine_Speed(t *testing.T) {
+	re := newTestRulesEngine(&AlarmRule_Schema{Id: "speeding", Type: RULE_SPEED, Severity: SEVERITY_WARNING, Threshold: 90, DurationSeconds: 30, Enabled: true})
+	start := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		speed  float64
+		offset time.Duration
+		alerts int
+	}{
+		{95, 0, 0},                 // over, timer starts
+		{100, 20 * time.Second, 0}, // over but not for long enough
+		{80, 25 * time.Second, 0},  // back under, timer resets
+		{95, 30 * time.Second, 0},  // over again, timer restarts
+		{95, 60 * time.Second, 1},  // over for 30s
+		{95, 70 * time.Second, 0},  // already fired for this stretch
+	}
+	for i, step := range steps {
+		alerts := re.evaluatePosition(&Position_Schema{DeviceId: "123456", FixTime: start.Add(step.offset), Valid: true, Speed: step.speed})
+		if len(alerts) != step.alerts {
+			t.Errorf("step %d: expected %d alerts, got %+v", i, step.alerts, alerts)
+		}
+	}
+}
+
+func TestRulesEngine_Alarm(t *testing.T) {
+	re := newTestRulesEngine(
+		&AlarmRule_Schema{Id: "panic", Type: RULE_ALARM, Severity: SEVERITY_CRITICAL, AlarmType: "PANIC", Enabled: true},
+		&AlarmRule_Schema{Id: "any", Type: RULE_ALARM, Severity: SEVERITY_INFO, Devices: []string{"999"}, Enabled: true},
+		&AlarmRule_Schema{Id: "disabled", Type: RULE_ALARM, Severity: SEVERITY_INFO},
+	)
+	alarmType, err := parseAlarmMessage("$ALARM;123456;20240817-123504;PANIC\r")
+	if err != nil || alarmType != "PANIC" {
+		t.Fatalf("parseAlarmMessage = %q, %v", alarmType, err)
+	}
+	alerts := re.evaluateAlarm("123456", alarmType, time.Now())
+	if len(alerts) != 1 || alerts[0].RuleId != "panic" || alerts[0].Severity != SEVERITY_CRITICAL {
+		t.Errorf("expected one critical panic alert, got %+v", alerts)
+	}
+	if alerts := re.evaluateAlarm("123456", "DOOR", time.Now()); len(alerts) != 0 {
+		t.Errorf("expected no alerts for a door alarm, got %+v", alerts)
+	}
+}
+
+func TestRulesEngine_Timers(t *testing.T) {
+	re := newTestRulesEngine(
+		&AlarmRule_Schema{Id: "offline", Type: RULE_OFFLINE, Severity: SEVERITY_WARNING, DurationSeconds: 600, Enabled: true},
+		&AlarmRule_Schema{Id: "nofix", Type: RULE_NO_FIX, Severity: SEVERITY_WARNING, DurationSeconds: 300, Enabled: true},
+	)
+	start := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+
+	// connected with a fix a minute in, no fix alert 5 minutes after that
+	re.ProcessPresence("123456", true, start)
+	re.evaluatePosition(&Position_Schema{DeviceId: "123456", FixTime: start.Add(time.Minute), Valid: true})
+	if alerts := re.evaluateTimers(start.Add(5 * time.Minute)); len(alerts) != 0 {
+		t.Errorf("expected no alerts yet, got %+v", alerts)
+	}
+	alerts := re.evaluateTimers(start.Add(6 * time.Minute))
+	if len(alerts) != 1 || alerts[0].RuleId != "nofix" {
+		t.Errorf("expected a no fix alert, got %+v", alerts)
+	}
+	if alerts := re.evaluateTimers(start.Add(7 * time.Minute)); len(alerts) != 0 {
+		t.Errorf("no fix alert should only fire once, got %+v", alerts)
+	}
+
+	// offline for 10 minutes
+	re.ProcessPresence("123456", false, start.Add(10*time.Minute))
+	if alerts := re.evaluateTimers(start.Add(19 * time.Minute)); len(alerts) != 0 {
+		t.Errorf("expected no alerts yet, got %+v", alerts)
+	}
+	alerts = re.evaluateTimers(start.Add(20 * time.Minute))
+	if len(alerts) != 1 || alerts[0].RuleId != "offline" {
+		t.Errorf("expected an offline alert, got %+v", alerts)
+	}
+}
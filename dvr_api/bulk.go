@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+BULK COMMANDS
+Send one command to many devices. {deviceId} in the command is replaced with the id of each device,
+the sends are spread out at ratePerSecond, and the report says which devices accepted the command,
+replied to it (see reply_tracker.go), failed, or weren't connected. A bulk command is complete once
+every device has replied or failed, or the reply timeout has passed.
+~~~~~~~~~~~~~~~
+*/
+
+// what happened for one device
+const (
+	BULK_PENDING  string = "pending"  // not sent yet
+	BULK_ACCEPTED string = "accepted" // written to the device, no reply yet
+	BULK_QUEUED   string = "queued"   // device wasn't connected, put in the command queue
+	BULK_REPLIED  string = "replied"  // the device replied
+	BULK_FAILED   string = "failed"   // not sent, see the error
+	BULK_OFFLINE  string = "offline"  // device wasn't connected and the command wasn't to be queued
+)
+
+// defaults and limits
+const (
+	BULK_DEFAULT_RATE          int = 10  // sends per second if the client doesn't say
+	BULK_MAX_RATE              int = 100 // most sends per second a client can ask for
+	BULK_DEFAULT_REPLY_TIMEOUT int = 60  // seconds we wait for replies if the client doesn't say
+)
+
+// a request to send a command to many devices, sent by API clients
+type BulkCommandRequest struct {
+	Devices             []string `json:"devices"`
+	Groups              []string `json:"groups"`              // devices in any of these groups are sent to as well
+	Tags                []string `json:"tags"`                // as are devices with all of these tags
+	Command             string   `json:"command"`             // may contain {deviceId}
+	RatePerSecond       int      `json:"ratePerSecond"`       // BULK_DEFAULT_RATE if not set
+	QueueTtlSeconds     int      `json:"queueTtlSeconds"`     // queue for devices that aren't connected, 0 to report them offline
+	ReplyTimeoutSeconds int      `json:"replyTimeoutSeconds"` // BULK_DEFAULT_REPLY_TIMEOUT if not set
+}
+
+// a bulk command and its report, stored in mongodb and sent to API clients
+type BulkCommand_Schema struct {
+	Id           string              `bson:"_id" json:"id"`
+	Command      string              `bson:"command" json:"command"`
+	Time         time.Time           `bson:"time" json:"time"`
+	Complete     bool                `bson:"complete" json:"complete"`
+	CompleteTime *time.Time          `bson:"completeTime,omitempty" json:"completeTime,omitempty"`
+	Counts       map[string]int      `bson:"counts" json:"counts"` // status against how many devices have it
+	Results      []BulkResult_Schema `bson:"results" json:"results"`
+}
+
+// what happened for one device
+type BulkResult_Schema struct {
+	DeviceId  string     `bson:"deviceId" json:"deviceId"`
+	Message   string     `bson:"message" json:"message"`
+	Status    string     `bson:"status" json:"status"`
+	Error     string     `bson:"error,omitempty" json:"error,omitempty"`
+	Reply     string     `bson:"reply,omitempty" json:"reply,omitempty"`
+	ReplyTime *time.Time `bson:"replyTime,omitempty" json:"replyTime,omitempty"`
+}
+
+// where bulk commands are kept, the DBConnection outside of tests
+type BulkCommandStore interface {
+	RecordBulkCommand(cmd *BulkCommand_Schema) error
+	GetBulkCommand(id string) (*BulkCommand_Schema, error)
+	QueryBulkCommands(after time.Time, before time.Time) ([]BulkCommand_Schema, error)
+}
+
+// check the request is something we can send, filling in the defaults
+func (req *BulkCommandRequest) Validate() error {
+	if len(req.Devices) == 0 {
+		return fmt.Errorf("devices, groups and tags don't pick out any devices")
+	}
+	for _, devId := range req.Devices {
+		var msgDevId string
+		message := renderForDevice(req.Command, devId)
+		if getIdFromMessage(&message, &msgDevId) != nil || msgDevId != devId {
+			return fmt.Errorf("command for device %v doesn't contain its id, use %v", devId, DEVICE_ID_PLACEHOLDER)
+		}
+	}
+	if req.RatePerSecond == 0 {
+		req.RatePerSecond = BULK_DEFAULT_RATE
+	}
+	if req.RatePerSecond < 0 || req.RatePerSecond > BULK_MAX_RATE {
+		return fmt.Errorf("ratePerSecond must be between 1 and %v", BULK_MAX_RATE)
+	}
+	if req.ReplyTimeoutSeconds == 0 {
+		req.ReplyTimeoutSeconds = BULK_DEFAULT_REPLY_TIMEOUT
+	}
+	if req.ReplyTimeoutSeconds < 0 || req.QueueTtlSeconds < 0 {
+		return fmt.Errorf("replyTimeoutSeconds and queueTtlSeconds can't be negative")
+	}
+	return nil
+}
+
+// a bulk command in progress
+type bulkRun struct {
+	cmd         BulkCommand_Schema
+	outstanding int // devices we're still waiting on, plus one until everything's been sent
+}
+
+// sends bulk commands
+type BulkSender struct {
+	// internal
+	running  map[string]*bulkRun // bulk commands that aren't complete yet, by id
+	sending  sync.WaitGroup      // sendAll goroutines
+	stop     chan struct{}       // closed when we're shutting down
+	stopping bool                // no new bulk commands once we're shutting down
+	lock     sync.Mutex          // sends happen on their own goroutines, replies come from the reply tracker
+
+	// injected
+	logger      *zap.Logger
+	store       BulkCommandStore
+	send        ProcessMessageFunction // this func is meant to send, or queue, a message for a device
+	isConnected func(devId string) bool
+	replies     *ReplyTracker
+	directory   *DeviceDirectory
+}
+
+// constructor
+func NewBulkSender(logger *zap.Logger, store BulkCommandStore, send ProcessMessageFunction, isConnected func(devId string) bool, replies *ReplyTracker, directory *DeviceDirectory) (*BulkSender, error) {
+	bs := &BulkSender{
+		running:     make(map[string]*bulkRun),
+		stop:        make(chan struct{}),
+		logger:      logger,
+		store:       store,
+		send:        send,
+		isConnected: isConnected,
+		replies:     replies,
+		directory:   directory,
+	}
+	return bs, nil
+}
+
+// returned by Start once we're shutting down
+var errBulkStopped = fmt.Errorf("shutting down, not starting bulk commands")
+
+// start sending a bulk command, returns it as it stands before anything is sent
+func (bs *BulkSender) Start(req *BulkCommandRequest) (*BulkCommand_Schema, error) {
+	bs.lock.Lock()
+	if bs.stopping {
+		bs.lock.Unlock()
+		return nil, errBulkStopped
+	}
+	bs.sending.Add(1)
+	bs.lock.Unlock()
+
+	run := &bulkRun{
+		cmd: BulkCommand_Schema{
+			Id:      uuid.New().String(),
+			Command: req.Command,
+			Time:    time.Now(),
+			Results: make([]BulkResult_Schema, len(req.Devices)),
+		},
+		outstanding: len(req.Devices) + 1,
+	}
+	for i, devId := range req.Devices {
+		run.cmd.Results[i] = BulkResult_Schema{DeviceId: devId, Message: renderForDevice(req.Command, devId), Status: BULK_PENDING}
+	}
+	run.cmd.Counts = countBulkResults(run.cmd.Results)
+	err := bs.store.RecordBulkCommand(&run.cmd)
+	if err != nil {
+		bs.sending.Done()
+		return nil, fmt.Errorf("error recording bulk command: %v", err)
+	}
+
+	bs.lock.Lock()
+	bs.running[run.cmd.Id] = run
+	snapshot := copyBulkCommand(&run.cmd)
+	bs.lock.Unlock()
+
+	go bs.sendAll(run, req)
+	return snapshot, nil
+}
+
+// stop sending bulk commands once the context is done, blocking until the ones being sent have
+// stopped. What hadn't been sent yet is failed.
+func (bs *BulkSender) Run(ctx context.Context) {
+	<-ctx.Done()
+	bs.lock.Lock()
+	bs.stopping = true
+	close(bs.stop)
+	bs.lock.Unlock()
+	bs.sending.Wait()
+}
+
+// send to each device in turn, no faster than the rate asked for
+func (bs *BulkSender) sendAll(run *bulkRun, req *BulkCommandRequest) {
+	defer bs.sending.Done()
+	ticker := time.NewTicker(time.Second / time.Duration(req.RatePerSecond))
+	defer ticker.Stop()
+	queueTtl := time.Duration(req.QueueTtlSeconds) * time.Second
+	replyTimeout := time.Duration(req.ReplyTimeoutSeconds) * time.Second
+
+	for i := range req.Devices {
+		if i > 0 && !bs.wait(ticker) {
+			bs.lock.Lock()
+			for j := i; j < len(req.Devices); j++ {
+				run.cmd.Results[j].Status = BULK_FAILED
+				run.cmd.Results[j].Error = "shut down before it was sent"
+				run.outstanding--
+			}
+			bs.lock.Unlock()
+			break
+		}
+		bs.lock.Lock()
+		res := run.cmd.Results[i]
+		bs.lock.Unlock()
+
+		connected := bs.isConnected(res.DeviceId)
+		if !connected && queueTtl == 0 {
+			bs.lock.Lock()
+			run.cmd.Results[i].Status = BULK_OFFLINE
+			run.outstanding--
+			bs.lock.Unlock()
+			continue
+		}
+
+		// wait for the reply before sending, the device can answer before send returns
+		deadline := time.Now().Add(replyTimeout)
+		if !connected {
+			deadline = deadline.Add(queueTtl)
+		}
+		waiting := bs.replies.Expect(res.DeviceId, res.Message, deadline, func(reply *MessageWrapper) { bs.recordReply(run, i, reply) }, func() { bs.settle(run) })
+		err := bs.send(&MessageWrapper{res.Message, &run.cmd.Id, time.Now(), DirectionToDevice, queueTtl})
+		// if it was answered anyway the reply has already settled it
+		cancelled := err != nil && bs.replies.Cancel(res.DeviceId, waiting)
+
+		bs.lock.Lock()
+		switch {
+		case cancelled:
+			run.cmd.Results[i].Status = BULK_FAILED
+			run.cmd.Results[i].Error = err.Error()
+			run.outstanding--
+		case run.cmd.Results[i].Status != BULK_PENDING:
+			// replied already
+		case err != nil:
+			run.cmd.Results[i].Status = BULK_FAILED
+			run.cmd.Results[i].Error = err.Error()
+		case connected:
+			run.cmd.Results[i].Status = BULK_ACCEPTED
+		default:
+			run.cmd.Results[i].Status = BULK_QUEUED
+		}
+		bs.lock.Unlock()
+	}
+
+	// everything's been sent, store how that went
+	bs.settle(run)
+}
+
+// wait for the next send, false if we're shutting down instead
+func (bs *BulkSender) wait(ticker *time.Ticker) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-bs.stop:
+		return false
+	}
+}
+
+// record a device's reply
+func (bs *BulkSender) recordReply(run *bulkRun, index int, reply *MessageWrapper) {
+	bs.lock.Lock()
+	replyTime := reply.recvdTime
+	res := &run.cmd.Results[index]
+	res.Status = BULK_REPLIED
+	res.Reply = reply.message
+	res.ReplyTime = &replyTime
+	bs.lock.Unlock()
+	bs.settle(run)
+}
+
+// one device has finished one way or another, or the sending has. Store the report and finish the bulk
+// command if that was the last thing we were waiting on.
+func (bs *BulkSender) settle(run *bulkRun) {
+	bs.lock.Lock()
+	run.outstanding--
+	if run.outstanding <= 0 && !run.cmd.Complete {
+		now := time.Now()
+		run.cmd.Complete = true
+		run.cmd.CompleteTime = &now
+		delete(bs.running, run.cmd.Id)
+	}
+	run.cmd.Counts = countBulkResults(run.cmd.Results)
+	record := copyBulkCommand(&run.cmd)
+	bs.lock.Unlock()
+
+	err := bs.store.RecordBulkCommand(record)
+	if err != nil {
+		bs.logger.Error("error recording bulk command", zap.String("bulkId", record.Id), zap.Error(err))
+	}
+}
+
+// get a bulk command's report
+func (bs *BulkSender) Get(id string) (*BulkCommand_Schema, error) {
+	bs.lock.Lock()
+	run, ok := bs.running[id]
+	if ok {
+		run.cmd.Counts = countBulkResults(run.cmd.Results)
+		cmd := copyBulkCommand(&run.cmd)
+		bs.lock.Unlock()
+		return cmd, nil
+	}
+	bs.lock.Unlock()
+	return bs.store.GetBulkCommand(id)
+}
+
+// how many devices have each status
+func countBulkResults(results []BulkResult_Schema) map[string]int {
+	counts := map[string]int{
+		BULK_PENDING:  0,
+		BULK_ACCEPTED: 0,
+		BULK_QUEUED:   0,
+		BULK_REPLIED:  0,
+		BULK_FAILED:   0,
+		BULK_OFFLINE:  0,
+	}
+	for _, res := range results {
+		counts[res.Status]++
+	}
+	return counts
+}
+
+// copy a bulk command so it can be stored or sent while it's being updated. Lock must be held.
+func copyBulkCommand(cmd *BulkCommand_Schema) *BulkCommand_Schema {
+	c := *cmd
+	c.Results = append([]BulkResult_Schema{}, cmd.Results...)
+	c.Counts = make(map[string]int, len(cmd.Counts))
+	for k, v := range cmd.Counts {
+		c.Counts[k] = v
+	}
+	return &c
+}
+
+// add the bulk command endpoints to the http server
+func (bs *BulkSender) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("POST /bulk", bs.handleStart)
+	svr.HandleFunc("GET /bulk", bs.handleList)
+	svr.HandleFunc("GET /bulk/{id}", bs.handleGet)
+}
+
+// POST /bulk, responds 202 with the bulk command, poll GET /bulk/{id} for its report
+func (bs *BulkSender) handleStart(w http.ResponseWriter, r *http.Request) {
+	var req BulkCommandRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid bulk command json: %v", err))
+		return
+	}
+	// without a directory only the devices listed are sent to
+	if bs.directory != nil {
+		req.Devices = bs.directory.Expand(req.Devices, &DeviceFilter{req.Groups, req.Tags})
+	}
+	err = req.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cmd, err := bs.Start(&req)
+	if err != nil {
+		bs.logger.Error("failed to start bulk command", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to start bulk command")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, cmd)
+}
+
+// GET /bulk?after=&before=
+func (bs *BulkSender) handleList(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cmds, err := bs.store.QueryBulkCommands(after, before)
+	if err != nil {
+		bs.logger.Error("failed to query bulk commands", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query bulk commands")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmds)
+}
+
+// GET /bulk/{id}
+func (bs *BulkSender) handleGet(w http.ResponseWriter, r *http.Request) {
+	cmd, err := bs.Get(r.PathValue("id"))
+	if err != nil {
+		bs.logger.Error("failed to get bulk command", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to get bulk command")
+		return
+	}
+	if cmd == nil {
+		writeError(w, http.StatusNotFound, "no such bulk command")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// insert or replace a bulk command, it's replaced as its report changes
+func (dbc *DBConnection) RecordBulkCommand(cmd *BulkCommand_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("bulk_commands")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": cmd.Id}, cmd, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get one bulk command, nil if there's no such bulk command
+func (dbc *DBConnection) GetBulkCommand(id string) (*BulkCommand_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("bulk_commands")
+	var cmd BulkCommand_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&cmd)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// get the bulk commands started between the two times, newest first, without their per device results
+func (dbc *DBConnection) QueryBulkCommands(after time.Time, before time.Time) ([]BulkCommand_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("bulk_commands")
+
+	filter := bson.M{
+		"time": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetProjection(bson.M{"results": 0})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying bulk commands: %v", err)
+	}
+	cmds := make([]BulkCommand_Schema, 0)
+	err = cursor.All(context.Background(), &cmds)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding bulk commands: %v", err)
+	}
+	return cmds, nil
+}
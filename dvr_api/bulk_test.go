@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory BulkCommandStore
+type memBulkCommandStore struct {
+	lock sync.Mutex
+	cmds map[string]BulkCommand_Schema
+}
+
+func (m *memBulkCommandStore) RecordBulkCommand(cmd *BulkCommand_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cmds[cmd.Id] = *copyBulkCommand(cmd)
+	return nil
+}
+
+func (m *memBulkCommandStore) GetBulkCommand(id string) (*BulkCommand_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cmd, ok := m.cmds[id]
+	if !ok {
+		return nil, nil
+	}
+	return &cmd, nil
+}
+
+func (m *memBulkCommandStore) QueryBulkCommands(after time.Time, before time.Time) ([]BulkCommand_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cmds := make([]BulkCommand_Schema, 0)
+	for _, cmd := range m.cmds {
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func TestBulkCommandRequestValidate(t *testing.T) {
+	req := BulkCommandRequest{Devices: []string{"123", "456"}, Command: "$CONFIG;{deviceId};APN;internet"}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("valid request: %v", err)
+	}
+	if req.RatePerSecond != BULK_DEFAULT_RATE || req.ReplyTimeoutSeconds != BULK_DEFAULT_REPLY_TIMEOUT {
+		t.Fatalf("defaults not filled in: %+v", req)
+	}
+	bad := []BulkCommandRequest{
+		{Command: "$CONFIG;{deviceId}"},
+		{Devices: []string{"123", "456"}, Command: "$CONFIG;123"},
+		{Devices: []string{"123"}, Command: "$CONFIG;{deviceId}", RatePerSecond: BULK_MAX_RATE + 1},
+		{Devices: []string{"123"}, Command: "$CONFIG;{deviceId}", QueueTtlSeconds: -1},
+	}
+	for i, req := range bad {
+		if err := req.Validate(); err == nil {
+			t.Errorf("bad request %v validated", i)
+		}
+	}
+}
+
+func TestBulkSender(t *testing.T) {
+	store := &memBulkCommandStore{cmds: make(map[string]BulkCommand_Schema)}
+	replies := NewReplyTracker()
+	send := func(msgWrap *MessageWrapper) error {
+		if msgWrap.message == "$CONFIG;456;APN;internet" {
+			return fmt.Errorf("write failed")
+		}
+		return nil
+	}
+	isConnected := func(devId string) bool { return devId != "789" }
+	bs, _ := NewBulkSender(zap.NewNop(), store, send, isConnected, replies, nil)
+
+	req := BulkCommandRequest{Devices: []string{"123", "456", "789", "321"}, Command: "$CONFIG;{deviceId};APN;internet", RatePerSecond: BULK_MAX_RATE}
+	req.Validate()
+	cmd, err := bs.Start(&req)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	waitFor(t, "the sends", func() bool {
+		c, _ := bs.Get(cmd.Id)
+		return c.Counts[BULK_PENDING] == 0
+	})
+
+	// one device replies, the other times out
+	devId := "123"
+	replies.ProcessMessage(&MessageWrapper{"$CONFIG;123;OK", &devId, time.Now(), DirectionFromDevice, 0})
+	waitFor(t, "the bulk command to complete", func() bool {
+		replies.expire(time.Now().Add(time.Hour))
+		c, _ := bs.Get(cmd.Id)
+		return c.Complete
+	})
+
+	got, _ := bs.Get(cmd.Id)
+	want := map[string]string{"123": BULK_REPLIED, "456": BULK_FAILED, "789": BULK_OFFLINE, "321": BULK_ACCEPTED}
+	for _, res := range got.Results {
+		if res.Status != want[res.DeviceId] {
+			t.Errorf("device %v is %v, want %v", res.DeviceId, res.Status, want[res.DeviceId])
+		}
+	}
+	if got.Counts[BULK_REPLIED] != 1 || got.Counts[BULK_FAILED] != 1 || got.Counts[BULK_OFFLINE] != 1 || got.Counts[BULK_ACCEPTED] != 1 {
+		t.Errorf("counts %v", got.Counts)
+	}
+}
+
+func TestBulkSender_ReplyBeforeSendReturns(t *testing.T) {
+	store := &memBulkCommandStore{cmds: make(map[string]BulkCommand_Schema)}
+	replies := NewReplyTracker()
+	// the device answers before the send has returned
+	send := func(msgWrap *MessageWrapper) error {
+		devId := "123"
+		return replies.ProcessMessage(&MessageWrapper{"$CONFIG;123;OK", &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	isConnected := func(devId string) bool { return true }
+	bs, _ := NewBulkSender(zap.NewNop(), store, send, isConnected, replies, nil)
+
+	req := BulkCommandRequest{Devices: []string{"123"}, Command: "$CONFIG;{deviceId};APN;internet", RatePerSecond: BULK_MAX_RATE}
+	req.Validate()
+	cmd, err := bs.Start(&req)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	waitFor(t, "the bulk command to complete", func() bool {
+		c, _ := bs.Get(cmd.Id)
+		return c.Complete
+	})
+	got, _ := bs.Get(cmd.Id)
+	if got.Results[0].Status != BULK_REPLIED {
+		t.Errorf("device is %v, want %v", got.Results[0].Status, BULK_REPLIED)
+	}
+}
+
+func TestBulkSender_Shutdown(t *testing.T) {
+	store := &memBulkCommandStore{cmds: make(map[string]BulkCommand_Schema)}
+	send := func(msgWrap *MessageWrapper) error { return nil }
+	isConnected := func(devId string) bool { return false }
+	bs, _ := NewBulkSender(zap.NewNop(), store, send, isConnected, NewReplyTracker(), nil)
+
+	// one a second, so the first has gone when we stop and the rest haven't
+	req := BulkCommandRequest{Devices: []string{"123", "456", "789"}, Command: "$CONFIG;{deviceId};APN;internet", RatePerSecond: 1}
+	req.Validate()
+	cmd, err := bs.Start(&req)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	waitFor(t, "the first send", func() bool {
+		c, _ := bs.Get(cmd.Id)
+		return c.Counts[BULK_OFFLINE] == 1
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bs.Run(ctx)
+
+	got, _ := store.GetBulkCommand(cmd.Id)
+	if !got.Complete || got.Counts[BULK_OFFLINE] != 1 || got.Counts[BULK_FAILED] != 2 {
+		t.Errorf("expected 1 offline and 2 failed, got %+v", got)
+	}
+	if _, err := bs.Start(&req); err != errBulkStopped {
+		t.Errorf("expected no new bulk commands after stopping, got %v", err)
+	}
+}
+
+func TestBulkSender_StartWithoutDirectory(t *testing.T) {
+	store := &memBulkCommandStore{cmds: make(map[string]BulkCommand_Schema)}
+	send := func(msgWrap *MessageWrapper) error { return nil }
+	bs, _ := NewBulkSender(zap.NewNop(), store, send, func(string) bool { return true }, NewReplyTracker(), nil)
+
+	body := fmt.Sprintf(`{"devices":["123"],"command":"$STATUS;{deviceId}","ratePerSecond":%v}`, BULK_MAX_RATE)
+	w := httptest.NewRecorder()
+	bs.handleStart(w, httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %v: %v", w.Code, w.Body.String())
+	}
+}
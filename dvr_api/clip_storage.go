@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+CLIP STORAGE
+Keeps the clips directory from filling the disk. The sweeper deletes clips older than the maximum
+age, then the oldest clips of each device over its quota, then the oldest clips overall while the
+total is over the global quota. Pinned clips, e.g. footage of an incident, count towards the quotas
+but are never deleted. Uploads still coming in count towards the quotas too, and ones that haven't
+had a chunk for a day are deleted. Each sweep is recorded with what it deleted.
+~~~~~~~~~~~~~~~
+*/
+
+// why a clip was deleted
+const (
+	CLIP_DELETED_AGE          string = "age"         // older than the maximum age
+	CLIP_DELETED_DEVICE_QUOTA string = "deviceQuota" // its device was over quota
+	CLIP_DELETED_GLOBAL_QUOTA string = "globalQuota" // all the clips together were over quota
+	CLIP_DELETED_MISSING      string = "missingFile" // the file had gone already
+)
+
+const (
+	CLIP_SWEEP_INTERVAL time.Duration = 10 * time.Minute // how often the sweeper runs
+	UPLOAD_STALE_AFTER  time.Duration = 24 * time.Hour   // uploads with no chunk for this long are deleted
+)
+
+// limits on the clips we keep, zero for no limit
+type ClipRetentionPolicy struct {
+	MaxAge           time.Duration `json:"-"`
+	MaxAgeDays       float64       `json:"maxAgeDays"` // MaxAge for API clients
+	DeviceQuotaBytes int64         `json:"deviceQuotaBytes"`
+	GlobalQuotaBytes int64         `json:"globalQuotaBytes"`
+}
+
+// one clip a sweep deleted
+type DeletedClip_Schema struct {
+	ClipId   string    `bson:"clipId" json:"clipId"`
+	DeviceId string    `bson:"deviceId" json:"deviceId"`
+	Size     int64     `bson:"size" json:"size"`
+	Time     time.Time `bson:"time" json:"time"` // when the clip was finished
+	Reason   string    `bson:"reason" json:"reason"`
+}
+
+// what a sweep did, stored in mongodb and sent to API clients
+type ClipSweep_Schema struct {
+	Id         string               `bson:"_id" json:"id"`
+	Time       time.Time            `bson:"time" json:"time"`
+	Deleted    []DeletedClip_Schema `bson:"deleted" json:"deleted"`
+	FreedBytes int64                `bson:"freedBytes" json:"freedBytes"`
+	UsedBytes  int64                `bson:"usedBytes" json:"usedBytes"` // after the sweep
+	OverQuota  []string             `bson:"overQuota" json:"overQuota"` // devices, and "global", still over quota because of pinned clips
+	Stale      []string             `bson:"stale" json:"stale"`         // uploads deleted for going quiet
+	Errors     []string             `bson:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// how much one device is using
+type DeviceClipUsage_Response struct {
+	DeviceId     string `json:"deviceId"`
+	Clips        int    `json:"clips"`
+	UsedBytes    int64  `json:"usedBytes"`
+	PinnedBytes  int64  `json:"pinnedBytes"`
+	PartialBytes int64  `json:"partialBytes"` // of uploads still coming in, counted in usedBytes
+}
+
+// the state of clip storage, sent to API clients
+type ClipStorage_Response struct {
+	Policy       ClipRetentionPolicy        `json:"policy"`
+	Clips        int                        `json:"clips"`
+	UsedBytes    int64                      `json:"usedBytes"`
+	PinnedBytes  int64                      `json:"pinnedBytes"`
+	PartialBytes int64                      `json:"partialBytes"` // of uploads still coming in, counted in usedBytes
+	Devices      []DeviceClipUsage_Response `json:"devices"`
+	LastSweep    *ClipSweep_Schema          `json:"lastSweep"`
+}
+
+// where clips and sweeps are kept, the DBConnection outside of tests
+type ClipStorageStore interface {
+	QueryClips(devId string, jobId string, after time.Time, before time.Time) ([]Clip_Schema, error)
+	GetClip(id string) (*Clip_Schema, error)
+	UpsertClip(clip *Clip_Schema) error
+	DeleteClip(id string) (bool, error)
+	GetUpload(id string) (*Upload_Schema, error)
+	DeleteUpload(id string) (bool, error)
+	RecordClipSweep(sweep *ClipSweep_Schema) error
+	QueryClipSweeps(after time.Time, before time.Time) ([]ClipSweep_Schema, error)
+}
+
+// enforces the retention policy on the clips directory
+type ClipStorage struct {
+	// internal
+	lastSweep *ClipSweep_Schema
+	lock      sync.Mutex // one sweep at a time, and no pinning during one
+
+	// injected
+	logger *zap.Logger
+	store  ClipStorageStore
+	dir    string
+	policy ClipRetentionPolicy
+}
+
+// constructor
+func NewClipStorage(logger *zap.Logger, store ClipStorageStore, dir string, policy ClipRetentionPolicy) (*ClipStorage, error) {
+	if policy.MaxAge < 0 || policy.DeviceQuotaBytes < 0 || policy.GlobalQuotaBytes < 0 {
+		return nil, fmt.Errorf("clip retention limits can't be negative")
+	}
+	policy.MaxAgeDays = policy.MaxAge.Hours() / 24
+	cs := &ClipStorage{
+		logger: logger,
+		store:  store,
+		dir:    dir,
+		policy: policy,
+	}
+	return cs, nil
+}
+
+// an upload's file in the partial directory
+type partialUpload struct {
+	id       string
+	deviceId string // empty if the upload's record has gone
+	size     int64
+	modified time.Time
+}
+
+// the uploads still coming in
+func (cs *ClipStorage) partialUploads() ([]partialUpload, error) {
+	entries, err := os.ReadDir(filepath.Join(cs.dir, "partial"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading partial uploads: %v", err)
+	}
+	partials := make([]partialUpload, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		partial := partialUpload{id: entry.Name(), size: info.Size(), modified: info.ModTime()}
+		upload, err := cs.store.GetUpload(partial.id)
+		if err != nil {
+			return nil, fmt.Errorf("error getting upload %v: %v", partial.id, err)
+		}
+		if upload != nil {
+			partial.deviceId = upload.DeviceId
+		}
+		partials = append(partials, partial)
+	}
+	return partials, nil
+}
+
+// sweep every interval, blocking until the context is done
+func (cs *ClipStorage) Run(ctx context.Context) {
+	ticker := time.NewTicker(CLIP_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			_, err := cs.Sweep(now)
+			if err != nil {
+				cs.logger.Error("error sweeping clips", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// delete what the policy says to and record what was deleted
+func (cs *ClipStorage) Sweep(now time.Time) (*ClipSweep_Schema, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	clips, err := cs.store.QueryClips("", "", time.Time{}, now)
+	if err != nil {
+		return nil, fmt.Errorf("error getting clips: %v", err)
+	}
+	// oldest first, so the quotas take the oldest
+	sort.Slice(clips, func(i, j int) bool { return clips[i].Time.Before(clips[j].Time) })
+
+	sweep := &ClipSweep_Schema{
+		Id:        uuid.New().String(),
+		Time:      now,
+		Deleted:   make([]DeletedClip_Schema, 0),
+		OverQuota: make([]string, 0),
+		Stale:     make([]string, 0),
+	}
+
+	// uploads still coming in count towards the quotas, ones that have stopped coming go
+	partials, err := cs.partialUploads()
+	if err != nil {
+		return nil, err
+	}
+	partialUsed := make(map[string]int64)
+	for _, partial := range partials {
+		if now.Sub(partial.modified) < UPLOAD_STALE_AFTER {
+			if partial.deviceId != "" {
+				partialUsed[partial.deviceId] += partial.size
+			}
+			sweep.UsedBytes += partial.size
+			continue
+		}
+		err := os.Remove(filepath.Join(cs.dir, "partial", partial.id))
+		if err == nil || os.IsNotExist(err) {
+			_, err = cs.store.DeleteUpload(partial.id)
+		}
+		if err != nil {
+			sweep.Errors = append(sweep.Errors, fmt.Sprintf("upload %v: %v", partial.id, err))
+			continue
+		}
+		sweep.Stale = append(sweep.Stale, partial.id)
+		sweep.FreedBytes += partial.size
+	}
+	deleted := make(map[string]bool)
+	remove := func(clip *Clip_Schema, reason string) {
+		if deleted[clip.Id] {
+			return
+		}
+		err := os.Remove(filepath.Join(cs.dir, clip.File))
+		if os.IsNotExist(err) {
+			reason = CLIP_DELETED_MISSING
+		} else if err != nil {
+			sweep.Errors = append(sweep.Errors, fmt.Sprintf("clip %v: %v", clip.Id, err))
+			return
+		}
+		_, err = cs.store.DeleteClip(clip.Id)
+		if err != nil {
+			sweep.Errors = append(sweep.Errors, fmt.Sprintf("clip %v: %v", clip.Id, err))
+			return
+		}
+		deleted[clip.Id] = true
+		sweep.Deleted = append(sweep.Deleted, DeletedClip_Schema{clip.Id, clip.DeviceId, clip.Size, clip.Time, reason})
+		sweep.FreedBytes += clip.Size
+	}
+
+	// too old
+	if cs.policy.MaxAge > 0 {
+		cutoff := now.Add(-cs.policy.MaxAge)
+		for i := range clips {
+			if !clips[i].Pinned && clips[i].Time.Before(cutoff) {
+				remove(&clips[i], CLIP_DELETED_AGE)
+			}
+		}
+	}
+
+	// devices over quota
+	if cs.policy.DeviceQuotaBytes > 0 {
+		used := make(map[string]int64)
+		for devId, bytes := range partialUsed {
+			used[devId] = bytes
+		}
+		for i := range clips {
+			if !deleted[clips[i].Id] {
+				used[clips[i].DeviceId] += clips[i].Size
+			}
+		}
+		for i := range clips {
+			clip := &clips[i]
+			if !clip.Pinned && !deleted[clip.Id] && used[clip.DeviceId] > cs.policy.DeviceQuotaBytes {
+				remove(clip, CLIP_DELETED_DEVICE_QUOTA)
+				if deleted[clip.Id] {
+					used[clip.DeviceId] -= clip.Size
+				}
+			}
+		}
+		for devId, bytes := range used {
+			if bytes > cs.policy.DeviceQuotaBytes {
+				sweep.OverQuota = append(sweep.OverQuota, devId)
+			}
+		}
+		sort.Strings(sweep.OverQuota)
+	}
+
+	// everything over quota
+	for i := range clips {
+		if !deleted[clips[i].Id] {
+			sweep.UsedBytes += clips[i].Size
+		}
+	}
+	if cs.policy.GlobalQuotaBytes > 0 {
+		for i := range clips {
+			clip := &clips[i]
+			if sweep.UsedBytes <= cs.policy.GlobalQuotaBytes {
+				break
+			}
+			if !clip.Pinned && !deleted[clip.Id] {
+				remove(clip, CLIP_DELETED_GLOBAL_QUOTA)
+				if deleted[clip.Id] {
+					sweep.UsedBytes -= clip.Size
+				}
+			}
+		}
+		if sweep.UsedBytes > cs.policy.GlobalQuotaBytes {
+			sweep.OverQuota = append(sweep.OverQuota, "global")
+		}
+	}
+
+	if len(sweep.Deleted) > 0 || len(sweep.Stale) > 0 || len(sweep.Errors) > 0 {
+		cs.logger.Info("swept clips", zap.Int("deleted", len(sweep.Deleted)), zap.Int("staleUploads", len(sweep.Stale)), zap.Int64("freedBytes", sweep.FreedBytes), zap.Strings("errors", sweep.Errors))
+	}
+	err = cs.store.RecordClipSweep(sweep)
+	if err != nil {
+		return nil, fmt.Errorf("error recording clip sweep: %v", err)
+	}
+	cs.lastSweep = sweep
+	return sweep, nil
+}
+
+// pin or unpin a clip. Returns the clip as it now stands, nil if there's no such clip.
+func (cs *ClipStorage) Pin(id string, pinned bool, reason string) (*Clip_Schema, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	clip, err := cs.store.GetClip(id)
+	if err != nil || clip == nil {
+		return nil, err
+	}
+	clip.Pinned = pinned
+	clip.PinReason = ""
+	if pinned {
+		clip.PinReason = reason
+	}
+	err = cs.store.UpsertClip(clip)
+	if err != nil {
+		return nil, err
+	}
+	return clip, nil
+}
+
+// how much is used, by whom, and what the last sweep did
+func (cs *ClipStorage) Usage() (*ClipStorage_Response, error) {
+	clips, err := cs.store.QueryClips("", "", time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	partials, err := cs.partialUploads()
+	if err != nil {
+		return nil, err
+	}
+	res := &ClipStorage_Response{Policy: cs.policy, Devices: make([]DeviceClipUsage_Response, 0)}
+	devices := make(map[string]*DeviceClipUsage_Response)
+	device := func(devId string) *DeviceClipUsage_Response {
+		dev, ok := devices[devId]
+		if !ok {
+			dev = &DeviceClipUsage_Response{DeviceId: devId}
+			devices[devId] = dev
+		}
+		return dev
+	}
+	for _, partial := range partials {
+		res.UsedBytes += partial.size
+		res.PartialBytes += partial.size
+		if partial.deviceId != "" {
+			dev := device(partial.deviceId)
+			dev.UsedBytes += partial.size
+			dev.PartialBytes += partial.size
+		}
+	}
+	for _, clip := range clips {
+		dev := device(clip.DeviceId)
+		dev.Clips++
+		dev.UsedBytes += clip.Size
+		res.Clips++
+		res.UsedBytes += clip.Size
+		if clip.Pinned {
+			dev.PinnedBytes += clip.Size
+			res.PinnedBytes += clip.Size
+		}
+	}
+	for _, dev := range devices {
+		res.Devices = append(res.Devices, *dev)
+	}
+	sort.Slice(res.Devices, func(i, j int) bool { return res.Devices[i].UsedBytes > res.Devices[j].UsedBytes })
+
+	cs.lock.Lock()
+	res.LastSweep = cs.lastSweep
+	cs.lock.Unlock()
+	return res, nil
+}
+
+// add the storage endpoints to the http server
+func (cs *ClipStorage) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /clips/storage", cs.handleUsage)
+	svr.HandleFunc("POST /clips/sweep", cs.handleSweep)
+	svr.HandleFunc("GET /clips/sweeps", cs.handleListSweeps)
+	svr.HandleFunc("PUT /clips/{id}/pin", cs.handlePin)
+	svr.HandleFunc("DELETE /clips/{id}/pin", cs.handleUnpin)
+}
+
+// GET /clips/storage
+func (cs *ClipStorage) handleUsage(w http.ResponseWriter, r *http.Request) {
+	res, err := cs.Usage()
+	if err != nil {
+		cs.logger.Error("failed to get clip storage usage", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to get clip storage usage")
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /clips/sweep, sweep now
+func (cs *ClipStorage) handleSweep(w http.ResponseWriter, r *http.Request) {
+	sweep, err := cs.Sweep(time.Now())
+	if err != nil {
+		cs.logger.Error("failed to sweep clips", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to sweep clips")
+		return
+	}
+	writeJSON(w, http.StatusOK, sweep)
+}
+
+// GET /clips/sweeps?after=&before=, newest first
+func (cs *ClipStorage) handleListSweeps(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sweeps, err := cs.store.QueryClipSweeps(after, before)
+	if err != nil {
+		cs.logger.Error("failed to query clip sweeps", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query clip sweeps")
+		return
+	}
+	writeJSON(w, http.StatusOK, sweeps)
+}
+
+// PUT /clips/{id}/pin, body: {"reason": "why it's kept"}
+func (cs *ClipStorage) handlePin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	cs.writePin(w, r, true, req.Reason)
+}
+
+// DELETE /clips/{id}/pin
+func (cs *ClipStorage) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	cs.writePin(w, r, false, "")
+}
+
+// pin or unpin the clip in the path and write it as the response
+func (cs *ClipStorage) writePin(w http.ResponseWriter, r *http.Request, pinned bool, reason string) {
+	clip, err := cs.Pin(r.PathValue("id"), pinned, reason)
+	if err != nil {
+		cs.logger.Error("failed to pin clip", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to pin clip")
+		return
+	}
+	if clip == nil {
+		writeError(w, http.StatusNotFound, "no such clip")
+		return
+	}
+	writeJSON(w, http.StatusOK, clip)
+}
+
+// delete a clip, returns false if there was no such clip
+func (dbc *DBConnection) DeleteClip(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("clips")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// record a sweep
+func (dbc *DBConnection) RecordClipSweep(sweep *ClipSweep_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("clip_sweeps")
+	_, err := coll.InsertOne(ctx, sweep)
+	return err
+}
+
+// get the sweeps between the times, newest first
+func (dbc *DBConnection) QueryClipSweeps(after time.Time, before time.Time) ([]ClipSweep_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("clip_sweeps")
+
+	filter := bson.M{"time": bson.M{"$gte": after, "$lte": before}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying clip sweeps: %v", err)
+	}
+	sweeps := make([]ClipSweep_Schema, 0)
+	err = cursor.All(context.Background(), &sweeps)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding clip sweeps: %v", err)
+	}
+	return sweeps, nil
+}
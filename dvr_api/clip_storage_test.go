@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory ClipStorageStore
+type memClipStorageStore struct {
+	memUploadStore
+	sweeps []ClipSweep_Schema
+}
+
+func (m *memClipStorageStore) DeleteClip(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.clips[id]
+	delete(m.clips, id)
+	return ok, nil
+}
+
+func (m *memClipStorageStore) DeleteUpload(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.uploads[id]
+	delete(m.uploads, id)
+	return ok, nil
+}
+
+func (m *memClipStorageStore) RecordClipSweep(sweep *ClipSweep_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sweeps = append(m.sweeps, *sweep)
+	return nil
+}
+
+func (m *memClipStorageStore) QueryClipSweeps(after time.Time, before time.Time) ([]ClipSweep_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]ClipSweep_Schema{}, m.sweeps...), nil
+}
+
+func TestClipStorage_Sweep(t *testing.T) {
+	dir := t.TempDir()
+	store := &memClipStorageStore{memUploadStore: memUploadStore{uploads: make(map[string]Upload_Schema), clips: make(map[string]Clip_Schema)}}
+	now := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	addClip := func(id string, devId string, size int64, age time.Duration, pinned bool) {
+		clip := Clip_Schema{Id: id, DeviceId: devId, Size: size, Time: now.Add(-age), File: id + ".mp4", Pinned: pinned}
+		os.WriteFile(filepath.Join(dir, clip.File), make([]byte, size), 0o644)
+		store.UpsertClip(&clip)
+	}
+	addClip("old", "123", 10, 40*24*time.Hour, false)
+	addClip("old-pinned", "123", 10, 40*24*time.Hour, true)
+	addClip("a1", "123", 30, 3*time.Hour, false)
+	addClip("a2", "123", 30, 2*time.Hour, false)
+	addClip("a3", "123", 30, time.Hour, false)
+	addClip("b1", "456", 40, 5*time.Hour, false)
+	addClip("b2", "456", 40, 4*time.Hour, false)
+	addClip("c1", "789", 60, 6*time.Hour, true)
+	addClip("c2", "789", 60, 6*time.Hour, true)
+
+	policy := ClipRetentionPolicy{MaxAge: 30 * 24 * time.Hour, DeviceQuotaBytes: 75, GlobalQuotaBytes: 220}
+	cs, err := NewClipStorage(zap.NewNop(), store, dir, policy)
+	if err != nil {
+		t.Fatalf("new clip storage: %v", err)
+	}
+	sweep, err := cs.Sweep(now)
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	// old goes on age, a1 and b1 to get 123 and 456 under quota, then b2 as the oldest unpinned clip
+	// left to bring the total (10 + 30 + 30 + 40 + 60 + 60 = 230) under 220. 789 stays over on pinned clips.
+	got := make(map[string]string)
+	for _, d := range sweep.Deleted {
+		got[d.ClipId] = d.Reason
+	}
+	want := map[string]string{"old": CLIP_DELETED_AGE, "a1": CLIP_DELETED_DEVICE_QUOTA, "b1": CLIP_DELETED_DEVICE_QUOTA, "b2": CLIP_DELETED_GLOBAL_QUOTA}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted %v, want %v", got, want)
+	}
+	if sweep.FreedBytes != 120 || sweep.UsedBytes != 190 || !reflect.DeepEqual(sweep.OverQuota, []string{"789"}) {
+		t.Errorf("sweep %+v", sweep)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a1.mp4")); !os.IsNotExist(err) {
+		t.Errorf("a1's file is still there")
+	}
+	if clip, _ := store.GetClip("old-pinned"); clip == nil {
+		t.Errorf("pinned clip deleted")
+	}
+
+	// unpinned, the 789 clips are fair game
+	cs.Pin("c1", false, "")
+	sweep, _ = cs.Sweep(now)
+	if len(sweep.Deleted) != 1 || sweep.Deleted[0].ClipId != "c1" {
+		t.Errorf("second sweep deleted %+v", sweep.Deleted)
+	}
+
+	usage, _ := cs.Usage()
+	if usage.Clips != 4 || usage.UsedBytes != 130 || usage.PinnedBytes != 70 || usage.LastSweep != sweep {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestClipStorage_PartialUploads(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "partial"), 0o755)
+	store := &memClipStorageStore{memUploadStore: memUploadStore{uploads: make(map[string]Upload_Schema), clips: make(map[string]Clip_Schema)}}
+	now := time.Now()
+	addUpload := func(id string, devId string, size int64, quiet time.Duration) {
+		path := filepath.Join(dir, "partial", id)
+		os.WriteFile(path, make([]byte, size), 0o644)
+		os.Chtimes(path, now.Add(-quiet), now.Add(-quiet))
+		store.UpsertUpload(&Upload_Schema{Id: id, DeviceId: devId, Status: UPLOAD_IN_PROGRESS})
+	}
+	addUpload("coming", "123", 50, time.Minute)
+	addUpload("stale", "123", 40, UPLOAD_STALE_AFTER+time.Hour)
+	clip := Clip_Schema{Id: "c1", DeviceId: "123", Size: 30, Time: now.Add(-time.Hour), File: "c1.mp4"}
+	os.WriteFile(filepath.Join(dir, clip.File), make([]byte, clip.Size), 0o644)
+	store.UpsertClip(&clip)
+
+	// the upload coming in puts 123 over quota, so the clip goes and the stale upload with it
+	cs, _ := NewClipStorage(zap.NewNop(), store, dir, ClipRetentionPolicy{DeviceQuotaBytes: 60})
+	sweep, err := cs.Sweep(now)
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if !reflect.DeepEqual(sweep.Stale, []string{"stale"}) || len(sweep.Deleted) != 1 || sweep.Deleted[0].ClipId != "c1" {
+		t.Errorf("sweep %+v", sweep)
+	}
+	if sweep.UsedBytes != 50 || sweep.FreedBytes != 70 {
+		t.Errorf("used %v, freed %v", sweep.UsedBytes, sweep.FreedBytes)
+	}
+	if upload, _ := store.GetUpload("stale"); upload != nil {
+		t.Error("stale upload still stored")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial", "stale")); !os.IsNotExist(err) {
+		t.Error("stale upload's file is still there")
+	}
+
+	usage, _ := cs.Usage()
+	if usage.UsedBytes != 50 || usage.PartialBytes != 50 || len(usage.Devices) != 1 || usage.Devices[0].PartialBytes != 50 {
+		t.Errorf("usage %+v", usage)
+	}
+}
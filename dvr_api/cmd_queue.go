@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+COMMAND QUEUE
+Commands for devices that aren't connected can be queued instead of failing. They're kept in mongodb
+and sent, oldest first, when the device next connects. A command that hasn't been delivered by its
+expiry time is expired. Each change of status is published as a "queue" event.
+~~~~~~~~~~~~~~~
+*/
+
+// statuses a queued command moves through, it only ever leaves QUEUED
+const (
+	CMD_QUEUED    string = "queued"
+	CMD_DELIVERED string = "delivered"
+	CMD_EXPIRED   string = "expired"
+	CMD_CANCELLED string = "cancelled"
+	CMD_FAILED    string = "failed"
+)
+
+// defaults for the queue
+const (
+	CMD_QUEUE_DEFAULT_TTL    time.Duration = 24 * time.Hour // how long a command waits if the client doesn't say
+	CMD_QUEUE_SWEEP_INTERVAL time.Duration = time.Minute    // how often we look for expired commands
+	CMD_QUEUE_MAX_ATTEMPTS   int           = 3              // failed sends before a command is given up on
+)
+
+// a command waiting for, or that waited for, a device. Stored in mongodb and sent to API clients.
+type QueuedCommand_Schema struct {
+	Id         string    `bson:"_id" json:"id"`
+	DeviceId   string    `bson:"deviceId" json:"deviceId"`
+	Message    string    `bson:"message" json:"message"`
+	QueuedTime time.Time `bson:"queuedTime" json:"queuedTime"`
+	ExpiryTime time.Time `bson:"expiryTime" json:"expiryTime"`
+	Status     string    `bson:"status" json:"status"`
+	StatusTime time.Time `bson:"statusTime" json:"statusTime"` // when the status last changed
+	Attempts   int       `bson:"attempts" json:"attempts"`     // failed sends so far
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// where the queue keeps its commands, the DBConnection outside of tests
+type CommandQueueStore interface {
+	InsertQueuedCommand(cmd *QueuedCommand_Schema) error
+	GetQueuedCommand(id string) (*QueuedCommand_Schema, error)
+	QueryQueuedCommands(devId string, pendingOnly bool) ([]QueuedCommand_Schema, error)
+	UpdateQueuedCommand(cmd *QueuedCommand_Schema, fromStatus string) (bool, error)
+}
+
+// holds commands for devices until they connect
+type CommandQueue struct {
+	// internal
+	locks map[string]*deviceLock // device id against a lock, one delivery run per device at a time so its commands go out in order
+	lock  sync.Mutex             // guards locks
+
+	// injected
+	logger       *zap.Logger
+	store        CommandQueueStore
+	send         ProcessMessageFunction // this func is meant to write a message to a connected device
+	isConnected  func(devId string) bool
+	publishEvent PublishEventFunction
+}
+
+// constructor
+func NewCommandQueue(logger *zap.Logger, store CommandQueueStore, send ProcessMessageFunction, isConnected func(devId string) bool, publishEvent PublishEventFunction) (*CommandQueue, error) {
+	cq := &CommandQueue{
+		locks:        make(map[string]*deviceLock),
+		logger:       logger,
+		store:        store,
+		send:         send,
+		isConnected:  isConnected,
+		publishEvent: publishEvent,
+	}
+	return cq, nil
+}
+
+// queue a message for its device, meant to be given to the message handler for devices that
+// aren't connected. msgWrap.queueTtl is how long it waits.
+func (cq *CommandQueue) Enqueue(msgWrap *MessageWrapper) error {
+	var devId string
+	err := getIdFromMessage(&msgWrap.message, &devId)
+	if err != nil {
+		return fmt.Errorf("couldn't parse device id from %v", msgWrap.message)
+	}
+	ttl := msgWrap.queueTtl
+	if ttl <= 0 {
+		ttl = CMD_QUEUE_DEFAULT_TTL
+	}
+	cmd := QueuedCommand_Schema{
+		Id:         uuid.New().String(),
+		DeviceId:   devId,
+		Message:    msgWrap.message,
+		QueuedTime: msgWrap.recvdTime,
+		ExpiryTime: msgWrap.recvdTime.Add(ttl),
+		Status:     CMD_QUEUED,
+		StatusTime: msgWrap.recvdTime,
+	}
+	err = cq.store.InsertQueuedCommand(&cmd)
+	if err != nil {
+		return fmt.Errorf("error queueing command: %v", err)
+	}
+	cq.publish(&cmd)
+
+	// the device may have connected since the message handler looked
+	if cq.isConnected(devId) {
+		go cq.Deliver(devId)
+	}
+	return nil
+}
+
+// deliver a device's queued commands when it connects, meant to be registered as a presence hook
+func (cq *CommandQueue) ProcessPresence(devId string, connected bool, t time.Time) {
+	if connected {
+		go cq.Deliver(devId)
+	}
+}
+
+// a device's delivery lock and how many delivery runs are holding or waiting for it
+type deviceLock struct {
+	sync.Mutex
+	users int
+}
+
+// take a device's delivery lock. It's forgotten once nothing's using it.
+func (cq *CommandQueue) lockDevice(devId string) *deviceLock {
+	cq.lock.Lock()
+	lock, ok := cq.locks[devId]
+	if !ok {
+		lock = &deviceLock{}
+		cq.locks[devId] = lock
+	}
+	lock.users++
+	cq.lock.Unlock()
+	lock.Lock()
+	return lock
+}
+
+// release a device's lock from lockDevice
+func (cq *CommandQueue) unlockDevice(devId string, lock *deviceLock) {
+	lock.Unlock()
+	cq.lock.Lock()
+	defer cq.lock.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(cq.locks, devId)
+	}
+}
+
+// send a device its queued commands, oldest first. Commands that have expired are expired instead.
+// A failed send stops the run so nothing overtakes the command, the rest wait for the next one.
+func (cq *CommandQueue) Deliver(devId string) {
+	lock := cq.lockDevice(devId)
+	defer cq.unlockDevice(devId, lock)
+
+	cmds, err := cq.store.QueryQueuedCommands(devId, true)
+	if err != nil {
+		cq.logger.Error("error getting queued commands", zap.String("devId", devId), zap.Error(err))
+		return
+	}
+	now := time.Now()
+	for i := range cmds {
+		if !now.Before(cmds[i].ExpiryTime) {
+			cq.transition(&cmds[i], CMD_EXPIRED, now, "")
+			continue
+		}
+		// stop if the device has gone, the rest wait for it to come back
+		if !cq.isConnected(devId) {
+			return
+		}
+		if !cq.deliverOne(&cmds[i]) {
+			return
+		}
+	}
+}
+
+// send one command. It's marked delivered before it's sent so a cancel can't race the send, and put
+// back if the send fails. Returns false if the send failed.
+func (cq *CommandQueue) deliverOne(cmd *QueuedCommand_Schema) bool {
+	queued := *cmd
+	if !cq.transition(cmd, CMD_DELIVERED, time.Now(), "") {
+		return true
+	}
+	err := cq.send(&MessageWrapper{cmd.Message, &cmd.Id, time.Now(), DirectionToDevice, 0})
+	if err == nil {
+		return true
+	}
+	cq.logger.Debug("error sending queued command", zap.String("cmdId", cmd.Id), zap.Error(err))
+
+	// put it back, or give up on it
+	status := CMD_QUEUED
+	if queued.Attempts+1 >= CMD_QUEUE_MAX_ATTEMPTS {
+		status = CMD_FAILED
+	}
+	cmd.Attempts = queued.Attempts + 1
+	cq.transition(cmd, status, time.Now(), err.Error())
+	return false
+}
+
+// move a command from its current status to another, publishing the change. Returns false if the
+// command had already moved on.
+func (cq *CommandQueue) transition(cmd *QueuedCommand_Schema, status string, t time.Time, errMsg string) bool {
+	from := cmd.Status
+	cmd.Status = status
+	cmd.StatusTime = t
+	cmd.Error = errMsg
+	ok, err := cq.store.UpdateQueuedCommand(cmd, from)
+	if err != nil {
+		cq.logger.Error("error updating queued command", zap.String("cmdId", cmd.Id), zap.Error(err))
+		return false
+	}
+	if ok {
+		cq.publish(cmd)
+	}
+	return ok
+}
+
+// publish a command's status
+func (cq *CommandQueue) publish(cmd *QueuedCommand_Schema) {
+	c := *cmd
+	err := cq.publishEvent(&DeviceEvent{EVENT_QUEUE, c.DeviceId, c.StatusTime, &c})
+	if err != nil {
+		cq.logger.Error("error publishing queue event", zap.Error(err))
+	}
+}
+
+// expire old commands, and deliver any whose device connected without us noticing, every interval. Blocks until the context is done.
+func (cq *CommandQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(CMD_QUEUE_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cq.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// one pass of Run
+func (cq *CommandQueue) sweep() {
+	cmds, err := cq.store.QueryQueuedCommands("", true)
+	if err != nil {
+		cq.logger.Error("error getting queued commands", zap.Error(err))
+		return
+	}
+	now := time.Now()
+	waiting := make(map[string]bool)
+	for i := range cmds {
+		if !now.Before(cmds[i].ExpiryTime) {
+			cq.transition(&cmds[i], CMD_EXPIRED, now, "")
+			continue
+		}
+		waiting[cmds[i].DeviceId] = true
+	}
+	for devId := range waiting {
+		if cq.isConnected(devId) {
+			cq.Deliver(devId)
+		}
+	}
+}
+
+// cancel a command that hasn't been sent yet. Returns the command as it now stands, nil if there's no
+// such command, and false if it had already left the queue.
+func (cq *CommandQueue) Cancel(id string) (*QueuedCommand_Schema, bool, error) {
+	cmd, err := cq.store.GetQueuedCommand(id)
+	if err != nil || cmd == nil {
+		return nil, false, err
+	}
+	if cmd.Status != CMD_QUEUED {
+		return cmd, false, nil
+	}
+	if !cq.transition(cmd, CMD_CANCELLED, time.Now(), "") {
+		// lost a race with a delivery or the sweep
+		cmd, err = cq.store.GetQueuedCommand(id)
+		return cmd, false, err
+	}
+	return cmd, true, nil
+}
+
+// a device's commands, oldest first. pendingOnly leaves out the ones that have left the queue.
+func (cq *CommandQueue) GetQueue(devId string, pendingOnly bool) ([]QueuedCommand_Schema, error) {
+	return cq.store.QueryQueuedCommands(devId, pendingOnly)
+}
+
+// add the queue endpoints to the http server
+func (cq *CommandQueue) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /devices/{id}/queue", cq.handleGetQueue)
+	svr.HandleFunc("GET /queue/{id}", cq.handleGet)
+	svr.HandleFunc("DELETE /queue/{id}", cq.handleCancel)
+}
+
+// GET /devices/{id}/queue?all=true
+func (cq *CommandQueue) handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	all := false
+	if v := r.URL.Query().Get("all"); v != "" {
+		var err error
+		all, err = strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "all must be true or false")
+			return
+		}
+	}
+	cmds, err := cq.GetQueue(r.PathValue("id"), !all)
+	if err != nil {
+		cq.logger.Error("failed to query command queue", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query command queue")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmds)
+}
+
+// GET /queue/{id}
+func (cq *CommandQueue) handleGet(w http.ResponseWriter, r *http.Request) {
+	cmd, err := cq.store.GetQueuedCommand(r.PathValue("id"))
+	if err != nil {
+		cq.logger.Error("failed to query queued command", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query queued command")
+		return
+	}
+	if cmd == nil {
+		writeError(w, http.StatusNotFound, "no such queued command")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// DELETE /queue/{id}
+func (cq *CommandQueue) handleCancel(w http.ResponseWriter, r *http.Request) {
+	cmd, cancelled, err := cq.Cancel(r.PathValue("id"))
+	if err != nil {
+		cq.logger.Error("failed to cancel queued command", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to cancel queued command")
+		return
+	}
+	if cmd == nil {
+		writeError(w, http.StatusNotFound, "no such queued command")
+		return
+	}
+	if !cancelled {
+		writeError(w, http.StatusConflict, fmt.Sprintf("command is already %v", cmd.Status))
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// insert a newly queued command
+func (dbc *DBConnection) InsertQueuedCommand(cmd *QueuedCommand_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("cmd_queue")
+	_, err := coll.InsertOne(ctx, cmd)
+	return err
+}
+
+// get one queued command, nil if there's no such command
+func (dbc *DBConnection) GetQueuedCommand(id string) (*QueuedCommand_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("cmd_queue")
+	var cmd QueuedCommand_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&cmd)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// get a device's commands oldest first, every device's if devId is empty
+func (dbc *DBConnection) QueryQueuedCommands(devId string, pendingOnly bool) ([]QueuedCommand_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("cmd_queue")
+
+	filter := bson.M{}
+	if devId != "" {
+		filter["deviceId"] = devId
+	}
+	if pendingOnly {
+		filter["status"] = CMD_QUEUED
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "queuedTime", Value: 1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying command queue: %v", err)
+	}
+	cmds := make([]QueuedCommand_Schema, 0)
+	err = cursor.All(context.Background(), &cmds)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding command queue: %v", err)
+	}
+	return cmds, nil
+}
+
+// write a command's new status, only if it's still in fromStatus. Returns false if it wasn't.
+func (dbc *DBConnection) UpdateQueuedCommand(cmd *QueuedCommand_Schema, fromStatus string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("cmd_queue")
+	update := bson.M{"$set": bson.M{
+		"status":     cmd.Status,
+		"statusTime": cmd.StatusTime,
+		"attempts":   cmd.Attempts,
+		"error":      cmd.Error,
+	}}
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": cmd.Id, "status": fromStatus}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory CommandQueueStore
+type memCommandQueueStore struct {
+	lock sync.Mutex
+	cmds map[string]QueuedCommand_Schema
+}
+
+func newMemCommandQueueStore() *memCommandQueueStore {
+	return &memCommandQueueStore{cmds: make(map[string]QueuedCommand_Schema)}
+}
+
+func (m *memCommandQueueStore) InsertQueuedCommand(cmd *QueuedCommand_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cmds[cmd.Id] = *cmd
+	return nil
+}
+
+func (m *memCommandQueueStore) GetQueuedCommand(id string) (*QueuedCommand_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cmd, ok := m.cmds[id]
+	if !ok {
+		return nil, nil
+	}
+	return &cmd, nil
+}
+
+func (m *memCommandQueueStore) QueryQueuedCommands(devId string, pendingOnly bool) ([]QueuedCommand_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cmds := make([]QueuedCommand_Schema, 0)
+	for _, cmd := range m.cmds {
+		if (devId == "" || cmd.DeviceId == devId) && (!pendingOnly || cmd.Status == CMD_QUEUED) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].QueuedTime.Before(cmds[j].QueuedTime) })
+	return cmds, nil
+}
+
+func (m *memCommandQueueStore) UpdateQueuedCommand(cmd *QueuedCommand_Schema, fromStatus string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cur, ok := m.cmds[cmd.Id]
+	if !ok || cur.Status != fromStatus {
+		return false, nil
+	}
+	m.cmds[cmd.Id] = *cmd
+	return true, nil
+}
+
+// stands in for a device, records what the queue sends it and the events published. Sends fail while failSends is set.
+type queueTestDevice struct {
+	lock      sync.Mutex
+	connected bool
+	failSends bool
+	sent      []string
+	events    []string
+}
+
+func newTestCommandQueue(store *memCommandQueueStore, dev *queueTestDevice) *CommandQueue {
+	send := func(msgWrap *MessageWrapper) error {
+		dev.lock.Lock()
+		defer dev.lock.Unlock()
+		if dev.failSends {
+			return fmt.Errorf("write failed")
+		}
+		dev.sent = append(dev.sent, msgWrap.message)
+		return nil
+	}
+	isConnected := func(devId string) bool {
+		dev.lock.Lock()
+		defer dev.lock.Unlock()
+		return dev.connected
+	}
+	publishEvent := func(event *DeviceEvent) error {
+		dev.lock.Lock()
+		defer dev.lock.Unlock()
+		dev.events = append(dev.events, event.Data.(*QueuedCommand_Schema).Status)
+		return nil
+	}
+	cq, _ := NewCommandQueue(zap.NewNop(), store, send, isConnected, publishEvent)
+	return cq
+}
+
+func TestCommandQueue_DeliverOnConnect(t *testing.T) {
+	store := newMemCommandQueueStore()
+	dev := &queueTestDevice{}
+	cq := newTestCommandQueue(store, dev)
+
+	now := time.Now()
+	msgs := []string{"$VIDEO;123;1", "$VIDEO;123;2", "$VIDEO;123;3"}
+	for i, msg := range msgs {
+		err := cq.Enqueue(&MessageWrapper{msg, nil, now.Add(time.Duration(i) * time.Second), DirectionToDevice, time.Hour})
+		if err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if len(dev.sent) != 0 {
+		t.Fatalf("sent %v before the device connected", dev.sent)
+	}
+
+	dev.connected = true
+	cq.Deliver("123")
+	if fmt.Sprint(dev.sent) != fmt.Sprint(msgs) {
+		t.Fatalf("sent %v, want %v in order", dev.sent, msgs)
+	}
+	pending, _ := cq.GetQueue("123", true)
+	if len(pending) != 0 {
+		t.Fatalf("%v commands still pending after delivery", len(pending))
+	}
+	if fmt.Sprint(dev.events) != "[queued queued queued delivered delivered delivered]" {
+		t.Fatalf("published %v", dev.events)
+	}
+}
+
+func TestCommandQueue_ExpireAndCancel(t *testing.T) {
+	store := newMemCommandQueueStore()
+	dev := &queueTestDevice{}
+	cq := newTestCommandQueue(store, dev)
+
+	old := time.Now().Add(-2 * time.Hour)
+	cq.Enqueue(&MessageWrapper{"$VIDEO;123;old", nil, old, DirectionToDevice, time.Hour})
+	cq.Enqueue(&MessageWrapper{"$VIDEO;123;cancel", nil, time.Now(), DirectionToDevice, time.Hour})
+	cq.Enqueue(&MessageWrapper{"$VIDEO;123;keep", nil, time.Now().Add(time.Second), DirectionToDevice, time.Hour})
+
+	all, _ := cq.GetQueue("123", false)
+	cmd, cancelled, err := cq.Cancel(all[1].Id)
+	if err != nil || !cancelled || cmd.Status != CMD_CANCELLED {
+		t.Fatalf("cancel: %v %v %v", cmd, cancelled, err)
+	}
+	_, cancelled, _ = cq.Cancel(all[1].Id)
+	if cancelled {
+		t.Fatalf("cancelled a command twice")
+	}
+
+	cq.sweep()
+	expired, _ := store.GetQueuedCommand(all[0].Id)
+	if expired.Status != CMD_EXPIRED {
+		t.Fatalf("old command is %v, want %v", expired.Status, CMD_EXPIRED)
+	}
+
+	dev.connected = true
+	cq.sweep()
+	if len(dev.sent) != 1 || dev.sent[0] != "$VIDEO;123;keep" {
+		t.Fatalf("sent %v, want only the command that wasn't cancelled or expired", dev.sent)
+	}
+}
+
+func TestCommandQueue_FailedSends(t *testing.T) {
+	store := newMemCommandQueueStore()
+	dev := &queueTestDevice{connected: true, failSends: true}
+	cq := newTestCommandQueue(store, dev)
+
+	cq.store.InsertQueuedCommand(&QueuedCommand_Schema{Id: "a", DeviceId: "123", Message: "$VIDEO;123", QueuedTime: time.Now(), ExpiryTime: time.Now().Add(time.Hour), Status: CMD_QUEUED})
+	for i := 1; i <= CMD_QUEUE_MAX_ATTEMPTS; i++ {
+		cq.Deliver("123")
+		cmd, _ := store.GetQueuedCommand("a")
+		if cmd.Attempts != i {
+			t.Fatalf("attempts = %v after %v deliveries", cmd.Attempts, i)
+		}
+		want := CMD_QUEUED
+		if i == CMD_QUEUE_MAX_ATTEMPTS {
+			want = CMD_FAILED
+		}
+		if cmd.Status != want {
+			t.Fatalf("status = %v after %v failed sends, want %v", cmd.Status, i, want)
+		}
+	}
+}
+
+func TestCommandQueue_FailedSendStopsDelivery(t *testing.T) {
+	store := newMemCommandQueueStore()
+	dev := &queueTestDevice{connected: true, failSends: true}
+	cq := newTestCommandQueue(store, dev)
+
+	msgs := []string{"$VIDEO;123;1", "$VIDEO;123;2", "$VIDEO;123;3"}
+	for i, msg := range msgs {
+		cq.store.InsertQueuedCommand(&QueuedCommand_Schema{Id: fmt.Sprint(i), DeviceId: "123", Message: msg, QueuedTime: time.Now(), ExpiryTime: time.Now().Add(time.Hour), Status: CMD_QUEUED})
+	}
+	// the first fails, so the ones after it aren't tried
+	cq.Deliver("123")
+	for i := range msgs {
+		cmd, _ := store.GetQueuedCommand(fmt.Sprint(i))
+		if cmd.Status != CMD_QUEUED || (i == 0) != (cmd.Attempts == 1) {
+			t.Errorf("command %v is %v after %v attempts, expected only the first tried", i, cmd.Status, cmd.Attempts)
+		}
+	}
+
+	dev.failSends = false
+	cq.Deliver("123")
+	if fmt.Sprint(dev.sent) != fmt.Sprint(msgs) {
+		t.Errorf("sent %v, want %v in order", dev.sent, msgs)
+	}
+}
+
+func TestCommandQueue_DeliverPerDevice(t *testing.T) {
+	store := newMemCommandQueueStore()
+	release := make(chan struct{})
+	var lock sync.Mutex
+	sent := make([]string, 0)
+	send := func(msgWrap *MessageWrapper) error {
+		if msgWrap.message == "$VIDEO;123" {
+			<-release
+		}
+		lock.Lock()
+		sent = append(sent, msgWrap.message)
+		lock.Unlock()
+		return nil
+	}
+	isConnected := func(devId string) bool { return true }
+	publishEvent := func(event *DeviceEvent) error { return nil }
+	cq, _ := NewCommandQueue(zap.NewNop(), store, send, isConnected, publishEvent)
+	for _, devId := range []string{"123", "456"} {
+		cq.store.InsertQueuedCommand(&QueuedCommand_Schema{Id: devId, DeviceId: devId, Message: "$VIDEO;" + devId, QueuedTime: time.Now(), ExpiryTime: time.Now().Add(time.Hour), Status: CMD_QUEUED})
+	}
+
+	// one device's slow send doesn't hold up another's delivery
+	done := make(chan struct{})
+	go func() {
+		cq.Deliver("123")
+		close(done)
+	}()
+	waitFor(t, "the first delivery to start", func() bool {
+		cmd, _ := store.GetQueuedCommand("123")
+		return cmd.Status == CMD_DELIVERED
+	})
+	cq.Deliver("456")
+	lock.Lock()
+	if fmt.Sprint(sent) != "[$VIDEO;456]" {
+		t.Errorf("expected 456 delivered while 123 was sending, got %v", sent)
+	}
+	lock.Unlock()
+	close(release)
+	<-done
+	if len(cq.locks) != 0 {
+		t.Errorf("expected the device locks to be forgotten, got %v", len(cq.locks))
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+COMMAND TEMPLATES
+Structured commands, e.g. {"type":"video","device":"123456","camera":4,"start":"...","lengthSeconds":5},
+validated against a template and rendered into the wire format, e.g.
+$VIDEO;123456;all;4;20231003-164514;5. The wire format is the command, the device id, then each of
+the template's params in order, separated by semicolons. Malformed commands are rejected here so
+they never reach a device.
+~~~~~~~~~~~~~~~
+*/
+
+// the kinds of param a template can take
+const (
+	PARAM_INT    string = "int"    // a whole number, between min and max if set
+	PARAM_STRING string = "string" // text without semicolons or line breaks
+	PARAM_ENUM   string = "enum"   // one of the options
+	PARAM_TIME   string = "time"   // RFC3339, or already in the device format 20060102-150405
+)
+
+// the format devices read and write times in
+const DEVICE_TIME_FORMAT string = "20060102-150405"
+
+// keys in a command request that aren't params
+const (
+	CMD_KEY_TYPE      string = "type"
+	CMD_KEY_DEVICE    string = "device"
+	CMD_KEY_QUEUE_TTL string = "queueTtlSeconds"
+)
+
+// one param of a command, sent to API clients so they can build forms
+type CommandParam struct {
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required"`
+	Default     string   `json:"default,omitempty"` // rendered as is if the param isn't given
+	Min         *int     `json:"min,omitempty"`
+	Max         *int     `json:"max,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// a command API clients can send without building the wire format themselves
+type CommandTemplate struct {
+	Type        string         `json:"type"`
+	Command     string         `json:"command"` // e.g. $VIDEO
+	Description string         `json:"description"`
+	Params      []CommandParam `json:"params"`
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// the commands we know how to build, add to this as devices learn new ones
+var COMMAND_TEMPLATES = []CommandTemplate{
+	{
+		Type:        "video",
+		Command:     "$VIDEO",
+		Description: "request footage from a camera",
+		Params: []CommandParam{
+			{Name: "videoType", Kind: PARAM_STRING, Default: "all", Description: "which footage, all of it by default"},
+			{Name: "camera", Kind: PARAM_INT, Required: true, Min: intPtr(0), Max: intPtr(8), Description: "channel number"},
+			{Name: "start", Kind: PARAM_TIME, Required: true, Description: "start of the footage, in the device's clock"},
+			{Name: "lengthSeconds", Kind: PARAM_INT, Required: true, Min: intPtr(1), Max: intPtr(300)},
+		},
+	},
+	{
+		Type:        "status",
+		Command:     "$STATUS",
+		Description: "ask the device for its status",
+		Params:      []CommandParam{},
+	},
+	{
+		Type:        "config",
+		Command:     "$CONFIG",
+		Description: "set a config value on the device",
+		Params: []CommandParam{
+			{Name: "key", Kind: PARAM_STRING, Required: true},
+			{Name: "value", Kind: PARAM_STRING, Required: true},
+		},
+	},
+}
+
+// find a template by type
+func getCommandTemplate(cmdType string) *CommandTemplate {
+	for i := range COMMAND_TEMPLATES {
+		if COMMAND_TEMPLATES[i].Type == cmdType {
+			return &COMMAND_TEMPLATES[i]
+		}
+	}
+	return nil
+}
+
+// a structured command sent by API clients. Every key other than type, device and queueTtlSeconds
+// is a param.
+type CommandRequest struct {
+	Type            string
+	Device          string
+	QueueTtlSeconds int // queue the command if the device isn't connected, 0 to fail it
+	Params          map[string]json.RawMessage
+
+	// a reserved key of the wrong type, reported by renderCommand rather than failing the whole
+	// request the command came in
+	invalid error
+}
+
+// pull the reserved keys out, leave the rest as params
+func (c *CommandRequest) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if raw, ok := fields[CMD_KEY_TYPE]; ok {
+		if json.Unmarshal(raw, &c.Type) != nil {
+			c.invalid = fmt.Errorf("type must be a string")
+		}
+		delete(fields, CMD_KEY_TYPE)
+	}
+	if raw, ok := fields[CMD_KEY_DEVICE]; ok {
+		if json.Unmarshal(raw, &c.Device) != nil {
+			c.invalid = fmt.Errorf("device must be a string")
+		}
+		delete(fields, CMD_KEY_DEVICE)
+	}
+	if raw, ok := fields[CMD_KEY_QUEUE_TTL]; ok {
+		if json.Unmarshal(raw, &c.QueueTtlSeconds) != nil {
+			c.invalid = fmt.Errorf("queueTtlSeconds must be a whole number")
+		}
+		delete(fields, CMD_KEY_QUEUE_TTL)
+	}
+	c.Params = fields
+	return nil
+}
+
+// check a command against its template and render the wire format
+func renderCommand(req *CommandRequest) (string, error) {
+	if req.invalid != nil {
+		return "", req.invalid
+	}
+	tmpl := getCommandTemplate(req.Type)
+	if tmpl == nil {
+		return "", fmt.Errorf("unknown command type %q", req.Type)
+	}
+	if req.Device == "" {
+		return "", fmt.Errorf("device can't be empty")
+	}
+	if _, err := strconv.ParseUint(req.Device, 10, 64); err != nil {
+		return "", fmt.Errorf("device must be a numeric device id")
+	}
+	if req.QueueTtlSeconds < 0 {
+		return "", fmt.Errorf("queueTtlSeconds can't be negative")
+	}
+	for name := range req.Params {
+		if !tmpl.hasParam(name) {
+			return "", fmt.Errorf("%v commands don't take %q", tmpl.Type, name)
+		}
+	}
+
+	fields := []string{tmpl.Command, req.Device}
+	for _, param := range tmpl.Params {
+		raw, ok := req.Params[param.Name]
+		if !ok || string(raw) == "null" {
+			if param.Required {
+				return "", fmt.Errorf("%v is required", param.Name)
+			}
+			fields = append(fields, param.Default)
+			continue
+		}
+		val, err := param.render(raw)
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", param.Name, err)
+		}
+		fields = append(fields, val)
+	}
+	return strings.Join(fields, ";"), nil
+}
+
+// does the template take a param with this name
+func (t *CommandTemplate) hasParam(name string) bool {
+	for _, param := range t.Params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check one param's value and render it for the wire format
+func (p *CommandParam) render(raw json.RawMessage) (string, error) {
+	switch p.Kind {
+	case PARAM_INT:
+		var i int
+		if err := json.Unmarshal(raw, &i); err != nil {
+			return "", fmt.Errorf("must be a whole number")
+		}
+		if p.Min != nil && i < *p.Min {
+			return "", fmt.Errorf("must be at least %v", *p.Min)
+		}
+		if p.Max != nil && i > *p.Max {
+			return "", fmt.Errorf("must be at most %v", *p.Max)
+		}
+		return strconv.Itoa(i), nil
+	case PARAM_STRING:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("must be a string")
+		}
+		if s == "" {
+			return "", fmt.Errorf("can't be empty")
+		}
+		if strings.ContainsAny(s, ";\r\n") {
+			return "", fmt.Errorf("can't contain semicolons or line breaks")
+		}
+		return s, nil
+	case PARAM_ENUM:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || !containsString(p.Options, s) {
+			return "", fmt.Errorf("must be one of %v", strings.Join(p.Options, ", "))
+		}
+		return s, nil
+	case PARAM_TIME:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("must be a string")
+		}
+		// the device's clock has no zone, so the time is rendered in the offset it's given in
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t.Format(DEVICE_TIME_FORMAT), nil
+		}
+		if _, err := time.Parse(DEVICE_TIME_FORMAT, s); err == nil {
+			return s, nil
+		}
+		return "", fmt.Errorf("must be RFC3339 or %v", DEVICE_TIME_FORMAT)
+	}
+	return "", fmt.Errorf("unknown param kind %v", p.Kind)
+}
+
+// what happened to a command sent with POST /commands
+type CommandSent_Response struct {
+	Message string `json:"message"`
+	Status  string `json:"status"` // JOB_SENT or JOB_QUEUED
+}
+
+// one rejected command in a websocket request
+type CommandError_Response struct {
+	Index int    `json:"index"` // position in the request's commands
+	Error string `json:"error"`
+}
+
+// sends structured commands on behalf of http clients
+type CommandSender struct {
+	logger      *zap.Logger
+	send        ProcessMessageFunction // this func is meant to send, or queue, a message for a device
+	isConnected func(devId string) bool
+}
+
+// constructor
+func NewCommandSender(logger *zap.Logger, send ProcessMessageFunction, isConnected func(devId string) bool) (*CommandSender, error) {
+	return &CommandSender{logger, send, isConnected}, nil
+}
+
+// add the command endpoints to the http server
+func (cs *CommandSender) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /commands/templates", cs.handleListTemplates)
+	svr.HandleFunc("POST /commands/render", cs.handleRender)
+	svr.HandleFunc("POST /commands", cs.handleSend)
+}
+
+// GET /commands/templates
+func (cs *CommandSender) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, COMMAND_TEMPLATES)
+}
+
+// read and render a command from the request body, writing an error response if it's no good
+func (cs *CommandSender) readCommand(w http.ResponseWriter, r *http.Request) (*CommandRequest, string, bool) {
+	var req CommandRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid command json: %v", err))
+		return nil, "", false
+	}
+	message, err := renderCommand(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, "", false
+	}
+	return &req, message, true
+}
+
+// POST /commands/render, the wire format without sending it
+func (cs *CommandSender) handleRender(w http.ResponseWriter, r *http.Request) {
+	_, message, ok := cs.readCommand(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": message})
+}
+
+// POST /commands, render and send
+func (cs *CommandSender) handleSend(w http.ResponseWriter, r *http.Request) {
+	req, message, ok := cs.readCommand(w, r)
+	if !ok {
+		return
+	}
+	res := CommandSent_Response{Message: message, Status: JOB_SENT}
+	if !cs.isConnected(req.Device) {
+		if req.QueueTtlSeconds == 0 {
+			writeError(w, http.StatusConflict, "device not connected")
+			return
+		}
+		res.Status = JOB_QUEUED
+	}
+	clientId := uuid.New().String()
+	err := cs.send(&MessageWrapper{message, &clientId, time.Now(), DirectionToDevice, time.Duration(req.QueueTtlSeconds) * time.Second})
+	if err != nil {
+		cs.logger.Error("failed to send command", zap.String("message", message), zap.Error(err))
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to send command: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
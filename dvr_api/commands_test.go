@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRenderCommand(t *testing.T) {
+	good := map[string]string{
+		`{"type":"video","device":"123456","camera":4,"start":"2023-10-03T16:45:14+01:00","lengthSeconds":5}`:             "$VIDEO;123456;all;4;20231003-164514;5",
+		`{"type":"video","device":"123456","videoType":"alarm","camera":0,"start":"20231003-164514","lengthSeconds":300}`: "$VIDEO;123456;alarm;0;20231003-164514;300",
+		`{"type":"status","device":"123456"}`:                                "$STATUS;123456",
+		`{"type":"config","device":"123456","key":"APN","value":"internet"}`: "$CONFIG;123456;APN;internet",
+	}
+	for body, want := range good {
+		var req CommandRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("%v: %v", body, err)
+		}
+		got, err := renderCommand(&req)
+		if err != nil || got != want {
+			t.Errorf("%v: got %q, %v, want %q", body, got, err, want)
+		}
+	}
+
+	bad := []string{
+		`{"type":"teleport","device":"123456"}`,
+		`{"type":"status"}`,
+		`{"type":"status","device":"12a456"}`,
+		`{"type":5,"device":"123456"}`,
+		`{"type":"status","device":"123456","camera":4}`,
+		`{"type":"video","device":"123456","start":"2023-10-03T16:45:14Z","lengthSeconds":5}`,
+		`{"type":"video","device":"123456","camera":9,"start":"2023-10-03T16:45:14Z","lengthSeconds":5}`,
+		`{"type":"video","device":"123456","camera":"4","start":"2023-10-03T16:45:14Z","lengthSeconds":5}`,
+		`{"type":"video","device":"123456","camera":4,"start":"yesterday","lengthSeconds":5}`,
+		`{"type":"video","device":"123456","camera":4,"start":"2023-10-03T16:45:14Z","lengthSeconds":0}`,
+		`{"type":"config","device":"123456","key":"APN","value":"internet;$REBOOT"}`,
+		`{"type":"status","device":"123456","queueTtlSeconds":-1}`,
+	}
+	for _, body := range bad {
+		var req CommandRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("%v: %v", body, err)
+		}
+		if got, err := renderCommand(&req); err == nil {
+			t.Errorf("%v rendered as %q", body, got)
+		}
+	}
+}
+
+func TestCommandParamEnum(t *testing.T) {
+	p := CommandParam{Name: "mode", Kind: PARAM_ENUM, Options: []string{"on", "off"}}
+	if got, err := p.render(json.RawMessage(`"on"`)); err != nil || got != "on" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := p.render(json.RawMessage(`"sideways"`)); err == nil {
+		t.Errorf("value outside the options rendered")
+	}
+}
+
+func TestCommandSender_Send(t *testing.T) {
+	sent := make([]*MessageWrapper, 0)
+	send := func(msgWrap *MessageWrapper) error {
+		if strings.HasPrefix(msgWrap.message, "$CONFIG") {
+			return fmt.Errorf("write failed")
+		}
+		sent = append(sent, msgWrap)
+		return nil
+	}
+	isConnected := func(devId string) bool { return devId == "123456" }
+	cs, _ := NewCommandSender(zap.NewNop(), send, isConnected)
+
+	cases := []struct {
+		body   string
+		status int
+	}{
+		{`{"type":"status","device":"123456"}`, http.StatusOK},
+		{`{"type":"status","device":"654321"}`, http.StatusConflict},
+		{`{"type":"status","device":"654321","queueTtlSeconds":60}`, http.StatusOK},
+		{`{"type":"status","device":"123456","camera":1}`, http.StatusBadRequest},
+		{`{"type":"config","device":"123456","key":"APN","value":"internet"}`, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		cs.handleSend(rec, httptest.NewRequest(http.MethodPost, "/commands", strings.NewReader(c.body)))
+		if rec.Code != c.status {
+			t.Errorf("%v: status %v, want %v", c.body, rec.Code, c.status)
+		}
+	}
+	if len(sent) != 2 || sent[0].message != "$STATUS;123456" || sent[1].queueTtl == 0 {
+		t.Errorf("sent %+v", sent)
+	}
+}
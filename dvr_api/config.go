@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+~~~~~~~~~~~~~~~
+CONFIGURATION
+Everything that changes between deployments, loaded in order of precedence:
+	flags, ex: -mongo-uri mongodb://db:27017/
+	environment variables, ex: DVR_API_MONGO_URI=mongodb://db:27017/
+	a YAML or TOML file named by -config or DVR_API_CONFIG, by its extension
+	the defaults in main.go
+Every setting has all three names, derived from the file key: mongoUri, DVR_API_MONGO_URI, -mongo-uri.
+Unknown keys in the file are errors, so a typo doesn't quietly leave the default in place. A TOML
+file is read with BurntSushi/toml then checked the same way as YAML.
+~~~~~~~~~~~~~~~
+*/
+
+const CONFIG_ENV_PREFIX string = "DVR_API_"
+
+// the settings, the yaml key of each is its name in the file
+type Config struct {
+	DeviceEndpoint     string                   `yaml:"deviceEndpoint" help:"endpoint for the device server"`
+	WebsocketEndpoint  string                   `yaml:"websocketEndpoint" help:"endpoint for the websocket api server"`
+	HttpEndpoint       string                   `yaml:"httpEndpoint" help:"endpoint for the REST api server"`
+	MongoUri           string                   `yaml:"mongoUri" help:"database uri"`
+	DbName             string                   `yaml:"dbName" help:"name of the database inside mongo"`
+	Prod               bool                     `yaml:"prod" help:"production logging, and no CORS"`
+	Capacity           int                      `yaml:"capacity" help:"how many devices can connect"`
+	BufSize            int                      `yaml:"bufSize" help:"bytes each device connection reads into"`
+	MsgBufSize         int                      `yaml:"msgBufSize" help:"capacity of each server's message queue"`
+	OverloadPolicy     OverloadPolicy           `yaml:"overloadPolicy" help:"what to do with a connection sending too fast: block, drop or disconnect"`
+	MsgWorkers         int                      `yaml:"msgWorkers" help:"messages from different devices processed at once"`
+	WriteQueueSize     int                      `yaml:"writeQueueSize" help:"messages and positions waiting to be written to the database"`
+	SpillDir           string                   `yaml:"spillDir" help:"where writes are kept while the database is down"`
+	SpillMaxBytes      int64                    `yaml:"spillMaxBytes" help:"most bytes of writes kept on disk while the database is down"`
+	ShutdownTimeout    time.Duration            `yaml:"shutdownTimeout" help:"how long to stop cleanly on SIGINT or SIGTERM"`
+	MqttBrokerUrl      string                   `yaml:"mqttBrokerUrl" help:"mqtt broker to bridge device messages to, empty to disable"`
+	MqttTopicPrefix    string                   `yaml:"mqttTopicPrefix" help:"first level of the mqtt topics"`
+	ClipStorageDir     string                   `yaml:"clipStorageDir" help:"where footage uploaded by devices is kept"`
+	ClipMaxAge         time.Duration            `yaml:"clipMaxAge" help:"clips older than this are deleted unless pinned, 0 for no limit"`
+	ClipDeviceQuota    int64                    `yaml:"clipDeviceQuota" help:"bytes of clips kept per device, 0 for no limit"`
+	ClipGlobalQuota    int64                    `yaml:"clipGlobalQuota" help:"bytes of clips kept altogether, 0 for no limit"`
+	MsgRetention       map[string]time.Duration `yaml:"msgRetention" help:"how long messages are kept by type, ex: GPS=2160h,*=0"`
+	MsgRetentionDryRun bool                     `yaml:"msgRetentionDryRun" help:"only report what message retention would prune"`
+}
+
+// the defaults from main.go
+func DefaultConfig() *Config {
+	retention := make(map[string]time.Duration, len(MSG_RETENTION))
+	for msgType, age := range MSG_RETENTION {
+		retention[msgType] = age
+	}
+	return &Config{
+		DeviceEndpoint:     DEVICE_SVR_ENDPOINT,
+		WebsocketEndpoint:  WEBSOCK_SVR_ENDPOINT,
+		HttpEndpoint:       HTTP_SVR_ENDPOINT,
+		MongoUri:           MONGODB_ENDPOINT,
+		DbName:             DB_NAME,
+		Prod:               PROD,
+		Capacity:           CAPACITY,
+		BufSize:            BUF_SIZE,
+		MsgBufSize:         SVR_MSGBUF_SIZE,
+		OverloadPolicy:     SVR_OVERLOAD_POLICY,
+		MsgWorkers:         MSG_WORKERS,
+		WriteQueueSize:     WRITE_QUEUE_SIZE,
+		SpillDir:           SPILL_DIR,
+		SpillMaxBytes:      SPILL_MAX_BYTES,
+		ShutdownTimeout:    SHUTDOWN_TIMEOUT,
+		MqttBrokerUrl:      MQTT_BROKER_URL,
+		MqttTopicPrefix:    MQTT_TOPIC_PREFIX,
+		ClipStorageDir:     CLIP_STORAGE_DIR,
+		ClipMaxAge:         CLIP_MAX_AGE,
+		ClipDeviceQuota:    CLIP_DEVICE_QUOTA,
+		ClipGlobalQuota:    CLIP_GLOBAL_QUOTA,
+		MsgRetention:       retention,
+		MsgRetentionDryRun: MSG_RETENTION_DRY_RUN,
+	}
+}
+
+// one setting's names and where it lives in the struct
+type configField struct {
+	key   string // in the file
+	env   string
+	flag  string
+	help  string
+	index int
+}
+
+// the names of every setting
+func configFields() []configField {
+	t := reflect.TypeOf(Config{})
+	fields := make([]configField, t.NumField())
+	for i := range fields {
+		f := t.Field(i)
+		key := f.Tag.Get("yaml")
+		words := splitCamel(key)
+		fields[i] = configField{
+			key:   key,
+			env:   CONFIG_ENV_PREFIX + strings.ToUpper(strings.Join(words, "_")),
+			flag:  strings.Join(words, "-"),
+			help:  f.Tag.Get("help"),
+			index: i,
+		}
+	}
+	return fields
+}
+
+// "mongoUri" -> ["mongo", "uri"]
+func splitCamel(s string) []string {
+	words := make([]string, 0)
+	start := 0
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(s[start:i]))
+			start = i
+		}
+	}
+	return append(words, strings.ToLower(s[start:]))
+}
+
+// set a setting from an environment variable or flag
+func (c *Config) set(field configField, value string) error {
+	v := reflect.ValueOf(c).Elem().Field(field.index)
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", field.key, err)
+		}
+		v.SetInt(int64(d))
+	case map[string]time.Duration:
+		// TYPE=age pairs, separated by commas
+		m := make(map[string]time.Duration)
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			msgType, age, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%v: expected TYPE=age, got %q", field.key, pair)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(age))
+			if err != nil {
+				return fmt.Errorf("%v: %v", field.key, err)
+			}
+			m[strings.TrimSpace(msgType)] = d
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%v: expected true or false, got %q", field.key, value)
+			}
+			v.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 0, 64)
+			if err != nil {
+				return fmt.Errorf("%v: expected a whole number, got %q", field.key, value)
+			}
+			v.SetInt(n)
+		default:
+			return fmt.Errorf("%v: can't be set from text", field.key)
+		}
+	}
+	return nil
+}
+
+// load the config from the file, environment and flags, in that order, and validate it. Also returns
+// whether -print-config was given.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, bool, error) {
+	fields := configFields()
+
+	// flags are kept until the file and environment have been applied
+	fs := flag.NewFlagSet("dvr_api", flag.ContinueOnError)
+	configPath, _ := lookupEnv(CONFIG_ENV_PREFIX + "CONFIG")
+	fs.StringVar(&configPath, "config", configPath, "YAML or TOML config file, also "+CONFIG_ENV_PREFIX+"CONFIG")
+	printConfig := fs.Bool("print-config", false, "print the config that would be used as YAML and exit")
+	flagged := make(map[int]string)
+	for _, field := range fields {
+		fs.Func(field.flag, field.help+", also "+field.env, func(s string) error {
+			flagged[field.index] = s
+			return nil
+		})
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	cfg := DefaultConfig()
+	if configPath != "" {
+		err = cfg.readFile(configPath)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	for _, field := range fields {
+		if value, ok := lookupEnv(field.env); ok {
+			err = cfg.set(field, value)
+			if err != nil {
+				return nil, false, fmt.Errorf("error in %v: %v", field.env, err)
+			}
+		}
+	}
+	for _, field := range fields {
+		if value, ok := flagged[field.index]; ok {
+			err = cfg.set(field, value)
+			if err != nil {
+				return nil, false, fmt.Errorf("error in -%v: %v", field.flag, err)
+			}
+		}
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, false, err
+	}
+	return cfg, *printConfig, nil
+}
+
+// overlay a config file, YAML or TOML by its extension
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// read into a map, then through the same decoder as yaml so the rules are the same
+		var table map[string]any
+		_, err := toml.Decode(string(data), &table)
+		if err != nil {
+			return fmt.Errorf("error reading %v: %v", path, err)
+		}
+		data, err = yaml.Marshal(table)
+		if err != nil {
+			return fmt.Errorf("error reading %v: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %v should end .yaml, .yml or .toml", path)
+	}
+
+	// maps in the file replace the defaults rather than adding to them
+	var keys map[string]any
+	if yaml.Unmarshal(data, &keys) == nil && keys["msgRetention"] != nil {
+		c.MsgRetention = nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return nil
+}
+
+// check the settings make sense together, reporting every problem at once
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	for key, endpoint := range map[string]string{"deviceEndpoint": c.DeviceEndpoint, "websocketEndpoint": c.WebsocketEndpoint, "httpEndpoint": c.HttpEndpoint} {
+		_, _, err := net.SplitHostPort(endpoint)
+		check(err == nil, "%v must be host:port, got %q", key, endpoint)
+	}
+	check(c.DeviceEndpoint != c.WebsocketEndpoint && c.DeviceEndpoint != c.HttpEndpoint && c.WebsocketEndpoint != c.HttpEndpoint, "the server endpoints must be different")
+	check(strings.HasPrefix(c.MongoUri, "mongodb://") || strings.HasPrefix(c.MongoUri, "mongodb+srv://"), "mongoUri must start mongodb:// or mongodb+srv://, got %q", c.MongoUri)
+	check(c.DbName != "" && !strings.ContainsAny(c.DbName, `/\. "$`), "dbName must be set and can't contain /\\. \"$, got %q", c.DbName)
+	check(c.Capacity > 0, "capacity must be more than 0, got %v", c.Capacity)
+	check(c.BufSize > 0, "bufSize must be more than 0, got %v", c.BufSize)
+	check(c.MsgBufSize > 0, "msgBufSize must be more than 0, got %v", c.MsgBufSize)
+	check(c.OverloadPolicy.Valid(), "overloadPolicy must be block, drop or disconnect, got %q", c.OverloadPolicy)
+	check(c.MsgWorkers > 0, "msgWorkers must be more than 0, got %v", c.MsgWorkers)
+	check(c.WriteQueueSize >= WRITE_BATCH_SIZE, "writeQueueSize must be at least the batch size, %v, got %v", WRITE_BATCH_SIZE, c.WriteQueueSize)
+	check(c.SpillDir != "", "spillDir must be set")
+	check(c.SpillMaxBytes > 0, "spillMaxBytes must be more than 0, got %v", c.SpillMaxBytes)
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be more than 0, got %v", c.ShutdownTimeout)
+	check(c.MqttBrokerUrl == "" || strings.Contains(c.MqttBrokerUrl, "://"), "mqttBrokerUrl must be a url like tcp://host:1883, got %q", c.MqttBrokerUrl)
+	check(c.MqttTopicPrefix != "" && !strings.ContainsAny(c.MqttTopicPrefix, "+#"), "mqttTopicPrefix must be set and can't contain + or #, got %q", c.MqttTopicPrefix)
+	check(c.ClipStorageDir != "", "clipStorageDir must be set")
+	check(c.ClipMaxAge >= 0, "clipMaxAge can't be negative, got %v", c.ClipMaxAge)
+	check(c.ClipDeviceQuota >= 0, "clipDeviceQuota can't be negative, got %v", c.ClipDeviceQuota)
+	check(c.ClipGlobalQuota >= 0, "clipGlobalQuota can't be negative, got %v", c.ClipGlobalQuota)
+	for msgType, age := range c.MsgRetention {
+		check(age >= 0, "msgRetention for %v can't be negative, got %v", msgType, age)
+	}
+
+	// map order isn't fixed, keep the report the same from run to run
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// write the config as YAML, as it would be read back
+func (c *Config) Write(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(c)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, printConfig, err := LoadConfig(nil, testEnv(nil))
+	if err != nil || printConfig {
+		t.Fatalf("expected the defaults to load, got %v", err)
+	}
+	if cfg.MongoUri != MONGODB_ENDPOINT || cfg.MsgRetention["GPS"] != MSG_RETENTION["GPS"] {
+		t.Errorf("expected the defaults, got %+v", cfg)
+	}
+
+	// the file overrides the defaults, the environment the file and flags the environment
+	path := writeConfigFile(t, "dvr_api.yaml", `
+mongoUri: mongodb://file:27017/
+capacity: 500
+msgWorkers: 4
+shutdownTimeout: 10s
+msgRetention:
+  GPS: 720h
+`)
+	env := testEnv(map[string]string{
+		"DVR_API_CONFIG":      path,
+		"DVR_API_CAPACITY":    "1000",
+		"DVR_API_MSG_WORKERS": "8",
+	})
+	cfg, printConfig, err = LoadConfig([]string{"-msg-workers", "32", "--print-config"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MongoUri != "mongodb://file:27017/" || cfg.Capacity != 1000 || cfg.MsgWorkers != 32 || cfg.ShutdownTimeout != 10*time.Second || !printConfig {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	// maps are replaced, not merged
+	if len(cfg.MsgRetention) != 1 || cfg.MsgRetention["GPS"] != 720*time.Hour {
+		t.Errorf("expected the file's retention only, got %v", cfg.MsgRetention)
+	}
+	cfg, _, err = LoadConfig([]string{"-msg-retention", "GPS=24h, *=0"}, env)
+	if err != nil || len(cfg.MsgRetention) != 2 || cfg.MsgRetention["GPS"] != 24*time.Hour {
+		t.Errorf("expected the flag's retention, got %v %v", cfg, err)
+	}
+
+	// printed config reads back the same
+	var buf bytes.Buffer
+	err = cfg.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := DefaultConfig()
+	err = again.readFile(writeConfigFile(t, "printed.yml", buf.String()))
+	if err != nil || again.Capacity != cfg.Capacity || again.ShutdownTimeout != cfg.ShutdownTimeout || len(again.MsgRetention) != 2 {
+		t.Errorf("expected the printed config to read back the same, got %+v %v", again, err)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	path := writeConfigFile(t, "dvr_api.yaml", "mongoUrl: mongodb://typo:27017/\n")
+	if _, _, err := LoadConfig([]string{"-config", path}, testEnv(nil)); err == nil || !strings.Contains(err.Error(), "mongoUrl") {
+		t.Errorf("expected an unknown key to be refused, got %v", err)
+	}
+	if _, _, err := LoadConfig(nil, testEnv(map[string]string{"DVR_API_SHUTDOWN_TIMEOUT": "soon"})); err == nil {
+		t.Errorf("expected a bad duration to be refused")
+	}
+	if _, _, err := LoadConfig([]string{"extra"}, testEnv(nil)); err == nil {
+		t.Errorf("expected stray arguments to be refused")
+	}
+
+	// every problem is reported at once
+	_, _, err := LoadConfig([]string{"-capacity", "0", "-overload-policy", "sometimes", "-http-endpoint", "9045", "-mongo-uri", "localhost"}, testEnv(nil))
+	if err == nil {
+		t.Fatal("expected an invalid config to be refused")
+	}
+	for _, want := range []string{"capacity", "overloadPolicy", "httpEndpoint", "mongoUri"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %v to be reported, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Toml(t *testing.T) {
+	path := writeConfigFile(t, "dvr_api.toml", `
+# staging
+mongoUri = "mongodb://staging:27017/" # inline comment
+dbName = 'dvr_api-staging'
+prod = true
+spillMaxBytes = 1_000_000
+shutdownTimeout = "45s"
+
+[msgRetention]
+GPS = "2160h"
+"*" = "0s"
+`)
+	cfg, _, err := LoadConfig([]string{"-config", path}, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MongoUri != "mongodb://staging:27017/" || cfg.DbName != "dvr_api-staging" || !cfg.Prod || cfg.SpillMaxBytes != 1000000 || cfg.ShutdownTimeout != 45*time.Second {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if len(cfg.MsgRetention) != 2 || cfg.MsgRetention["GPS"] != 2160*time.Hour {
+		t.Errorf("unexpected retention: %v", cfg.MsgRetention)
+	}
+
+	// the rest of toml works too
+	path = writeConfigFile(t, "dvr_api.toml", `
+dbName = """
+dvr_api-staging"""
+msgRetention = { GPS = "1h" }
+mqtt.unknown = 1
+`)
+	if _, _, err := LoadConfig([]string{"-config", path}, testEnv(nil)); err == nil || !strings.Contains(err.Error(), "mqtt") {
+		t.Errorf("expected only the unknown dotted key to be refused, got %v", err)
+	}
+	path = writeConfigFile(t, "dvr_api.toml", `
+dbName = """
+dvr_api-staging"""
+msgRetention = { GPS = "1h" }
+`)
+	cfg, _, err = LoadConfig([]string{"-config", path}, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DbName != "dvr_api-staging" || len(cfg.MsgRetention) != 1 || cfg.MsgRetention["GPS"] != time.Hour {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	for _, bad := range []string{"capacity = 010", "capacity = 1\ncapacity = 2", `dbName = "unterminated`} {
+		path := writeConfigFile(t, "dvr_api.toml", bad)
+		if _, _, err := LoadConfig([]string{"-config", path}, testEnv(nil)); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parsed %q", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 8, 17, 12, 35, 4, 0, time.UTC) // a Saturday
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 8, 17, 12, 36, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 8, 18, 2, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 8, 17, 12, 45, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, 8, 19, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 8, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * 5", time.Date(2024, 8, 23, 12, 0, 0, 0, time.UTC)}, // either day field matching is enough
+		{"@monthly", time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", c.expr, err)
+		}
+		got := cron.Next(from)
+		if !got.Equal(c.want) {
+			t.Errorf("%q next = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestCronNext_Location(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	cron, _ := parseCron("0 2 * * *")
+	from := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	got := cron.Next(from.In(loc))
+	want := time.Date(2024, 8, 18, 1, 0, 0, 0, time.UTC) // 02:00 BST
+	if !got.Equal(want) {
+		t.Errorf("next = %v, want %v", got, want)
+	}
+}
@@ -29,7 +29,7 @@ func NewDBConnection(logger *zap.Logger, uri string, dbName string) (*DBConnecti
 	}
 	var result bson.M
 	// ping db to check the connection
-	err = client.Database(dbName).RunCommand(context.TODO(), bson.D{{"ping", 1}}).Decode(&result)
+	err = client.Database(dbName).RunCommand(context.TODO(), bson.D{{Key: "ping", Value: 1}}).Decode(&result)
 	if err != nil {
 		return nil, err
 	}
@@ -42,19 +42,78 @@ func NewDBConnection(logger *zap.Logger, uri string, dbName string) (*DBConnecti
 	}, nil
 }
 
-// insert a record into the database
-func (dbc *DBConnection) RecordMessage_ToFromDevice(fromDevice bool, msg *MessageWrapper) (*mongo.UpdateResult, error) {
-
-	// record direction
-	var directionDescriptor string
-	switch fromDevice {
-	// msg sent by the device
-	case true:
-		directionDescriptor = "from device"
-	// msg sent by an API client to a device
-	case false:
-		directionDescriptor = "to device"
+// close the connection to the database, waiting for operations in progress up to the context's deadline
+func (dbc *DBConnection) Disconnect(ctx context.Context) error {
+	return dbc.client.Disconnect(ctx)
+}
+
+// create the indexes the collections are queried by. Creating an index that already exists is a no-op.
+func (dbc *DBConnection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	indexes := map[string][]mongo.IndexModel{
+		"positions": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "fixTime", Value: 1}}},
+			{Keys: bson.D{{Key: "fixTime", Value: 1}}},
+		},
+		"geofence_events": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "time", Value: 1}}},
+		},
+		"webhook_deliveries": {
+			{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "time", Value: -1}}},
+		},
+		"cmd_queue": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "status", Value: 1}, {Key: "queuedTime", Value: 1}}},
+		},
+		"schedule_runs": {
+			{Keys: bson.D{{Key: "jobId", Value: 1}, {Key: "time", Value: -1}}},
+		},
+		"bulk_commands": {
+			{Keys: bson.D{{Key: "time", Value: -1}}},
+		},
+		"video_jobs": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "requestTime", Value: -1}}},
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "requestTime", Value: -1}}},
+		},
+		"clips": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "jobId", Value: 1}}},
+		},
+		"clip_sweeps": {
+			{Keys: bson.D{{Key: "time", Value: -1}}},
+		},
+		"prune_runs": {
+			{Keys: bson.D{{Key: "time", Value: -1}}},
+		},
+		"trips": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "startTime", Value: 1}}},
+			{Keys: bson.D{{Key: "startTime", Value: 1}}},
+			{Keys: bson.D{{Key: "inProgress", Value: 1}}},
+		},
+		"rollups": {
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "resolution", Value: 1}, {Key: "start", Value: 1}}},
+			{Keys: bson.D{{Key: "resolution", Value: 1}, {Key: "start", Value: 1}}},
+		},
+		"device_groups": {
+			{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"alerts": {
+			{Keys: bson.D{{Key: "time", Value: -1}}},
+			{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "time", Value: -1}}},
+		},
 	}
+	for collName, models := range indexes {
+		_, err := dbc.client.Database(dbc.dbName).Collection(collName).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return fmt.Errorf("error creating indexes on %v: %v", collName, err)
+		}
+	}
+	return nil
+}
+
+// insert a record into the database
+func (dbc *DBConnection) RecordMessage_ToFromDevice(msg *MessageWrapper) (*mongo.UpdateResult, error) {
 
 	// timeout, threadsafety
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -77,7 +136,7 @@ func (dbc *DBConnection) RecordMessage_ToFromDevice(fromDevice bool, msg *Messag
 		RecvdTime:  msg.recvdTime,
 		PacketTime: packetTime,
 		Message:    msg.message,
-		Direction:  directionDescriptor,
+		Direction:  msg.direction,
 	}
 
 	var devId string
@@ -104,40 +163,85 @@ func (dbc *DBConnection) RecordMessage_ToFromDevice(fromDevice bool, msg *Messag
 	return updateResult, nil
 }
 
-func (dbc *DBConnection) QueryMsgHistory(devices []string, before time.Time, after time.Time) ([]bson.M, error) {
+// get the message history of each device in the list, where a message was received between the two
+// times. With trim only the messages received between them are included.
+func (dbc *DBConnection) QueryMsgHistory(devices []string, before time.Time, after time.Time, trim bool) ([]Device_Schema, error) {
 	// might be worth storing this to avoid redeclaration upon each function call
 	coll := dbc.client.Database(dbc.dbName).Collection("devices")
 
-	// query filter. Device id in devices, and packet_time between the two dates passed
-	filter := bson.D{
-		{"DeviceId", bson.D{
-			{"$in", devices},
-		}},
-		{"MsgHistory", bson.D{
-			{"$elemMatch", bson.D{
-				{"receivedTime", bson.D{
-					{"$gte", after},
-					{"$lt", before},
-				}},
+	// in range condition, used to pick the documents and then again to pick the messages out of them
+	inRange := bson.M{
+		"$gte": after,
+		"$lt":  before,
+	}
+
+	// the whole history of each device with a message in range. Exclude _id field
+	history := bson.M{"_id": 0, "DeviceId": 1, "MsgHistory": 1}
+	if trim {
+		history["MsgHistory"] = bson.M{"$filter": bson.M{
+			"input": "$MsgHistory",
+			"as":    "msg",
+			"cond": bson.M{"$and": bson.A{
+				bson.M{"$gte": bson.A{"$$msg.receivedTime", after}},
+				bson.M{"$lt": bson.A{"$$msg.receivedTime", before}},
 			}},
-		}},
+		}}
+	}
+
+	// Device id in devices and at least one message in range
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"DeviceId":   bson.M{"$in": devices},
+			"MsgHistory": bson.M{"$elemMatch": bson.M{"receivedTime": inRange}},
+		}}},
+		{{Key: "$project", Value: history}},
 	}
 
-	// query using above. Exclude _id field
-	cursor, err := coll.Find(context.Background(), filter, options.Find().SetProjection(bson.M{"_id": 0}))
+	cursor, err := coll.Aggregate(context.Background(), pipeline)
 	if err != nil {
 		return nil, fmt.Errorf("error querying database: %v", err)
 	}
+	defer cursor.Close(context.Background())
 
 	// iterate over the cursor returned and return docuements that match the query
-	var documents []bson.M
+	var documents []Device_Schema
 	for cursor.Next(context.Background()) {
-		var result bson.M
+		var result Device_Schema
 		err := cursor.Decode(&result)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("error decoding device document: %v", err)
+		}
+		// rows written before the migration ran may still hold a legacy spelling
+		for i := range result.MsgHistory {
+			result.MsgHistory[i].Direction = result.MsgHistory[i].Direction.Normalise()
 		}
 		documents = append(documents, result)
 	}
 	return documents, nil
 }
+
+// rewrite the legacy direction spellings stored in message history to the canonical values.
+// Safe to run on every start, once nothing is left to rewrite it matches no documents.
+func (dbc *DBConnection) MigrateDirections() (int64, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("devices")
+
+	legacy := []MsgDirection{legacyDbFromDevice, legacyDbToDevice, legacyWsFromDevice, legacyWsToDevice}
+	var modified int64 = 0
+	for _, dir := range legacy {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		res, err := coll.UpdateMany(
+			ctx,
+			bson.M{"MsgHistory.direction": dir},
+			bson.M{"$set": bson.M{"MsgHistory.$[msg].direction": dir.Normalise()}},
+			options.Update().SetArrayFilters(options.ArrayFilters{
+				Filters: []interface{}{bson.M{"msg.direction": dir}},
+			}),
+		)
+		cancel()
+		if err != nil {
+			return modified, fmt.Errorf("error migrating direction %q: %v", dir, err)
+		}
+		modified += res.ModifiedCount
+	}
+	return modified, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net"
 	"time"
@@ -8,18 +9,29 @@ import (
 	"go.uber.org/zap"
 )
 
+// called when a device connects, connected = true, or disconnects, connected = false
+type PresenceHookFunction func(devId string, connected bool, t time.Time)
+
 type DeviceSvr struct {
 	logger         *zap.Logger
-	endpoint       string               // IP + port, ex: "192.168.1.77:9047"
-	capacity       int                  // num of connections
-	sockOpBufSize  int                  // how much memory do we give each connection to perform send/recv operations
-	sockOpBufStack Stack[*[]byte]       // memory region we give each conn to so send/recv
-	svrMsgBufSize  int                  // how many messages can we queue on the server at once
-	svrMsgBufChan  chan MessageWrapper  // the channel we use to queue the messages
-	connIndex      Dictionary[net.Conn] // index the connection objects against the ids of the devices represented thusly
+	endpoint       string                 // IP + port, ex: "192.168.1.77:9047"
+	capacity       int                    // num of connections
+	sockOpBufSize  int                    // how much memory do we give each connection to perform send/recv operations
+	sockOpBufStack Stack[*[]byte]         // memory region we give each conn to so send/recv
+	svrMsgBufSize  int                    // how many messages can we queue on the server at once
+	svrMsgQueue    *MsgQueue              // the queue we put the messages on
+	connIndex      Dictionary[net.Conn]   // index the connection objects against the ids of the devices represented thusly
+	presenceHooks  []PresenceHookFunction // run when a device connects or disconnects
+	conns          connSet[net.Conn]      // open connections, identified or not
 }
 
-func NewDeviceSvr(logger *zap.Logger, endpoint string, capacity int, bufSize int, svrMsgBufSize int) (*DeviceSvr, error) {
+func NewDeviceSvr(logger *zap.Logger, endpoint string, capacity int, bufSize int, svrMsgBufSize int, overloadPolicy OverloadPolicy) (*DeviceSvr, error) {
+	// queue between the connections and the message handler
+	queue, err := NewMsgQueue("devices", svrMsgBufSize, overloadPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	// holder struct
 	svr := DeviceSvr{
 		logger,
@@ -28,8 +40,10 @@ func NewDeviceSvr(logger *zap.Logger, endpoint string, capacity int, bufSize int
 		bufSize,
 		Stack[*[]byte]{},
 		svrMsgBufSize,
-		make(chan MessageWrapper),
-		Dictionary[net.Conn]{}}
+		queue,
+		Dictionary[net.Conn]{},
+		nil,
+		connSet[net.Conn]{}}
 
 	// init the stack we use to store the buffers
 	svr.sockOpBufStack.Init()
@@ -54,22 +68,55 @@ func (s *DeviceSvr) Init() error {
 	return nil
 }
 
-// run the server, blocking
-func (s *DeviceSvr) Run() {
+// register a function to run when a device connects or disconnects. Call before Run.
+func (s *DeviceSvr) OnPresence(hook PresenceHookFunction) {
+	s.presenceHooks = append(s.presenceHooks, hook)
+}
+
+// tell the presence hooks about a device connecting or disconnecting
+func (s *DeviceSvr) notifyPresence(devId string, connected bool) {
+	now := time.Now()
+	for _, hook := range s.presenceHooks {
+		hook(devId, connected, now)
+	}
+}
+
+// is a device connected right now
+func (s *DeviceSvr) IsConnected(devId string) bool {
+	_, ok := s.connIndex.Get(devId)
+	return ok
+}
+
+// run the server, blocking until the context is done and every connection is closed
+func (s *DeviceSvr) Run(ctx context.Context) {
 	ln, err := net.Listen("tcp", s.endpoint)
 	if err != nil {
 		s.logger.Fatal("error listening on %v: %v", zap.String("s.endpoint", s.endpoint), zap.Error(err))
 	} else {
 		s.logger.Info("device server listening on: %v", zap.String("s.endpoint", s.endpoint))
 	}
+
+	// stop accepting when we're told to
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			s.logger.Info("error accepting websocket connection: %v", zap.Error(err))
 			continue
 		}
+		if !s.conns.Add(c) {
+			c.Close()
+			continue
+		}
 		s.logger.Info("connection accepted on device svr...")
 		go func() {
+			defer s.conns.Done(c)
 			err := s.connHandler(c)
 			if err != nil {
 				s.logger.Error("error in device connection loop: %v", zap.Error(err))
@@ -77,6 +124,10 @@ func (s *DeviceSvr) Run() {
 			c.Close()
 		}()
 	}
+
+	// hang up on the devices, what they've sent is already queued
+	s.conns.CloseAll(func(c net.Conn) { c.Close() })
+	s.logger.Info("device server stopped")
 }
 
 // handle each connection
@@ -126,10 +177,24 @@ func (s *DeviceSvr) connHandler(conn net.Conn) error {
 				continue
 			}
 			s.connIndex.Add(id, conn)
-			defer s.connIndex.Delete(id)
+			s.svrMsgQueue.Connect(id)
+			s.notifyPresence(id, true)
+			defer func() {
+				s.connIndex.Delete(id)
+				s.svrMsgQueue.Disconnect(id)
+				s.notifyPresence(id, false)
+			}()
 		}
 
-		// send the messages to the relay
-		s.svrMsgBufChan <- MessageWrapper{msg, &id, time.Now()}
+		// send the messages to the relay. A device that's flooding us might get cut off.
+		err = s.svrMsgQueue.Push(id, MessageWrapper{msg, &id, time.Now(), DirectionFromDevice, 0})
+		if err == errSourceOverloaded {
+			s.logger.Warn("disconnecting device sending too fast", zap.String("id", id))
+			s.sockOpBufStack.Push(buf)
+			return err
+		}
+		if err != nil {
+			s.logger.Debug("dropped message from device", zap.String("id", id), zap.Error(err))
+		}
 	}
 }
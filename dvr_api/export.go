@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+TRACK EXPORT
+Turn the gps messages in a device's history into a route mapping tools can load.
+~~~~~~~~~~~~~~~
+*/
+
+// formats we can export a track as, against the content type we serve them with
+var trackFormats = map[string]string{
+	"gpx":     "application/gpx+xml",
+	"kml":     "application/vnd.google-earth.kml+xml",
+	"geojson": "application/geo+json",
+}
+
+// build the track of a device out of the gps messages in its history. Only valid fixes with a fix
+// time between the two times are kept, oldest first.
+func trackFromHistory(history []DeviceMessage_Schema, after time.Time, before time.Time) []Position_Schema {
+	track := make([]Position_Schema, 0)
+	for _, msg := range history {
+		if msg.Direction.Normalise() != DirectionFromDevice || !isGpsMessage(msg.Message) {
+			continue
+		}
+		pos, err := parseGpsMessage(msg.Message, msg.RecvdTime)
+		if err != nil || !pos.Valid {
+			continue
+		}
+		if pos.FixTime.Before(after) || !pos.FixTime.Before(before) {
+			continue
+		}
+		track = append(track, *pos)
+	}
+	sort.SliceStable(track, func(i, j int) bool {
+		return track[i].FixTime.Before(track[j].FixTime)
+	})
+	return track
+}
+
+// reduce the number of points in a track with Douglas-Peucker, keeping every point which is further
+// than the tolerance from the line drawn through the points we keep.
+func simplifyTrack(track []Position_Schema, toleranceMeters float64) []Position_Schema {
+	if len(track) < 3 || toleranceMeters <= 0 {
+		return track
+	}
+	keep := make([]bool, len(track))
+	keep[0] = true
+	keep[len(track)-1] = true
+
+	// segments left to check, as index pairs. Using a stack rather than recursion so long trips can't blow it.
+	segments := Stack[[2]int]{}
+	segments.Init()
+	segments.Push([2]int{0, len(track) - 1})
+	for !segments.IsEmpty() {
+		seg, _ := segments.Pop()
+		first, last := seg[0], seg[1]
+		furthest, furthestDist := -1, toleranceMeters
+		for i := first + 1; i < last; i++ {
+			dist := distanceToSegmentMeters(
+				track[i].Latitude, track[i].Longitude,
+				track[first].Latitude, track[first].Longitude,
+				track[last].Latitude, track[last].Longitude,
+			)
+			if dist > furthestDist {
+				furthest, furthestDist = i, dist
+			}
+		}
+		if furthest == -1 {
+			continue
+		}
+		keep[furthest] = true
+		segments.Push([2]int{first, furthest})
+		segments.Push([2]int{furthest, last})
+	}
+
+	simplified := make([]Position_Schema, 0)
+	for i, pos := range track {
+		if keep[i] {
+			simplified = append(simplified, pos)
+		}
+	}
+	return simplified
+}
+
+// GPX 1.1, just the parts we fill in
+type gpxDoc struct {
+	XMLName xml.Name `xml:"gpx"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+// write a track as GPX
+func writeGpx(w io.Writer, devId string, track []Position_Schema) error {
+	doc := gpxDoc{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "dvr_api",
+		Track:   gpxTrack{Name: devId},
+	}
+	for _, pos := range track {
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxPoint{pos.Latitude, pos.Longitude, pos.FixTime.UTC().Format(time.RFC3339)})
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// KML 2.2, just the parts we fill in
+type kmlDoc struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name      string       `xml:"name"`
+	Placemark kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name       string        `xml:"name"`
+	LineString kmlLineString `xml:"LineString"`
+}
+
+type kmlLineString struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+// write a track as KML
+func writeKml(w io.Writer, devId string, track []Position_Schema) error {
+	// coordinates are lon,lat,alt tuples seperated by whitespace
+	coords := make([]byte, 0, len(track)*32)
+	for i, pos := range track {
+		if i > 0 {
+			coords = append(coords, ' ')
+		}
+		coords = strconv.AppendFloat(coords, pos.Longitude, 'f', -1, 64)
+		coords = append(coords, ',')
+		coords = strconv.AppendFloat(coords, pos.Latitude, 'f', -1, 64)
+		coords = append(coords, ",0"...)
+	}
+	doc := kmlDoc{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+		Document: kmlDocument{
+			Name: devId,
+			Placemark: kmlPlacemark{
+				Name:       devId,
+				LineString: kmlLineString{1, string(coords)},
+			},
+		},
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// GeoJSON feature holding the track as a LineString. Fix times go in the coordTimes property as
+// other tools that convert from GPX do.
+type geoJsonFeature struct {
+	Type       string           `json:"type"`
+	Geometry   geoJsonGeometry  `json:"geometry"`
+	Properties geoJsonTrackProp `json:"properties"`
+}
+
+type geoJsonGeometry struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+type geoJsonTrackProp struct {
+	DeviceId   string      `json:"deviceId"`
+	CoordTimes []time.Time `json:"coordTimes"`
+}
+
+// write a track as GeoJSON
+func writeGeoJson(w io.Writer, devId string, track []Position_Schema) error {
+	feature := geoJsonFeature{
+		Type:     "Feature",
+		Geometry: geoJsonGeometry{"LineString", make([][2]float64, len(track))},
+		Properties: geoJsonTrackProp{
+			DeviceId:   devId,
+			CoordTimes: make([]time.Time, len(track)),
+		},
+	}
+	for i, pos := range track {
+		feature.Geometry.Coordinates[i] = [2]float64{pos.Longitude, pos.Latitude}
+		feature.Properties.CoordTimes[i] = pos.FixTime
+	}
+	return json.NewEncoder(w).Encode(feature)
+}
+
+// GET /devices/{id}/track?format=gpx|kml|geojson&after=&before=&simplify=
+// simplify is a tolerance in meters, leave it out to get every fix.
+func (s *httpSvr) handleExportTrack(w http.ResponseWriter, r *http.Request) {
+	devId := r.PathValue("id")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "geojson"
+	}
+	contentType, ok := trackFormats[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format: %v", format))
+		return
+	}
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var tolerance float64 = 0
+	if v := r.URL.Query().Get("simplify"); v != "" {
+		tolerance, err = strconv.ParseFloat(v, 64)
+		if err != nil || tolerance < 0 {
+			writeError(w, http.StatusBadRequest, "simplify must be a tolerance in meters")
+			return
+		}
+	}
+
+	// build the track from the message history
+	devices, err := s.dbc.QueryMsgHistory([]string{devId}, before, after, true)
+	if err != nil {
+		s.logger.Error("failed to query msg history", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query message history")
+		return
+	}
+	track := make([]Position_Schema, 0)
+	for _, dev := range devices {
+		track = append(track, trackFromHistory(dev.MsgHistory, after, before)...)
+	}
+	track = simplifyTrack(track, tolerance)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v.%v\"", devId, format))
+	w.WriteHeader(http.StatusOK)
+	switch format {
+	case "gpx":
+		err = writeGpx(w, devId, track)
+	case "kml":
+		err = writeKml(w, devId, track)
+	case "geojson":
+		err = writeGeoJson(w, devId, track)
+	}
+	if err != nil {
+		s.logger.Error("failed to write track", zap.String("format", format), zap.Error(err))
+	}
+}
+
+/*
+~~~~~~~~~~~~~~~
+HISTORY EXPORT
+Flatten message history into one row per message for spreadsheets and other pipelines.
+~~~~~~~~~~~~~~~
+*/
+
+// parsed field columns in the csv, in order. Fields a message doesn't have are left blank.
+var messageRowFieldColumns = []string{"fixTime", "valid", "latitude", "longitude", "speed", "heading", "satellites"}
+
+// pull what we can understand out of a message. Only gps messages have parsed fields at the moment.
+func parseMessageFields(message string) map[string]string {
+	if !isGpsMessage(message) {
+		return nil
+	}
+	pos, err := parseGpsMessage(message, time.Time{})
+	if err != nil {
+		return nil
+	}
+	return map[string]string{
+		"fixTime":    pos.FixTime.Format(time.RFC3339),
+		"valid":      strconv.FormatBool(pos.Valid),
+		"latitude":   strconv.FormatFloat(pos.Latitude, 'f', -1, 64),
+		"longitude":  strconv.FormatFloat(pos.Longitude, 'f', -1, 64),
+		"speed":      strconv.FormatFloat(pos.Speed, 'f', -1, 64),
+		"heading":    strconv.FormatFloat(pos.Heading, 'f', -1, 64),
+		"satellites": strconv.Itoa(pos.Satellites),
+	}
+}
+
+// one row per message across all the devices, with direction values for the given api version
+func flattenHistory(devices []Device_Schema, apiVersion int) []MessageRow_Response {
+	rows := make([]MessageRow_Response, 0)
+	for _, dev := range devices {
+		for _, msg := range dev.MsgHistory {
+			rows = append(rows, MessageRow_Response{
+				DeviceId:   dev.DeviceId,
+				Direction:  msg.Direction.ForHttpVersion(apiVersion),
+				PacketTime: msg.PacketTime,
+				RecvdTime:  msg.RecvdTime,
+				Command:    getCommandFromMessage(msg.Message),
+				Message:    msg.Message,
+				Fields:     parseMessageFields(msg.Message),
+			})
+		}
+	}
+	return rows
+}
+
+// write rows as csv with a header row
+func writeCsvRows(w io.Writer, rows []MessageRow_Response) error {
+	cw := csv.NewWriter(w)
+	header := append([]string{"deviceId", "direction", "packetTime", "receivedTime", "command", "message"}, messageRowFieldColumns...)
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+	record := make([]string, len(header))
+	for _, row := range rows {
+		record[0] = row.DeviceId
+		record[1] = string(row.Direction)
+		record[2] = row.PacketTime.Format(time.RFC3339Nano)
+		record[3] = row.RecvdTime.Format(time.RFC3339Nano)
+		record[4] = row.Command
+		record[5] = row.Message
+		for i, col := range messageRowFieldColumns {
+			record[6+i] = row.Fields[col]
+		}
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// write rows as newline delimited json, one object per line
+func writeNdjsonRows(w io.Writer, rows []MessageRow_Response) error {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		err := enc.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
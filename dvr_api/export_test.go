@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+// history with fixes out of order, a void fix, a message to the device and a non gps message
+func testHistory() []DeviceMessage_Schema {
+	return []DeviceMessage_Schema{
+		{Message: "$GPS;123456;20240817-120010;A;51.5010;-0.1200;30;90;8\r", Direction: DirectionFromDevice},
+		{Message: "$GPS;123456;20240817-120000;A;51.5000;-0.1200;30;90;8\r", Direction: DirectionFromDevice},
+		{Message: "$GPS;123456;20240817-120005;V;0;0;0;0;0\r", Direction: DirectionFromDevice},
+		{Message: "$VIDEO;123456;all;4;20240817-120000;5\r", Direction: DirectionToDevice},
+		{Message: "$GPS;123456;20240817-120020;A;51.5020;-0.1200;30;90;8\r", Direction: "from device"},
+		{Message: "$GPS;123456;20240817-130000;A;51.6000;-0.1200;30;90;8\r", Direction: DirectionFromDevice},
+	}
+}
+
+func TestTrackFromHistory(t *testing.T) {
+	after := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	before := time.Date(2024, 8, 17, 12, 30, 0, 0, time.UTC)
+	track := trackFromHistory(testHistory(), after, before)
+	if len(track) != 3 {
+		t.Fatalf("expected 3 points, got %d", len(track))
+	}
+	for i, lat := range []float64{51.5000, 51.5010, 51.5020} {
+		if track[i].Latitude != lat {
+			t.Errorf("point %d latitude = %v, want %v", i, track[i].Latitude, lat)
+		}
+	}
+}
+
+func TestSimplifyTrack(t *testing.T) {
+	// a straight line north with one point ~70m off to the side
+	track := []Position_Schema{
+		{Latitude: 51.500, Longitude: -0.1200},
+		{Latitude: 51.501, Longitude: -0.1200},
+		{Latitude: 51.502, Longitude: -0.1190},
+		{Latitude: 51.503, Longitude: -0.1200},
+		{Latitude: 51.504, Longitude: -0.1200},
+	}
+	if got := simplifyTrack(track, 0); len(got) != 5 {
+		t.Errorf("tolerance 0 should keep every point, kept %d", len(got))
+	}
+	if got := simplifyTrack(track, 50); len(got) != 3 || got[1].Longitude != -0.1190 {
+		t.Errorf("tolerance 50m should keep the ends and the detour, got %+v", got)
+	}
+	if got := simplifyTrack(track, 100); len(got) != 2 {
+		t.Errorf("tolerance 100m should keep just the ends, kept %d", len(got))
+	}
+}
+
+func TestWriteTrackFormats(t *testing.T) {
+	track := trackFromHistory(testHistory(), time.Time{}, time.Now())
+
+	// gpx
+	var buf bytes.Buffer
+	if err := writeGpx(&buf, "123456", track); err != nil {
+		t.Fatalf("writeGpx: %v", err)
+	}
+	var gpx gpxDoc
+	if err := xml.Unmarshal(buf.Bytes(), &gpx); err != nil {
+		t.Fatalf("gpx output doesn't parse: %v", err)
+	}
+	if len(gpx.Track.Segment.Points) != len(track) || gpx.Track.Segment.Points[0].Time != "2024-08-17T12:00:00Z" {
+		t.Errorf("unexpected gpx points: %+v", gpx.Track.Segment.Points)
+	}
+
+	// kml
+	buf.Reset()
+	if err := writeKml(&buf, "123456", track); err != nil {
+		t.Fatalf("writeKml: %v", err)
+	}
+	var kml kmlDoc
+	if err := xml.Unmarshal(buf.Bytes(), &kml); err != nil {
+		t.Fatalf("kml output doesn't parse: %v", err)
+	}
+	coords := strings.Fields(kml.Document.Placemark.LineString.Coordinates)
+	if len(coords) != len(track) || coords[0] != "-0.12,51.5,0" {
+		t.Errorf("unexpected kml coordinates: %v", coords)
+	}
+
+	// geojson
+	buf.Reset()
+	if err := writeGeoJson(&buf, "123456", track); err != nil {
+		t.Fatalf("writeGeoJson: %v", err)
+	}
+	var feature geoJsonFeature
+	if err := json.Unmarshal(buf.Bytes(), &feature); err != nil {
+		t.Fatalf("geojson output doesn't parse: %v", err)
+	}
+	if feature.Geometry.Type != "LineString" || len(feature.Geometry.Coordinates) != len(track) || feature.Geometry.Coordinates[0] != [2]float64{-0.12, 51.5} {
+		t.Errorf("unexpected geojson geometry: %+v", feature.Geometry)
+	}
+}
+
+func TestWriteHistoryRows(t *testing.T) {
+	devices := []Device_Schema{{DeviceId: "123456", MsgHistory: testHistory()[2:5]}}
+
+	// v1 rows keep the legacy direction values
+	rows := flattenHistory(devices, API_V1)
+	if len(rows) != 3 || rows[1].Direction != "to device" || rows[1].Command != "VIDEO" || rows[1].Fields != nil {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	if rows[2].Fields["latitude"] != "51.502" || rows[2].Fields["valid"] != "true" {
+		t.Errorf("unexpected parsed fields: %+v", rows[2].Fields)
+	}
+
+	// csv, header plus one record per row
+	var buf bytes.Buffer
+	if err := writeCsvRows(&buf, flattenHistory(devices, API_V2)); err != nil {
+		t.Fatalf("writeCsvRows: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("csv output doesn't parse: %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "deviceId" || records[3][1] != "fromDevice" || records[3][8] != "51.502" {
+		t.Errorf("unexpected csv records: %v", records)
+	}
+
+	// ndjson, one object per line
+	buf.Reset()
+	if err := writeNdjsonRows(&buf, rows); err != nil {
+		t.Fatalf("writeNdjsonRows: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	var row MessageRow_Response
+	if err := json.Unmarshal([]byte(lines[2]), &row); err != nil || row.Fields["satellites"] != "8" {
+		t.Errorf("unexpected ndjson row %q: %v", lines[2], err)
+	}
+}
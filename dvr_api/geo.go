@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+)
+
+/*
+~~~~~~~~~~~~~~~
+GEO HELPERS
+Good enough for the distances a vehicle covers, not for surveying.
+~~~~~~~~~~~~~~~
+*/
+
+const EARTH_RADIUS_METERS float64 = 6371008.8
+
+// great circle distance between two points in meters
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * EARTH_RADIUS_METERS * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// project a point onto a flat plane in meters around the reference latitude. Only accurate close to
+// the reference, which is all we need for comparing points a few km apart.
+func projectMeters(lat, lon, refLat float64) (float64, float64) {
+	x := lon * math.Pi / 180 * EARTH_RADIUS_METERS * math.Cos(refLat*math.Pi/180)
+	y := lat * math.Pi / 180 * EARTH_RADIUS_METERS
+	return x, y
+}
+
+// distance in meters from a point to the segment between a and b
+func distanceToSegmentMeters(lat, lon, aLat, aLon, bLat, bLon float64) float64 {
+	px, py := projectMeters(lat, lon, lat)
+	ax, ay := projectMeters(aLat, aLon, lat)
+	bx, by := projectMeters(bLat, bLon, lat)
+	dx, dy := bx-ax, by-ay
+	if dx == 0 && dy == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	// how far along the segment the closest point is, clamped to the ends
+	t := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+// a point on the earth
+type LatLon struct {
+	Lat float64 `bson:"lat" json:"lat"`
+	Lon float64 `bson:"lon" json:"lon"`
+}
+
+// is the point inside the polygon. Ray casting, treating lat/lon as flat which is fine for
+// polygons that don't cross the antimeridian or a pole.
+func pointInPolygon(lat, lon float64, polygon []LatLon) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
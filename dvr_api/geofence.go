@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+GEOFENCES
+Check each gps fix against the geofences defined over the http api, emitting an event when a device
+enters, leaves, or has stayed inside a fence for its dwell time.
+~~~~~~~~~~~~~~~
+*/
+
+// shapes a geofence can be
+const (
+	GEOFENCE_POLYGON string = "polygon"
+	GEOFENCE_CIRCLE  string = "circle"
+)
+
+// kinds of geofence event
+const (
+	GEOFENCE_ENTER string = "enter"
+	GEOFENCE_EXIT  string = "exit"
+	GEOFENCE_DWELL string = "dwell"
+)
+
+// a geofence, stored in mongodb and sent to/received from API clients as is
+type Geofence_Schema struct {
+	Id           string   `bson:"_id" json:"id"`
+	Name         string   `bson:"name" json:"name"`
+	Type         string   `bson:"type" json:"type"`                                     // polygon or circle
+	Polygon      []LatLon `bson:"polygon,omitempty" json:"polygon,omitempty"`           // polygon only, at least 3 vertices
+	Center       *LatLon  `bson:"center,omitempty" json:"center,omitempty"`             // circle only
+	RadiusMeters float64  `bson:"radiusMeters,omitempty" json:"radiusMeters,omitempty"` // circle only
+	Devices      []string `bson:"devices" json:"devices"`                               // devices the fence applies to, empty for all of them
+	DwellSeconds int      `bson:"dwellSeconds" json:"dwellSeconds"`                     // emit a dwell event after this long inside, 0 to never
+}
+
+// an enter, exit or dwell, stored in mongodb and sent to API clients as is
+type GeofenceEvent_Schema struct {
+	GeofenceId   string    `bson:"geofenceId" json:"geofenceId"`
+	GeofenceName string    `bson:"geofenceName" json:"geofenceName"`
+	DeviceId     string    `bson:"deviceId" json:"deviceId"`
+	Type         string    `bson:"type" json:"type"` // enter, exit or dwell
+	Time         time.Time `bson:"time" json:"time"` // fix time of the position that triggered the event
+	Latitude     float64   `bson:"latitude" json:"latitude"`
+	Longitude    float64   `bson:"longitude" json:"longitude"`
+}
+
+// check the geofence is something we can evaluate
+func (g *Geofence_Schema) Validate() error {
+	if g.DwellSeconds < 0 {
+		return fmt.Errorf("dwellSeconds can't be negative")
+	}
+	switch g.Type {
+	case GEOFENCE_POLYGON:
+		if len(g.Polygon) < 3 {
+			return fmt.Errorf("polygon needs at least 3 vertices")
+		}
+		for _, p := range g.Polygon {
+			if !validLatLon(p) {
+				return fmt.Errorf("polygon vertex out of range: %v", p)
+			}
+		}
+	case GEOFENCE_CIRCLE:
+		if g.Center == nil || !validLatLon(*g.Center) {
+			return fmt.Errorf("circle needs a valid center")
+		}
+		if g.RadiusMeters <= 0 {
+			return fmt.Errorf("circle needs a positive radiusMeters")
+		}
+	default:
+		return fmt.Errorf("type must be %v or %v", GEOFENCE_POLYGON, GEOFENCE_CIRCLE)
+	}
+	return nil
+}
+
+// is the point inside the fence
+func (g *Geofence_Schema) Contains(lat, lon float64) bool {
+	switch g.Type {
+	case GEOFENCE_POLYGON:
+		return pointInPolygon(lat, lon, g.Polygon)
+	case GEOFENCE_CIRCLE:
+		return distanceMeters(lat, lon, g.Center.Lat, g.Center.Lon) <= g.RadiusMeters
+	}
+	return false
+}
+
+// does the fence apply to the device
+func (g *Geofence_Schema) AppliesTo(devId string) bool {
+	if len(g.Devices) == 0 {
+		return true
+	}
+	for _, d := range g.Devices {
+		if d == devId {
+			return true
+		}
+	}
+	return false
+}
+
+func validLatLon(p LatLon) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+// where a device is relative to one fence
+type fenceState struct {
+	inside    bool
+	since     time.Time // fix time it went inside
+	dwellSent bool
+}
+
+// evaluates positions against the geofences
+type GeofenceEngine struct {
+	// internal
+	fences map[string]*Geofence_Schema       // fence id against fence
+	states map[string]map[string]*fenceState // device id against fence id against state
+	lock   sync.Mutex                        // positions come from the message handler, changes from the http server
+
+	// injected
+	logger       *zap.Logger
+	dbc          *DBConnection
+	publishEvent PublishEventFunction // this func is meant to publish an event about a device to subscribers
+}
+
+// constructor, loads the fences already defined
+func NewGeofenceEngine(logger *zap.Logger, dbc *DBConnection, publishEvent PublishEventFunction) (*GeofenceEngine, error) {
+	ge := &GeofenceEngine{
+		fences:       make(map[string]*Geofence_Schema),
+		states:       make(map[string]map[string]*fenceState),
+		logger:       logger,
+		dbc:          dbc,
+		publishEvent: publishEvent,
+	}
+	fences, err := dbc.QueryGeofences()
+	if err != nil {
+		return nil, fmt.Errorf("error loading geofences: %v", err)
+	}
+	for i := range fences {
+		ge.fences[fences[i].Id] = &fences[i]
+	}
+	return ge, nil
+}
+
+// check one position against every fence that applies to the device, recording and publishing any events
+func (ge *GeofenceEngine) ProcessPosition(pos *Position_Schema) error {
+	if !pos.Valid {
+		return nil
+	}
+	events := ge.evaluate(pos)
+	for i := range events {
+		err := ge.dbc.RecordGeofenceEvent(&events[i])
+		if err != nil {
+			return fmt.Errorf("error recording geofence event: %v", err)
+		}
+		err = ge.publishEvent(&DeviceEvent{EVENT_GEOFENCE, events[i].DeviceId, events[i].Time, &events[i]})
+		if err != nil {
+			return fmt.Errorf("error publishing geofence event: %v", err)
+		}
+	}
+	return nil
+}
+
+// work out which events a position causes and update the state of the device. The first position we
+// see for a device against a fence only sets where it is, we don't know if it just crossed the boundary.
+func (ge *GeofenceEngine) evaluate(pos *Position_Schema) []GeofenceEvent_Schema {
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+
+	if ge.states[pos.DeviceId] == nil {
+		ge.states[pos.DeviceId] = make(map[string]*fenceState)
+	}
+	devStates := ge.states[pos.DeviceId]
+
+	events := make([]GeofenceEvent_Schema, 0)
+	for id, fence := range ge.fences {
+		if !fence.AppliesTo(pos.DeviceId) {
+			continue
+		}
+		inside := fence.Contains(pos.Latitude, pos.Longitude)
+		state, known := devStates[id]
+		if !known {
+			devStates[id] = &fenceState{inside: inside, since: pos.FixTime}
+			continue
+		}
+		event := GeofenceEvent_Schema{
+			GeofenceId:   fence.Id,
+			GeofenceName: fence.Name,
+			DeviceId:     pos.DeviceId,
+			Time:         pos.FixTime,
+			Latitude:     pos.Latitude,
+			Longitude:    pos.Longitude,
+		}
+		switch {
+		case inside && !state.inside:
+			*state = fenceState{inside: true, since: pos.FixTime}
+			event.Type = GEOFENCE_ENTER
+		case !inside && state.inside:
+			*state = fenceState{inside: false, since: pos.FixTime}
+			event.Type = GEOFENCE_EXIT
+		case inside && fence.DwellSeconds > 0 && !state.dwellSent && pos.FixTime.Sub(state.since) >= time.Duration(fence.DwellSeconds)*time.Second:
+			state.dwellSent = true
+			event.Type = GEOFENCE_DWELL
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// add or replace a fence
+func (ge *GeofenceEngine) PutFence(fence *Geofence_Schema) error {
+	err := ge.dbc.UpsertGeofence(fence)
+	if err != nil {
+		return err
+	}
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+	ge.fences[fence.Id] = fence
+	// the shape may have changed, so forget where devices were relative to it
+	for _, devStates := range ge.states {
+		delete(devStates, fence.Id)
+	}
+	return nil
+}
+
+// remove a fence, returns false if there was no such fence
+func (ge *GeofenceEngine) DeleteFence(id string) (bool, error) {
+	deleted, err := ge.dbc.DeleteGeofence(id)
+	if err != nil {
+		return false, err
+	}
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+	delete(ge.fences, id)
+	for _, devStates := range ge.states {
+		delete(devStates, id)
+	}
+	return deleted, nil
+}
+
+// list the fences
+func (ge *GeofenceEngine) GetFences() []Geofence_Schema {
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+	fences := make([]Geofence_Schema, 0, len(ge.fences))
+	for _, fence := range ge.fences {
+		fences = append(fences, *fence)
+	}
+	return fences
+}
+
+// get one fence
+func (ge *GeofenceEngine) GetFence(id string) (Geofence_Schema, bool) {
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+	fence, ok := ge.fences[id]
+	if !ok {
+		return Geofence_Schema{}, false
+	}
+	return *fence, true
+}
+
+// add the geofence endpoints to the http server
+func (ge *GeofenceEngine) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /geofences", ge.handleList)
+	svr.HandleFunc("POST /geofences", ge.handleCreate)
+	svr.HandleFunc("GET /geofences/{id}", ge.handleGet)
+	svr.HandleFunc("PUT /geofences/{id}", ge.handleUpdate)
+	svr.HandleFunc("DELETE /geofences/{id}", ge.handleDelete)
+	svr.HandleFunc("GET /devices/{id}/geofence-events", ge.handleGetEvents)
+}
+
+// GET /geofences
+func (ge *GeofenceEngine) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ge.GetFences())
+}
+
+// GET /geofences/{id}
+func (ge *GeofenceEngine) handleGet(w http.ResponseWriter, r *http.Request) {
+	fence, ok := ge.GetFence(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such geofence")
+		return
+	}
+	writeJSON(w, http.StatusOK, fence)
+}
+
+// POST /geofences
+func (ge *GeofenceEngine) handleCreate(w http.ResponseWriter, r *http.Request) {
+	ge.handlePut(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// PUT /geofences/{id}
+func (ge *GeofenceEngine) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := ge.GetFence(id); !ok {
+		writeError(w, http.StatusNotFound, "no such geofence")
+		return
+	}
+	ge.handlePut(w, r, id, http.StatusOK)
+}
+
+// read, validate and store a fence from the request body
+func (ge *GeofenceEngine) handlePut(w http.ResponseWriter, r *http.Request, id string, status int) {
+	var fence Geofence_Schema
+	err := json.NewDecoder(r.Body).Decode(&fence)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid geofence json: %v", err))
+		return
+	}
+	fence.Id = id
+	if fence.Devices == nil {
+		fence.Devices = []string{}
+	}
+	err = fence.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = ge.PutFence(&fence)
+	if err != nil {
+		ge.logger.Error("failed to store geofence", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store geofence")
+		return
+	}
+	writeJSON(w, status, fence)
+}
+
+// DELETE /geofences/{id}
+func (ge *GeofenceEngine) handleDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := ge.DeleteFence(r.PathValue("id"))
+	if err != nil {
+		ge.logger.Error("failed to delete geofence", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to delete geofence")
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "no such geofence")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /devices/{id}/geofence-events?after=&before=
+func (ge *GeofenceEngine) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events, err := ge.dbc.QueryGeofenceEvents(r.PathValue("id"), after, before)
+	if err != nil {
+		ge.logger.Error("failed to query geofence events", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query geofence events")
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// get every geofence
+func (dbc *DBConnection) QueryGeofences() ([]Geofence_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("geofences")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying geofences: %v", err)
+	}
+	fences := make([]Geofence_Schema, 0)
+	err = cursor.All(ctx, &fences)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geofences: %v", err)
+	}
+	return fences, nil
+}
+
+// insert or replace a geofence
+func (dbc *DBConnection) UpsertGeofence(fence *Geofence_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("geofences")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": fence.Id}, fence, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete a geofence, returns false if there was nothing to delete
+func (dbc *DBConnection) DeleteGeofence(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("geofences")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// insert a geofence event
+func (dbc *DBConnection) RecordGeofenceEvent(event *GeofenceEvent_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("geofence_events")
+	_, err := coll.InsertOne(ctx, event)
+	return err
+}
+
+// get the geofence events of a device between the two times, oldest first
+func (dbc *DBConnection) QueryGeofenceEvents(devId string, after time.Time, before time.Time) ([]GeofenceEvent_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("geofence_events")
+
+	filter := bson.M{
+		"deviceId": devId,
+		"time": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}}).SetProjection(bson.M{"_id": 0})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying geofence events: %v", err)
+	}
+	events := make([]GeofenceEvent_Schema, 0)
+	err = cursor.All(context.Background(), &events)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geofence events: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// roughly 1km square around 51.5,-0.12
+var testSquare = []LatLon{{51.495, -0.127}, {51.495, -0.113}, {51.505, -0.113}, {51.505, -0.127}}
+
+func TestGeofenceContains(t *testing.T) {
+	poly := Geofence_Schema{Type: GEOFENCE_POLYGON, Polygon: testSquare}
+	if !poly.Contains(51.5, -0.12) {
+		t.Error("center of the square should be inside")
+	}
+	if poly.Contains(51.51, -0.12) {
+		t.Error("point north of the square should be outside")
+	}
+
+	circle := Geofence_Schema{Type: GEOFENCE_CIRCLE, Center: &LatLon{51.5, -0.12}, RadiusMeters: 500}
+	if !circle.Contains(51.503, -0.12) {
+		t.Error("point ~330m from the center should be inside")
+	}
+	if circle.Contains(51.506, -0.12) {
+		t.Error("point ~670m from the center should be outside")
+	}
+}
+
+func TestGeofenceValidate(t *testing.T) {
+	invalid := []Geofence_Schema{
+		{Type: "square"},
+		{Type: GEOFENCE_POLYGON, Polygon: testSquare[:2]},
+		{Type: GEOFENCE_POLYGON, Polygon: []LatLon{{91, 0}, {0, 0}, {0, 1}}},
+		{Type: GEOFENCE_CIRCLE, RadiusMeters: 10},
+		{Type: GEOFENCE_CIRCLE, Center: &LatLon{51.5, -0.12}},
+		{Type: GEOFENCE_POLYGON, Polygon: testSquare, DwellSeconds: -1},
+	}
+	for _, g := range invalid {
+		if g.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", g)
+		}
+	}
+	valid := Geofence_Schema{Type: GEOFENCE_POLYGON, Polygon: testSquare}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected square to be valid: %v", err)
+	}
+}
+
+func TestGeofenceEvaluate(t *testing.T) {
+	ge := &GeofenceEngine{
+		fences: map[string]*Geofence_Schema{
+			"depot": {Id: "depot", Name: "Depot", Type: GEOFENCE_POLYGON, Polygon: testSquare, DwellSeconds: 60},
+			"other": {Id: "other", Type: GEOFENCE_POLYGON, Polygon: testSquare, Devices: []string{"999"}},
+		},
+		states: make(map[string]map[string]*fenceState),
+	}
+	start := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		lat    float64
+		offset time.Duration
+		want   string // event type, blank for none
+	}{
+		{51.51, 0, ""},                            // first fix just sets the state
+		{51.51, 10 * time.Second, ""},             // still outside
+		{51.50, 20 * time.Second, GEOFENCE_ENTER}, // crossed in
+		{51.50, 60 * time.Second, ""},             // inside but not for long enough
+		{51.50, 80 * time.Second, GEOFENCE_DWELL}, // inside for 60s
+		{51.50, 90 * time.Second, ""},             // dwell only sent once
+		{51.51, 100 * time.Second, GEOFENCE_EXIT}, // crossed out
+	}
+	for i, step := range steps {
+		events := ge.evaluate(&Position_Schema{DeviceId: "123456", FixTime: start.Add(step.offset), Valid: true, Latitude: step.lat, Longitude: -0.12})
+		if step.want == "" {
+			if len(events) != 0 {
+				t.Errorf("step %d: expected no events, got %+v", i, events)
+			}
+			continue
+		}
+		if len(events) != 1 || events[0].Type != step.want || events[0].GeofenceId != "depot" {
+			t.Errorf("step %d: expected one %v event, got %+v", i, step.want, events)
+		}
+	}
+}
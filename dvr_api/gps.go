@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+GPS
+Devices report fixes in the format:
+$GPS;[DeviceID];[fix time];[A = valid fix, V = no fix];[latitude];[longitude];[speed km/h];[heading];[satellites]<CR>
+ex: $GPS;123456;20240817-123504;A;51.507400;-0.127800;42.5;270;9\r
+~~~~~~~~~~~~~~~
+*/
+
+// one gps fix, stored in the positions collection and sent to API clients as is
+type Position_Schema struct {
+	DeviceId   string    `bson:"deviceId" json:"deviceId"`
+	FixTime    time.Time `bson:"fixTime" json:"fixTime"`
+	RecvdTime  time.Time `bson:"receivedTime" json:"receivedTime"`
+	Valid      bool      `bson:"valid" json:"valid"`
+	Latitude   float64   `bson:"latitude" json:"latitude"`
+	Longitude  float64   `bson:"longitude" json:"longitude"`
+	Speed      float64   `bson:"speed" json:"speed"`     // km/h
+	Heading    float64   `bson:"heading" json:"heading"` // degrees clockwise from north
+	Satellites int       `bson:"satellites" json:"satellites"`
+}
+
+// is this a gps message
+func isGpsMessage(message string) bool {
+	return getCommandFromMessage(message) == "GPS"
+}
+
+// parse a $GPS message into a position
+func parseGpsMessage(message string, recvdTime time.Time) (*Position_Schema, error) {
+	fields := strings.Split(strings.TrimSpace(message), ";")
+	if len(fields) < 9 || fields[0] != "$GPS" {
+		return nil, fmt.Errorf("not a complete gps message: %q", message)
+	}
+
+	pos := Position_Schema{
+		DeviceId:  fields[1],
+		RecvdTime: recvdTime,
+	}
+	var err error
+	if _, err = strconv.Atoi(pos.DeviceId); err != nil {
+		return nil, fmt.Errorf("invalid device id in gps message: %q", pos.DeviceId)
+	}
+	if pos.FixTime, err = time.Parse("20060102-150405", fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid fix time in gps message: %v", err)
+	}
+	switch fields[3] {
+	case "A":
+		pos.Valid = true
+	case "V":
+		pos.Valid = false
+	default:
+		return nil, fmt.Errorf("invalid fix status in gps message: %q", fields[3])
+	}
+	if pos.Latitude, err = strconv.ParseFloat(fields[4], 64); err != nil || pos.Latitude < -90 || pos.Latitude > 90 {
+		return nil, fmt.Errorf("invalid latitude in gps message: %q", fields[4])
+	}
+	if pos.Longitude, err = strconv.ParseFloat(fields[5], 64); err != nil || pos.Longitude < -180 || pos.Longitude > 180 {
+		return nil, fmt.Errorf("invalid longitude in gps message: %q", fields[5])
+	}
+	if pos.Speed, err = strconv.ParseFloat(fields[6], 64); err != nil || pos.Speed < 0 {
+		return nil, fmt.Errorf("invalid speed in gps message: %q", fields[6])
+	}
+	if pos.Heading, err = strconv.ParseFloat(fields[7], 64); err != nil {
+		return nil, fmt.Errorf("invalid heading in gps message: %q", fields[7])
+	}
+	if pos.Satellites, err = strconv.Atoi(fields[8]); err != nil || pos.Satellites < 0 {
+		return nil, fmt.Errorf("invalid satellite count in gps message: %q", fields[8])
+	}
+	return &pos, nil
+}
+
+// insert a position into the positions collection
+func (dbc *DBConnection) RecordPosition(pos *Position_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("positions")
+	_, err := coll.InsertOne(ctx, pos)
+	return err
+}
+
+// get the positions of a device with a fix time between the two times, oldest first
+func (dbc *DBConnection) QueryPositions(devId string, after time.Time, before time.Time) ([]Position_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("positions")
+
+	filter := bson.M{
+		"deviceId": devId,
+		"fixTime": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "fixTime", Value: 1}}).SetProjection(bson.M{"_id": 0})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying positions: %v", err)
+	}
+
+	positions := make([]Position_Schema, 0)
+	err = cursor.All(context.Background(), &positions)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding positions: %v", err)
+	}
+	return positions, nil
+}
+
+// GET /devices/{id}/positions?after=&before=
+func (s *httpSvr) handleGetPositions(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	positions, err := s.dbc.QueryPositions(r.PathValue("id"), after, before)
+	if err != nil {
+		s.logger.Error("failed to query positions", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query positions")
+		return
+	}
+	writeJSON(w, http.StatusOK, positions)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGpsMessage(t *testing.T) {
+	recvd := time.Date(2024, 8, 17, 12, 35, 10, 0, time.UTC)
+	pos, err := parseGpsMessage("$GPS;123456;20240817-123504;A;51.507400;-0.127800;42.5;270;9\r", recvd)
+	if err != nil {
+		t.Fatalf("parseGpsMessage returned error: %v", err)
+	}
+	want := Position_Schema{
+		DeviceId:   "123456",
+		FixTime:    time.Date(2024, 8, 17, 12, 35, 4, 0, time.UTC),
+		RecvdTime:  recvd,
+		Valid:      true,
+		Latitude:   51.5074,
+		Longitude:  -0.1278,
+		Speed:      42.5,
+		Heading:    270,
+		Satellites: 9,
+	}
+	if *pos != want {
+		t.Errorf("parseGpsMessage = %+v, want %+v", *pos, want)
+	}
+}
+
+func TestParseGpsMessage_Invalid(t *testing.T) {
+	msgs := []string{
+		"$VIDEO;123456;all;4;20231003-164514;5\r",
+		"$GPS;123456;20240817-123504;A;51.5;-0.12\r",
+		"$GPS;abc;20240817-123504;A;51.5;-0.12;0;0;9\r",
+		"$GPS;123456;2024-08-17;A;51.5;-0.12;0;0;9\r",
+		"$GPS;123456;20240817-123504;X;51.5;-0.12;0;0;9\r",
+		"$GPS;123456;20240817-123504;A;91;-0.12;0;0;9\r",
+		"$GPS;123456;20240817-123504;A;51.5;-181;0;0;9\r",
+		"$GPS;123456;20240817-123504;A;51.5;-0.12;-1;0;9\r",
+		"$GPS;123456;20240817-123504;A;51.5;-0.12;0;0;many\r",
+	}
+	for _, msg := range msgs {
+		if _, err := parseGpsMessage(msg, time.Now()); err == nil {
+			t.Errorf("parseGpsMessage(%q) should have returned an error", msg)
+		}
+	}
+}
+
+func TestGetCommandFromMessage(t *testing.T) {
+	cases := map[string]string{
+		"$GPS;123456;20240817-123504\r":         "GPS",
+		"$VIDEO;123456;all;4;20231003-164514;5": "VIDEO",
+		"nonsense":                              "nonsense",
+	}
+	for msg, want := range cases {
+		if got := getCommandFromMessage(msg); got != want {
+			t.Errorf("getCommandFromMessage(%q) = %q, want %q", msg, got, want)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+GROUPS AND TAGS
+Devices can be put in named groups and given free-form tags. A DeviceFilter picks devices by them:
+a device matches if it's in any of the groups (or groups is empty) and has every one of the tags.
+Groups can be referred to by id or name. History queries, subscriptions, bulk commands, scheduled
+jobs and the connected devices list take filters as well as device ids.
+~~~~~~~~~~~~~~~
+*/
+
+// a named set of devices, stored in mongodb and sent to/received from API clients as is
+type DeviceGroup_Schema struct {
+	Id      string   `bson:"_id" json:"id"`
+	Name    string   `bson:"name" json:"name"`
+	Devices []string `bson:"devices" json:"devices"`
+}
+
+// the tags of one device, stored in mongodb
+type DeviceTags_Schema struct {
+	DeviceId string   `bson:"_id" json:"deviceId"`
+	Tags     []string `bson:"tags" json:"tags"`
+}
+
+// what we know about a device's groups and tags, sent to API clients
+type DeviceInfo_Response struct {
+	DeviceId string   `json:"deviceId"`
+	Groups   []string `json:"groups"` // group names
+	Tags     []string `json:"tags"`
+}
+
+// picks devices by group and tag, sent by API clients
+type DeviceFilter struct {
+	Groups []string `json:"groups"` // ids or names, a device in any of them matches
+	Tags   []string `json:"tags"`   // a device with all of them matches
+}
+
+// where the directory keeps groups and tags, the DBConnection outside of tests
+type DirectoryStore interface {
+	QueryDeviceGroups() ([]DeviceGroup_Schema, error)
+	UpsertDeviceGroup(group *DeviceGroup_Schema) error
+	DeleteDeviceGroup(id string) (bool, error)
+	QueryDeviceTags() ([]DeviceTags_Schema, error)
+	SetDeviceTags(tags *DeviceTags_Schema) error
+}
+
+// does the filter pick anything out
+func (f *DeviceFilter) IsEmpty() bool {
+	return f == nil || (len(f.Groups) == 0 && len(f.Tags) == 0)
+}
+
+// trim and sort a list of tags or device ids, dropping empty and repeated ones
+func cleanList(items []string) []string {
+	seen := make(map[string]bool)
+	clean := make([]string, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" || seen[item] {
+			continue
+		}
+		seen[item] = true
+		clean = append(clean, item)
+	}
+	sort.Strings(clean)
+	return clean
+}
+
+// keeps the groups and tags of devices
+type DeviceDirectory struct {
+	// internal
+	groups map[string]*DeviceGroup_Schema // group id against group
+	tags   map[string][]string            // device id against tags
+	lock   sync.Mutex                     // read from many goroutines, changed by the http server
+
+	// injected
+	logger *zap.Logger
+	store  DirectoryStore
+}
+
+// constructor, loads the groups and tags already defined
+func NewDeviceDirectory(logger *zap.Logger, store DirectoryStore) (*DeviceDirectory, error) {
+	dd := &DeviceDirectory{
+		groups: make(map[string]*DeviceGroup_Schema),
+		tags:   make(map[string][]string),
+		logger: logger,
+		store:  store,
+	}
+	groups, err := store.QueryDeviceGroups()
+	if err != nil {
+		return nil, fmt.Errorf("error loading device groups: %v", err)
+	}
+	for i := range groups {
+		dd.groups[groups[i].Id] = &groups[i]
+	}
+	tags, err := store.QueryDeviceTags()
+	if err != nil {
+		return nil, fmt.Errorf("error loading device tags: %v", err)
+	}
+	for _, t := range tags {
+		dd.tags[t.DeviceId] = t.Tags
+	}
+	return dd, nil
+}
+
+// find a group by id or name. Lock must be held.
+func (dd *DeviceDirectory) findGroup(ref string) *DeviceGroup_Schema {
+	if group, ok := dd.groups[ref]; ok {
+		return group
+	}
+	for _, group := range dd.groups {
+		if group.Name == ref {
+			return group
+		}
+	}
+	return nil
+}
+
+// does the device match the filter. Lock must be held.
+func (dd *DeviceDirectory) matches(devId string, f *DeviceFilter) bool {
+	if len(f.Groups) > 0 {
+		inGroup := false
+		for _, ref := range f.Groups {
+			group := dd.findGroup(ref)
+			if group != nil && containsString(group.Devices, devId) {
+				inGroup = true
+				break
+			}
+		}
+		if !inGroup {
+			return false
+		}
+	}
+	for _, tag := range f.Tags {
+		if !containsString(dd.tags[devId], tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// every device we know of that matches the filter, sorted
+func (dd *DeviceDirectory) Resolve(f *DeviceFilter) []string {
+	devices := make([]string, 0)
+	if f.IsEmpty() {
+		return devices
+	}
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+
+	// devices in the groups if there are any, otherwise every device with tags
+	candidates := make(map[string]bool)
+	if len(f.Groups) > 0 {
+		for _, ref := range f.Groups {
+			if group := dd.findGroup(ref); group != nil {
+				for _, devId := range group.Devices {
+					candidates[devId] = true
+				}
+			}
+		}
+	} else {
+		for devId := range dd.tags {
+			candidates[devId] = true
+		}
+	}
+	for devId := range candidates {
+		if dd.matches(devId, f) {
+			devices = append(devices, devId)
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// the devices listed plus the devices the filter picks out, without repeats
+func (dd *DeviceDirectory) Expand(devices []string, f *DeviceFilter) []string {
+	seen := make(map[string]bool)
+	expanded := make([]string, 0, len(devices))
+	for _, devId := range append(append([]string{}, devices...), dd.Resolve(f)...) {
+		if !seen[devId] {
+			seen[devId] = true
+			expanded = append(expanded, devId)
+		}
+	}
+	return expanded
+}
+
+// the devices listed that match the filter, all of them if the filter is empty
+func (dd *DeviceDirectory) Filter(devices []string, f *DeviceFilter) []string {
+	if f.IsEmpty() {
+		return devices
+	}
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	filtered := make([]string, 0)
+	for _, devId := range devices {
+		if dd.matches(devId, f) {
+			filtered = append(filtered, devId)
+		}
+	}
+	return filtered
+}
+
+// is the name used by a group other than the one with this id
+func (dd *DeviceDirectory) nameTaken(name string, id string) bool {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	for _, other := range dd.groups {
+		if other.Name == name && other.Id != id {
+			return true
+		}
+	}
+	return false
+}
+
+// add or replace a group
+func (dd *DeviceDirectory) PutGroup(group *DeviceGroup_Schema) error {
+	err := dd.store.UpsertDeviceGroup(group)
+	if err != nil {
+		return err
+	}
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	dd.groups[group.Id] = group
+	return nil
+}
+
+// remove a group, returns false if there was no such group
+func (dd *DeviceDirectory) DeleteGroup(id string) (bool, error) {
+	deleted, err := dd.store.DeleteDeviceGroup(id)
+	if err != nil {
+		return false, err
+	}
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	delete(dd.groups, id)
+	return deleted, nil
+}
+
+// list the groups
+func (dd *DeviceDirectory) GetGroups() []DeviceGroup_Schema {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	groups := make([]DeviceGroup_Schema, 0, len(dd.groups))
+	for _, group := range dd.groups {
+		groups = append(groups, *group)
+	}
+	return groups
+}
+
+// get one group by id or name
+func (dd *DeviceDirectory) GetGroup(ref string) (DeviceGroup_Schema, bool) {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	group := dd.findGroup(ref)
+	if group == nil {
+		return DeviceGroup_Schema{}, false
+	}
+	return *group, true
+}
+
+// replace a device's tags
+func (dd *DeviceDirectory) SetTags(devId string, tags []string) ([]string, error) {
+	tags = cleanList(tags)
+	err := dd.store.SetDeviceTags(&DeviceTags_Schema{devId, tags})
+	if err != nil {
+		return nil, err
+	}
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	if len(tags) == 0 {
+		delete(dd.tags, devId)
+	} else {
+		dd.tags[devId] = tags
+	}
+	return tags, nil
+}
+
+// the groups and tags of a device
+func (dd *DeviceDirectory) GetInfo(devId string) DeviceInfo_Response {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	info := DeviceInfo_Response{DeviceId: devId, Groups: make([]string, 0), Tags: append([]string{}, dd.tags[devId]...)}
+	for _, group := range dd.groups {
+		if containsString(group.Devices, devId) {
+			info.Groups = append(info.Groups, group.Name)
+		}
+	}
+	sort.Strings(info.Groups)
+	return info
+}
+
+// add the group and tag endpoints to the http server
+func (dd *DeviceDirectory) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /groups", dd.handleListGroups)
+	svr.HandleFunc("POST /groups", dd.handleCreateGroup)
+	svr.HandleFunc("GET /groups/{id}", dd.handleGetGroup)
+	svr.HandleFunc("PUT /groups/{id}", dd.handleUpdateGroup)
+	svr.HandleFunc("DELETE /groups/{id}", dd.handleDeleteGroup)
+	svr.HandleFunc("GET /devices", dd.handleListDevices)
+	svr.HandleFunc("GET /devices/{id}/tags", dd.handleGetTags)
+	svr.HandleFunc("PUT /devices/{id}/tags", dd.handleSetTags)
+}
+
+// GET /groups
+func (dd *DeviceDirectory) handleListGroups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, dd.GetGroups())
+}
+
+// GET /groups/{id}, id or name
+func (dd *DeviceDirectory) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := dd.GetGroup(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such group")
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+// POST /groups
+func (dd *DeviceDirectory) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	dd.handlePutGroup(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// PUT /groups/{id}
+func (dd *DeviceDirectory) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := dd.GetGroup(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such group")
+		return
+	}
+	dd.handlePutGroup(w, r, group.Id, http.StatusOK)
+}
+
+// read, validate and store a group from the request body
+func (dd *DeviceDirectory) handlePutGroup(w http.ResponseWriter, r *http.Request, id string, status int) {
+	var group DeviceGroup_Schema
+	err := json.NewDecoder(r.Body).Decode(&group)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid group json: %v", err))
+		return
+	}
+	group.Id = id
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		writeError(w, http.StatusBadRequest, "name can't be empty")
+		return
+	}
+	if dd.nameTaken(group.Name, group.Id) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("there's already a group called %q", group.Name))
+		return
+	}
+	group.Devices = cleanList(group.Devices)
+	err = dd.PutGroup(&group)
+	if mongo.IsDuplicateKeyError(err) {
+		// another request took the name since we checked
+		writeError(w, http.StatusConflict, fmt.Sprintf("there's already a group called %q", group.Name))
+		return
+	}
+	if err != nil {
+		dd.logger.Error("failed to store group", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store group")
+		return
+	}
+	writeJSON(w, status, group)
+}
+
+// DELETE /groups/{id}, id or name
+func (dd *DeviceDirectory) handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := dd.GetGroup(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such group")
+		return
+	}
+	_, err := dd.DeleteGroup(group.Id)
+	if err != nil {
+		dd.logger.Error("failed to delete group", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to delete group")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /devices?group=&tag=, both can be repeated. The devices in groups or with tags that match.
+func (dd *DeviceDirectory) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	f := &DeviceFilter{Groups: r.URL.Query()["group"], Tags: r.URL.Query()["tag"]}
+	var devices []string
+	if f.IsEmpty() {
+		// everything we know about
+		dd.lock.Lock()
+		known := make(map[string]bool)
+		for devId := range dd.tags {
+			known[devId] = true
+		}
+		for _, group := range dd.groups {
+			for _, devId := range group.Devices {
+				known[devId] = true
+			}
+		}
+		dd.lock.Unlock()
+		for devId := range known {
+			devices = append(devices, devId)
+		}
+		sort.Strings(devices)
+	} else {
+		devices = dd.Resolve(f)
+	}
+	res := make([]DeviceInfo_Response, len(devices))
+	for i, devId := range devices {
+		res[i] = dd.GetInfo(devId)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// GET /devices/{id}/tags
+func (dd *DeviceDirectory) handleGetTags(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, dd.GetInfo(r.PathValue("id")))
+}
+
+// PUT /devices/{id}/tags, body: {"tags": ["..."]}
+func (dd *DeviceDirectory) handleSetTags(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	devId := r.PathValue("id")
+	_, err = dd.SetTags(devId, req.Tags)
+	if err != nil {
+		dd.logger.Error("failed to store device tags", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store device tags")
+		return
+	}
+	writeJSON(w, http.StatusOK, dd.GetInfo(devId))
+}
+
+// get every device group
+func (dbc *DBConnection) QueryDeviceGroups() ([]DeviceGroup_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("device_groups")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying device groups: %v", err)
+	}
+	groups := make([]DeviceGroup_Schema, 0)
+	err = cursor.All(ctx, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding device groups: %v", err)
+	}
+	return groups, nil
+}
+
+// insert or replace a device group
+func (dbc *DBConnection) UpsertDeviceGroup(group *DeviceGroup_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("device_groups")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": group.Id}, group, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete a device group, returns false if there was nothing to delete
+func (dbc *DBConnection) DeleteDeviceGroup(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("device_groups")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// get the tags of every device that has any
+func (dbc *DBConnection) QueryDeviceTags() ([]DeviceTags_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("device_tags")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying device tags: %v", err)
+	}
+	tags := make([]DeviceTags_Schema, 0)
+	err = cursor.All(ctx, &tags)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding device tags: %v", err)
+	}
+	return tags, nil
+}
+
+// replace the tags of a device, removing its record if it has none left
+func (dbc *DBConnection) SetDeviceTags(tags *DeviceTags_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("device_tags")
+	if len(tags.Tags) == 0 {
+		_, err := coll.DeleteOne(ctx, bson.M{"_id": tags.DeviceId})
+		return err
+	}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": tags.DeviceId}, tags, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// in memory DirectoryStore
+type memDirectoryStore struct {
+	lock   sync.Mutex
+	groups map[string]DeviceGroup_Schema
+	tags   map[string]DeviceTags_Schema
+}
+
+func newMemDirectoryStore() *memDirectoryStore {
+	return &memDirectoryStore{groups: make(map[string]DeviceGroup_Schema), tags: make(map[string]DeviceTags_Schema)}
+}
+
+func (m *memDirectoryStore) QueryDeviceGroups() ([]DeviceGroup_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	groups := make([]DeviceGroup_Schema, 0)
+	for _, g := range m.groups {
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (m *memDirectoryStore) UpsertDeviceGroup(group *DeviceGroup_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// names are unique, like the index on the collection
+	for _, g := range m.groups {
+		if g.Name == group.Name && g.Id != group.Id {
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+		}
+	}
+	m.groups[group.Id] = *group
+	return nil
+}
+
+func (m *memDirectoryStore) DeleteDeviceGroup(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.groups[id]
+	delete(m.groups, id)
+	return ok, nil
+}
+
+func (m *memDirectoryStore) QueryDeviceTags() ([]DeviceTags_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tags := make([]DeviceTags_Schema, 0)
+	for _, t := range m.tags {
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+func (m *memDirectoryStore) SetDeviceTags(tags *DeviceTags_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tags[tags.DeviceId] = *tags
+	return nil
+}
+
+func newTestDirectory(t *testing.T) *DeviceDirectory {
+	dd, err := NewDeviceDirectory(zap.NewNop(), newMemDirectoryStore())
+	if err != nil {
+		t.Fatalf("new directory: %v", err)
+	}
+	dd.PutGroup(&DeviceGroup_Schema{Id: "g1", Name: "buses", Devices: []string{"123", "456"}})
+	dd.PutGroup(&DeviceGroup_Schema{Id: "g2", Name: "vans", Devices: []string{"789"}})
+	dd.SetTags("123", []string{"north", " depot-a ", "north"})
+	dd.SetTags("789", []string{"north"})
+	dd.SetTags("321", []string{"depot-a"})
+	return dd
+}
+
+func TestDeviceDirectory_Resolve(t *testing.T) {
+	dd := newTestDirectory(t)
+	cases := []struct {
+		filter DeviceFilter
+		want   []string
+	}{
+		{DeviceFilter{Groups: []string{"buses"}}, []string{"123", "456"}},
+		{DeviceFilter{Groups: []string{"g1", "vans"}}, []string{"123", "456", "789"}},
+		{DeviceFilter{Tags: []string{"north"}}, []string{"123", "789"}},
+		{DeviceFilter{Tags: []string{"north", "depot-a"}}, []string{"123"}},
+		{DeviceFilter{Groups: []string{"buses"}, Tags: []string{"north"}}, []string{"123"}},
+		{DeviceFilter{Groups: []string{"nope"}}, []string{}},
+		{DeviceFilter{}, []string{}},
+	}
+	for i, c := range cases {
+		if got := dd.Resolve(&c.filter); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %v: got %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestDeviceDirectory_ExpandAndFilter(t *testing.T) {
+	dd := newTestDirectory(t)
+	got := dd.Expand([]string{"999", "123"}, &DeviceFilter{Tags: []string{"depot-a"}})
+	if want := []string{"999", "123", "321"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expand: got %v, want %v", got, want)
+	}
+	if got := dd.Expand([]string{"999"}, nil); !reflect.DeepEqual(got, []string{"999"}) {
+		t.Errorf("expand without filter: got %v", got)
+	}
+	got = dd.Filter([]string{"123", "456", "789", "999"}, &DeviceFilter{Groups: []string{"buses", "vans"}, Tags: []string{"north"}})
+	if want := []string{"123", "789"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filter: got %v, want %v", got, want)
+	}
+	if got := dd.Filter([]string{"999"}, nil); !reflect.DeepEqual(got, []string{"999"}) {
+		t.Errorf("filter without filter: got %v", got)
+	}
+}
+
+func TestDeviceDirectory_Info(t *testing.T) {
+	dd := newTestDirectory(t)
+	info := dd.GetInfo("123")
+	if !reflect.DeepEqual(info.Groups, []string{"buses"}) || !reflect.DeepEqual(info.Tags, []string{"depot-a", "north"}) {
+		t.Errorf("info %+v", info)
+	}
+	dd.DeleteGroup("g1")
+	dd.SetTags("123", nil)
+	info = dd.GetInfo("123")
+	if len(info.Groups) != 0 || len(info.Tags) != 0 {
+		t.Errorf("info after delete %+v", info)
+	}
+}
+
+func TestDeviceDirectory_PutGroupNameRace(t *testing.T) {
+	store := newMemDirectoryStore()
+	dd, _ := NewDeviceDirectory(zap.NewNop(), store)
+	// stored by another request after the name was checked
+	store.UpsertDeviceGroup(&DeviceGroup_Schema{Id: "other", Name: "buses"})
+
+	r := httptest.NewRequest(http.MethodPost, "/groups", strings.NewReader(`{"name":"buses"}`))
+	w := httptest.NewRecorder()
+	dd.handlePutGroup(w, r, "g1", http.StatusCreated)
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusConflict)
+	}
+}
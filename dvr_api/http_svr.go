@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type httpSvr struct {
-	logger   *zap.Logger
-	endpoint string // IP + port, ex: "192.168.1.77:9047"
-	dbc      *DBConnection
+	logger    *zap.Logger
+	endpoint  string // IP + port, ex: "192.168.1.77:9047"
+	dbc       *DBConnection
+	mux       *http.ServeMux   // routes requests to the handler for each endpoint
+	directory *DeviceDirectory // resolves the groups and tags in history queries, nil if not set
 }
 
 func NewHttpSvr(logger *zap.Logger, endpoint string, dbc *DBConnection) (*httpSvr, error) {
@@ -21,12 +26,36 @@ func NewHttpSvr(logger *zap.Logger, endpoint string, dbc *DBConnection) (*httpSv
 		logger,
 		endpoint,
 		dbc,
+		http.NewServeMux(),
+		nil,
 	}
+
+	// message history. Clients that predate versioning POST to any path, so the
+	// catch-all keeps serving them the v1 api.
+	svr.HandleFunc("POST /", svr.handleMsgHistory(API_V1))
+	svr.HandleFunc("POST /v1/history", svr.handleMsgHistory(API_V1))
+	svr.HandleFunc("POST /v2/history", svr.handleMsgHistory(API_V2))
+
+	// positions parsed out of gps messages
+	svr.HandleFunc("GET /devices/{id}/positions", svr.handleGetPositions)
+
+	// the route a device took, for mapping tools
+	svr.HandleFunc("GET /devices/{id}/track", svr.handleExportTrack)
 	return &svr, nil
 }
 
-// run the server
-func (s *httpSvr) Run() {
+// let history queries pick devices by group and tag. Call before Run.
+func (s *httpSvr) SetDirectory(directory *DeviceDirectory) {
+	s.directory = directory
+}
+
+// register a handler for a route, pattern is as in http.ServeMux
+func (s *httpSvr) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// run the server, blocking until the context is done and the requests in progress have finished
+func (s *httpSvr) Run(ctx context.Context) {
 	// listen tcp
 	l, err := net.Listen("tcp", s.endpoint)
 	if err != nil {
@@ -39,55 +68,155 @@ func (s *httpSvr) Run() {
 	httpSvr := &http.Server{
 		Handler: s,
 	}
+
+	// stop accepting when we're told to, letting the requests in progress finish
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		err := httpSvr.Shutdown(context.Background())
+		if err != nil {
+			s.logger.Error("error stopping http api server", zap.Error(err))
+		}
+	}()
 	err = httpSvr.Serve(l)
-	if err != nil {
+	if err != http.ErrServerClosed {
 		s.logger.Fatal("error serving http api server: %v", zap.Error(err))
 	}
+	<-stopped
+	s.logger.Info("http server stopped")
 }
 
 // serve the http API
 func (s *httpSvr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// error handling
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	if !PROD {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	} else {
 		s.logger.Fatal("cors enabled on http server, disable in prod")
 	}
 
-	// read the bytes
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.logger.Error("Unable to read request body", zap.Error(err))
-		return
-	}
+	// pass to whichever handler is registered for the route
+	s.mux.ServeHTTP(w, r)
+}
 
-	// unmarshal bytes into a struct we can work with
-	var req ApiRequest_HTTP
-	err = json.Unmarshal(body, &req)
-	if err != nil {
-		s.logger.Warn("failed to unmarshal json: \n%v", zap.String("body", string(body)))
-	}
+// query message history for the devices in the request body. ?format=csv|ndjson|json picks the output, json by default.
+func (s *httpSvr) handleMsgHistory(apiVersion int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// read the bytes
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.logger.Error("Unable to read request body", zap.Error(err))
+			return
+		}
 
-	// query the database
-	res, err := s.dbc.QueryMsgHistory(req.Devices, req.Before, req.After)
-	if err != nil {
-		s.logger.Error("failed to query msg history: %v", zap.Error(err))
+		// unmarshal bytes into a struct we can work with
+		var req ApiRequest_HTTP
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			s.logger.Warn("failed to unmarshal json: \n%v", zap.String("body", string(body)))
+		}
+
+		// json unless they asked for one of the flat formats
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" && format != "ndjson" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format: %v", format))
+			return
+		}
+
+		// add the devices in the groups and with the tags asked for
+		devIds := req.Devices
+		if s.directory != nil {
+			devIds = s.directory.Expand(req.Devices, &DeviceFilter{req.Groups, req.Tags})
+		}
+
+		// query the database
+		devices, err := s.dbc.QueryMsgHistory(devIds, req.Before, req.After, req.Trim)
+		if err != nil {
+			s.logger.Error("failed to query msg history: %v", zap.Error(err))
+		}
+
+		// flat formats get one row per message
+		switch format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"history.csv\"")
+			w.WriteHeader(http.StatusOK)
+			err = writeCsvRows(w, flattenHistory(devices, apiVersion))
+		case "ndjson":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			err = writeNdjsonRows(w, flattenHistory(devices, apiVersion))
+		}
+		if format != "json" {
+			if err != nil {
+				s.logger.Error("failed to write msg history", zap.String("format", format), zap.Error(err))
+			}
+			return
+		}
+
+		// convert into the shape, and direction values, this version of the api uses
+		res := make([]DeviceHistory_Response, len(devices))
+		for i, dev := range devices {
+			res[i] = DeviceHistory_Response{
+				DeviceId:   dev.DeviceId,
+				MsgHistory: make([]DeviceMessage_Response, len(dev.MsgHistory)),
+			}
+			for j, msg := range dev.MsgHistory {
+				res[i].MsgHistory[j] = DeviceMessage_Response{
+					RecvdTime:  msg.RecvdTime,
+					PacketTime: msg.PacketTime,
+					Message:    msg.Message,
+					Direction:  msg.Direction.ForHttpVersion(apiVersion),
+				}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, res)
 	}
+}
 
-	// marshal back into json
-	bytes, err := json.Marshal(res)
+// marshal v into json and write it as the response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bytes, err := json.Marshal(v)
 	if err != nil {
-		s.logger.Error("failed to marshal golang struct into json bytes: %v", zap.Error(err))
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
 		return
 	}
 
 	// set the response header Content-Type to application/json
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(bytes)
 }
+
+// write an error message as the json response
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// read the after and before query parameters, RFC3339 formatted. Missing after means
+// from the start of time, missing before means up until now.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	after := time.Time{}
+	before := time.Now()
+	var err error
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return after, before, fmt.Errorf("invalid after parameter: %v", err)
+		}
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return after, before, fmt.Errorf("invalid before parameter: %v", err)
+		}
+	}
+	if !after.Before(before) {
+		return after, before, fmt.Errorf("after must be before before")
+	}
+	return after, before, nil
+}
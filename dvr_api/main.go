@@ -8,29 +8,88 @@ TODO:
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-// Globals
+// defaults, overridden by the config file, environment and flags. See config.go.
 const (
 	// endopints
 	DEVICE_SVR_ENDPOINT  string = "127.0.0.1:9047"           // endpoint for dev svr
 	WEBSOCK_SVR_ENDPOINT string = "127.0.0.1:9046"           // endpoint for api websock svr
 	HTTP_SVR_ENDPOINT    string = "127.0.0.1:9045"           // endpoint for api REST svr
 	MONGODB_ENDPOINT     string = "mongodb://0.0.0.0:27017/" // database uri
+	DB_NAME              string = "dvr_api-GPS-DB"           // name of the database inside mongo
+	MQTT_BROKER_URL      string = ""                         // mqtt broker to bridge device messages to, ex: "tcp://127.0.0.1:1883". Empty to disable.
+	MQTT_TOPIC_PREFIX    string = "dvr"                      // first level of the mqtt topics
+	CLIP_STORAGE_DIR     string = "clips"                    // where footage uploaded by devices is kept
+	SPILL_DIR            string = "spill"                    // where writes are kept while the database is down
 
-	// just use this for the logger atm
-	PROD bool = false
+	// clip retention, 0 for no limit
+	CLIP_MAX_AGE      time.Duration = 30 * 24 * time.Hour // clips older than this are deleted unless pinned
+	CLIP_DEVICE_QUOTA int64         = 10 << 30            // bytes of clips kept per device
+	CLIP_GLOBAL_QUOTA int64         = 100 << 30           // bytes of clips kept altogether
+
+	// only report what the message retention job would prune, don't delete anything
+	MSG_RETENTION_DRY_RUN bool = false
 
 	// server configuration variables
-	CAPACITY        int = 20   // how many devices can connect to the server
-	BUF_SIZE        int = 1024 // how much memory will you allocate to IO operations
-	SVR_MSGBUF_SIZE int = 40   // capacity of message queue
+	CAPACITY         int   = 20      // how many devices can connect to the server
+	BUF_SIZE         int   = 1024    // how much memory will you allocate to IO operations
+	SVR_MSGBUF_SIZE  int   = 40      // capacity of each server's message queue
+	WRITE_QUEUE_SIZE int   = 10000   // messages and positions waiting to be written to the database
+	SPILL_MAX_BYTES  int64 = 1 << 30 // most writes kept on disk while the database is down
+	MSG_WORKERS      int   = 16      // messages from different devices processed at once
+
+	// how long we give ourselves to stop cleanly on SIGINT or SIGTERM
+	SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
 )
 
+// what a server does with a connection sending faster than its share of the queue is taken: block,
+// drop or disconnect
+const SVR_OVERLOAD_POLICY OverloadPolicy = OVERLOAD_BLOCK
+
+// just use this for the logger atm. Set from the config before anything else runs.
+var PROD bool = false
+
+// how long messages are kept by type, the command without the '$'. "*" covers every other type,
+// 0 keeps them forever
+var MSG_RETENTION = map[string]time.Duration{
+	"GPS":                      90 * 24 * time.Hour,
+	"ALARM":                    2 * 365 * 24 * time.Hour,
+	"HEARTBEAT":                7 * 24 * time.Hour,
+	MSG_RETENTION_DEFAULT_TYPE: 0,
+}
+
 func main() {
+	// load the config, or just print it
+	cfg, printConfig, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		err = cfg.Write(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	PROD = cfg.Prod
+
 	// set up our logger
 	var logger *zap.Logger
 	if PROD {
@@ -49,33 +108,51 @@ func main() {
 	defer logger.Sync() // flushes buffer, if any
 
 	// create DB connection
-	dbc, err := NewDBConnection(logger, MONGODB_ENDPOINT, "dvr_api-GPS-DB")
+	dbc, err := NewDBConnection(logger, cfg.MongoUri, cfg.DbName)
 	if err != nil {
 		logger.Fatal("fatal error creating database connection: %v", zap.Error(err))
 	}
 
+	// bring direction values written by older versions in line with the current ones
+	migrated, err := dbc.MigrateDirections()
+	if err != nil {
+		logger.Fatal("fatal error migrating message directions: %v", zap.Error(err))
+	}
+	logger.Info("migrated legacy message directions", zap.Int64("migrated", migrated))
+
+	// make sure the collections are indexed
+	err = dbc.EnsureIndexes()
+	if err != nil {
+		logger.Fatal("fatal error creating database indexes: %v", zap.Error(err))
+	}
+
 	// create device server struct
-	devSvr, err := NewDeviceSvr(logger, DEVICE_SVR_ENDPOINT, CAPACITY, BUF_SIZE, SVR_MSGBUF_SIZE)
+	devSvr, err := NewDeviceSvr(logger, cfg.DeviceEndpoint, cfg.Capacity, cfg.BufSize, cfg.MsgBufSize, cfg.OverloadPolicy)
 	if err != nil {
 		logger.Fatal("fatal error creating device server: %v", zap.Error(err))
 	}
 
 	// create ws server struct
-	wsSvr, err := NewWebSockSvr(logger, WEBSOCK_SVR_ENDPOINT, CAPACITY, BUF_SIZE, SVR_MSGBUF_SIZE, devSvr.connIndex.GetAllKeys)
+	wsSvr, err := NewWebSockSvr(logger, cfg.WebsocketEndpoint, cfg.Capacity, cfg.BufSize, cfg.MsgBufSize, cfg.OverloadPolicy, devSvr.connIndex.GetAllKeys)
 	if err != nil {
 		logger.Fatal("fatal error creating api server: %v", zap.Error(err))
 	}
 
 	// create http server struct
-	httpSvr, err := NewHttpSvr(logger, HTTP_SVR_ENDPOINT, dbc)
+	httpSvr, err := NewHttpSvr(logger, cfg.HttpEndpoint, dbc)
 	if err != nil {
 		logger.Fatal("fatal error creating REST api server: %v", zap.Error(err))
 	}
 
-	// start the servers listening
-	go devSvr.Run()
-	go wsSvr.Run()
-	go httpSvr.Run()
+	// device groups and tags, usable as filters by the api servers
+	directory, err := NewDeviceDirectory(logger, dbc)
+	if err != nil {
+		logger.Fatal("fatal error creating device directory: %v", zap.Error(err))
+	}
+	directory.RegisterRoutes(httpSvr)
+	RegisterQueueRoutes(httpSvr, devSvr.svrMsgQueue, wsSvr.svrMsgQueue)
+	httpSvr.SetDirectory(directory)
+	wsSvr.SetDirectory(directory)
 
 	// create the 'relay' struct, start the intake of the messages
 	subHandler, err := NewSubscriptionHandler(logger, devSvr, wsSvr, dbc)
@@ -83,23 +160,272 @@ func main() {
 		logger.Fatal("fatal error creating relay struct: %v", zap.Error(err))
 	}
 
+	// run until we're told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// background jobs, waited for on the way down. The ones that send commands stop with ctx, while the
+	// devices' workers can still take them. The rest own hooks the workers call, so they stop once the
+	// workers have finished.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var senders, jobs sync.WaitGroup
+	runOn := func(wg *sync.WaitGroup, ctx context.Context, run func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx)
+		}()
+	}
+	runSender := func(run func(context.Context)) { runOn(&senders, ctx, run) }
+	runJob := func(run func(context.Context)) { runOn(&jobs, jobsCtx, run) }
+
+	// deliver events to webhooks
+	webhooks, err := NewWebhookDispatcher(logger, dbc)
+	if err != nil {
+		logger.Fatal("fatal error creating webhook dispatcher: %v", zap.Error(err))
+	}
+	webhooks.RegisterRoutes(httpSvr)
+	runJob(webhooks.Run)
+
+	// events go to websocket subscribers and webhooks
+	publishEvent := publishToAll(subHandler.PublishEvent, webhooks.Notify)
+
 	// create the 'relay' struct, start the intake of the messages. Inject the publish function into the handler struct
-	msgHandler, err := NewMessageHandler(logger, devSvr, wsSvr, dbc, subHandler.Publish)
+	msgHandler, err := NewMessageHandler(logger, devSvr, wsSvr, dbc, subHandler.Publish, publishEvent)
 	if err != nil {
 		logger.Fatal("fatal error creating relay struct: %v", zap.Error(err))
 	}
 
-	// handle messages
+	// write messages and positions to the database in batches, off the hot path
+	writer, err := NewWriteBehind(logger, dbc, cfg.WriteQueueSize)
+	if err != nil {
+		logger.Fatal("fatal error creating database writer: %v", zap.Error(err))
+	}
+	spill, err := NewSpillBuffer(cfg.SpillDir, cfg.SpillMaxBytes)
+	if err != nil {
+		logger.Fatal("fatal error creating spill buffer: %v", zap.Error(err))
+	}
+	writer.SetSpill(spill)
+	writer.RegisterRoutes(httpSvr)
+	msgHandler.SetWriteBehind(writer)
+	writerCtx, stopWriter := context.WithCancel(context.Background())
+	writerDone := make(chan struct{})
+	go func() {
+		writer.Run(writerCtx)
+		close(writerDone)
+	}()
+
+	// process messages from different devices in parallel, each device's in order
+	workers, err := NewMsgWorkerPool(logger, cfg.MsgWorkers, MSG_WORKER_QUEUE_SIZE)
+	if err != nil {
+		logger.Fatal("fatal error creating message workers: %v", zap.Error(err))
+	}
+	workers.RegisterRoutes(httpSvr)
+	msgHandler.SetWorkers(workers)
+	workers.Run()
+
+	// evaluate positions against the geofences
+	geofences, err := NewGeofenceEngine(logger, dbc, publishEvent)
+	if err != nil {
+		logger.Fatal("fatal error creating geofence engine: %v", zap.Error(err))
+	}
+	geofences.RegisterRoutes(httpSvr)
+	msgHandler.OnPosition(geofences.ProcessPosition)
+
+	// evaluate the alarm rules
+	rules, err := NewRulesEngine(logger, dbc, publishEvent)
+	if err != nil {
+		logger.Fatal("fatal error creating rules engine: %v", zap.Error(err))
+	}
+	rules.RegisterRoutes(httpSvr)
+	msgHandler.OnPosition(rules.ProcessPosition)
+	msgHandler.OnMessage(rules.ProcessMessage)
+	devSvr.OnPresence(rules.ProcessPresence)
+	runJob(rules.Run)
+
+	// queue commands for devices that aren't connected, deliver them when they connect
+	cmdQueue, err := NewCommandQueue(logger, dbc, msgHandler.SendToDevice, devSvr.IsConnected, publishEvent)
+	if err != nil {
+		logger.Fatal("fatal error creating command queue: %v", zap.Error(err))
+	}
+	cmdQueue.RegisterRoutes(httpSvr)
+	msgHandler.SetCommandQueue(cmdQueue.Enqueue)
+	wsSvr.SetCommandQueue(cmdQueue)
+	devSvr.OnPresence(cmdQueue.ProcessPresence)
+	runJob(cmdQueue.Run)
+
+	// track video requests through to the footage arriving
+	videos, err := NewVideoJobs(logger, dbc, publishEvent)
+	if err != nil {
+		logger.Fatal("fatal error creating video job tracker: %v", zap.Error(err))
+	}
+	videos.RegisterRoutes(httpSvr)
+	msgHandler.OnSend(videos.ProcessSend)
+	msgHandler.OnMessage(videos.ProcessMessage)
+	runJob(videos.Run)
+
+	// take footage uploads for the video requests, serve the clips back
+	uploads, err := NewUploadReceiver(logger, dbc, cfg.ClipStorageDir, videos)
+	if err != nil {
+		logger.Fatal("fatal error creating upload receiver: %v", zap.Error(err))
+	}
+	uploads.RegisterRoutes(httpSvr)
+
+	// keep the clips within their quotas
+	clipStorage, err := NewClipStorage(logger, dbc, cfg.ClipStorageDir, ClipRetentionPolicy{MaxAge: cfg.ClipMaxAge, DeviceQuotaBytes: cfg.ClipDeviceQuota, GlobalQuotaBytes: cfg.ClipGlobalQuota})
+	if err != nil {
+		logger.Fatal("fatal error creating clip storage: %v", zap.Error(err))
+	}
+	clipStorage.RegisterRoutes(httpSvr)
+	runJob(clipStorage.Run)
+
+	// prune old message history by type
+	msgRetention, err := NewMessageRetention(logger, dbc, cfg.MsgRetention, cfg.MsgRetentionDryRun)
+	if err != nil {
+		logger.Fatal("fatal error creating message retention: %v", zap.Error(err))
+	}
+	msgRetention.RegisterRoutes(httpSvr)
+	runJob(msgRetention.Run)
+
+	// summarise positions and alarms per minute and hour for long range reports
+	rollups, err := NewRollups(logger, dbc)
+	if err != nil {
+		logger.Fatal("fatal error creating rollups: %v", zap.Error(err))
+	}
+	rollups.RegisterRoutes(httpSvr)
+	runJob(rollups.Run)
+
+	// split the positions into trips
+	trips, err := NewTripDetector(logger, dbc, publishEvent, directory)
+	if err != nil {
+		logger.Fatal("fatal error creating trip detector: %v", zap.Error(err))
+	}
+	trips.RegisterRoutes(httpSvr)
+	msgHandler.OnPosition(trips.ProcessPosition)
+	msgHandler.OnMessage(trips.ProcessMessage)
+	runJob(trips.Run)
+
+	// match device replies to the commands we send on behalf of the scheduler and bulk commands
+	replies := NewReplyTracker()
+	msgHandler.OnMessage(replies.ProcessMessage)
+	runJob(replies.Run)
+
+	// send commands to devices on a schedule
+	scheduler, err := NewScheduler(logger, dbc, msgHandler.SendCommand, devSvr.IsConnected, replies, directory)
+	if err != nil {
+		logger.Fatal("fatal error creating scheduler: %v", zap.Error(err))
+	}
+	scheduler.RegisterRoutes(httpSvr)
+	runSender(scheduler.Run)
+
+	// structured commands, validated and rendered into the wire format
+	commands, err := NewCommandSender(logger, msgHandler.SendCommand, devSvr.IsConnected)
+	if err != nil {
+		logger.Fatal("fatal error creating command sender: %v", zap.Error(err))
+	}
+	commands.RegisterRoutes(httpSvr)
+
+	// send one command to many devices
+	bulk, err := NewBulkSender(logger, dbc, msgHandler.SendCommand, devSvr.IsConnected, replies, directory)
+	if err != nil {
+		logger.Fatal("fatal error creating bulk sender: %v", zap.Error(err))
+	}
+	bulk.RegisterRoutes(httpSvr)
+	runSender(bulk.Run)
+
+	// bridge device messages to and commands from mqtt, if configured
+	var mqttBridge *MqttBridge
+	if cfg.MqttBrokerUrl != "" {
+		mqttBridge, err = NewMqttBridge(logger, cfg.MqttBrokerUrl, cfg.MqttTopicPrefix, msgHandler.SendCommand)
+		if err != nil {
+			logger.Fatal("fatal error creating mqtt bridge: %v", zap.Error(err))
+		}
+		msgHandler.OnMessage(mqttBridge.ProcessMessage)
+		err = mqttBridge.Run()
+		if err != nil {
+			logger.Fatal("fatal error connecting to mqtt broker: %v", zap.Error(err))
+		}
+	}
+
+	// publish devices connecting and disconnecting
+	devSvr.OnPresence(msgHandler.ProcessPresence)
+
+	// start the servers listening
+	var servers sync.WaitGroup
+	for _, run := range []func(context.Context){devSvr.Run, wsSvr.Run, httpSvr.Run} {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			run(ctx)
+		}()
+	}
+
+	// handle messages and subscriptions, until the servers have stopped
+	intakeCtx, stopIntake := context.WithCancel(context.Background())
+	intakeDone := make(chan struct{})
 	go func() {
-		err = msgHandler.MsgIntake()
+		defer close(intakeDone)
+		err := msgHandler.MsgIntake(intakeCtx)
 		if err != nil {
 			logger.Fatal("fatal error in MessageHandler(): %v", zap.Error(err))
 		}
 	}()
+	go func() {
+		err := subHandler.SubIntake(intakeCtx)
+		if err != nil {
+			logger.Fatal("fatal error in SubsciptionHandler(): %v", zap.Error(err))
+		}
+	}()
 
-	// handle subscriptions
-	err = subHandler.SubIntake()
+	<-ctx.Done()
+	stop() // a second signal kills us
+	logger.Info("shutting down", zap.Duration("timeout", cfg.ShutdownTimeout))
+	err = runShutdown(logger, cfg.ShutdownTimeout,
+		shutdownStep{"servers", func() error {
+			servers.Wait()
+			return nil
+		}},
+		shutdownStep{"command senders", func() error {
+			senders.Wait()
+			return nil
+		}},
+		shutdownStep{"message intake", func() error {
+			stopIntake()
+			<-intakeDone
+			return nil
+		}},
+		shutdownStep{"message workers", func() error {
+			workers.Close()
+			return nil
+		}},
+		shutdownStep{"mqtt bridge", func() error {
+			if mqttBridge != nil {
+				mqttBridge.Close()
+			}
+			return nil
+		}},
+		shutdownStep{"background jobs", func() error {
+			stopJobs()
+			jobs.Wait()
+			return nil
+		}},
+		shutdownStep{"database writes", func() error {
+			stopWriter()
+			<-writerDone
+			return nil
+		}},
+		shutdownStep{"webhooks", func() error {
+			webhooks.Drain()
+			return nil
+		}},
+		shutdownStep{"database", func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			return dbc.Disconnect(ctx)
+		}},
+	)
 	if err != nil {
-		logger.Fatal("fatal error in SubsciptionHandler(): %v", zap.Error(err))
+		logger.Fatal("fatal error shutting down: %v", zap.Error(err))
 	}
+	logger.Info("shut down cleanly")
 }
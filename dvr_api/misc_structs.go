@@ -9,6 +9,15 @@ type ApiReq_WS struct {
 	Messages            []string `json:"messages"`
 	Subscriptions       []string `json:"subscriptions"`
 	GetConnectedDevices bool     `json:"getConnectedDevices"`
+	QueueIfOffline      bool     `json:"queueIfOffline"`  // queue messages for devices that aren't connected
+	QueueTtlSeconds     int      `json:"queueTtlSeconds"` // how long they stay queued, CMD_QUEUE_DEFAULT_TTL if not set
+	GetQueue            []string `json:"getQueue"`        // devices to list the queued commands of
+	CancelQueued        []string `json:"cancelQueued"`    // ids of queued commands to cancel
+
+	Commands []CommandRequest `json:"commands"` // structured commands, rendered and sent like messages
+
+	SubscriptionFilter     *DeviceFilter `json:"subscriptionFilter"`     // also subscribe to the devices in these groups/with these tags
+	ConnectedDevicesFilter *DeviceFilter `json:"connectedDevicesFilter"` // only list connected devices in these groups/with these tags
 }
 
 // used in ws_svr.go to send a websocket message containing all
@@ -16,6 +25,40 @@ type ApiRes_WS struct {
 	ConnectedDevicesList []string `json:"connectedDevicesList"`
 }
 
+// something the server worked out about a device, pushed to v2 websocket subscribers of that device
+type DeviceEvent struct {
+	Event    string    `json:"event"` // one of the EVENT_ constants, tells the client what's in Data
+	DeviceId string    `json:"deviceId"`
+	Time     time.Time `json:"time"`
+	Data     any       `json:"data"`
+}
+
+// a device connecting to or disconnecting from the device server
+type Presence_Response struct {
+	Connected bool `json:"connected"`
+}
+
+// types of DeviceEvent
+const (
+	EVENT_POSITION string = "position" // Data is a Position_Schema
+	EVENT_GEOFENCE string = "geofence" // Data is a GeofenceEvent_Schema
+	EVENT_ALERT    string = "alert"    // Data is an Alert_Schema
+	EVENT_PRESENCE string = "presence" // Data is a Presence_Response
+	EVENT_QUEUE    string = "queue"    // Data is a QueuedCommand_Schema
+	EVENT_VIDEO    string = "video"    // Data is a VideoJob_Schema
+	EVENT_TRIP     string = "trip"     // Data is a Trip_Schema
+)
+
+// used in ws_svr.go to say which of the commands sent were rejected
+type ApiCommandRes_WS struct {
+	CommandErrors []CommandError_Response `json:"commandErrors"`
+}
+
+// used in ws_svr.go to send the queued commands asked for with getQueue
+type ApiQueueRes_WS struct {
+	QueuedCommands []QueuedCommand_Schema `json:"queuedCommands"`
+}
+
 // used in ws_svr.go - use to convey subscription requests to the handler from the server
 type SubReqWrapper struct {
 	clientId   *string
@@ -25,36 +68,129 @@ type SubReqWrapper struct {
 
 // pass messages out of servers into handlers
 type MessageWrapper struct {
-	message   string    // text the tcp client sent
-	clientId  *string   // index which the message sender with in the connIndex of the server
-	recvdTime time.Time // recvd time
+	message   string        // text the tcp client sent
+	clientId  *string       // index which the message sender with in the connIndex of the server
+	recvdTime time.Time     // recvd time
+	direction MsgDirection  // whether the message is travelling to or from the device
+	queueTtl  time.Duration // if the device isn't connected queue the message for this long, 0 to not queue it
 }
 
 // Device schema for modelling in mongodb
 type Device_Schema struct {
-	DeviceId   string                 `bson:"device_id"`
-	MsgHistory []DeviceMessage_Schema `bson:"msg_history"`
+	DeviceId   string                 `bson:"DeviceId"`
+	MsgHistory []DeviceMessage_Schema `bson:"MsgHistory"`
 }
 
 // Device message schema for modelling in mongodb
 type DeviceMessage_Schema struct {
-	RecvdTime  time.Time `bson:"receivedTime"`
-	PacketTime time.Time `bson:"packetTime"`
-	Message    string    `bson:"message"`
-	Direction  string    `bson:"direction"`
+	RecvdTime  time.Time    `bson:"receivedTime"`
+	PacketTime time.Time    `bson:"packetTime"`
+	Message    string       `bson:"message"`
+	Direction  MsgDirection `bson:"direction"`
 }
 
 // use to represent a message we're sending to an API client
 type DeviceMessage_Response struct {
-	RecvdTime  time.Time `json:"receivedTime"`
-	PacketTime time.Time `json:"packetTime"`
-	Message    string    `json:"message"`
-	Direction  string    `json:"direction"`
+	RecvdTime  time.Time    `json:"receivedTime"`
+	PacketTime time.Time    `json:"packetTime"`
+	Message    string       `json:"message"`
+	Direction  MsgDirection `json:"direction"`
+}
+
+// use to represent the message history of one device we're sending to an API client
+type DeviceHistory_Response struct {
+	DeviceId   string                   `json:"DeviceId"`
+	MsgHistory []DeviceMessage_Response `json:"MsgHistory"`
+}
+
+// one message flattened into a row, used for the csv and ndjson history formats
+type MessageRow_Response struct {
+	DeviceId   string            `json:"deviceId"`
+	Direction  MsgDirection      `json:"direction"`
+	PacketTime time.Time         `json:"packetTime"`
+	RecvdTime  time.Time         `json:"receivedTime"`
+	Command    string            `json:"command"`
+	Message    string            `json:"message"`
+	Fields     map[string]string `json:"fields,omitempty"` // whatever we could parse out of the message
 }
 
 // struct we marshal a http request body, formatted in json, into.
 type ApiRequest_HTTP struct {
 	Devices []string  `bson:"devices"`
+	Groups  []string  `bson:"groups"` // devices in any of these groups are queried too
+	Tags    []string  `bson:"tags"`   // as are devices with all of these tags
 	Before  time.Time `bson:"before"`
 	After   time.Time `bson:"after"`
+	Trim    bool      `bson:"trim"` // only include the messages received in range, not each device's whole history
+}
+
+/*
+~~~~~~~~~~~~~~~
+MESSAGE DIRECTION
+~~~~~~~~~~~~~~~
+*/
+
+// which way a message travelled relative to the device
+type MsgDirection string
+
+const (
+	DirectionFromDevice MsgDirection = "fromDevice" // sent by the device
+	DirectionToDevice   MsgDirection = "toDevice"   // sent to the device by an api client
+)
+
+// spellings used before the direction values were unified. The db used the first pair,
+// the websocket api the second. v1 clients still get these.
+const (
+	legacyDbFromDevice MsgDirection = "from device"
+	legacyDbToDevice   MsgDirection = "to device"
+	legacyWsFromDevice MsgDirection = "from"
+	legacyWsToDevice   MsgDirection = "to"
+)
+
+// api versions. v1 is the api as it was before the direction values were unified.
+const (
+	API_V1     int = 1
+	API_V2     int = 2
+	API_LATEST int = API_V2
+)
+
+// map any spelling of a direction, legacy or not, onto the canonical value
+func (d MsgDirection) Normalise() MsgDirection {
+	switch d {
+	case DirectionFromDevice, legacyDbFromDevice, legacyWsFromDevice:
+		return DirectionFromDevice
+	case DirectionToDevice, legacyDbToDevice, legacyWsToDevice:
+		return DirectionToDevice
+	}
+	return d
+}
+
+// the value a http api client of the given version expects
+func (d MsgDirection) ForHttpVersion(version int) MsgDirection {
+	d = d.Normalise()
+	if version >= API_V2 {
+		return d
+	}
+	switch d {
+	case DirectionFromDevice:
+		return legacyDbFromDevice
+	case DirectionToDevice:
+		return legacyDbToDevice
+	}
+	return d
+}
+
+// the value a websocket api client of the given version expects
+func (d MsgDirection) ForWsVersion(version int) MsgDirection {
+	d = d.Normalise()
+	if version >= API_V2 {
+		return d
+	}
+	switch d {
+	case DirectionFromDevice:
+		return legacyWsFromDevice
+	case DirectionToDevice:
+		return legacyWsToDevice
+	}
+	return d
 }
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+// every spelling should map onto the canonical value
+func TestMsgDirection_Normalise(t *testing.T) {
+	cases := map[MsgDirection]MsgDirection{
+		"fromDevice":  DirectionFromDevice,
+		"from device": DirectionFromDevice,
+		"from":        DirectionFromDevice,
+		"toDevice":    DirectionToDevice,
+		"to device":   DirectionToDevice,
+		"to":          DirectionToDevice,
+	}
+	for in, want := range cases {
+		if got := in.Normalise(); got != want {
+			t.Errorf("MsgDirection(%q).Normalise() = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// v1 clients should keep getting the values they got before versioning
+func TestMsgDirection_ForVersion(t *testing.T) {
+	if got := DirectionFromDevice.ForHttpVersion(API_V1); got != "from device" {
+		t.Errorf("http v1 from device = %q", got)
+	}
+	if got := DirectionToDevice.ForHttpVersion(API_V1); got != "to device" {
+		t.Errorf("http v1 to device = %q", got)
+	}
+	if got := DirectionFromDevice.ForWsVersion(API_V1); got != "from" {
+		t.Errorf("ws v1 from device = %q", got)
+	}
+	if got := DirectionToDevice.ForWsVersion(API_V1); got != "to" {
+		t.Errorf("ws v1 to device = %q", got)
+	}
+	if got := MsgDirection("to device").ForWsVersion(API_V2); got != DirectionToDevice {
+		t.Errorf("ws v2 legacy to device = %q", got)
+	}
+	if got := MsgDirection("from").ForHttpVersion(API_LATEST); got != DirectionFromDevice {
+		t.Errorf("http latest legacy from = %q", got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+MQTT BRIDGE
+Optional. Mirrors every message from a device onto [prefix]/[DeviceID]/[command] as the same JSON the
+v2 websocket api sends, and takes commands for devices on [prefix]/[DeviceID]/cmd as the raw message
+text, the same as the websocket api's "messages" field. The outcome of each command is published to
+[prefix]/[DeviceID]/cmd/result.
+~~~~~~~~~~~~~~~
+*/
+
+// how long we wait on the broker before giving up on an operation
+const MQTT_TIMEOUT time.Duration = 10 * time.Second
+
+// this is meant for the function in the message handler that processes messages from api clients
+type ProcessMessageFunction func(*MessageWrapper) error
+
+// outcome of a command received over mqtt
+type MqttCmdResult_Response struct {
+	Message string `json:"message"`
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// relays device messages to, and commands from, an mqtt broker
+type MqttBridge struct {
+	// internal
+	client   mqtt.Client
+	prefix   string // first level of every topic
+	clientId string // our id with the broker, also used as the clientId of the commands we pass on
+
+	// injected
+	logger         *zap.Logger
+	processCommand ProcessMessageFunction // this func is meant to send a message to a device
+}
+
+// constructor, doesn't connect until Run
+func NewMqttBridge(logger *zap.Logger, brokerUrl string, prefix string, processCommand ProcessMessageFunction) (*MqttBridge, error) {
+	if strings.ContainsAny(prefix, "+#") || prefix == "" {
+		return nil, fmt.Errorf("invalid mqtt topic prefix: %q", prefix)
+	}
+	mb := &MqttBridge{
+		prefix:         strings.TrimSuffix(prefix, "/"),
+		clientId:       "dvr_api-" + uuid.New().String(),
+		logger:         logger,
+		processCommand: processCommand,
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerUrl).
+		SetClientID(mb.clientId).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(mb.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warn("lost connection to mqtt broker", zap.Error(err))
+		})
+	mb.client = mqtt.NewClient(opts)
+	return mb, nil
+}
+
+// connect to the broker, keeps retrying in the background if it isn't reachable
+func (mb *MqttBridge) Run() error {
+	token := mb.client.Connect()
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		mb.logger.Warn("mqtt broker not reachable yet, retrying in the background")
+		return nil
+	}
+	return token.Error()
+}
+
+// disconnect from the broker
+func (mb *MqttBridge) Close() {
+	mb.client.Disconnect(uint(MQTT_TIMEOUT / time.Millisecond))
+}
+
+// (re)subscribe to the command topic each time we connect, the broker forgets us in between
+func (mb *MqttBridge) onConnect(client mqtt.Client) {
+	mb.logger.Info("connected to mqtt broker")
+	token := client.Subscribe(mb.prefix+"/+/cmd", 1, mb.onCommand)
+	if token.WaitTimeout(MQTT_TIMEOUT) && token.Error() != nil {
+		mb.logger.Error("error subscribing to mqtt command topic", zap.Error(token.Error()))
+	}
+}
+
+// mirror a message from a device onto its topic, meant to be registered as a message hook
+func (mb *MqttBridge) ProcessMessage(msgWrap *MessageWrapper) error {
+	if !mb.client.IsConnectionOpen() {
+		return nil
+	}
+	command := getCommandFromMessage(msgWrap.message)
+	if command == "" || strings.ContainsAny(command, "+#/") {
+		return fmt.Errorf("can't publish message with command %q to mqtt", command)
+	}
+	packetTime, _ := getDateFromMessage(msgWrap.message)
+	payload, err := json.Marshal(&DeviceMessage_Response{msgWrap.recvdTime, packetTime, msgWrap.message, msgWrap.direction.ForWsVersion(API_LATEST)})
+	if err != nil {
+		return err
+	}
+	// don't wait for the broker, the message handler has other messages to get on with
+	mb.client.Publish(fmt.Sprintf("%v/%v/%v", mb.prefix, *msgWrap.clientId, command), 0, false, payload)
+	return nil
+}
+
+// a command for a device arrived
+func (mb *MqttBridge) onCommand(client mqtt.Client, m mqtt.Message) {
+	// topic is [prefix]/[DeviceID]/cmd
+	levels := strings.Split(strings.TrimPrefix(m.Topic(), mb.prefix+"/"), "/")
+	if len(levels) != 2 {
+		return
+	}
+	devId := levels[0]
+	message := string(m.Payload())
+
+	result := MqttCmdResult_Response{Message: message, Ok: true}
+	err := mb.routeCommand(devId, message)
+	if err != nil {
+		result.Ok = false
+		result.Error = err.Error()
+		mb.logger.Debug("error processing mqtt command", zap.String("devId", devId), zap.Error(err))
+	}
+	payload, _ := json.Marshal(&result)
+	client.Publish(fmt.Sprintf("%v/%v/cmd/result", mb.prefix, devId), 1, false, payload)
+}
+
+// check a command is for the device whose topic it came in on and pass it on
+func (mb *MqttBridge) routeCommand(devId string, message string) error {
+	var msgDevId string
+	err := getIdFromMessage(&message, &msgDevId)
+	if err != nil {
+		return fmt.Errorf("couldn't parse device id from %v", message)
+	}
+	if msgDevId != devId {
+		return fmt.Errorf("command for device %v sent on the topic of device %v", msgDevId, devId)
+	}
+	return mb.processCommand(&MessageWrapper{message, &mb.clientId, time.Now(), DirectionToDevice, 0})
+}
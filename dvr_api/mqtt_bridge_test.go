@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"go.uber.org/zap"
+)
+
+// start an embedded broker on a free port, returns its url
+func startTestBroker(t *testing.T) string {
+	broker := mochi.New(nil)
+	err := broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatalf("adding broker auth hook: %v", err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	err = broker.AddListener(tcp)
+	if err != nil {
+		t.Fatalf("adding broker listener: %v", err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() { broker.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+// connect a plain client to the broker, as an mqtt integration would
+func connectTestClient(t *testing.T, url string) mqtt.Client {
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(url).SetClientID("test-client"))
+	token := client.Connect()
+	if !token.WaitTimeout(MQTT_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("connecting test client: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+func TestMqttBridge(t *testing.T) {
+	url := startTestBroker(t)
+
+	// commands the bridge passes on
+	var lock sync.Mutex
+	commands := make([]string, 0)
+	bridge, err := NewMqttBridge(zap.NewNop(), url, "dvr", func(msgWrap *MessageWrapper) error {
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, msgWrap.message)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewMqttBridge: %v", err)
+	}
+	if err := bridge.Run(); err != nil {
+		t.Fatalf("bridge.Run: %v", err)
+	}
+	defer bridge.Close()
+
+	// everything published for the device
+	client := connectTestClient(t, url)
+	received := make(chan mqtt.Message, 10)
+	token := client.Subscribe("dvr/123456/#", 1, func(_ mqtt.Client, m mqtt.Message) { received <- m })
+	if !token.WaitTimeout(MQTT_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("subscribing test client: %v", token.Error())
+	}
+	next := func() mqtt.Message {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(MQTT_TIMEOUT):
+			t.Fatal("timed out waiting for mqtt message")
+			return nil
+		}
+	}
+
+	// device message mirrored onto dvr/[DeviceID]/[command]
+	devId := "123456"
+	err = bridge.ProcessMessage(&MessageWrapper{"$GPS;123456;20240817-123504;A;51.5;-0.12;0;0;9\r", &devId, time.Now(), DirectionFromDevice, 0})
+	if err != nil {
+		t.Fatalf("ProcessMessage: %v", err)
+	}
+	m := next()
+	var res DeviceMessage_Response
+	if m.Topic() != "dvr/123456/GPS" || json.Unmarshal(m.Payload(), &res) != nil || res.Direction != DirectionFromDevice {
+		t.Errorf("unexpected mirrored message on %v: %s", m.Topic(), m.Payload())
+	}
+
+	// command passed on and the outcome published
+	client.Publish("dvr/123456/cmd", 1, false, "$VIDEO;123456;all;4;20231003-164514;5")
+	for m = next(); m.Topic() == "dvr/123456/cmd"; m = next() {
+	}
+	var result MqttCmdResult_Response
+	if m.Topic() != "dvr/123456/cmd/result" || json.Unmarshal(m.Payload(), &result) != nil || !result.Ok {
+		t.Errorf("unexpected command result on %v: %s", m.Topic(), m.Payload())
+	}
+	lock.Lock()
+	if len(commands) != 1 || commands[0] != "$VIDEO;123456;all;4;20231003-164514;5" {
+		t.Errorf("unexpected commands passed on: %v", commands)
+	}
+	lock.Unlock()
+
+	// command for a different device than the topic is rejected
+	client.Publish("dvr/123456/cmd", 1, false, "$VIDEO;654321;all;4;20231003-164514;5")
+	for m = next(); m.Topic() == "dvr/123456/cmd"; m = next() {
+	}
+	result = MqttCmdResult_Response{}
+	if json.Unmarshal(m.Payload(), &result) != nil || result.Ok {
+		t.Errorf("mismatched command should have failed: %s", m.Payload())
+	}
+	lock.Lock()
+	if len(commands) != 1 {
+		t.Errorf("mismatched command shouldn't have been passed on: %v", commands)
+	}
+	lock.Unlock()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -10,62 +12,198 @@ import (
 // this is meant for the publish function in the sub handler.
 type PublishFunction func(*MessageWrapper) error
 
+// this is meant for the publish event function in the sub handler.
+type PublishEventFunction func(*DeviceEvent) error
+
+// combine publish event functions into one that calls each of them in turn, even if one fails
+func publishToAll(fns ...PublishEventFunction) PublishEventFunction {
+	return func(event *DeviceEvent) error {
+		var firstErr error
+		for _, fn := range fns {
+			err := fn(event)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+// called with each position parsed out of the messages from devices
+type PositionHookFunction func(*Position_Schema) error
+
+// called with each message from a device
+type MessageHookFunction func(*MessageWrapper) error
+
 // record and index connected devices and clients
 type MessageHandler struct {
 	// internal
-	lock sync.Mutex // might be uneccessary
+	lock          sync.Mutex             // might be uneccessary
+	positionHooks []PositionHookFunction // run on each position after it's recorded and published
+	messageHooks  []MessageHookFunction  // run on each message from a device after it's recorded and published
+	sendHooks     []MessageHookFunction  // run on each message after it's written to its device
+	queueCommand  ProcessMessageFunction // queues messages for devices that aren't connected, nil if there's no queue
+	writer        *WriteBehind           // batches database writes, nil to write each one as it comes
+	workers       *MsgWorkerPool         // processes messages per device in parallel, nil to process them in MsgIntake
 
 	// injected
-	logger  *zap.Logger
-	devices *DeviceSvr      // dev svr
-	clients *WebSockSvr     // api svr
-	dbc     *DBConnection   // mongodb database connection
-	publish PublishFunction // this func is meant to publish a message to subscribers
+	logger       *zap.Logger
+	devices      *DeviceSvr           // dev svr
+	clients      *WebSockSvr          // api svr
+	dbc          *DBConnection        // mongodb database connection
+	publish      PublishFunction      // this func is meant to publish a message to subscribers
+	publishEvent PublishEventFunction // this func is meant to publish an event about a device to subscribers
 }
 
 // constructor
-func NewMessageHandler(logger *zap.Logger, devices *DeviceSvr, clients *WebSockSvr, dbc *DBConnection, publish PublishFunction) (*MessageHandler, error) {
+func NewMessageHandler(logger *zap.Logger, devices *DeviceSvr, clients *WebSockSvr, dbc *DBConnection, publish PublishFunction, publishEvent PublishEventFunction) (*MessageHandler, error) {
 	r := &MessageHandler{
-		logger:  logger,
-		devices: devices,
-		clients: clients,
-		dbc:     dbc,
-		publish: publish,
+		logger:       logger,
+		devices:      devices,
+		clients:      clients,
+		dbc:          dbc,
+		publish:      publish,
+		publishEvent: publishEvent,
 	}
 	return r, nil
 }
 
-// take messages from servers, handle, first step
-func (mh *MessageHandler) MsgIntake() error {
+// register a function to run on each position. Call before MsgIntake.
+func (mh *MessageHandler) OnPosition(hook PositionHookFunction) {
+	mh.positionHooks = append(mh.positionHooks, hook)
+}
+
+// register a function to run on each message from a device. Call before MsgIntake.
+func (mh *MessageHandler) OnMessage(hook MessageHookFunction) {
+	mh.messageHooks = append(mh.messageHooks, hook)
+}
+
+// register a function to run on each message written to a device, from any goroutine. Call before MsgIntake.
+func (mh *MessageHandler) OnSend(hook MessageHookFunction) {
+	mh.sendHooks = append(mh.sendHooks, hook)
+}
+
+// queue messages that ask to be queued when their device isn't connected. Call before MsgIntake.
+func (mh *MessageHandler) SetCommandQueue(queueCommand ProcessMessageFunction) {
+	mh.queueCommand = queueCommand
+}
+
+// record messages and positions through the writer instead of one at a time. Call before MsgIntake.
+func (mh *MessageHandler) SetWriteBehind(writer *WriteBehind) {
+	mh.writer = writer
+}
+
+// process messages on a pool of workers instead of one at a time. Call before MsgIntake.
+func (mh *MessageHandler) SetWorkers(workers *MsgWorkerPool) {
+	mh.workers = workers
+}
+
+// process a message on its device's worker, or here and now without workers
+func (mh *MessageHandler) dispatch(devId string, msgWrap *MessageWrapper, process ProcessMessageFunction) error {
+	if mh.workers != nil {
+		return mh.workers.Dispatch(devId, msgWrap, process)
+	}
+	return process(msgWrap)
+}
+
+// send a command for a device from outside the intake, e.g. the scheduler or the mqtt bridge. It goes
+// through the device's worker so it's in order with the other commands for it, and this waits for it
+// to be processed. Don't call it from a worker, it'd be waiting on itself.
+func (mh *MessageHandler) SendCommand(msgWrap *MessageWrapper) error {
+	var devId string
+	if getIdFromMessage(&msgWrap.message, &devId) != nil {
+		devId = *msgWrap.clientId
+	}
+	done := make(chan error, 1)
+	err := mh.dispatch(devId, msgWrap, func(msgWrap *MessageWrapper) error {
+		err := mh.ProcessMsgFromApiClient(msgWrap)
+		done <- err
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// record a message, queued if there's a writer
+func (mh *MessageHandler) recordMessage(msgWrap *MessageWrapper) error {
+	if mh.writer != nil {
+		return mh.writer.RecordMessage(msgWrap)
+	}
+	_, err := mh.dbc.RecordMessage_ToFromDevice(msgWrap) // MatchedCount, ModifiedCount, UpsertedCount
+	return err
+}
+
+// record a position, queued if there's a writer
+func (mh *MessageHandler) recordPosition(pos *Position_Schema) error {
+	if mh.writer != nil {
+		return mh.writer.RecordPosition(pos)
+	}
+	return mh.dbc.RecordPosition(pos)
+}
+
+// take messages from servers, handle, first step. Once the context is done, and the servers have
+// stopped, what's left on their queues is handled before returning.
+func (mh *MessageHandler) MsgIntake(ctx context.Context) error {
 	// handle messages, main program loop
 	for i := 0; ; i++ {
 		select {
 		// process one message received from the device server
-		case msgWrap, ok := <-mh.devices.svrMsgBufChan:
+		case msgWrap, ok := <-mh.devices.svrMsgQueue.Out():
 			if ok {
-				mh.logger.Info("Processing message", zap.String("msgWrap.message", msgWrap.message), zap.String("*msgWrap.clientId", *msgWrap.clientId))
-				err := mh.ProcessMsgFromDevice(&msgWrap)
-				if err != nil {
-					mh.logger.Error("error processing message from device", zap.Error(err))
-				}
+				mh.intakeFromDevice(&msgWrap)
 			} else {
 				mh.logger.Error("Couldn't receive value from devMsgChan")
 			}
 		// process one message received from the API server
-		case msgWrap, ok := <-mh.clients.svrMsgBufChan:
+		case msgWrap, ok := <-mh.clients.svrMsgQueue.Out():
 			if ok {
-				mh.logger.Info("Processing message", zap.String("msgWrap.message", msgWrap.message), zap.String("*msgWrap.clientId", *msgWrap.clientId))
-				err := mh.ProcessMsgFromApiClient(&msgWrap)
-				if err != nil {
-					mh.logger.Error("error processing message from api client", zap.Error(err))
-				}
+				mh.intakeFromApiClient(&msgWrap)
 			} else {
 				mh.logger.Error("Couldn't receive value from apiMsgChan")
 			}
+		// drain the queues and stop
+		case <-ctx.Done():
+			for {
+				select {
+				case msgWrap := <-mh.devices.svrMsgQueue.Out():
+					mh.intakeFromDevice(&msgWrap)
+				case msgWrap := <-mh.clients.svrMsgQueue.Out():
+					mh.intakeFromApiClient(&msgWrap)
+				default:
+					return nil
+				}
+			}
 		}
 	}
 }
 
+// hand one message taken from the device server's queue to its worker
+func (mh *MessageHandler) intakeFromDevice(msgWrap *MessageWrapper) {
+	mh.devices.svrMsgQueue.Taken(msgWrap)
+	mh.logger.Info("Processing message", zap.String("msgWrap.message", msgWrap.message), zap.String("*msgWrap.clientId", *msgWrap.clientId))
+	err := mh.dispatch(*msgWrap.clientId, msgWrap, mh.ProcessMsgFromDevice)
+	if err != nil {
+		mh.logger.Error("error processing message from device", zap.Error(err))
+	}
+}
+
+// hand one message taken from the API server's queue to its device's worker
+func (mh *MessageHandler) intakeFromApiClient(msgWrap *MessageWrapper) {
+	mh.clients.svrMsgQueue.Taken(msgWrap)
+	mh.logger.Info("Processing message", zap.String("msgWrap.message", msgWrap.message), zap.String("*msgWrap.clientId", *msgWrap.clientId))
+	// commands go to the worker of the device they're for, so they're in order with what it sends
+	var devId string
+	if getIdFromMessage(&msgWrap.message, &devId) != nil {
+		devId = *msgWrap.clientId
+	}
+	err := mh.dispatch(devId, msgWrap, mh.ProcessMsgFromApiClient)
+	if err != nil {
+		mh.logger.Error("error processing message from api client", zap.Error(err))
+	}
+}
+
 // handle one message from an api client
 func (mh *MessageHandler) ProcessMsgFromApiClient(msgWrap *MessageWrapper) error {
 
@@ -76,10 +214,27 @@ func (mh *MessageHandler) ProcessMsgFromApiClient(msgWrap *MessageWrapper) error
 		return fmt.Errorf("couldn't parse device id from %v", msgWrap.message)
 	}
 
+	// queue it for later if the device isn't connected and the client asked us to
+	if !mh.devices.IsConnected(dev_id) && msgWrap.queueTtl > 0 && mh.queueCommand != nil {
+		return mh.queueCommand(msgWrap)
+	}
+	return mh.SendToDevice(msgWrap)
+}
+
+// write a message to its device and record it. Only errors if the message wasn't sent.
+func (mh *MessageHandler) SendToDevice(msgWrap *MessageWrapper) error {
+
+	// extract the device the message pertains to
+	var dev_id string
+	err := getIdFromMessage(&msgWrap.message, &dev_id)
+	if err != nil {
+		return fmt.Errorf("couldn't parse device id from %v", msgWrap.message)
+	}
+
 	// verify device connection, get the connection object
 	devConn, devConnOk := mh.devices.connIndex.Get(dev_id)
 	if !devConnOk {
-		return fmt.Errorf("message sent for device not connected: %v", err)
+		return fmt.Errorf("message sent for device not connected: %v", dev_id)
 	}
 
 	// send the requested message to the device
@@ -88,10 +243,18 @@ func (mh *MessageHandler) ProcessMsgFromApiClient(msgWrap *MessageWrapper) error
 		return fmt.Errorf("error writing to device connection: %v", err)
 	}
 
-	// record message in database
-	_, err = mh.dbc.RecordMessage_ToFromDevice(false, msgWrap) // MatchedCount, ModifiedCount, UpsertedCount
+	// record message in database. It's gone to the device, so this failing doesn't fail the send.
+	err = mh.recordMessage(msgWrap)
 	if err != nil {
-		return fmt.Errorf("error recording message in db: %v", err)
+		mh.logger.Error("error recording message in db", zap.Error(err))
+	}
+
+	// same goes for the hooks
+	for _, hook := range mh.sendHooks {
+		err = hook(msgWrap)
+		if err != nil {
+			mh.logger.Error("error in send hook", zap.Error(err))
+		}
 	}
 
 	// no err
@@ -102,7 +265,7 @@ func (mh *MessageHandler) ProcessMsgFromApiClient(msgWrap *MessageWrapper) error
 func (mh *MessageHandler) ProcessMsgFromDevice(msgWrap *MessageWrapper) error {
 
 	// record message in database
-	_, err := mh.dbc.RecordMessage_ToFromDevice(true, msgWrap) // MatchedCount, ModifiedCount, UpsertedCount
+	err := mh.recordMessage(msgWrap)
 	if err != nil {
 		return fmt.Errorf("error recording message in db: %v", err)
 	}
@@ -113,6 +276,59 @@ func (mh *MessageHandler) ProcessMsgFromDevice(msgWrap *MessageWrapper) error {
 		return fmt.Errorf("error publishing message: %v", err)
 	}
 
+	// let anything else that works off messages have a look. One failing shouldn't stop the others.
+	for _, hook := range mh.messageHooks {
+		err = hook(msgWrap)
+		if err != nil {
+			mh.logger.Error("error in message hook", zap.Error(err))
+		}
+	}
+
+	// gps messages also get stored and published as a position
+	if isGpsMessage(msgWrap.message) {
+		err = mh.processPosition(msgWrap)
+		if err != nil {
+			return fmt.Errorf("error processing gps message: %v", err)
+		}
+	}
+
 	// no err
 	return nil
 }
+
+// parse a gps message, record and publish the position
+func (mh *MessageHandler) processPosition(msgWrap *MessageWrapper) error {
+	pos, err := parseGpsMessage(msgWrap.message, msgWrap.recvdTime)
+	if err != nil {
+		return err
+	}
+
+	// record position in database
+	err = mh.recordPosition(pos)
+	if err != nil {
+		return fmt.Errorf("error recording position in db: %v", err)
+	}
+
+	// publish the position
+	err = mh.publishEvent(&DeviceEvent{EVENT_POSITION, pos.DeviceId, pos.FixTime, pos})
+	if err != nil {
+		return fmt.Errorf("error publishing position: %v", err)
+	}
+
+	// let anything else that works off positions have a look. One failing shouldn't stop the others.
+	for _, hook := range mh.positionHooks {
+		err = hook(pos)
+		if err != nil {
+			mh.logger.Error("error in position hook", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// publish a device connecting or disconnecting, meant to be registered as a presence hook
+func (mh *MessageHandler) ProcessPresence(devId string, connected bool, t time.Time) {
+	err := mh.publishEvent(&DeviceEvent{EVENT_PRESENCE, devId, t, &Presence_Response{connected}})
+	if err != nil {
+		mh.logger.Error("error publishing presence", zap.Error(err))
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+~~~~~~~~~~~~~~~
+MESSAGE QUEUES
+The bounded queue between a server's connections and the message handler. Every connection, a device
+or an API client, is a source, and a source can only have its share of the queue waiting at once, so
+a burst from one device can't fill the queue and stall reads from the rest. What happens to a source
+that's used its share, or finds the queue full, is the overload policy:
+	block - the connection stops reading until there's room
+	drop - the message is dropped
+	disconnect - the connection is closed
+Each source's messages are counted while it's connected.
+~~~~~~~~~~~~~~~
+*/
+
+type OverloadPolicy string
+
+const (
+	OVERLOAD_BLOCK      OverloadPolicy = "block"
+	OVERLOAD_DROP       OverloadPolicy = "drop"
+	OVERLOAD_DISCONNECT OverloadPolicy = "disconnect"
+)
+
+const (
+	MSG_QUEUE_SOURCE_SHARE int = 4  // a source can have at most 1/this of the queue waiting
+	MSG_QUEUE_TOP_SOURCES  int = 20 // sources in the status by default
+)
+
+var (
+	errMsgDropped       = errors.New("message queue overloaded, message dropped")
+	errSourceOverloaded = errors.New("message queue overloaded, disconnecting")
+)
+
+// is it a policy we know
+func (p OverloadPolicy) Valid() bool {
+	return p == OVERLOAD_BLOCK || p == OVERLOAD_DROP || p == OVERLOAD_DISCONNECT
+}
+
+// what one connection has put on the queue
+type queueSource struct {
+	waiting   int
+	queued    int64
+	dropped   int64
+	blocked   int64
+	connected time.Time
+	gone      bool // disconnected, forgotten once what it has waiting is taken
+}
+
+// how one source is getting on, sent to API clients
+type QueueSource_Response struct {
+	Source    string    `json:"source"`
+	Waiting   int       `json:"waiting"`
+	Queued    int64     `json:"queued"`
+	Dropped   int64     `json:"dropped"`
+	Blocked   int64     `json:"blocked"` // times it had to wait for room
+	Connected time.Time `json:"connected"`
+}
+
+// how a queue is getting on, sent to API clients
+type MsgQueueStats_Response struct {
+	Name         string                 `json:"name"`
+	Policy       OverloadPolicy         `json:"policy"`
+	Capacity     int                    `json:"capacity"`
+	SourceLimit  int                    `json:"sourceLimit"` // most one source can have waiting
+	Depth        int                    `json:"depth"`
+	Sources      int                    `json:"sources"`
+	Queued       int64                  `json:"queued"`
+	Dropped      int64                  `json:"dropped"`
+	Blocked      int64                  `json:"blocked"`
+	Disconnected int64                  `json:"disconnected"`
+	TopSources   []QueueSource_Response `json:"topSources"` // busiest first
+}
+
+// bounded queue of messages with per source limits
+type MsgQueue struct {
+	// internal
+	ch           chan MessageWrapper
+	sources      map[string]*queueSource
+	sourceLimit  int
+	queued       int64
+	dropped      int64
+	blocked      int64
+	disconnected int64
+	lock         sync.Mutex
+	hasRoom      *sync.Cond // signalled when a message is taken
+
+	// injected
+	name   string
+	policy OverloadPolicy
+}
+
+// constructor
+func NewMsgQueue(name string, size int, policy OverloadPolicy) (*MsgQueue, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("%v queue size must be at least 1, got %v", name, size)
+	}
+	if !policy.Valid() {
+		return nil, fmt.Errorf("unknown overload policy %q, expected block, drop or disconnect", policy)
+	}
+	q := &MsgQueue{
+		ch:          make(chan MessageWrapper, size),
+		sources:     make(map[string]*queueSource),
+		sourceLimit: max(1, size/MSG_QUEUE_SOURCE_SHARE),
+		name:        name,
+		policy:      policy,
+	}
+	q.hasRoom = sync.NewCond(&q.lock)
+	return q, nil
+}
+
+// start counting a connection's messages
+func (q *MsgQueue) Connect(source string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	src, ok := q.sources[source]
+	if !ok {
+		q.sources[source] = &queueSource{connected: time.Now()}
+		return
+	}
+	// back before what it sent last time was taken, that still counts against it
+	if src.gone {
+		src.gone = false
+		src.connected = time.Now()
+	}
+}
+
+// stop counting a connection's messages. What it has waiting is still delivered, the source is kept
+// until it has been so Taken doesn't count it against a new connection from the same source.
+func (q *MsgQueue) Disconnect(source string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	src, ok := q.sources[source]
+	if !ok {
+		return
+	}
+	if src.waiting == 0 {
+		delete(q.sources, source)
+		return
+	}
+	src.gone = true
+}
+
+// the source's counts, adding it if it isn't connected. Lock must be held.
+func (q *MsgQueue) source(source string) *queueSource {
+	src, ok := q.sources[source]
+	if !ok {
+		src = &queueSource{connected: time.Now()}
+		q.sources[source] = src
+	}
+	return src
+}
+
+// queue a message from a source. Errors with errMsgDropped if it was dropped, or errSourceOverloaded
+// if the source should be disconnected.
+func (q *MsgQueue) Push(source string, msgWrap MessageWrapper) error {
+	q.lock.Lock()
+	src := q.source(source)
+	if src.waiting >= q.sourceLimit || len(q.ch) == cap(q.ch) {
+		switch q.policy {
+		case OVERLOAD_DROP:
+			src.dropped++
+			q.dropped++
+			q.lock.Unlock()
+			return errMsgDropped
+		case OVERLOAD_DISCONNECT:
+			src.dropped++
+			q.dropped++
+			q.disconnected++
+			q.lock.Unlock()
+			return errSourceOverloaded
+		}
+		src.blocked++
+		q.blocked++
+		for src.waiting >= q.sourceLimit {
+			q.hasRoom.Wait()
+		}
+	}
+	src.waiting++
+	src.queued++
+	q.queued++
+	q.lock.Unlock()
+
+	// only blocks if every source is using its share at once
+	q.ch <- msgWrap
+	return nil
+}
+
+// the messages to take, pass each to Taken
+func (q *MsgQueue) Out() <-chan MessageWrapper {
+	return q.ch
+}
+
+// call with each message taken off Out, so its source has room for another
+func (q *MsgQueue) Taken(msgWrap *MessageWrapper) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if src, ok := q.sources[*msgWrap.clientId]; ok && src.waiting > 0 {
+		src.waiting--
+		if src.gone && src.waiting == 0 {
+			delete(q.sources, *msgWrap.clientId)
+		}
+	}
+	q.hasRoom.Broadcast()
+}
+
+// how the queue is getting on, with up to top of the busiest sources
+func (q *MsgQueue) Stats(top int) MsgQueueStats_Response {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := MsgQueueStats_Response{
+		Name:         q.name,
+		Policy:       q.policy,
+		Capacity:     cap(q.ch),
+		SourceLimit:  q.sourceLimit,
+		Depth:        len(q.ch),
+		Queued:       q.queued,
+		Dropped:      q.dropped,
+		Blocked:      q.blocked,
+		Disconnected: q.disconnected,
+		TopSources:   make([]QueueSource_Response, 0, len(q.sources)),
+	}
+	for id, src := range q.sources {
+		// disconnected ones are only kept to count down what they left
+		if src.gone {
+			continue
+		}
+		stats.Sources++
+		stats.TopSources = append(stats.TopSources, QueueSource_Response{id, src.waiting, src.queued, src.dropped, src.blocked, src.connected})
+	}
+	// the ones being held back first, then the most messages
+	sort.Slice(stats.TopSources, func(i, j int) bool {
+		a, b := stats.TopSources[i], stats.TopSources[j]
+		if a.Dropped+a.Blocked != b.Dropped+b.Blocked {
+			return a.Dropped+a.Blocked > b.Dropped+b.Blocked
+		}
+		if a.Queued != b.Queued {
+			return a.Queued > b.Queued
+		}
+		return a.Source < b.Source
+	})
+	if len(stats.TopSources) > top {
+		stats.TopSources = stats.TopSources[:top]
+	}
+	return stats
+}
+
+// register the API routes for the queues
+func RegisterQueueRoutes(svr *httpSvr, queues ...*MsgQueue) {
+	svr.HandleFunc("GET /queues/status", func(w http.ResponseWriter, r *http.Request) {
+		top := MSG_QUEUE_TOP_SOURCES
+		if s := r.URL.Query().Get("top"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "top must be a whole number")
+				return
+			}
+			top = n
+		}
+		res := make([]MsgQueueStats_Response, len(queues))
+		for i, q := range queues {
+			res[i] = q.Stats(top)
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
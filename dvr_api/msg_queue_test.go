@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func queueMsg(source *string) MessageWrapper {
+	return MessageWrapper{"$GPS;" + *source, source, time.Now(), DirectionFromDevice, 0}
+}
+
+func TestMsgQueue_Drop(t *testing.T) {
+	if _, err := NewMsgQueue("devices", 8, "sometimes"); err == nil {
+		t.Errorf("expected an unknown policy to be refused")
+	}
+	q, err := NewMsgQueue("devices", 8, OVERLOAD_DROP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noisy, quiet := "123", "456"
+	q.Connect(noisy)
+	q.Connect(quiet)
+
+	// the noisy device only gets its share, the quiet one still gets in
+	for i := 0; i < 5; i++ {
+		err := q.Push(noisy, queueMsg(&noisy))
+		if (i < 2) != (err == nil) {
+			t.Errorf("push %v: expected the first 2 in and the rest dropped, got %v", i, err)
+		}
+	}
+	if err := q.Push(quiet, queueMsg(&quiet)); err != nil {
+		t.Errorf("expected the quiet device's message to get in, got %v", err)
+	}
+
+	// taking one frees up room
+	msgWrap := <-q.Out()
+	q.Taken(&msgWrap)
+	if err := q.Push(noisy, queueMsg(&noisy)); err != nil {
+		t.Errorf("expected room once a message was taken, got %v", err)
+	}
+
+	stats := q.Stats(1)
+	if stats.Depth != 3 || stats.Queued != 4 || stats.Dropped != 3 || stats.SourceLimit != 2 || stats.Sources != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if len(stats.TopSources) != 1 || stats.TopSources[0].Source != noisy || stats.TopSources[0].Waiting != 2 || stats.TopSources[0].Dropped != 3 {
+		t.Errorf("expected the noisy device first, got %+v", stats.TopSources)
+	}
+	q.Disconnect(noisy)
+	if q.Stats(10).Sources != 1 {
+		t.Errorf("expected the disconnected device to be forgotten")
+	}
+}
+
+func TestMsgQueue_Disconnect(t *testing.T) {
+	q, _ := NewMsgQueue("devices", 4, OVERLOAD_DISCONNECT)
+	devId := "123"
+	if err := q.Push(devId, queueMsg(&devId)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(devId, queueMsg(&devId)); err != errSourceOverloaded {
+		t.Errorf("expected the device to be disconnected, got %v", err)
+	}
+	if q.Stats(10).Disconnected != 1 {
+		t.Errorf("expected the disconnect to be counted")
+	}
+}
+
+func TestMsgQueue_Block(t *testing.T) {
+	q, _ := NewMsgQueue("devices", 4, OVERLOAD_BLOCK)
+	devId := "123"
+	q.Push(devId, queueMsg(&devId))
+
+	done := make(chan error)
+	go func() {
+		done <- q.Push(devId, queueMsg(&devId))
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the push to wait for the device's share to free up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	msgWrap := <-q.Out()
+	q.Taken(&msgWrap)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the push to go in, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the push to carry on once there's room")
+	}
+	if stats := q.Stats(10); stats.Blocked != 1 || stats.Queued != 2 || stats.Depth != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMsgQueue_Reconnect(t *testing.T) {
+	q, _ := NewMsgQueue("devices", 8, OVERLOAD_DROP)
+	devId := "123"
+	q.Connect(devId)
+	q.Push(devId, queueMsg(&devId))
+	q.Push(devId, queueMsg(&devId))
+
+	// back before what it sent is taken, so that still counts against its share
+	q.Disconnect(devId)
+	q.Connect(devId)
+	if err := q.Push(devId, queueMsg(&devId)); err != errMsgDropped {
+		t.Errorf("expected the device to still be at its limit, got %v", err)
+	}
+	msgWrap := <-q.Out()
+	q.Taken(&msgWrap)
+	if err := q.Push(devId, queueMsg(&devId)); err != nil {
+		t.Errorf("expected room once one was taken, got %v", err)
+	}
+	if err := q.Push(devId, queueMsg(&devId)); err != errMsgDropped {
+		t.Errorf("expected the device to be back at its limit, got %v", err)
+	}
+
+	// gone for good, it's forgotten once the last is taken
+	q.Disconnect(devId)
+	for i := 0; i < 2; i++ {
+		msgWrap := <-q.Out()
+		q.Taken(&msgWrap)
+	}
+	if len(q.sources) != 0 {
+		t.Errorf("expected the source to be forgotten, got %v", len(q.sources))
+	}
+}
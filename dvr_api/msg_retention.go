@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+MESSAGE RETENTION
+Prunes message history by message type, the command without the '$', e.g. GPS for $GPS messages.
+Each type has a maximum age, with "*" covering every type without its own. Messages live in an
+array on each device's document so TTL indexes can't reach them, instead a background job pulls the
+old ones out. The GPS age applies to the positions parsed out of GPS messages as well. A dry run
+counts what would go without deleting anything.
+~~~~~~~~~~~~~~~
+*/
+
+// the type that covers every message type without its own age
+const MSG_RETENTION_DEFAULT_TYPE string = "*"
+
+// how often the background job runs
+const MSG_RETENTION_INTERVAL time.Duration = time.Hour
+
+// what to prune in one go: messages of a type received before a time
+type MessagePrune struct {
+	Type   string    // MSG_RETENTION_DEFAULT_TYPE for every type not in Except
+	Except []string  // only used with the default type
+	Before time.Time // messages received before this go
+}
+
+// how many of one type were, or would be, pruned
+type PruneResult_Schema struct {
+	Type   string    `bson:"type" json:"type"`
+	Before time.Time `bson:"before" json:"before"`
+	Count  int64     `bson:"count" json:"count"`
+	Error  string    `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// one run of the pruning job, stored in mongodb and sent to API clients
+type PruneRun_Schema struct {
+	Id        string               `bson:"_id" json:"id"`
+	Time      time.Time            `bson:"time" json:"time"`
+	DryRun    bool                 `bson:"dryRun" json:"dryRun"`
+	Messages  []PruneResult_Schema `bson:"messages" json:"messages"`
+	Positions *PruneResult_Schema  `bson:"positions,omitempty" json:"positions,omitempty"`
+}
+
+// a retention rule, sent to API clients
+type RetentionRule_Response struct {
+	Type    string  `json:"type"`
+	MaxDays float64 `json:"maxDays"` // 0 keeps them forever
+}
+
+// the retention policy and the last run, sent to API clients
+type MessageRetention_Response struct {
+	Rules   []RetentionRule_Response `json:"rules"`
+	DryRun  bool                     `json:"dryRun"` // the background job only reports
+	LastRun *PruneRun_Schema         `json:"lastRun"`
+}
+
+// where messages are pruned and runs are kept, the DBConnection outside of tests
+type MessageRetentionStore interface {
+	PruneMessages(p *MessagePrune, dryRun bool) (int64, error)
+	PrunePositions(before time.Time, dryRun bool) (int64, error)
+	RecordPruneRun(run *PruneRun_Schema) error
+	QueryPruneRuns(after time.Time, before time.Time) ([]PruneRun_Schema, error)
+}
+
+// prunes message history
+type MessageRetention struct {
+	// internal
+	lastRun *PruneRun_Schema
+	lock    sync.Mutex // for lastRun
+	runLock sync.Mutex // one run at a time
+
+	// injected
+	logger *zap.Logger
+	store  MessageRetentionStore
+	rules  map[string]time.Duration // message type against how long to keep it, 0 for forever
+	dryRun bool                     // only report from the background job
+}
+
+// constructor
+func NewMessageRetention(logger *zap.Logger, store MessageRetentionStore, rules map[string]time.Duration, dryRun bool) (*MessageRetention, error) {
+	clean := make(map[string]time.Duration, len(rules))
+	for msgType, maxAge := range rules {
+		if maxAge < 0 {
+			return nil, fmt.Errorf("retention for %v can't be negative", msgType)
+		}
+		clean[strings.ToUpper(strings.TrimPrefix(msgType, "$"))] = maxAge
+	}
+	mr := &MessageRetention{
+		logger: logger,
+		store:  store,
+		rules:  clean,
+		dryRun: dryRun,
+	}
+	return mr, nil
+}
+
+// the prunes the rules make at a time, typed ones first, sorted
+func (mr *MessageRetention) prunes(now time.Time) []MessagePrune {
+	typed := make([]string, 0, len(mr.rules))
+	for msgType := range mr.rules {
+		if msgType != MSG_RETENTION_DEFAULT_TYPE {
+			typed = append(typed, msgType)
+		}
+	}
+	sort.Strings(typed)
+
+	prunes := make([]MessagePrune, 0, len(mr.rules))
+	for _, msgType := range typed {
+		if maxAge := mr.rules[msgType]; maxAge > 0 {
+			prunes = append(prunes, MessagePrune{Type: msgType, Before: now.Add(-maxAge)})
+		}
+	}
+	// types with their own rule are left out of the default even if they keep forever
+	if maxAge := mr.rules[MSG_RETENTION_DEFAULT_TYPE]; maxAge > 0 {
+		prunes = append(prunes, MessagePrune{Type: MSG_RETENTION_DEFAULT_TYPE, Except: typed, Before: now.Add(-maxAge)})
+	}
+	return prunes
+}
+
+// prune, or count what would be pruned, and record the run
+func (mr *MessageRetention) Prune(now time.Time, dryRun bool) (*PruneRun_Schema, error) {
+	mr.runLock.Lock()
+	defer mr.runLock.Unlock()
+
+	run := &PruneRun_Schema{
+		Id:       uuid.New().String(),
+		Time:     now,
+		DryRun:   dryRun,
+		Messages: make([]PruneResult_Schema, 0),
+	}
+	for _, p := range mr.prunes(now) {
+		res := PruneResult_Schema{Type: p.Type, Before: p.Before}
+		count, err := mr.store.PruneMessages(&p, dryRun)
+		res.Count = count
+		if err != nil {
+			res.Error = err.Error()
+			mr.logger.Error("error pruning messages", zap.String("type", p.Type), zap.Error(err))
+		}
+		run.Messages = append(run.Messages, res)
+	}
+
+	// positions come from gps messages so go with them
+	gpsAge, ok := mr.rules["GPS"]
+	if !ok {
+		gpsAge = mr.rules[MSG_RETENTION_DEFAULT_TYPE]
+	}
+	if gpsAge > 0 {
+		res := PruneResult_Schema{Type: "positions", Before: now.Add(-gpsAge)}
+		count, err := mr.store.PrunePositions(res.Before, dryRun)
+		res.Count = count
+		if err != nil {
+			res.Error = err.Error()
+			mr.logger.Error("error pruning positions", zap.Error(err))
+		}
+		run.Positions = &res
+	}
+
+	err := mr.store.RecordPruneRun(run)
+	if err != nil {
+		return nil, fmt.Errorf("error recording prune run: %v", err)
+	}
+	mr.lock.Lock()
+	mr.lastRun = run
+	mr.lock.Unlock()
+	return run, nil
+}
+
+// prune every interval, blocking until the context is done
+func (mr *MessageRetention) Run(ctx context.Context) {
+	ticker := time.NewTicker(MSG_RETENTION_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			_, err := mr.Prune(now, mr.dryRun)
+			if err != nil {
+				mr.logger.Error("error pruning message history", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// add the retention endpoints to the http server
+func (mr *MessageRetention) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /retention/messages", mr.handleGet)
+	svr.HandleFunc("POST /retention/messages/prune", mr.handlePrune)
+	svr.HandleFunc("GET /retention/messages/runs", mr.handleListRuns)
+}
+
+// GET /retention/messages
+func (mr *MessageRetention) handleGet(w http.ResponseWriter, r *http.Request) {
+	res := MessageRetention_Response{Rules: make([]RetentionRule_Response, 0, len(mr.rules)), DryRun: mr.dryRun}
+	for msgType, maxAge := range mr.rules {
+		res.Rules = append(res.Rules, RetentionRule_Response{msgType, maxAge.Hours() / 24})
+	}
+	sort.Slice(res.Rules, func(i, j int) bool { return res.Rules[i].Type < res.Rules[j].Type })
+	mr.lock.Lock()
+	res.LastRun = mr.lastRun
+	mr.lock.Unlock()
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /retention/messages/prune?dryRun=true, prune now
+func (mr *MessageRetention) handlePrune(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "dryRun must be true or false")
+			return
+		}
+	}
+	run, err := mr.Prune(time.Now(), dryRun)
+	if err != nil {
+		mr.logger.Error("failed to prune messages", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to prune messages")
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// GET /retention/messages/runs?after=&before=, newest first
+func (mr *MessageRetention) handleListRuns(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	runs, err := mr.store.QueryPruneRuns(after, before)
+	if err != nil {
+		mr.logger.Error("failed to query prune runs", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query prune runs")
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// the condition on one stored message that picks out the messages to prune
+func messagePruneCondition(p *MessagePrune) bson.M {
+	cond := bson.M{"receivedTime": bson.M{"$lt": p.Before}}
+	if p.Type != MSG_RETENTION_DEFAULT_TYPE {
+		cond["message"] = primitive.Regex{Pattern: "^\\$" + regexp.QuoteMeta(p.Type) + "(;|\\r|$)", Options: "i"}
+	} else if len(p.Except) > 0 {
+		quoted := make([]string, len(p.Except))
+		for i, t := range p.Except {
+			quoted[i] = regexp.QuoteMeta(t)
+		}
+		cond["message"] = bson.M{"$not": primitive.Regex{Pattern: "^\\$(" + strings.Join(quoted, "|") + ")(;|\\r|$)", Options: "i"}}
+	}
+	return cond
+}
+
+// pull the messages out of the devices' history, returning how many there were. A dry run only counts.
+func (dbc *DBConnection) PruneMessages(p *MessagePrune, dryRun bool) (int64, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("devices")
+	cond := messagePruneCondition(p)
+
+	// count them first, the update only says how many devices it changed
+	elemCond := bson.M{}
+	for k, v := range cond {
+		elemCond["MsgHistory."+k] = v
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"MsgHistory": bson.M{"$elemMatch": cond}}}},
+		{{Key: "$unwind", Value: "$MsgHistory"}},
+		{{Key: "$match", Value: elemCond}},
+		{{Key: "$count", Value: "count"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, fmt.Errorf("error counting messages to prune: %v", err)
+	}
+	var counts []struct {
+		Count int64 `bson:"count"`
+	}
+	err = cursor.All(ctx, &counts)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding message count: %v", err)
+	}
+	if len(counts) == 0 {
+		return 0, nil
+	}
+	if dryRun {
+		return counts[0].Count, nil
+	}
+
+	// a pull and a push on the same document don't clash, so no need to hold up recording with the lock
+	_, err = coll.UpdateMany(ctx, bson.M{"MsgHistory": bson.M{"$elemMatch": cond}}, bson.M{"$pull": bson.M{"MsgHistory": cond}})
+	if err != nil {
+		return 0, fmt.Errorf("error pruning messages: %v", err)
+	}
+	return counts[0].Count, nil
+}
+
+// delete the positions fixed before the time, returning how many there were. A dry run only counts.
+func (dbc *DBConnection) PrunePositions(before time.Time, dryRun bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("positions")
+	filter := bson.M{"fixTime": bson.M{"$lt": before}}
+	if dryRun {
+		return coll.CountDocuments(ctx, filter)
+	}
+	res, err := coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// record a prune run
+func (dbc *DBConnection) RecordPruneRun(run *PruneRun_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("prune_runs")
+	_, err := coll.InsertOne(ctx, run)
+	return err
+}
+
+// get the prune runs between the times, newest first
+func (dbc *DBConnection) QueryPruneRuns(after time.Time, before time.Time) ([]PruneRun_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("prune_runs")
+
+	filter := bson.M{"time": bson.M{"$gte": after, "$lte": before}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying prune runs: %v", err)
+	}
+	runs := make([]PruneRun_Schema, 0)
+	err = cursor.All(context.Background(), &runs)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding prune runs: %v", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// in memory MessageRetentionStore
+type memMessageRetentionStore struct {
+	lock      sync.Mutex
+	messages  []DeviceMessage_Schema
+	positions []Position_Schema
+	runs      []PruneRun_Schema
+}
+
+func (m *memMessageRetentionStore) matches(p *MessagePrune, msg *DeviceMessage_Schema) bool {
+	if !msg.RecvdTime.Before(p.Before) {
+		return false
+	}
+	cmd := getCommandFromMessage(msg.Message)
+	if p.Type != MSG_RETENTION_DEFAULT_TYPE {
+		return cmd == p.Type
+	}
+	return !containsString(p.Except, cmd)
+}
+
+func (m *memMessageRetentionStore) PruneMessages(p *MessagePrune, dryRun bool) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	kept := make([]DeviceMessage_Schema, 0, len(m.messages))
+	var count int64
+	for _, msg := range m.messages {
+		if m.matches(p, &msg) {
+			count++
+			if !dryRun {
+				continue
+			}
+		}
+		kept = append(kept, msg)
+	}
+	m.messages = kept
+	return count, nil
+}
+
+func (m *memMessageRetentionStore) PrunePositions(before time.Time, dryRun bool) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	kept := make([]Position_Schema, 0, len(m.positions))
+	var count int64
+	for _, pos := range m.positions {
+		if pos.FixTime.Before(before) {
+			count++
+			if !dryRun {
+				continue
+			}
+		}
+		kept = append(kept, pos)
+	}
+	m.positions = kept
+	return count, nil
+}
+
+func (m *memMessageRetentionStore) RecordPruneRun(run *PruneRun_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.runs = append(m.runs, *run)
+	return nil
+}
+
+func (m *memMessageRetentionStore) QueryPruneRuns(after time.Time, before time.Time) ([]PruneRun_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]PruneRun_Schema{}, m.runs...), nil
+}
+
+func TestMessageRetention_Prune(t *testing.T) {
+	now := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	store := &memMessageRetentionStore{}
+	addMsg := func(cmd string, age time.Duration) {
+		store.messages = append(store.messages, DeviceMessage_Schema{RecvdTime: now.Add(-age), Message: "$" + cmd + ";123456;20240901-120000;"})
+	}
+	addMsg("GPS", 100*day)
+	addMsg("GPS", 10*day)
+	addMsg("ALARM", 400*day)
+	addMsg("ALARM", 800*day)
+	addMsg("HEARTBEAT", 8*day)
+	addMsg("HEARTBEAT", 6*day)
+	addMsg("VIDEO", 1000*day)
+	addMsg("STATUS", 40*day)
+	addMsg("STATUS", 20*day)
+	store.positions = []Position_Schema{{FixTime: now.Add(-100 * day)}, {FixTime: now.Add(-day)}}
+
+	rules := map[string]time.Duration{
+		"$gps":      90 * day,
+		"ALARM":     2 * 365 * day,
+		"HEARTBEAT": 7 * day,
+		"VIDEO":     0, // forever, and kept out of the default
+		"*":         30 * day,
+	}
+	mr, err := NewMessageRetention(zap.NewNop(), store, rules, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func(run *PruneRun_Schema) map[string]int64 {
+		c := make(map[string]int64)
+		for _, res := range run.Messages {
+			if res.Error != "" {
+				t.Errorf("%v: %v", res.Type, res.Error)
+			}
+			c[res.Type] = res.Count
+		}
+		return c
+	}
+	want := map[string]int64{"GPS": 1, "ALARM": 1, "HEARTBEAT": 1, "*": 1}
+
+	// a dry run counts without deleting
+	run, err := mr.Prune(now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !run.DryRun || len(store.messages) != 9 || len(store.positions) != 2 {
+		t.Fatalf("dry run deleted something: %v messages, %v positions", len(store.messages), len(store.positions))
+	}
+	got := counts(run)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("dry run %v: expected %v, got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got["VIDEO"]; ok {
+		t.Errorf("types kept forever shouldn't be pruned")
+	}
+	if run.Positions == nil || run.Positions.Count != 1 {
+		t.Errorf("expected 1 position to go with the gps rule, got %+v", run.Positions)
+	}
+
+	// the real thing deletes the same
+	run, err = mr.Prune(now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = counts(run)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%v: expected %v, got %v", k, v, got[k])
+		}
+	}
+	if len(store.messages) != 5 || len(store.positions) != 1 {
+		t.Errorf("expected 5 messages and 1 position left, got %v and %v", len(store.messages), len(store.positions))
+	}
+	for _, msg := range store.messages {
+		if getCommandFromMessage(msg.Message) == "VIDEO" {
+			return
+		}
+	}
+	t.Errorf("the video message should have been kept")
+}
+
+func TestMessageRetention_Negative(t *testing.T) {
+	_, err := NewMessageRetention(zap.NewNop(), &memMessageRetentionStore{}, map[string]time.Duration{"GPS": -time.Hour}, false)
+	if err == nil {
+		t.Errorf("expected an error for a negative age")
+	}
+}
+
+func TestMessagePruneCondition(t *testing.T) {
+	// the patterns sent to mongodb, checked against go's regexp which reads them the same
+	pattern := func(cond bson.M) *regexp.Regexp {
+		var re primitive.Regex
+		switch v := cond["message"].(type) {
+		case primitive.Regex:
+			re = v
+		case bson.M:
+			re = v["$not"].(primitive.Regex)
+		}
+		return regexp.MustCompile("(?" + re.Options + ")" + re.Pattern)
+	}
+
+	gps := pattern(messagePruneCondition(&MessagePrune{Type: "GPS"}))
+	for msg, want := range map[string]bool{
+		"$GPS;123456;20240901-120000;A;":   true,
+		"$gps;123456;":                     true,
+		"$GPSX;123456;20240901-120000;A;":  false,
+		"$ALARM;123456;20240901-120000;1;": false,
+	} {
+		if gps.MatchString(msg) != want {
+			t.Errorf("GPS rule on %q: expected %v", msg, want)
+		}
+	}
+
+	cond := messagePruneCondition(&MessagePrune{Type: MSG_RETENTION_DEFAULT_TYPE, Except: []string{"GPS", "ALARM"}})
+	if _, ok := cond["message"].(bson.M); !ok {
+		t.Fatalf("expected the default rule to exclude the typed ones, got %v", cond)
+	}
+	except := pattern(cond)
+	if !except.MatchString("$ALARM;123456;") || except.MatchString("$STATUS;123456;") {
+		t.Errorf("default rule excludes the wrong messages")
+	}
+
+	if _, ok := messagePruneCondition(&MessagePrune{Type: MSG_RETENTION_DEFAULT_TYPE})["message"]; ok {
+		t.Errorf("default rule with nothing to exclude shouldn't filter on the message")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+MESSAGE WORKERS
+Messages are processed by a pool of workers rather than one at a time in MsgIntake. Each message goes
+to a worker picked by its device id, so all of one device's messages, and the commands sent to it,
+are processed in the order they arrived while different devices are processed side by side. A worker
+that falls behind only holds up the devices that hash to it.
+~~~~~~~~~~~~~~~
+*/
+
+const (
+	MSG_WORKER_QUEUE_SIZE int = 256 // messages waiting for each worker before dispatching blocks
+)
+
+// a message and what to do with it
+type msgJob struct {
+	msgWrap MessageWrapper
+	process ProcessMessageFunction
+	queued  time.Time
+}
+
+// one worker's share of the messages
+type msgShard struct {
+	jobs      chan msgJob
+	processed int64
+	failed    int64
+	busy      time.Duration // time spent processing
+	maxWait   time.Duration // longest a message has waited in the queue
+}
+
+// how one worker is getting on, sent to API clients
+type MsgWorkerStats_Response struct {
+	Worker         int     `json:"worker"`
+	QueueDepth     int     `json:"queueDepth"`
+	Processed      int64   `json:"processed"`
+	Failed         int64   `json:"failed"`
+	BusySeconds    float64 `json:"busySeconds"`
+	MaxWaitSeconds float64 `json:"maxWaitSeconds"`
+}
+
+// how the pool is getting on, sent to API clients
+type MsgWorkersStats_Response struct {
+	Workers       int                       `json:"workers"`
+	QueueCapacity int                       `json:"queueCapacity"` // per worker
+	QueueDepth    int                       `json:"queueDepth"`
+	Processed     int64                     `json:"processed"`
+	Failed        int64                     `json:"failed"`
+	PerWorker     []MsgWorkerStats_Response `json:"perWorker"`
+}
+
+// workers that process messages in order per device
+type MsgWorkerPool struct {
+	// internal
+	shards      []*msgShard
+	closed      bool           // Close has been called, nothing more can be dispatched
+	dispatching sync.WaitGroup // dispatches in progress, Close waits for them before closing the queues
+	lock        sync.Mutex     // guards the shard counters and closed
+	running     sync.WaitGroup // the workers
+
+	// injected
+	logger *zap.Logger
+}
+
+// constructor
+func NewMsgWorkerPool(logger *zap.Logger, workers int, queueSize int) (*MsgWorkerPool, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("need at least one message worker, got %v", workers)
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("message worker queue size can't be negative, got %v", queueSize)
+	}
+	wp := &MsgWorkerPool{logger: logger, shards: make([]*msgShard, workers)}
+	for i := range wp.shards {
+		wp.shards[i] = &msgShard{jobs: make(chan msgJob, queueSize)}
+	}
+	return wp, nil
+}
+
+// which worker a device's messages go to
+func (wp *MsgWorkerPool) shardFor(devId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(devId))
+	return int(h.Sum32() % uint32(len(wp.shards)))
+}
+
+// returned by Dispatch once the pool is closed
+var errWorkersClosed = fmt.Errorf("message workers are closed")
+
+// queue a message for the device's worker, blocking while that worker's queue is full. Errors if the
+// pool has been closed.
+func (wp *MsgWorkerPool) Dispatch(devId string, msgWrap *MessageWrapper, process ProcessMessageFunction) error {
+	wp.lock.Lock()
+	if wp.closed {
+		wp.lock.Unlock()
+		return errWorkersClosed
+	}
+	wp.dispatching.Add(1)
+	wp.lock.Unlock()
+	defer wp.dispatching.Done()
+
+	// not under the lock, the workers need it while we wait for room
+	wp.shards[wp.shardFor(devId)].jobs <- msgJob{*msgWrap, process, time.Now()}
+	return nil
+}
+
+// start the workers, they stop when Close is called
+func (wp *MsgWorkerPool) Run() {
+	for _, shard := range wp.shards {
+		wp.running.Add(1)
+		go wp.work(shard)
+	}
+}
+
+// stop taking messages and wait for the workers to finish what's queued. Nothing can be dispatched after.
+func (wp *MsgWorkerPool) Close() {
+	wp.lock.Lock()
+	wp.closed = true
+	wp.lock.Unlock()
+	wp.dispatching.Wait()
+	for _, shard := range wp.shards {
+		close(shard.jobs)
+	}
+	wp.running.Wait()
+}
+
+// process one worker's messages in the order they were queued
+func (wp *MsgWorkerPool) work(shard *msgShard) {
+	defer wp.running.Done()
+	for job := range shard.jobs {
+		start := time.Now()
+		err := job.process(&job.msgWrap)
+		took := time.Since(start)
+		if err != nil {
+			wp.logger.Error("error processing message", zap.String("message", job.msgWrap.message), zap.Error(err))
+		}
+
+		wp.lock.Lock()
+		shard.processed++
+		if err != nil {
+			shard.failed++
+		}
+		shard.busy += took
+		shard.maxWait = max(shard.maxWait, start.Sub(job.queued))
+		wp.lock.Unlock()
+	}
+}
+
+// how each worker is getting on
+func (wp *MsgWorkerPool) Stats() MsgWorkersStats_Response {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	stats := MsgWorkersStats_Response{
+		Workers:   len(wp.shards),
+		PerWorker: make([]MsgWorkerStats_Response, len(wp.shards)),
+	}
+	for i, shard := range wp.shards {
+		stats.QueueCapacity = cap(shard.jobs)
+		stats.QueueDepth += len(shard.jobs)
+		stats.Processed += shard.processed
+		stats.Failed += shard.failed
+		stats.PerWorker[i] = MsgWorkerStats_Response{
+			Worker:         i,
+			QueueDepth:     len(shard.jobs),
+			Processed:      shard.processed,
+			Failed:         shard.failed,
+			BusySeconds:    shard.busy.Seconds(),
+			MaxWaitSeconds: shard.maxWait.Seconds(),
+		}
+	}
+	return stats
+}
+
+// register the API routes
+func (wp *MsgWorkerPool) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /workers/status", wp.handleStatus)
+}
+
+// GET /workers/status
+func (wp *MsgWorkerPool) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, wp.Stats())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMsgWorkerPool_Order(t *testing.T) {
+	wp, err := NewMsgWorkerPool(zap.NewNop(), 8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMsgWorkerPool(zap.NewNop(), 0, 4); err == nil {
+		t.Errorf("expected a pool without workers to be refused")
+	}
+
+	var lock sync.Mutex
+	seen := make(map[string][]int)
+	inFlight := make(map[string]bool)
+	overlapped := false
+	process := func(msgWrap *MessageWrapper) error {
+		devId := *msgWrap.clientId
+		lock.Lock()
+		overlapped = overlapped || inFlight[devId]
+		inFlight[devId] = true
+		lock.Unlock()
+
+		var i int
+		fmt.Sscanf(msgWrap.message, "$GPS;"+devId+";%d", &i)
+		time.Sleep(time.Duration(i%3) * time.Microsecond)
+
+		lock.Lock()
+		seen[devId] = append(seen[devId], i)
+		inFlight[devId] = false
+		lock.Unlock()
+		if i == 0 {
+			return fmt.Errorf("first message")
+		}
+		return nil
+	}
+
+	wp.Run()
+	devices, perDevice := 200, 50
+	for i := 0; i < perDevice; i++ {
+		for d := 0; d < devices; d++ {
+			devId := fmt.Sprint(d)
+			wp.Dispatch(devId, &MessageWrapper{fmt.Sprintf("$GPS;%v;%v", devId, i), &devId, time.Now(), DirectionFromDevice, 0}, process)
+		}
+	}
+	wp.Close()
+
+	if overlapped {
+		t.Errorf("expected one device's messages never to be processed at the same time")
+	}
+	for d := 0; d < devices; d++ {
+		got := seen[fmt.Sprint(d)]
+		if len(got) != perDevice {
+			t.Fatalf("expected %v messages for %v, got %v", perDevice, d, len(got))
+		}
+		for i := range got {
+			if got[i] != i {
+				t.Fatalf("messages for %v out of order at %v: %v", d, i, got[i])
+			}
+		}
+	}
+	stats := wp.Stats()
+	if stats.Processed != int64(devices*perDevice) || stats.Failed != int64(devices) || stats.QueueDepth != 0 || len(stats.PerWorker) != 8 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	devId := "0"
+	if err := wp.Dispatch(devId, &MessageWrapper{"$GPS;0;50", &devId, time.Now(), DirectionFromDevice, 0}, process); err != errWorkersClosed {
+		t.Errorf("expected dispatching after close to fail, got %v", err)
+	}
+}
+
+func TestMessageHandler_SendCommand(t *testing.T) {
+	devices, err := NewDeviceSvr(zap.NewNop(), "127.0.0.1:0", 1, 1024, 4, OVERLOAD_BLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp, _ := NewMsgWorkerPool(zap.NewNop(), 4, 4)
+	mh, _ := NewMessageHandler(zap.NewNop(), devices, nil, nil, nil, nil)
+	mh.SetWorkers(wp)
+	var lock sync.Mutex
+	order := make([]string, 0)
+	mh.SetCommandQueue(func(msgWrap *MessageWrapper) error {
+		lock.Lock()
+		order = append(order, msgWrap.message)
+		lock.Unlock()
+		return fmt.Errorf("queue full")
+	})
+	wp.Run()
+	defer wp.Close()
+
+	// a command from the websocket is still being processed on the device's worker
+	release := make(chan struct{})
+	clientId := "client"
+	mh.dispatch("123", &MessageWrapper{"$VIDEO;123", &clientId, time.Now(), DirectionToDevice, time.Minute}, func(msgWrap *MessageWrapper) error {
+		<-release
+		return mh.ProcessMsgFromApiClient(msgWrap)
+	})
+
+	// so one sent from elsewhere waits behind it, and gets its error back
+	sent := make(chan error)
+	go func() {
+		sent <- mh.SendCommand(&MessageWrapper{"$CONFIG;123", &clientId, time.Now(), DirectionToDevice, time.Minute})
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expected the command to wait for the one before it")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-sent; err == nil || err.Error() != "queue full" {
+		t.Errorf("expected the command's error, got %v", err)
+	}
+	if len(order) != 2 || order[0] != "$VIDEO;123" || order[1] != "$CONFIG;123" {
+		t.Errorf("expected the commands in the order they were sent, got %v", order)
+	}
+}
+
+// an in memory store that takes about as long as a round trip to the database
+type slowWriteBehindStore struct {
+	memWriteBehindStore
+}
+
+func (m *slowWriteBehindStore) RecordMessages(msgs []*MessageWrapper) ([]int, error) {
+	time.Sleep(time.Millisecond)
+	return m.memWriteBehindStore.RecordMessages(msgs)
+}
+
+func (m *slowWriteBehindStore) RecordPositions(positions []*Position_Schema) ([]int, error) {
+	time.Sleep(time.Millisecond)
+	return m.memWriteBehindStore.RecordPositions(positions)
+}
+
+// throughput of gps messages through the message handler and the write behind writer, with each
+// message spending about as long in the hooks as a geofence or rule lookup and each batch as long as
+// a database round trip
+func BenchmarkMsgWorkerPool(b *testing.B) {
+	for _, devices := range []int{1000, 10000} {
+		msgs := make([]string, devices)
+		ids := make([]string, devices)
+		for i := range ids {
+			ids[i] = fmt.Sprint(100000 + i)
+			msgs[i] = fmt.Sprintf("$GPS;%v;20240817-123504;A;51.507400;-0.127800;42.5;270;9", ids[i])
+		}
+		for _, workers := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("devices=%v/workers=%v", devices, workers), func(b *testing.B) {
+				wp, err := NewMsgWorkerPool(zap.NewNop(), workers, MSG_WORKER_QUEUE_SIZE)
+				if err != nil {
+					b.Fatal(err)
+				}
+				writer, err := NewWriteBehind(zap.NewNop(), &slowWriteBehindStore{}, 4*WRITE_BATCH_SIZE)
+				if err != nil {
+					b.Fatal(err)
+				}
+				publish := func(msgWrap *MessageWrapper) error { return nil }
+				publishEvent := func(event *DeviceEvent) error { return nil }
+				mh, _ := NewMessageHandler(zap.NewNop(), nil, nil, nil, publish, publishEvent)
+				mh.SetWriteBehind(writer)
+				mh.SetWorkers(wp)
+				mh.OnPosition(func(pos *Position_Schema) error {
+					time.Sleep(100 * time.Microsecond)
+					return nil
+				})
+
+				ctx, cancel := context.WithCancel(context.Background())
+				writing := make(chan struct{})
+				go func() {
+					writer.Run(ctx)
+					close(writing)
+				}()
+				wp.Run()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					d := i % devices
+					mh.dispatch(ids[d], &MessageWrapper{msgs[d], &ids[d], time.Now(), DirectionFromDevice, 0}, mh.ProcessMsgFromDevice)
+				}
+				// done once everything's been written
+				wp.Close()
+				cancel()
+				<-writing
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+~~~~~~~~~~~~~~~
+REPLY TRACKER
+Matches messages from devices to commands sent to them. A message from the device with the same
+command as the one sent, e.g. $VIDEO in response to $VIDEO, before the deadline is taken as its reply.
+Commands waiting for a reply from the same device are matched oldest first.
+~~~~~~~~~~~~~~~
+*/
+
+// how often we look for commands whose deadline has passed
+const REPLY_TRACKER_INTERVAL time.Duration = time.Second
+
+// called with the reply to a command
+type ReplyFunction func(reply *MessageWrapper)
+
+// a command we're waiting for a device to reply to
+type awaitingReply struct {
+	command   string // without the '$'
+	deadline  time.Time
+	onReply   ReplyFunction
+	onTimeout func() // nil if the caller doesn't care
+}
+
+// tracks commands waiting for replies
+type ReplyTracker struct {
+	awaiting map[string][]*awaitingReply // device id against commands waiting for a reply, oldest first
+	lock     sync.Mutex                  // commands go out from several goroutines, replies come from the message handler
+}
+
+// constructor
+func NewReplyTracker() *ReplyTracker {
+	return &ReplyTracker{awaiting: make(map[string][]*awaitingReply)}
+}
+
+// wait for a device to reply to a message sent to it. onReply is called with the reply, or onTimeout
+// once the deadline passes without one. Both are called without the tracker's lock held. Call it
+// before sending, a device can reply before the send returns.
+func (rt *ReplyTracker) Expect(devId string, message string, deadline time.Time, onReply ReplyFunction, onTimeout func()) *awaitingReply {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	a := &awaitingReply{getCommandFromMessage(message), deadline, onReply, onTimeout}
+	rt.awaiting[devId] = append(rt.awaiting[devId], a)
+	return a
+}
+
+// stop waiting for a reply, e.g. because the command couldn't be sent. Neither callback is called.
+// False if it's already been replied to or timed out.
+func (rt *ReplyTracker) Cancel(devId string, a *awaitingReply) bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	waiting := rt.awaiting[devId]
+	for i := range waiting {
+		if waiting[i] == a {
+			rt.awaiting[devId] = append(waiting[:i:i], waiting[i+1:]...)
+			if len(rt.awaiting[devId]) == 0 {
+				delete(rt.awaiting, devId)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// match a message from a device to a command waiting for a reply, meant to be registered as a message hook
+func (rt *ReplyTracker) ProcessMessage(msgWrap *MessageWrapper) error {
+	devId := *msgWrap.clientId
+	command := getCommandFromMessage(msgWrap.message)
+
+	rt.lock.Lock()
+	var matched *awaitingReply
+	waiting := rt.awaiting[devId]
+	for i, a := range waiting {
+		if a.command == command && msgWrap.recvdTime.Before(a.deadline) {
+			matched = a
+			rt.awaiting[devId] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(rt.awaiting[devId]) == 0 {
+		delete(rt.awaiting, devId)
+	}
+	rt.lock.Unlock()
+
+	if matched != nil {
+		matched.onReply(msgWrap)
+	}
+	return nil
+}
+
+// time out commands as their deadlines pass, blocking until the context is done
+func (rt *ReplyTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(REPLY_TRACKER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			rt.expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forget the commands whose deadline has passed, letting their senders know
+func (rt *ReplyTracker) expire(now time.Time) {
+	rt.lock.Lock()
+	expired := make([]*awaitingReply, 0)
+	for devId, waiting := range rt.awaiting {
+		kept := make([]*awaitingReply, 0, len(waiting))
+		for _, a := range waiting {
+			if now.Before(a.deadline) {
+				kept = append(kept, a)
+			} else {
+				expired = append(expired, a)
+			}
+		}
+		if len(kept) == 0 {
+			delete(rt.awaiting, devId)
+		} else {
+			rt.awaiting[devId] = kept
+		}
+	}
+	rt.lock.Unlock()
+
+	for _, a := range expired {
+		if a.onTimeout != nil {
+			a.onTimeout()
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+ROLLUPS
+Per device summaries of the positions and alarms in each minute and each hour, for reports over
+long ranges that don't need every fix. The raw data is left alone. The job works an hour at a time
+from a watermark, recomputing the hour it's in on every run until the hour is over, so a summary is
+always rebuilt from scratch and running it twice changes nothing.
+
+Distance and moving time come from the segments between consecutive valid fixes, counted in the
+bucket of the later fix. Segments with a gap longer than ROLLUP_MAX_GAP aren't counted, we don't
+know where the device went. Alarms are the $ALARM messages received in the bucket.
+~~~~~~~~~~~~~~~
+*/
+
+// the sizes of bucket we roll up into
+const (
+	ROLLUP_MINUTE string = "minute"
+	ROLLUP_HOUR   string = "hour"
+)
+
+// the bucket size of each resolution
+var ROLLUP_RESOLUTIONS = map[string]time.Duration{
+	ROLLUP_MINUTE: time.Minute,
+	ROLLUP_HOUR:   time.Hour,
+}
+
+const (
+	ROLLUP_INTERVAL         time.Duration = time.Minute     // how often the job runs
+	ROLLUP_DELAY            time.Duration = 2 * time.Minute // how long we give fixes to arrive before rolling them up
+	ROLLUP_MAX_GAP          time.Duration = 5 * time.Minute // longest gap between fixes we count distance and moving time over
+	ROLLUP_MAX_HOURS        int           = 24              // most hours rolled up in one run, so catching up doesn't hog the db
+	ROLLUP_MOVING_SPEED_KMH float64       = 3               // slower than this counts as stopped
+)
+
+// the summary of one device over one bucket
+type Rollup_Schema struct {
+	Id             string    `bson:"_id" json:"-"` // device id/resolution/bucket start unix seconds
+	DeviceId       string    `bson:"deviceId" json:"deviceId"`
+	Resolution     string    `bson:"resolution" json:"resolution"`
+	Start          time.Time `bson:"start" json:"start"`
+	Fixes          int       `bson:"fixes" json:"fixes"` // valid fixes
+	DistanceMeters float64   `bson:"distanceMeters" json:"distanceMeters"`
+	MaxSpeed       float64   `bson:"maxSpeed" json:"maxSpeed"` // km/h
+	MovingSeconds  float64   `bson:"movingSeconds" json:"movingSeconds"`
+	Alarms         int       `bson:"alarms" json:"alarms"`
+}
+
+// an alarm from a device at a time
+type DeviceAlarm struct {
+	DeviceId string    `bson:"deviceId"`
+	Time     time.Time `bson:"time"`
+}
+
+// where raw data is read and rollups are kept, the DBConnection outside of tests
+type RollupStore interface {
+	QueryAllPositions(after time.Time, before time.Time) ([]Position_Schema, error)
+	QueryAlarms(after time.Time, before time.Time) ([]DeviceAlarm, error)
+	ReplaceRollups(after time.Time, before time.Time, rollups []Rollup_Schema) error
+	QueryRollups(devId string, resolution string, after time.Time, before time.Time) ([]Rollup_Schema, error)
+	GetRollupWatermark() (time.Time, error)
+	SetRollupWatermark(t time.Time) error
+}
+
+// rolls up positions and alarms
+type Rollups struct {
+	// internal
+	lock sync.Mutex // one run at a time
+
+	// injected
+	logger *zap.Logger
+	store  RollupStore
+}
+
+// constructor
+func NewRollups(logger *zap.Logger, store RollupStore) (*Rollups, error) {
+	return &Rollups{logger: logger, store: store}, nil
+}
+
+func rollupId(devId string, resolution string, start time.Time) string {
+	return fmt.Sprintf("%v/%v/%v", devId, resolution, start.Unix())
+}
+
+// get a device's bucket, adding it if it isn't there yet
+func rollupBucket(buckets map[string]*Rollup_Schema, devId string, resolution string, start time.Time) *Rollup_Schema {
+	id := rollupId(devId, resolution, start)
+	bucket, ok := buckets[id]
+	if !ok {
+		bucket = &Rollup_Schema{Id: id, DeviceId: devId, Resolution: resolution, Start: start}
+		buckets[id] = bucket
+	}
+	return bucket
+}
+
+// roll up one hour. Positions may start up to ROLLUP_MAX_GAP before the hour, those are only used as
+// the start of the first segment. Returns the minute and hour rollups, sorted.
+func rollupHour(hour time.Time, positions []Position_Schema, alarms []DeviceAlarm) []Rollup_Schema {
+	minutes := make(map[string]*Rollup_Schema)
+
+	byDevice := make(map[string][]Position_Schema)
+	for _, pos := range positions {
+		if pos.Valid {
+			byDevice[pos.DeviceId] = append(byDevice[pos.DeviceId], pos)
+		}
+	}
+	for devId, track := range byDevice {
+		sort.SliceStable(track, func(i, j int) bool { return track[i].FixTime.Before(track[j].FixTime) })
+		for i, pos := range track {
+			if pos.FixTime.Before(hour) || !pos.FixTime.Before(hour.Add(time.Hour)) {
+				continue
+			}
+			bucket := rollupBucket(minutes, devId, ROLLUP_MINUTE, pos.FixTime.Truncate(time.Minute))
+			bucket.Fixes++
+			if pos.Speed > bucket.MaxSpeed {
+				bucket.MaxSpeed = pos.Speed
+			}
+			if i == 0 {
+				continue
+			}
+			prev := track[i-1]
+			gap := pos.FixTime.Sub(prev.FixTime)
+			if gap <= 0 || gap > ROLLUP_MAX_GAP {
+				continue
+			}
+			bucket.DistanceMeters += distanceMeters(prev.Latitude, prev.Longitude, pos.Latitude, pos.Longitude)
+			if prev.Speed >= ROLLUP_MOVING_SPEED_KMH || pos.Speed >= ROLLUP_MOVING_SPEED_KMH {
+				bucket.MovingSeconds += gap.Seconds()
+			}
+		}
+	}
+	for _, alarm := range alarms {
+		if alarm.Time.Before(hour) || !alarm.Time.Before(hour.Add(time.Hour)) {
+			continue
+		}
+		rollupBucket(minutes, alarm.DeviceId, ROLLUP_MINUTE, alarm.Time.Truncate(time.Minute)).Alarms++
+	}
+
+	// the hours are the sum of their minutes
+	hours := make(map[string]*Rollup_Schema)
+	for _, minute := range minutes {
+		bucket := rollupBucket(hours, minute.DeviceId, ROLLUP_HOUR, hour)
+		bucket.add(minute)
+	}
+
+	rollups := make([]Rollup_Schema, 0, len(minutes)+len(hours))
+	for _, buckets := range []map[string]*Rollup_Schema{minutes, hours} {
+		for _, bucket := range buckets {
+			rollups = append(rollups, *bucket)
+		}
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if rollups[i].DeviceId != rollups[j].DeviceId {
+			return rollups[i].DeviceId < rollups[j].DeviceId
+		}
+		if rollups[i].Resolution != rollups[j].Resolution {
+			return rollups[i].Resolution < rollups[j].Resolution
+		}
+		return rollups[i].Start.Before(rollups[j].Start)
+	})
+	return rollups
+}
+
+// add another bucket's numbers to this one
+func (r *Rollup_Schema) add(other *Rollup_Schema) {
+	r.Fixes += other.Fixes
+	r.DistanceMeters += other.DistanceMeters
+	r.MovingSeconds += other.MovingSeconds
+	r.Alarms += other.Alarms
+	if other.MaxSpeed > r.MaxSpeed {
+		r.MaxSpeed = other.MaxSpeed
+	}
+}
+
+// roll up the hours from the watermark up to the one the time is in, at most ROLLUP_MAX_HOURS of
+// them. The watermark moves past the hours that are over.
+func (ru *Rollups) RollUp(now time.Time) error {
+	ru.lock.Lock()
+	defer ru.lock.Unlock()
+
+	until := now.Add(-ROLLUP_DELAY)
+	hour, err := ru.store.GetRollupWatermark()
+	if err != nil {
+		return fmt.Errorf("error getting rollup watermark: %v", err)
+	}
+	if hour.IsZero() {
+		// nothing's been rolled up yet, start from here. Older data can be rolled up with a rebuild.
+		hour = until.Truncate(time.Hour)
+	}
+	for i := 0; i < ROLLUP_MAX_HOURS && hour.Before(until); i++ {
+		positions, err := ru.store.QueryAllPositions(hour.Add(-ROLLUP_MAX_GAP), hour.Add(time.Hour))
+		if err != nil {
+			return fmt.Errorf("error querying positions for %v: %v", hour, err)
+		}
+		alarms, err := ru.store.QueryAlarms(hour, hour.Add(time.Hour))
+		if err != nil {
+			return fmt.Errorf("error querying alarms for %v: %v", hour, err)
+		}
+		// what was there goes, a device with nothing in the hour any more shouldn't keep its buckets
+		err = ru.store.ReplaceRollups(hour, hour.Add(time.Hour), rollupHour(hour, positions, alarms))
+		if err != nil {
+			return fmt.Errorf("error storing rollups for %v: %v", hour, err)
+		}
+
+		// the hour we're still in is done again next run
+		if hour.Add(time.Hour).After(until) {
+			break
+		}
+		hour = hour.Add(time.Hour)
+		err = ru.store.SetRollupWatermark(hour)
+		if err != nil {
+			return fmt.Errorf("error setting rollup watermark: %v", err)
+		}
+	}
+	return nil
+}
+
+// roll everything from the time on up again, over the next runs
+func (ru *Rollups) Rebuild(after time.Time) error {
+	ru.lock.Lock()
+	defer ru.lock.Unlock()
+	return ru.store.SetRollupWatermark(after.UTC().Truncate(time.Hour))
+}
+
+// roll up every interval, blocking until the context is done
+func (ru *Rollups) Run(ctx context.Context) {
+	ticker := time.NewTicker(ROLLUP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			err := ru.RollUp(now)
+			if err != nil {
+				ru.logger.Error("error rolling up telemetry", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// add the aggregate endpoints to the http server
+func (ru *Rollups) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /devices/{id}/aggregates", ru.handleGetDevice)
+	svr.HandleFunc("GET /aggregates", ru.handleGetFleet)
+	svr.HandleFunc("POST /aggregates/rebuild", ru.handleRebuild)
+}
+
+// GET /devices/{id}/aggregates?resolution=&after=&before=, the device's buckets oldest first
+func (ru *Rollups) handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	resolution := r.URL.Query().Get("resolution")
+	if resolution == "" {
+		resolution = ROLLUP_HOUR
+	}
+	if _, ok := ROLLUP_RESOLUTIONS[resolution]; !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("resolution must be %v or %v", ROLLUP_MINUTE, ROLLUP_HOUR))
+		return
+	}
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rollups, err := ru.store.QueryRollups(r.PathValue("id"), resolution, after, before)
+	if err != nil {
+		ru.logger.Error("failed to query rollups", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query aggregates")
+		return
+	}
+	writeJSON(w, http.StatusOK, rollups)
+}
+
+// GET /aggregates?after=&before=, one summary per device over the hours between the times
+func (ru *Rollups) handleGetFleet(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rollups, err := ru.store.QueryRollups("", ROLLUP_HOUR, after, before)
+	if err != nil {
+		ru.logger.Error("failed to query rollups", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query aggregates")
+		return
+	}
+	writeJSON(w, http.StatusOK, summariseRollups(rollups))
+}
+
+// sum rollups into one per device, the start being the first bucket's, sorted by device
+func summariseRollups(rollups []Rollup_Schema) []Rollup_Schema {
+	byDevice := make(map[string]*Rollup_Schema)
+	for i := range rollups {
+		sum, ok := byDevice[rollups[i].DeviceId]
+		if !ok {
+			sum = &Rollup_Schema{DeviceId: rollups[i].DeviceId, Resolution: rollups[i].Resolution, Start: rollups[i].Start}
+			byDevice[rollups[i].DeviceId] = sum
+		}
+		if rollups[i].Start.Before(sum.Start) {
+			sum.Start = rollups[i].Start
+		}
+		sum.add(&rollups[i])
+	}
+	summaries := make([]Rollup_Schema, 0, len(byDevice))
+	for _, sum := range byDevice {
+		summaries = append(summaries, *sum)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].DeviceId < summaries[j].DeviceId })
+	return summaries
+}
+
+// POST /aggregates/rebuild?after=, roll up again from the time on, e.g. to fill in data from before
+// the job started
+func (ru *Rollups) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("after")
+	if v == "" {
+		writeError(w, http.StatusBadRequest, "after is required")
+		return
+	}
+	after, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid after parameter: %v", err))
+		return
+	}
+	if after.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "after can't be in the future")
+		return
+	}
+	err = ru.Rebuild(after)
+	if err != nil {
+		ru.logger.Error("failed to rebuild rollups", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to rebuild aggregates")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]time.Time{"from": after.UTC().Truncate(time.Hour)})
+}
+
+// get the positions of every device with a fix time between the two times
+func (dbc *DBConnection) QueryAllPositions(after time.Time, before time.Time) ([]Position_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("positions")
+
+	filter := bson.M{"fixTime": bson.M{"$gte": after, "$lt": before}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying positions: %v", err)
+	}
+	positions := make([]Position_Schema, 0)
+	err = cursor.All(context.Background(), &positions)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding positions: %v", err)
+	}
+	return positions, nil
+}
+
+// get the alarms devices sent between the two times, by received time
+func (dbc *DBConnection) QueryAlarms(after time.Time, before time.Time) ([]DeviceAlarm, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("devices")
+
+	cond := bson.M{
+		"receivedTime": bson.M{"$gte": after, "$lt": before},
+		"message":      primitive.Regex{Pattern: "^\\$ALARM;", Options: "i"},
+	}
+	elemCond := bson.M{}
+	for k, v := range cond {
+		elemCond["MsgHistory."+k] = v
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"MsgHistory": bson.M{"$elemMatch": cond}}}},
+		{{Key: "$unwind", Value: "$MsgHistory"}},
+		{{Key: "$match", Value: elemCond}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "deviceId": "$DeviceId", "time": "$MsgHistory.receivedTime"}}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error querying alarms: %v", err)
+	}
+	alarms := make([]DeviceAlarm, 0)
+	err = cursor.All(ctx, &alarms)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding alarms: %v", err)
+	}
+	return alarms, nil
+}
+
+// replace every rollup with a start between the two times with these
+func (dbc *DBConnection) ReplaceRollups(after time.Time, before time.Time, rollups []Rollup_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("rollups")
+	_, err := coll.DeleteMany(ctx, bson.M{"start": bson.M{"$gte": after, "$lt": before}})
+	if err != nil {
+		return err
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(rollups))
+	for i := range rollups {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": rollups[i].Id}).SetReplacement(rollups[i]).SetUpsert(true)
+	}
+	_, err = coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// get the rollups of a device, or every device if empty, with a start between the two times, oldest first
+func (dbc *DBConnection) QueryRollups(devId string, resolution string, after time.Time, before time.Time) ([]Rollup_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("rollups")
+
+	filter := bson.M{
+		"resolution": resolution,
+		"start":      bson.M{"$gte": after, "$lt": before},
+	}
+	if devId != "" {
+		filter["deviceId"] = devId
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "start", Value: 1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying rollups: %v", err)
+	}
+	rollups := make([]Rollup_Schema, 0)
+	err = cursor.All(context.Background(), &rollups)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding rollups: %v", err)
+	}
+	return rollups, nil
+}
+
+// where the rollup job has got to, zero if it hasn't run
+func (dbc *DBConnection) GetRollupWatermark() (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("rollup_state")
+	var state struct {
+		Watermark time.Time `bson:"watermark"`
+	}
+	err := coll.FindOne(ctx, bson.M{"_id": "watermark"}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return state.Watermark, err
+}
+
+// record where the rollup job has got to
+func (dbc *DBConnection) SetRollupWatermark(t time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("rollup_state")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": "watermark"}, bson.M{"_id": "watermark", "watermark": t}, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory RollupStore
+type memRollupStore struct {
+	lock      sync.Mutex
+	positions []Position_Schema
+	alarms    []DeviceAlarm
+	rollups   map[string]Rollup_Schema
+	watermark time.Time
+	queries   int // hours of positions queried
+}
+
+func (m *memRollupStore) QueryAllPositions(after time.Time, before time.Time) ([]Position_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queries++
+	positions := make([]Position_Schema, 0)
+	for _, pos := range m.positions {
+		if !pos.FixTime.Before(after) && pos.FixTime.Before(before) {
+			positions = append(positions, pos)
+		}
+	}
+	return positions, nil
+}
+
+func (m *memRollupStore) QueryAlarms(after time.Time, before time.Time) ([]DeviceAlarm, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	alarms := make([]DeviceAlarm, 0)
+	for _, alarm := range m.alarms {
+		if !alarm.Time.Before(after) && alarm.Time.Before(before) {
+			alarms = append(alarms, alarm)
+		}
+	}
+	return alarms, nil
+}
+
+func (m *memRollupStore) ReplaceRollups(after time.Time, before time.Time, rollups []Rollup_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, r := range m.rollups {
+		if !r.Start.Before(after) && r.Start.Before(before) {
+			delete(m.rollups, id)
+		}
+	}
+	for _, r := range rollups {
+		m.rollups[r.Id] = r
+	}
+	return nil
+}
+
+func (m *memRollupStore) QueryRollups(devId string, resolution string, after time.Time, before time.Time) ([]Rollup_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rollups := make([]Rollup_Schema, 0)
+	for _, r := range m.rollups {
+		if (devId == "" || r.DeviceId == devId) && r.Resolution == resolution && !r.Start.Before(after) && r.Start.Before(before) {
+			rollups = append(rollups, r)
+		}
+	}
+	return rollups, nil
+}
+
+func (m *memRollupStore) GetRollupWatermark() (time.Time, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.watermark, nil
+}
+
+func (m *memRollupStore) SetRollupWatermark(t time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.watermark = t
+	return nil
+}
+
+// a fix heading north from the equator, each 0.001 degrees is about 111m
+func rollupFix(devId string, t time.Time, lat float64, speed float64) Position_Schema {
+	return Position_Schema{DeviceId: devId, FixTime: t, Valid: true, Latitude: lat, Speed: speed}
+}
+
+func TestRollupHour(t *testing.T) {
+	hour := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+	leg := distanceMeters(0, 0, 0.001, 0)
+	positions := []Position_Schema{
+		rollupFix("123", hour.Add(-30*time.Second), 0, 40), // before the hour, starts the first segment
+		rollupFix("123", hour.Add(30*time.Second), 0.001, 50),
+		rollupFix("123", hour.Add(90*time.Second), 0.002, 60),
+		rollupFix("123", hour.Add(100*time.Second), 0.002, 0), // stopped, still moving into it
+		rollupFix("123", hour.Add(110*time.Second), 0.002, 0),
+		rollupFix("123", hour.Add(20*time.Minute), 0.010, 30), // after a gap, not counted
+		{DeviceId: "123", FixTime: hour.Add(20*time.Minute + time.Second), Valid: false, Speed: 200},
+		rollupFix("123", hour.Add(time.Hour), 0.020, 90), // next hour
+		rollupFix("456", hour.Add(5*time.Minute), 1, 10),
+	}
+	alarms := []DeviceAlarm{
+		{"123", hour.Add(95 * time.Second)},
+		{"789", hour.Add(59 * time.Minute)},
+		{"789", hour.Add(-time.Second)},
+	}
+
+	rollups := rollupHour(hour, positions, alarms)
+	got := make(map[string]Rollup_Schema)
+	for _, r := range rollups {
+		got[r.Id] = r
+	}
+	if len(got) != 8 {
+		t.Fatalf("expected 8 rollups, got %v: %+v", len(got), rollups)
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 0.01 }
+
+	m0 := got[rollupId("123", ROLLUP_MINUTE, hour)]
+	if m0.Fixes != 1 || !near(m0.DistanceMeters, leg) || m0.MovingSeconds != 60 || m0.MaxSpeed != 50 {
+		t.Errorf("minute 0: %+v", m0)
+	}
+	m1 := got[rollupId("123", ROLLUP_MINUTE, hour.Add(time.Minute))]
+	if m1.Fixes != 3 || !near(m1.DistanceMeters, leg) || m1.MovingSeconds != 70 || m1.MaxSpeed != 60 || m1.Alarms != 1 {
+		t.Errorf("minute 1: %+v", m1)
+	}
+	m20 := got[rollupId("123", ROLLUP_MINUTE, hour.Add(20*time.Minute))]
+	if m20.Fixes != 1 || m20.DistanceMeters != 0 || m20.MovingSeconds != 0 {
+		t.Errorf("minute 20: %+v", m20)
+	}
+	h := got[rollupId("123", ROLLUP_HOUR, hour)]
+	if h.Fixes != 5 || !near(h.DistanceMeters, 2*leg) || h.MovingSeconds != 130 || h.MaxSpeed != 60 || h.Alarms != 1 {
+		t.Errorf("hour: %+v", h)
+	}
+	if r := got[rollupId("456", ROLLUP_HOUR, hour)]; r.Fixes != 1 || r.DistanceMeters != 0 {
+		t.Errorf("456 hour: %+v", r)
+	}
+	if r := got[rollupId("789", ROLLUP_HOUR, hour)]; r.Alarms != 1 || r.Fixes != 0 {
+		t.Errorf("789 hour: %+v", r)
+	}
+}
+
+func TestRollups_RollUp(t *testing.T) {
+	start := time.Date(2024, 8, 17, 10, 0, 0, 0, time.UTC)
+	store := &memRollupStore{rollups: make(map[string]Rollup_Schema), watermark: start}
+	for i := 0; i < 4*60; i++ {
+		store.positions = append(store.positions, rollupFix("123", start.Add(time.Duration(i)*time.Minute), float64(i)*0.001, 50))
+	}
+	ru, err := NewRollups(zap.NewNop(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// catch up to the hour we're in, which is done but the watermark doesn't pass it
+	now := start.Add(2*time.Hour + 30*time.Minute)
+	err = ru.RollUp(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.watermark.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("expected the watermark at 12:00, got %v", store.watermark)
+	}
+	hours, _ := store.QueryRollups("123", ROLLUP_HOUR, start, now)
+	summary := summariseRollups(hours)
+	if len(hours) != 3 || len(summary) != 1 {
+		t.Fatalf("expected 3 hours for one device, got %v", len(hours))
+	}
+	if summary[0].Fixes != 3*60 {
+		t.Errorf("expected 180 fixes, got %v", summary[0].Fixes)
+	}
+	// nothing before the first fix to move from
+	if summary[0].MovingSeconds != float64(179*60) {
+		t.Errorf("expected 179 minutes moving, got %v", summary[0].MovingSeconds/60)
+	}
+
+	// the rest of the hour is filled in on the next run, the same buckets replaced
+	store.queries = 0
+	err = ru.RollUp(start.Add(3*time.Hour + 5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.queries != 2 || !store.watermark.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("expected to roll up 12:00 and 13:00 and stop at 13:00, queried %v up to %v", store.queries, store.watermark)
+	}
+	hours, _ = store.QueryRollups("123", ROLLUP_HOUR, start, start.Add(4*time.Hour))
+	summary = summariseRollups(hours)
+	if len(hours) != 4 || summary[0].Fixes != 4*60 {
+		t.Errorf("expected 4 hours and 240 fixes, got %v and %v", len(hours), summary[0].Fixes)
+	}
+
+	// a rebuild starts again from the hour
+	ru.Rebuild(start.Add(90 * time.Minute))
+	if !store.watermark.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected a rebuild to move the watermark back to 11:00, got %v", store.watermark)
+	}
+
+	// and buckets of fixes that have gone since don't survive it
+	store.lock.Lock()
+	store.positions = store.positions[:60]
+	store.lock.Unlock()
+	err = ru.RollUp(start.Add(3*time.Hour + 5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hours, _ = store.QueryRollups("123", ROLLUP_HOUR, start, start.Add(4*time.Hour))
+	if len(hours) != 1 {
+		t.Errorf("expected only 10:00 left after the rebuild, got %v hours", len(hours))
+	}
+}
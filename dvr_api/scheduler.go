@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+SCHEDULER
+Commands sent to devices at a set time, once ("at") or repeatedly ("cron", see cron.go). The command
+can contain {deviceId}, which is replaced with the id of each device it's sent to. Every run is
+recorded with what happened for each device, and the device's reply (see reply_tracker.go) is recorded
+against the run.
+Jobs are kept in mongodb so they survive restarts. A one shot job that was due while we were down
+runs when we start, a recurring one waits for its next time.
+~~~~~~~~~~~~~~~
+*/
+
+// what happened for one device in a run
+const (
+	JOB_SENT    string = "sent"    // written to the device, waiting for a reply
+	JOB_QUEUED  string = "queued"  // device wasn't connected, put in the command queue
+	JOB_FAILED  string = "failed"  // not sent, see the error
+	JOB_REPLIED string = "replied" // the device replied
+)
+
+const (
+	SCHEDULER_INTERVAL     time.Duration = time.Second     // how often we look for jobs that are due
+	SCHEDULER_REPLY_WINDOW time.Duration = 5 * time.Minute // how long after it gets a command we wait for a device to reply
+)
+
+// a scheduled job, stored in mongodb and sent to/received from API clients. NextRun and LastRun are
+// ours to set.
+type ScheduledJob_Schema struct {
+	Id              string     `bson:"_id" json:"id"`
+	Name            string     `bson:"name" json:"name"`
+	Devices         []string   `bson:"devices" json:"devices"`
+	Groups          []string   `bson:"groups,omitempty" json:"groups,omitempty"`                   // devices in these groups when the job runs
+	Tags            []string   `bson:"tags,omitempty" json:"tags,omitempty"`                       // and devices with all these tags when it runs
+	Command         string     `bson:"command" json:"command"`                                     // may contain {deviceId}
+	At              *time.Time `bson:"at,omitempty" json:"at,omitempty"`                           // run once at this time
+	Cron            string     `bson:"cron,omitempty" json:"cron,omitempty"`                       // or run whenever this matches
+	Timezone        string     `bson:"timezone,omitempty" json:"timezone,omitempty"`               // IANA name the cron is read in, the server's if empty
+	QueueTtlSeconds int        `bson:"queueTtlSeconds,omitempty" json:"queueTtlSeconds,omitempty"` // queue for devices that aren't connected, 0 to fail them
+	Enabled         bool       `bson:"enabled" json:"enabled"`
+	NextRun         *time.Time `bson:"nextRun,omitempty" json:"nextRun,omitempty"`
+	LastRun         *time.Time `bson:"lastRun,omitempty" json:"lastRun,omitempty"`
+}
+
+// one run of a job
+type JobRun_Schema struct {
+	Id      string             `bson:"_id" json:"id"`
+	JobId   string             `bson:"jobId" json:"jobId"`
+	JobName string             `bson:"jobName" json:"jobName"`
+	Time    time.Time          `bson:"time" json:"time"`
+	Results []JobResult_Schema `bson:"results" json:"results"`
+}
+
+// what happened for one device in a run
+type JobResult_Schema struct {
+	DeviceId  string     `bson:"deviceId" json:"deviceId"`
+	Message   string     `bson:"message" json:"message"`
+	Status    string     `bson:"status" json:"status"`
+	Error     string     `bson:"error,omitempty" json:"error,omitempty"`
+	Reply     string     `bson:"reply,omitempty" json:"reply,omitempty"`
+	ReplyTime *time.Time `bson:"replyTime,omitempty" json:"replyTime,omitempty"`
+}
+
+// where the scheduler keeps its jobs and runs, the DBConnection outside of tests
+type ScheduleStore interface {
+	QueryScheduledJobs() ([]ScheduledJob_Schema, error)
+	UpsertScheduledJob(job *ScheduledJob_Schema) error
+	DeleteScheduledJob(id string) (bool, error)
+	RecordJobRun(run *JobRun_Schema) error
+	QueryJobRuns(jobId string, after time.Time, before time.Time) ([]JobRun_Schema, error)
+}
+
+// check the job is something we can run
+func (j *ScheduledJob_Schema) Validate() error {
+	byFilter := len(j.Groups) > 0 || len(j.Tags) > 0
+	if len(j.Devices) == 0 && !byFilter {
+		return fmt.Errorf("set at least one of devices, groups or tags")
+	}
+	if j.Command == "" {
+		return fmt.Errorf("command can't be empty")
+	}
+	// we don't know which devices groups and tags pick out until the job runs
+	if byFilter && !strings.Contains(j.Command, DEVICE_ID_PLACEHOLDER) {
+		return fmt.Errorf("command for a job with groups or tags must use %v", DEVICE_ID_PLACEHOLDER)
+	}
+	for _, devId := range j.Devices {
+		var msgDevId string
+		message := renderForDevice(j.Command, devId)
+		if getIdFromMessage(&message, &msgDevId) != nil || msgDevId != devId {
+			return fmt.Errorf("command for device %v doesn't contain its id, use %v", devId, DEVICE_ID_PLACEHOLDER)
+		}
+	}
+	if (j.At == nil) == (j.Cron == "") {
+		return fmt.Errorf("set one of at or cron")
+	}
+	if j.Cron != "" {
+		if _, err := parseCron(j.Cron); err != nil {
+			return err
+		}
+	}
+	if _, err := j.location(); err != nil {
+		return fmt.Errorf("unknown timezone %q", j.Timezone)
+	}
+	if j.QueueTtlSeconds < 0 {
+		return fmt.Errorf("queueTtlSeconds can't be negative")
+	}
+	return nil
+}
+
+// the timezone the cron is read in. LoadLocation would give UTC for an empty name, not the server's.
+func (j *ScheduledJob_Schema) location() (*time.Location, error) {
+	if j.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(j.Timezone)
+}
+
+// when the job should next run after now, nil if it shouldn't
+func (j *ScheduledJob_Schema) next(now time.Time) *time.Time {
+	if !j.Enabled {
+		return nil
+	}
+	if j.At != nil {
+		if j.LastRun != nil && !j.LastRun.Before(*j.At) {
+			return nil
+		}
+		at := *j.At
+		return &at
+	}
+	cron, err := parseCron(j.Cron)
+	if err != nil {
+		return nil
+	}
+	loc, err := j.location()
+	if err != nil {
+		return nil
+	}
+	next := cron.Next(now.In(loc))
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+// runs scheduled jobs
+type Scheduler struct {
+	// internal
+	jobs map[string]*ScheduledJob_Schema // job id against job
+	lock sync.Mutex                      // jobs run on the ticker, replies come from the reply tracker, changes from the http server
+
+	// injected
+	logger      *zap.Logger
+	store       ScheduleStore
+	send        ProcessMessageFunction // this func is meant to send, or queue, a message for a device
+	isConnected func(devId string) bool
+	replies     *ReplyTracker
+	directory   *DeviceDirectory
+}
+
+// constructor, loads the jobs already defined
+func NewScheduler(logger *zap.Logger, store ScheduleStore, send ProcessMessageFunction, isConnected func(devId string) bool, replies *ReplyTracker, directory *DeviceDirectory) (*Scheduler, error) {
+	s := &Scheduler{
+		jobs:        make(map[string]*ScheduledJob_Schema),
+		logger:      logger,
+		store:       store,
+		send:        send,
+		isConnected: isConnected,
+		replies:     replies,
+		directory:   directory,
+	}
+	jobs, err := store.QueryScheduledJobs()
+	if err != nil {
+		return nil, fmt.Errorf("error loading scheduled jobs: %v", err)
+	}
+	now := time.Now()
+	for i := range jobs {
+		jobs[i].NextRun = jobs[i].next(now)
+		s.jobs[jobs[i].Id] = &jobs[i]
+	}
+	return s, nil
+}
+
+// run jobs as they come due, blocking until the context is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(SCHEDULER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.tick(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run the jobs that are due
+func (s *Scheduler) tick(now time.Time) {
+	s.lock.Lock()
+	due := make([]ScheduledJob_Schema, 0)
+	for _, job := range s.jobs {
+		if job.NextRun == nil || now.Before(*job.NextRun) {
+			continue
+		}
+		ran := now
+		job.LastRun = &ran
+		job.NextRun = job.next(now)
+		due = append(due, *job)
+	}
+	s.lock.Unlock()
+
+	for i := range due {
+		err := s.store.UpsertScheduledJob(&due[i])
+		if err != nil {
+			s.logger.Error("error storing scheduled job", zap.String("jobId", due[i].Id), zap.Error(err))
+		}
+		go s.RunJob(&due[i], now)
+	}
+}
+
+// send a job's command to each of its devices and record what happened
+func (s *Scheduler) RunJob(job *ScheduledJob_Schema, now time.Time) *JobRun_Schema {
+	// without a directory only the devices listed are sent to
+	devices := job.Devices
+	if s.directory != nil {
+		devices = s.directory.Expand(job.Devices, &DeviceFilter{job.Groups, job.Tags})
+	}
+	run := &JobRun_Schema{
+		Id:      uuid.New().String(),
+		JobId:   job.Id,
+		JobName: job.Name,
+		Time:    now,
+		Results: make([]JobResult_Schema, 0, len(devices)),
+	}
+	for _, devId := range devices {
+		run.Results = append(run.Results, JobResult_Schema{DeviceId: devId, Message: renderForDevice(job.Command, devId), Status: JOB_SENT})
+	}
+	queueTtl := time.Duration(job.QueueTtlSeconds) * time.Second
+	for i := range run.Results {
+		devId, message := run.Results[i].DeviceId, run.Results[i].Message
+		connected := s.isConnected(devId)
+		if !connected && queueTtl == 0 {
+			s.lock.Lock()
+			run.Results[i].Status = JOB_FAILED
+			run.Results[i].Error = "device not connected"
+			s.lock.Unlock()
+			continue
+		}
+
+		// wait for the reply before sending. Queued commands may not go out until their ttl is nearly up.
+		deadline := now.Add(SCHEDULER_REPLY_WINDOW)
+		if !connected {
+			deadline = deadline.Add(queueTtl)
+		}
+		waiting := s.replies.Expect(devId, message, deadline, func(reply *MessageWrapper) { s.recordReply(run, i, reply) }, nil)
+		err := s.send(&MessageWrapper{message, &job.Id, now, DirectionToDevice, queueTtl})
+		if err != nil {
+			s.replies.Cancel(devId, waiting)
+		}
+
+		s.lock.Lock()
+		if err != nil {
+			run.Results[i].Status = JOB_FAILED
+			run.Results[i].Error = err.Error()
+		} else if !connected && run.Results[i].Status == JOB_SENT {
+			run.Results[i].Status = JOB_QUEUED
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	record := copyJobRun(run)
+	s.lock.Unlock()
+	err := s.store.RecordJobRun(record)
+	if err != nil {
+		s.logger.Error("error recording job run", zap.String("jobId", job.Id), zap.Error(err))
+	}
+	return record
+}
+
+// record a device's reply against the run that sent it the command
+func (s *Scheduler) recordReply(run *JobRun_Schema, index int, reply *MessageWrapper) {
+	s.lock.Lock()
+	replyTime := reply.recvdTime
+	res := &run.Results[index]
+	res.Status = JOB_REPLIED
+	res.Reply = reply.message
+	res.ReplyTime = &replyTime
+	record := copyJobRun(run)
+	s.lock.Unlock()
+
+	err := s.store.RecordJobRun(record)
+	if err != nil {
+		s.logger.Error("error recording job run reply", zap.String("jobId", run.JobId), zap.Error(err))
+	}
+}
+
+// copy a run so it can be stored while replies are written to the original. Lock must be held.
+func copyJobRun(run *JobRun_Schema) *JobRun_Schema {
+	c := *run
+	c.Results = append([]JobResult_Schema{}, run.Results...)
+	return &c
+}
+
+// add or replace a job, working out when it next runs
+func (s *Scheduler) PutJob(job *ScheduledJob_Schema) error {
+	s.lock.Lock()
+	if old, ok := s.jobs[job.Id]; ok {
+		job.LastRun = old.LastRun
+	}
+	s.lock.Unlock()
+	job.NextRun = job.next(time.Now())
+
+	err := s.store.UpsertScheduledJob(job)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.jobs[job.Id] = job
+	return nil
+}
+
+// remove a job, returns false if there was no such job
+func (s *Scheduler) DeleteJob(id string) (bool, error) {
+	deleted, err := s.store.DeleteScheduledJob(id)
+	if err != nil {
+		return false, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.jobs, id)
+	return deleted, nil
+}
+
+// list the jobs
+func (s *Scheduler) GetJobs() []ScheduledJob_Schema {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs := make([]ScheduledJob_Schema, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// get one job
+func (s *Scheduler) GetJob(id string) (ScheduledJob_Schema, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ScheduledJob_Schema{}, false
+	}
+	return *job, true
+}
+
+// add the schedule endpoints to the http server
+func (s *Scheduler) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /schedules", s.handleList)
+	svr.HandleFunc("POST /schedules", s.handleCreate)
+	svr.HandleFunc("GET /schedules/{id}", s.handleGet)
+	svr.HandleFunc("PUT /schedules/{id}", s.handleUpdate)
+	svr.HandleFunc("DELETE /schedules/{id}", s.handleDelete)
+	svr.HandleFunc("POST /schedules/{id}/run", s.handleRunNow)
+	svr.HandleFunc("GET /schedules/{id}/runs", s.handleGetRuns)
+}
+
+// GET /schedules
+func (s *Scheduler) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.GetJobs())
+}
+
+// GET /schedules/{id}
+func (s *Scheduler) handleGet(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.GetJob(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such scheduled job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// POST /schedules
+func (s *Scheduler) handleCreate(w http.ResponseWriter, r *http.Request) {
+	s.handlePut(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// PUT /schedules/{id}
+func (s *Scheduler) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.GetJob(id); !ok {
+		writeError(w, http.StatusNotFound, "no such scheduled job")
+		return
+	}
+	s.handlePut(w, r, id, http.StatusOK)
+}
+
+// read, validate and store a job from the request body
+func (s *Scheduler) handlePut(w http.ResponseWriter, r *http.Request, id string, status int) {
+	// jobs are enabled unless they say otherwise
+	job := ScheduledJob_Schema{Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(&job)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid scheduled job json: %v", err))
+		return
+	}
+	job.Id = id
+	job.LastRun = nil
+	err = job.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = s.PutJob(&job)
+	if err != nil {
+		s.logger.Error("failed to store scheduled job", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store scheduled job")
+		return
+	}
+	writeJSON(w, status, job)
+}
+
+// DELETE /schedules/{id}
+func (s *Scheduler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := s.DeleteJob(r.PathValue("id"))
+	if err != nil {
+		s.logger.Error("failed to delete scheduled job", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to delete scheduled job")
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "no such scheduled job")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /schedules/{id}/run, runs the job now without changing when it next runs
+func (s *Scheduler) handleRunNow(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.GetJob(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such scheduled job")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.RunJob(&job, time.Now()))
+}
+
+// GET /schedules/{id}/runs?after=&before=
+func (s *Scheduler) handleGetRuns(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	runs, err := s.store.QueryJobRuns(r.PathValue("id"), after, before)
+	if err != nil {
+		s.logger.Error("failed to query job runs", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query job runs")
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// get every scheduled job
+func (dbc *DBConnection) QueryScheduledJobs() ([]ScheduledJob_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("schedules")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying scheduled jobs: %v", err)
+	}
+	jobs := make([]ScheduledJob_Schema, 0)
+	err = cursor.All(ctx, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding scheduled jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// insert or replace a scheduled job
+func (dbc *DBConnection) UpsertScheduledJob(job *ScheduledJob_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("schedules")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": job.Id}, job, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete a scheduled job, returns false if there was nothing to delete
+func (dbc *DBConnection) DeleteScheduledJob(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("schedules")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// insert or replace a job run, it's replaced as replies come in
+func (dbc *DBConnection) RecordJobRun(run *JobRun_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("schedule_runs")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": run.Id}, run, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get the runs of a job between the two times, newest first
+func (dbc *DBConnection) QueryJobRuns(jobId string, after time.Time, before time.Time) ([]JobRun_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("schedule_runs")
+
+	filter := bson.M{
+		"jobId": jobId,
+		"time": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying job runs: %v", err)
+	}
+	runs := make([]JobRun_Schema, 0)
+	err = cursor.All(context.Background(), &runs)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding job runs: %v", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory ScheduleStore
+type memScheduleStore struct {
+	lock sync.Mutex
+	jobs map[string]ScheduledJob_Schema
+	runs map[string]JobRun_Schema
+}
+
+func newMemScheduleStore() *memScheduleStore {
+	return &memScheduleStore{jobs: make(map[string]ScheduledJob_Schema), runs: make(map[string]JobRun_Schema)}
+}
+
+func (m *memScheduleStore) QueryScheduledJobs() ([]ScheduledJob_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jobs := make([]ScheduledJob_Schema, 0)
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (m *memScheduleStore) UpsertScheduledJob(job *ScheduledJob_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.jobs[job.Id] = *job
+	return nil
+}
+
+func (m *memScheduleStore) DeleteScheduledJob(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.jobs[id]
+	delete(m.jobs, id)
+	return ok, nil
+}
+
+func (m *memScheduleStore) RecordJobRun(run *JobRun_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.runs[run.Id] = *run
+	return nil
+}
+
+func (m *memScheduleStore) QueryJobRuns(jobId string, after time.Time, before time.Time) ([]JobRun_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	runs := make([]JobRun_Schema, 0)
+	for _, r := range m.runs {
+		if r.JobId == jobId {
+			runs = append(runs, r)
+		}
+	}
+	return runs, nil
+}
+
+func TestScheduledJobValidate(t *testing.T) {
+	at := time.Now()
+	ok := ScheduledJob_Schema{Devices: []string{"123", "456"}, Command: "$STATUS;{deviceId}", Cron: "0 2 * * *", Timezone: "UTC"}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("valid job: %v", err)
+	}
+	bad := []ScheduledJob_Schema{
+		{Devices: []string{"123"}, Command: "$STATUS;123", Cron: "0 2 * * *", At: &at},
+		{Devices: []string{"123"}, Command: "$STATUS;123"},
+		{Devices: []string{"123", "456"}, Command: "$STATUS;123", Cron: "0 2 * * *"},
+		{Devices: []string{"123"}, Command: "$STATUS;123", Cron: "0 25 * * *"},
+		{Devices: []string{"123"}, Command: "$STATUS;123", Cron: "0 2 * * *", Timezone: "Nowhere/Special"},
+		{Command: "$STATUS;123", Cron: "0 2 * * *"},
+		{Groups: []string{"buses"}, Command: "$STATUS;123", Cron: "0 2 * * *"},
+	}
+	byGroup := ScheduledJob_Schema{Groups: []string{"buses"}, Command: "$STATUS;{deviceId}", Cron: "0 2 * * *"}
+	if err := byGroup.Validate(); err != nil {
+		t.Fatalf("valid job by group: %v", err)
+	}
+	for i, job := range bad {
+		if err := job.Validate(); err == nil {
+			t.Errorf("bad job %v validated", i)
+		}
+	}
+}
+
+func TestScheduledJob_EmptyTimezoneIsLocal(t *testing.T) {
+	job := ScheduledJob_Schema{Enabled: true, Cron: "0 2 * * *"}
+	next := job.next(time.Now())
+	if next == nil || next.Location() != time.Local || next.Hour() != 2 {
+		t.Errorf("next = %v, want 02:00 server time", next)
+	}
+}
+
+func TestScheduler_RunAndReply(t *testing.T) {
+	store := newMemScheduleStore()
+	var lock sync.Mutex
+	sent := make([]string, 0)
+	send := func(msgWrap *MessageWrapper) error {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, msgWrap.message)
+		return nil
+	}
+	isConnected := func(devId string) bool { return devId != "789" }
+	s, _ := NewScheduler(zap.NewNop(), store, send, isConnected, NewReplyTracker(), nil)
+
+	at := time.Now().Add(time.Minute)
+	job := ScheduledJob_Schema{Id: "job", Devices: []string{"123", "456", "789"}, Command: "$STATUS;{deviceId}", At: &at, Enabled: true}
+	s.PutJob(&job)
+
+	// not due yet
+	s.tick(at.Add(-time.Second))
+	if runs, _ := store.QueryJobRuns("job", time.Time{}, time.Now()); len(runs) != 0 {
+		t.Fatalf("ran early")
+	}
+
+	run := s.RunJob(&job, at)
+	if fmt.Sprint(sent) != "[$STATUS;123 $STATUS;456]" {
+		t.Fatalf("sent %v", sent)
+	}
+	if run.Results[2].Status != JOB_FAILED {
+		t.Fatalf("offline device result %v, want %v", run.Results[2].Status, JOB_FAILED)
+	}
+
+	// a reply to something else, then the reply
+	devId := "456"
+	s.replies.ProcessMessage(&MessageWrapper{"$GPS;456;20240817-123504;A;0;0;0;0;0", &devId, at.Add(time.Second), DirectionFromDevice, 0})
+	s.replies.ProcessMessage(&MessageWrapper{"$STATUS;456;OK", &devId, at.Add(2 * time.Second), DirectionFromDevice, 0})
+	store.lock.Lock()
+	stored := store.runs[run.Id]
+	store.lock.Unlock()
+	if stored.Results[1].Status != JOB_REPLIED || stored.Results[1].Reply != "$STATUS;456;OK" {
+		t.Fatalf("reply not recorded: %+v", stored.Results[1])
+	}
+	if stored.Results[0].Status != JOB_SENT {
+		t.Fatalf("device that didn't reply is %v", stored.Results[0].Status)
+	}
+}
+
+func TestScheduler_OneShotRunsOnce(t *testing.T) {
+	store := newMemScheduleStore()
+	var lock sync.Mutex
+	runs := 0
+	send := func(msgWrap *MessageWrapper) error {
+		lock.Lock()
+		defer lock.Unlock()
+		runs++
+		return nil
+	}
+	s, _ := NewScheduler(zap.NewNop(), store, send, func(string) bool { return true }, NewReplyTracker(), nil)
+
+	at := time.Now().Add(-time.Minute)
+	s.PutJob(&ScheduledJob_Schema{Id: "job", Devices: []string{"123"}, Command: "$STATUS;123", At: &at, Enabled: true})
+	s.tick(time.Now())
+	s.tick(time.Now())
+	waitFor(t, "the job to run", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return runs == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	if runs != 1 {
+		t.Fatalf("one shot job ran %v times", runs)
+	}
+	lock.Unlock()
+	job, _ := s.GetJob("job")
+	if job.NextRun != nil || job.LastRun == nil {
+		t.Fatalf("one shot job after running: next %v last %v", job.NextRun, job.LastRun)
+	}
+
+	// reloading doesn't run it again
+	s2, _ := NewScheduler(zap.NewNop(), store, send, func(string) bool { return true }, NewReplyTracker(), nil)
+	if job, _ := s2.GetJob("job"); job.NextRun != nil {
+		t.Fatalf("reloaded one shot job is due again at %v", job.NextRun)
+	}
+}
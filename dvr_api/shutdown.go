@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+SHUTDOWN
+On SIGINT or SIGTERM the servers stop accepting connections and hang up on the ones they have, API
+clients getting a close frame, and the jobs that send commands stop. Then what's been received is
+processed, the rest of the background jobs stop, and everything is written to the database before
+it's disconnected. Each step waits for the one before, and the lot has to finish within
+the shutdownTimeout in the config or we give up and exit anyway.
+~~~~~~~~~~~~~~~
+*/
+
+// one thing to do on the way down
+type shutdownStep struct {
+	name string
+	fn   func() error
+}
+
+// run the steps in order, giving up if they haven't all finished within the timeout. Errors from a
+// step are logged and the next one runs anyway.
+func runShutdown(logger *zap.Logger, timeout time.Duration, steps ...shutdownStep) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, step := range steps {
+			start := time.Now()
+			err := step.fn()
+			if err != nil {
+				logger.Error("error shutting down", zap.String("step", step.name), zap.Error(err))
+				continue
+			}
+			logger.Info("shut down", zap.String("step", step.name), zap.Duration("took", time.Since(start)))
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("shutdown didn't finish within %v", timeout)
+	}
+}
+
+// a server's open connections, so they can be closed on shutdown and their handlers waited for
+type connSet[T comparable] struct {
+	conns    map[T]struct{}
+	closing  bool
+	handlers sync.WaitGroup
+	lock     sync.Mutex
+}
+
+// track a connection while its handler runs. False if the server is shutting down, close it instead.
+func (cs *connSet[T]) Add(conn T) bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.closing {
+		return false
+	}
+	if cs.conns == nil {
+		cs.conns = make(map[T]struct{})
+	}
+	cs.conns[conn] = struct{}{}
+	cs.handlers.Add(1)
+	return true
+}
+
+// the connection's handler has finished with it
+func (cs *connSet[T]) Done(conn T) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	delete(cs.conns, conn)
+	cs.handlers.Done()
+}
+
+// refuse new connections, close the open ones all at once and wait for their handlers to finish
+func (cs *connSet[T]) CloseAll(close func(conn T)) {
+	cs.lock.Lock()
+	cs.closing = true
+	for conn := range cs.conns {
+		go close(conn)
+	}
+	cs.lock.Unlock()
+	cs.handlers.Wait()
+}
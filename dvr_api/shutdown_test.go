@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRunShutdown(t *testing.T) {
+	order := make([]string, 0)
+	step := func(name string, err error) shutdownStep {
+		return shutdownStep{name, func() error {
+			order = append(order, name)
+			return err
+		}}
+	}
+	err := runShutdown(zap.NewNop(), time.Second, step("servers", nil), step("intake", fmt.Errorf("oops")), step("database", nil))
+	if err != nil || fmt.Sprint(order) != "[servers intake database]" {
+		t.Errorf("expected every step in order despite the error, got %v %v", order, err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	err = runShutdown(zap.NewNop(), 50*time.Millisecond, shutdownStep{"stuck", func() error {
+		<-block
+		return nil
+	}})
+	if err == nil {
+		t.Errorf("expected a step that doesn't finish to time out")
+	}
+}
+
+func TestConnSet(t *testing.T) {
+	var cs connSet[net.Conn]
+	a, b := net.Pipe()
+	if !cs.Add(a) {
+		t.Fatal("expected a connection to be accepted")
+	}
+	// the handler finishes once its connection is closed
+	go func() {
+		defer cs.Done(a)
+		a.Read(make([]byte, 1))
+	}()
+	done := make(chan struct{})
+	go func() {
+		cs.CloseAll(func(c net.Conn) { c.Close() })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected CloseAll to close the connection and wait for its handler")
+	}
+	if cs.Add(b) {
+		t.Errorf("expected connections to be refused once closing")
+	}
+}
+
+func TestMsgIntake_Drain(t *testing.T) {
+	logger := zap.NewNop()
+	devices, err := NewDeviceSvr(logger, "127.0.0.1:0", 4, 64, 8, OVERLOAD_BLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := NewWebSockSvr(logger, "127.0.0.1:0", 4, 64, 8, OVERLOAD_BLOCK, devices.connIndex.GetAllKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(*MessageWrapper) error { return nil }
+	publishEvent := func(*DeviceEvent) error { return nil }
+	mh, _ := NewMessageHandler(logger, devices, clients, nil, publish, publishEvent)
+	store := &memWriteBehindStore{}
+	writer := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+	mh.SetWriteBehind(writer)
+
+	// left on the queue when the servers stopped
+	devId := "123"
+	for i := 0; i < 2; i++ {
+		devices.svrMsgQueue.Push(devId, MessageWrapper{fmt.Sprintf("$HEARTBEAT;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = mh.MsgIntake(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer writes what's queued on its way out
+	writerCtx, stopWriter := context.WithCancel(context.Background())
+	stopWriter()
+	writer.Run(writerCtx)
+	if len(store.messages) != 2 {
+		t.Errorf("expected the queued messages to be written, got %v", store.messages)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+~~~~~~~~~~~~~~~
+SPILL BUFFER
+Where the database writer puts what it can't write while the database is down, to be replayed in
+order once it's back. Kept on disk as segment files of newline delimited json, named by sequence
+number so the oldest sorts first. Each append is synced before it returns, so a crash doesn't lose
+what was spilled. The buffer is bounded, once it's full appends are refused.
+~~~~~~~~~~~~~~~
+*/
+
+const (
+	SPILL_SEGMENT_BYTES int64  = 4 << 20 // start a new segment once the current one is this big
+	SPILL_SEGMENT_EXT   string = ".ndjson"
+)
+
+var errSpillFull = errors.New("spill buffer is full")
+
+// a message or position as it's kept on disk
+type spillRecord struct {
+	Message   string           `json:"message,omitempty"`
+	ClientId  string           `json:"clientId,omitempty"`
+	RecvdTime time.Time        `json:"receivedTime,omitempty"`
+	Direction MsgDirection     `json:"direction,omitempty"`
+	Position  *Position_Schema `json:"position,omitempty"`
+	Queued    time.Time        `json:"queued"`
+}
+
+func newSpillRecord(pw *pendingWrite) spillRecord {
+	rec := spillRecord{Position: pw.pos, Queued: pw.queued}
+	if pw.msg != nil {
+		rec.Message = pw.msg.message
+		rec.RecvdTime = pw.msg.recvdTime
+		rec.Direction = pw.msg.direction
+		if pw.msg.clientId != nil {
+			rec.ClientId = *pw.msg.clientId
+		}
+	}
+	return rec
+}
+
+func (rec *spillRecord) pendingWrite() pendingWrite {
+	if rec.Position != nil {
+		return pendingWrite{pos: rec.Position, queued: rec.Queued}
+	}
+	clientId := rec.ClientId
+	return pendingWrite{msg: &MessageWrapper{rec.Message, &clientId, rec.RecvdTime, rec.Direction, 0}, queued: rec.Queued}
+}
+
+// how full the spill buffer is, sent to API clients
+type SpillStats_Response struct {
+	Bytes    int64     `json:"bytes"`
+	MaxBytes int64     `json:"maxBytes"`
+	Segments int       `json:"segments"`
+	Oldest   time.Time `json:"oldest"` // when the oldest spilled write was queued, zero if there isn't one
+}
+
+// segment files of pending writes
+type SpillBuffer struct {
+	// internal
+	segments []string // file names, oldest first
+	bytes    int64    // size of all the segments
+	cur      *os.File // the newest segment if it's open for appending
+	curBytes int64
+	next     int       // sequence number of the next segment
+	oldest   time.Time // when the first write in the oldest segment was queued
+	lock     sync.Mutex
+
+	// injected
+	dir      string
+	maxBytes int64
+}
+
+// constructor, picks up the segments left from before
+func NewSpillBuffer(dir string, maxBytes int64) (*SpillBuffer, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating spill directory: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spill directory: %v", err)
+	}
+	sb := &SpillBuffer{dir: dir, maxBytes: maxBytes, segments: make([]string, 0)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SPILL_SEGMENT_EXT) {
+			continue
+		}
+		var seq int
+		if _, err := fmt.Sscanf(name, "%d"+SPILL_SEGMENT_EXT, &seq); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("error reading spill segment: %v", err)
+		}
+		sb.segments = append(sb.segments, name)
+		sb.bytes += info.Size()
+		sb.next = max(sb.next, seq+1)
+	}
+	sort.Strings(sb.segments)
+	if len(sb.segments) > 0 {
+		sb.oldest = sb.firstQueued(sb.segments[0])
+	}
+	return sb, nil
+}
+
+// add writes to the end of the buffer, synced to disk before returning
+func (sb *SpillBuffer) Append(batch []pendingWrite) error {
+	var buf strings.Builder
+	for i := range batch {
+		line, err := json.Marshal(newSpillRecord(&batch[i]))
+		if err != nil {
+			return fmt.Errorf("error encoding spill record: %v", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if sb.bytes+int64(buf.Len()) > sb.maxBytes {
+		return errSpillFull
+	}
+	wasEmpty := len(sb.segments) == 0
+	if sb.cur == nil || sb.curBytes >= SPILL_SEGMENT_BYTES {
+		err := sb.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := sb.cur.WriteString(buf.String())
+	if err == nil {
+		err = sb.cur.Sync()
+	}
+	if err != nil {
+		// cut off what got written so the segment doesn't end in a torn record. If we can't, the
+		// segment is left as it is and appends carry on in a new one, its reader stops at the tear.
+		if truncErr := sb.cur.Truncate(sb.curBytes); truncErr != nil {
+			sb.curBytes += int64(n)
+			sb.bytes += int64(n)
+			sb.closeCurrent()
+		}
+		return fmt.Errorf("error writing spill segment: %v", err)
+	}
+	if wasEmpty && len(batch) > 0 {
+		sb.oldest = batch[0].queued
+	}
+	sb.curBytes += int64(n)
+	sb.bytes += int64(n)
+	return nil
+}
+
+// close the current segment and open a new one
+func (sb *SpillBuffer) rotate() error {
+	sb.closeCurrent()
+	name := fmt.Sprintf("%012d%v", sb.next, SPILL_SEGMENT_EXT)
+	f, err := os.OpenFile(filepath.Join(sb.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error creating spill segment: %v", err)
+	}
+	sb.next++
+	sb.cur = f
+	sb.curBytes = 0
+	sb.segments = append(sb.segments, name)
+	return nil
+}
+
+func (sb *SpillBuffer) closeCurrent() {
+	if sb.cur != nil {
+		sb.cur.Close()
+		sb.cur = nil
+	}
+}
+
+// read the oldest segment, "" if there aren't any. Further appends go to a new segment.
+func (sb *SpillBuffer) Oldest() (string, []pendingWrite, error) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if len(sb.segments) == 0 {
+		return "", nil, nil
+	}
+	name := sb.segments[0]
+	if len(sb.segments) == 1 {
+		sb.closeCurrent()
+	}
+
+	f, err := os.Open(filepath.Join(sb.dir, name))
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening spill segment: %v", err)
+	}
+	defer f.Close()
+	batch := make([]pendingWrite, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var rec spillRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			// a line cut short by a crash mid write, nothing after it was synced
+			break
+		}
+		batch = append(batch, rec.pendingWrite())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, fmt.Errorf("error reading spill segment: %v", err)
+	}
+	return name, batch, nil
+}
+
+// replace a segment with what's left of it, removing it if nothing is
+func (sb *SpillBuffer) Replace(name string, remaining []pendingWrite) error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if len(sb.segments) == 0 || sb.segments[0] != name {
+		return fmt.Errorf("%v isn't the oldest spill segment", name)
+	}
+	path := filepath.Join(sb.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error reading spill segment: %v", err)
+	}
+
+	if len(remaining) == 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("error removing spill segment: %v", err)
+		}
+		sb.segments = sb.segments[1:]
+		sb.bytes -= info.Size()
+		sb.oldest = time.Time{}
+		if len(sb.segments) > 0 {
+			sb.oldest = sb.firstQueued(sb.segments[0])
+		}
+		return nil
+	}
+
+	// write the rest to the side and swap it in, so a crash leaves one or the other
+	var buf strings.Builder
+	for i := range remaining {
+		line, err := json.Marshal(newSpillRecord(&remaining[i]))
+		if err != nil {
+			return fmt.Errorf("error encoding spill record: %v", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(buf.String()), 0o644)
+	if err != nil {
+		return fmt.Errorf("error rewriting spill segment: %v", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("error rewriting spill segment: %v", err)
+	}
+	sb.bytes += int64(buf.Len()) - info.Size()
+	sb.oldest = remaining[0].queued
+	return nil
+}
+
+// when the first write in a segment was queued, zero if it can't be read
+func (sb *SpillBuffer) firstQueued(name string) time.Time {
+	f, err := os.Open(filepath.Join(sb.dir, name))
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return time.Time{}
+	}
+	var rec spillRecord
+	if json.Unmarshal(line, &rec) != nil {
+		return time.Time{}
+	}
+	return rec.Queued
+}
+
+// is there anything spilled
+func (sb *SpillBuffer) IsEmpty() bool {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return len(sb.segments) == 0
+}
+
+// how full it is
+func (sb *SpillBuffer) Stats() SpillStats_Response {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return SpillStats_Response{Bytes: sb.bytes, MaxBytes: sb.maxBytes, Segments: len(sb.segments), Oldest: sb.oldest}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func spillBatchOf(from int, to int, queued time.Time) []pendingWrite {
+	devId := "123"
+	batch := make([]pendingWrite, 0)
+	for i := from; i < to; i++ {
+		batch = append(batch, pendingWrite{msg: &MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, queued, DirectionFromDevice, 0}, queued: queued})
+	}
+	return batch
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := NewSpillBuffer(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := time.Date(2024, 8, 17, 9, 0, 0, 0, time.UTC)
+	if err := sb.Append(spillBatchOf(0, 10, queued)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Append([]pendingWrite{{pos: &Position_Schema{DeviceId: "123", Speed: 40}, queued: queued.Add(time.Minute)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// what's there is picked up again after a restart
+	sb, err = NewSpillBuffer(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sb.Stats()
+	if stats.Segments != 1 || stats.Bytes == 0 || !stats.Oldest.Equal(queued) {
+		t.Errorf("expected 1 segment queued at %v, got %+v", queued, stats)
+	}
+	// appends after reading go to a new segment
+	name, batch, err := sb.Oldest()
+	if err != nil || len(batch) != 11 {
+		t.Fatalf("expected 11 spilled writes, got %v %v", len(batch), err)
+	}
+	if batch[3].msg.message != "$GPS;123;3" || *batch[3].msg.clientId != "123" || batch[10].pos == nil || batch[10].pos.Speed != 40 {
+		t.Errorf("spilled writes didn't come back as they went in: %+v %+v", batch[3].msg, batch[10])
+	}
+	if err := sb.Append(spillBatchOf(10, 12, queued.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Stats().Segments != 2 {
+		t.Errorf("expected a second segment, got %+v", sb.Stats())
+	}
+
+	// keep the last 5
+	if err := sb.Replace(name, batch[6:]); err != nil {
+		t.Fatal(err)
+	}
+	_, batch, _ = sb.Oldest()
+	if len(batch) != 5 || batch[0].msg.message != "$GPS;123;6" || !sb.Stats().Oldest.Equal(queued) {
+		t.Errorf("expected the last 5 to be kept, got %v", len(batch))
+	}
+	if err := sb.Replace(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	name, batch, _ = sb.Oldest()
+	if len(batch) != 2 || !sb.Stats().Oldest.Equal(queued.Add(time.Hour)) {
+		t.Errorf("expected the second segment to be next, got %v %+v", len(batch), sb.Stats())
+	}
+	if err := sb.Replace(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !sb.IsEmpty() || sb.Stats().Bytes != 0 {
+		t.Errorf("expected an empty buffer, got %+v", sb.Stats())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected the segments to be removed, got %v files", len(entries))
+	}
+}
+
+func TestSpillBuffer_Full(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := NewSpillBuffer(dir, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Append(spillBatchOf(0, 2, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Append(spillBatchOf(2, 20, time.Now())); err != errSpillFull {
+		t.Errorf("expected the buffer to be full, got %v", err)
+	}
+
+	// a line cut short by a crash is left off
+	sb.closeCurrent()
+	f, _ := os.OpenFile(filepath.Join(dir, sb.segments[0]), os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"message":"$GPS;12`)
+	f.Close()
+	_, batch, err := sb.Oldest()
+	if err != nil || len(batch) != 2 {
+		t.Errorf("expected the 2 whole writes, got %v %v", len(batch), err)
+	}
+}
+
+func TestSpillBuffer_WriteFails(t *testing.T) {
+	sb, err := NewSpillBuffer(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Append(spillBatchOf(0, 2, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	bytes := sb.Stats().Bytes
+
+	// the segment can't be written to any more, so it's left and the next append starts another
+	sb.cur.Close()
+	if err := sb.Append(spillBatchOf(2, 4, time.Now())); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if sb.cur != nil || sb.Stats().Bytes != bytes {
+		t.Errorf("expected the failed segment closed with %v bytes, got %+v", bytes, sb.Stats())
+	}
+	if err := sb.Append(spillBatchOf(4, 6, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Stats().Segments != 2 {
+		t.Errorf("expected a second segment, got %+v", sb.Stats())
+	}
+	_, batch, err := sb.Oldest()
+	if err != nil || len(batch) != 2 {
+		t.Errorf("expected the 2 writes from before, got %v %v", len(batch), err)
+	}
+}
+
+func TestWriteBehind_Spill(t *testing.T) {
+	store := &memWriteBehindStore{failures: WRITE_MAX_ATTEMPTS}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+	spill, err := NewSpillBuffer(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.SetSpill(spill)
+
+	devId := "123"
+	record := func(from int, to int) {
+		for i := from; i < to; i++ {
+			wb.RecordMessage(&MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+		}
+		wb.Flush()
+	}
+	// 3 of the first 4 go in before it gives up, the last is spilled along with everything after
+	record(0, 4)
+	record(4, 8)
+	stats := wb.Stats(time.Now())
+	if !stats.Spilling || stats.Spilled != 5 || stats.Dropped != 0 || stats.Spill.Segments == 0 {
+		t.Errorf("expected 5 spilled, got %+v %+v", stats, stats.Spill)
+	}
+	if len(store.messages) != 3 {
+		t.Errorf("expected nothing written while spilling, got %v", len(store.messages))
+	}
+
+	// the database is back, replay in order then go back to writing
+	if err := wb.replay(time.Now().Add(SPILL_REPLAY_INTERVAL)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wb.replay(time.Now().Add(SPILL_REPLAY_INTERVAL)); err != nil {
+		t.Fatal(err)
+	}
+	record(8, 10)
+	stats = wb.Stats(time.Now())
+	if stats.Spilling || stats.Replayed != 5 || stats.Spill.Segments != 0 {
+		t.Errorf("expected the spill to be replayed, got %+v %+v", stats, stats.Spill)
+	}
+	if len(store.messages) != 10 {
+		t.Fatalf("expected 10 messages, got %v", len(store.messages))
+	}
+	for i, msg := range store.messages {
+		if msg != fmt.Sprintf("$GPS;123;%v", i) {
+			t.Fatalf("messages out of order at %v: %v", i, msg)
+		}
+	}
+}
+
+func TestWriteBehind_ShutdownSpills(t *testing.T) {
+	store := &memWriteBehindStore{failures: WRITE_MAX_ATTEMPTS}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+	wb.backoff = time.Hour
+	spill, err := NewSpillBuffer(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.SetSpill(spill)
+
+	devId := "123"
+	for i := 0; i < 4; i++ {
+		wb.RecordMessage(&MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	// no waiting out the backoff on the way down, what fails is spilled straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wb.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the writer to stop without retrying")
+	}
+	stats := wb.Stats(time.Now())
+	if store.calls != 1 || len(store.messages) != 2 || stats.Spilled != 2 || stats.Retries != 0 {
+		t.Errorf("expected 2 written and 2 spilled in one attempt, got %v calls %v written %+v", store.calls, len(store.messages), stats)
+	}
+}
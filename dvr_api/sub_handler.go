@@ -13,7 +13,7 @@ type SubscriptionHandler struct {
 
 	// internal
 	subscriptions map[string]map[string]string // device ids against connections. Use internal map just for indexing the keys
-	lock          sync.Mutex                   // might be uneccessary
+	lock          sync.Mutex                   // Subscribe and Publish are called from different goroutines
 
 	// injected
 	logger  *zap.Logger
@@ -34,24 +34,32 @@ func NewSubscriptionHandler(logger *zap.Logger, devices *DeviceSvr, clients *Web
 	return r, nil
 }
 
-func (sh *SubscriptionHandler) SubIntake() error {
+func (sh *SubscriptionHandler) SubIntake(ctx context.Context) error {
 	// handle messages, main program loop
 	for i := 0; ; i++ {
+		select {
 		// process one message received from the API server
-		subReq, ok := <-sh.clients.svrSubReqBufChan
-		if ok {
-			err := sh.Subscribe(&subReq)
-			if err != nil {
-				sh.logger.Error("error processing subscription request: %v", zap.Error(err))
+		case subReq, ok := <-sh.clients.svrSubReqBufChan:
+			if ok {
+				err := sh.Subscribe(&subReq)
+				if err != nil {
+					sh.logger.Error("error processing subscription request: %v", zap.Error(err))
+				}
+			} else {
+				sh.logger.Error("Couldn't receive value from svrSubReqBufChan")
 			}
-		} else {
-			sh.logger.Error("Couldn't receive value from svrSubReqBufChan")
+		// the api server has stopped, there's no one left to subscribe
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
 // add the subscription requester's connection onto the list of subscribers for each device
 func (sh *SubscriptionHandler) Subscribe(subReq *SubReqWrapper) error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
 	// delete old subs
 	for _, val := range subReq.oldDevlist {
 		// if the map that holds subs isn't inited then just continue
@@ -74,31 +82,66 @@ func (sh *SubscriptionHandler) Subscribe(subReq *SubReqWrapper) error {
 
 // publish a message. This function works
 func (sh *SubscriptionHandler) Publish(msgWrap *MessageWrapper) error {
-	// check if there are even eny susbcribers
-	if sh.subscriptions[*msgWrap.clientId] == nil {
-		return nil
+	packTime, _ := getDateFromMessage(msgWrap.message)
+	sh.broadcast(*msgWrap.clientId, func(client *wsClient) any {
+		return &DeviceMessage_Response{msgWrap.recvdTime, packTime, msgWrap.message, msgWrap.direction.ForWsVersion(client.apiVersion)}
+	})
+	// no err
+	return nil
+}
+
+// publish an event about a device. Only v2 clients know what to do with events, v1 clients don't get them.
+func (sh *SubscriptionHandler) PublishEvent(event *DeviceEvent) error {
+	sh.broadcast(event.DeviceId, func(client *wsClient) any {
+		if client.apiVersion < API_V2 {
+			return nil
+		}
+		return event
+	})
+	// no err
+	return nil
+}
+
+// write to every subscriber of a device. build returns what to send to that subscriber, or nil to skip them.
+func (sh *SubscriptionHandler) broadcast(devId string, build func(client *wsClient) any) {
+	// copy the subscriber list so we aren't holding the lock while writing
+	sh.lock.Lock()
+	subscribers := make([]string, 0, len(sh.subscriptions[devId]))
+	for k := range sh.subscriptions[devId] {
+		subscribers = append(subscribers, k)
 	}
+	sh.lock.Unlock()
+
 	// broadcast message to subscribers
-	for k, _ := range sh.subscriptions[*msgWrap.clientId] {
+	for _, k := range subscribers {
 		// get the websocket connection associated with the id stored in the sub list
-		conn, ok := sh.clients.connIndex.Get(k)
+		client, ok := sh.clients.connIndex.Get(k)
 		if !ok {
 			// if client doesn't exist remove its entry in the map and continue
-			delete(sh.subscriptions[*msgWrap.clientId], k)
+			sh.unsubscribe(devId, k)
+			continue
+		}
+		res := build(client)
+		if res == nil {
 			continue
 		}
-		packTime, err := getDateFromMessage(msgWrap.message)
-		devMsg := &DeviceMessage_Response{msgWrap.recvdTime, packTime, msgWrap.message, "from"}
 		// send message to this subscriber
-		err = wsjson.Write(context.TODO(), conn, devMsg)
+		err := wsjson.Write(context.TODO(), client.conn, res)
 		if err != nil {
-			delete(sh.subscriptions[*msgWrap.clientId], k)
+			sh.unsubscribe(devId, k)
 			sh.logger.Debug("removed subscriber %v from subscription list because a write operation failed", zap.String("k", k))
 			continue
 		}
 	}
-	// no err
-	return nil
+}
+
+// remove one client from the subscribers of a device
+func (sh *SubscriptionHandler) unsubscribe(devId string, clientId string) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if sh.subscriptions[devId] != nil {
+		delete(sh.subscriptions[devId], clientId)
+	}
 }
 
 // not used
@@ -113,14 +156,14 @@ func (sh *SubscriptionHandler) PublishConnectedDevices(msgWrap *MessageWrapper)
 	// broadcast message to subscribers
 	for _, k := range connectedDevices {
 		// get the websocket connection associated with the id stored in the sub list
-		conn, ok := sh.clients.connIndex.Get(k)
+		client, ok := sh.clients.connIndex.Get(k)
 		if !ok {
 			continue
 		}
 		// send message to this subscriber
-		err := wsjson.Write(context.TODO(), conn, connectedDevList)
+		err := wsjson.Write(context.TODO(), client.conn, connectedDevList)
 		if err != nil {
-			delete(sh.subscriptions[*msgWrap.clientId], k)
+			sh.unsubscribe(*msgWrap.clientId, k)
 			sh.logger.Debug("removed subscriber %v from subscription list because a write operation failed", zap.String("k", k))
 			continue
 		}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+TRIPS
+Split each device's fixes into journeys. A trip starts when the device moves off from where it was
+parked and ends when it has been stopped for TRIP_STOP_DURATION, the ignition goes off, or the fixes
+stop coming for TRIP_MAX_GAP. A trip that ended on a stop ends where the device stopped, not when we
+noticed. Trips shorter than TRIP_MIN_DISTANCE_METERS are gps drift and are dropped.
+
+Devices that report their ignition do so in the format:
+$IGN;[DeviceID];[time];[ON|OFF]<CR>
+ex: $IGN;123456;20240817-123504;OFF\r
+~~~~~~~~~~~~~~~
+*/
+
+const (
+	TRIP_START_SPEED_KMH     float64       = 5                // moving off at this speed starts a trip
+	TRIP_STOP_SPEED_KMH      float64       = 3                // slower than this counts as stopped
+	TRIP_STOP_DURATION       time.Duration = 3 * time.Minute  // stopped for this long ends a trip
+	TRIP_MAX_GAP             time.Duration = 10 * time.Minute // no fixes for this long ends a trip
+	TRIP_MIN_DISTANCE_METERS float64       = 100              // shorter trips are dropped
+	TRIP_CHECK_INTERVAL      time.Duration = 30 * time.Second // how often trips in progress are saved and checked for missing fixes
+)
+
+// why a trip ended
+const (
+	TRIP_END_STOPPED  string = "stopped"
+	TRIP_END_IGNITION string = "ignitionOff"
+	TRIP_END_NO_FIXES string = "noFixes"
+)
+
+// a journey, stored in mongodb and sent to API clients as is
+type Trip_Schema struct {
+	Id              string    `bson:"_id" json:"id"`
+	DeviceId        string    `bson:"deviceId" json:"deviceId"`
+	InProgress      bool      `bson:"inProgress" json:"inProgress"` // the end is the last fix so far
+	StartTime       time.Time `bson:"startTime" json:"startTime"`
+	EndTime         time.Time `bson:"endTime" json:"endTime"`
+	Start           LatLon    `bson:"start" json:"start"`
+	End             LatLon    `bson:"end" json:"end"`
+	DistanceMeters  float64   `bson:"distanceMeters" json:"distanceMeters"`
+	DurationSeconds float64   `bson:"durationSeconds" json:"durationSeconds"`
+	MaxSpeed        float64   `bson:"maxSpeed" json:"maxSpeed"` // km/h
+	EndReason       string    `bson:"endReason,omitempty" json:"endReason,omitempty"`
+}
+
+// where trips are kept, the DBConnection outside of tests
+type TripStore interface {
+	UpsertTrip(trip *Trip_Schema) error
+	DeleteTrip(id string) (bool, error)
+	QueryTrips(devices []string, after time.Time, before time.Time) ([]Trip_Schema, error)
+	QueryOpenTrips() ([]Trip_Schema, error)
+}
+
+// where a device is in its trip
+type tripState struct {
+	trip         *Trip_Schema     // nil when parked
+	saved        bool             // trip is in the store
+	dirty        bool             // trip has changed since it was saved
+	last         *Position_Schema // last valid fix, nil if none yet
+	stopped      *Position_Schema // first fix of the stop the device is in, nil if moving
+	stopDistance float64          // trip distance when it stopped
+	pending      []tripChange     // to save, oldest first
+	saving       sync.Mutex       // held while saving, so a device's changes reach the store in the order they were made
+}
+
+// a trip to save, or drop if it was too short
+type tripChange struct {
+	trip    Trip_Schema
+	dropped bool
+	publish bool // it's new or it's ended, we don't publish every save in between
+}
+
+// segments positions into trips
+type TripDetector struct {
+	// internal
+	states map[string]*tripState // device id against state
+	lock   sync.Mutex            // positions come in from the message handler, checks from the timer
+
+	// injected
+	logger       *zap.Logger
+	store        TripStore
+	publishEvent PublishEventFunction // this func is meant to publish an event about a device to subscribers
+	directory    *DeviceDirectory     // resolves the groups and tags in fleet reports, nil if not set
+}
+
+// constructor, picks up the trips that were in progress
+func NewTripDetector(logger *zap.Logger, store TripStore, publishEvent PublishEventFunction, directory *DeviceDirectory) (*TripDetector, error) {
+	td := &TripDetector{
+		states:       make(map[string]*tripState),
+		logger:       logger,
+		store:        store,
+		publishEvent: publishEvent,
+		directory:    directory,
+	}
+	trips, err := store.QueryOpenTrips()
+	if err != nil {
+		return nil, fmt.Errorf("error loading trips in progress: %v", err)
+	}
+	now := time.Now()
+	for i := range trips {
+		trip := trips[i]
+		// carry on from the end, giving the device TRIP_MAX_GAP from now to send another fix
+		last := &Position_Schema{DeviceId: trip.DeviceId, FixTime: trip.EndTime, RecvdTime: now, Valid: true, Latitude: trip.End.Lat, Longitude: trip.End.Lon}
+		td.states[trip.DeviceId] = &tripState{trip: &trip, saved: true, last: last}
+	}
+	return td, nil
+}
+
+// segment a position, meant to be registered as a position hook
+func (td *TripDetector) ProcessPosition(pos *Position_Schema) error {
+	if !pos.Valid {
+		return nil
+	}
+	return td.apply(td.evaluate(pos))
+}
+
+// end the trip when the ignition goes off, meant to be registered as a message hook
+func (td *TripDetector) ProcessMessage(msgWrap *MessageWrapper) error {
+	if getCommandFromMessage(msgWrap.message) != "IGN" {
+		return nil
+	}
+	fields := strings.Split(strings.TrimSpace(msgWrap.message), ";")
+	if len(fields) < 4 {
+		return fmt.Errorf("not a complete ignition message: %q", msgWrap.message)
+	}
+	if !strings.EqualFold(fields[3], "OFF") {
+		return nil
+	}
+	td.lock.Lock()
+	var pending []*tripState
+	if st, ok := td.states[*msgWrap.clientId]; ok && st.trip != nil {
+		td.queue(st, td.end(st, TRIP_END_IGNITION))
+		pending = append(pending, st)
+	}
+	td.lock.Unlock()
+	return td.apply(pending)
+}
+
+// queue a change to be saved. Lock must be held.
+func (td *TripDetector) queue(st *tripState, change tripChange) {
+	if change.trip.Id != "" {
+		st.pending = append(st.pending, change)
+	}
+}
+
+// move a device's trip along with a position, returning the device if it has changes to save
+func (td *TripDetector) evaluate(pos *Position_Schema) []*tripState {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	st, ok := td.states[pos.DeviceId]
+	if !ok {
+		st = &tripState{}
+		td.states[pos.DeviceId] = st
+	}
+	if st.last != nil && !pos.FixTime.After(st.last.FixTime) {
+		// repeated or out of order, the trip has moved past it
+		return nil
+	}
+
+	if st.trip != nil && pos.FixTime.Sub(st.last.FixTime) > TRIP_MAX_GAP {
+		td.queue(st, td.end(st, TRIP_END_NO_FIXES))
+	}
+
+	if st.trip == nil {
+		if pos.Speed >= TRIP_START_SPEED_KMH {
+			// it moved off from where it was parked, if we know
+			from := pos
+			if st.last != nil && pos.FixTime.Sub(st.last.FixTime) <= TRIP_MAX_GAP {
+				from = st.last
+			}
+			st.trip = &Trip_Schema{
+				Id:         uuid.New().String(),
+				DeviceId:   pos.DeviceId,
+				InProgress: true,
+				StartTime:  from.FixTime,
+				Start:      LatLon{from.Latitude, from.Longitude},
+				MaxSpeed:   from.Speed,
+			}
+			st.saved = false
+			st.stopped = nil
+			td.extend(st, from, pos)
+		}
+	} else {
+		td.extend(st, st.last, pos)
+		if pos.Speed >= TRIP_STOP_SPEED_KMH {
+			st.stopped = nil
+		} else if st.stopped == nil {
+			st.stopped = pos
+			st.stopDistance = st.trip.DistanceMeters
+		} else if pos.FixTime.Sub(st.stopped.FixTime) >= TRIP_STOP_DURATION {
+			td.queue(st, td.end(st, TRIP_END_STOPPED))
+		}
+	}
+	st.last = pos
+	if len(st.pending) == 0 {
+		return nil
+	}
+	return []*tripState{st}
+}
+
+// add the segment between two fixes to the trip
+func (td *TripDetector) extend(st *tripState, from *Position_Schema, to *Position_Schema) {
+	trip := st.trip
+	if from != to {
+		trip.DistanceMeters += distanceMeters(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	}
+	if to.Speed > trip.MaxSpeed {
+		trip.MaxSpeed = to.Speed
+	}
+	trip.EndTime = to.FixTime
+	trip.End = LatLon{to.Latitude, to.Longitude}
+	trip.DurationSeconds = trip.EndTime.Sub(trip.StartTime).Seconds()
+	st.dirty = true
+}
+
+// end a device's trip where it stopped, or at the last fix if it didn't
+func (td *TripDetector) end(st *tripState, reason string) tripChange {
+	trip := st.trip
+	if st.stopped != nil {
+		trip.EndTime = st.stopped.FixTime
+		trip.End = LatLon{st.stopped.Latitude, st.stopped.Longitude}
+		trip.DistanceMeters = st.stopDistance
+		trip.DurationSeconds = trip.EndTime.Sub(trip.StartTime).Seconds()
+	}
+	trip.InProgress = false
+	trip.EndReason = reason
+
+	change := tripChange{trip: *trip, publish: true}
+	if trip.DistanceMeters < TRIP_MIN_DISTANCE_METERS {
+		change.dropped = true
+	}
+	if change.dropped && !st.saved {
+		// never saved, so nothing to do
+		change = tripChange{}
+	}
+	st.trip = nil
+	st.saved = false
+	st.dirty = false
+	st.stopped = nil
+	return change
+}
+
+// save the devices' queued changes. Whoever holds a device's saving lock saves everything queued for
+// it, so a snapshot taken before a trip ended can't be saved after the end and undo it.
+func (td *TripDetector) apply(pending []*tripState) error {
+	var firstErr error
+	for _, st := range pending {
+		st.saving.Lock()
+		td.lock.Lock()
+		changes := st.pending
+		st.pending = nil
+		td.lock.Unlock()
+
+		for i := range changes {
+			err := td.save(&changes[i])
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		st.saving.Unlock()
+	}
+	return firstErr
+}
+
+// save, drop and publish a trip
+func (td *TripDetector) save(change *tripChange) error {
+	if change.dropped {
+		_, err := td.store.DeleteTrip(change.trip.Id)
+		if err != nil {
+			return fmt.Errorf("error dropping trip: %v", err)
+		}
+		return nil
+	}
+	err := td.store.UpsertTrip(&change.trip)
+	if err != nil {
+		return fmt.Errorf("error saving trip: %v", err)
+	}
+	if !change.publish {
+		return nil
+	}
+	err = td.publishEvent(&DeviceEvent{EVENT_TRIP, change.trip.DeviceId, change.trip.EndTime, &change.trip})
+	if err != nil {
+		return fmt.Errorf("error publishing trip: %v", err)
+	}
+	return nil
+}
+
+// end the trips of devices that have stopped sending fixes, and save the ones in progress. Returns
+// the devices with changes to save.
+func (td *TripDetector) check(now time.Time) []*tripState {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	pending := make([]*tripState, 0)
+	for _, st := range td.states {
+		if st.trip == nil {
+			continue
+		}
+		if now.Sub(st.last.RecvdTime) > TRIP_MAX_GAP {
+			td.queue(st, td.end(st, TRIP_END_NO_FIXES))
+		} else if st.dirty && st.trip.DistanceMeters >= TRIP_MIN_DISTANCE_METERS {
+			// not worth saving until it's long enough to be a trip
+			td.queue(st, tripChange{trip: *st.trip, publish: !st.saved})
+			st.saved = true
+			st.dirty = false
+		}
+		if len(st.pending) > 0 {
+			pending = append(pending, st)
+		}
+	}
+	return pending
+}
+
+// check the trips in progress every interval, blocking until the context is done
+func (td *TripDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(TRIP_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			err := td.apply(td.check(now))
+			if err != nil {
+				td.logger.Error("error checking trips", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// add the trip endpoints to the http server
+func (td *TripDetector) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /devices/{id}/trips", td.handleGetDevice)
+	svr.HandleFunc("GET /trips", td.handleGetFleet)
+}
+
+// GET /devices/{id}/trips?after=&before=, trips starting between the times, oldest first
+func (td *TripDetector) handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	trips, err := td.store.QueryTrips([]string{r.PathValue("id")}, after, before)
+	if err != nil {
+		td.logger.Error("failed to query trips", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query trips")
+		return
+	}
+	writeJSON(w, http.StatusOK, trips)
+}
+
+// GET /trips?after=&before=&device=&group=&tag=&format=json|csv, trips of the fleet starting between
+// the times. device, group and tag can be repeated, leave them all out for every device.
+func (td *TripDetector) handleGetFleet(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format: %v", format))
+		return
+	}
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	devices := r.URL.Query()["device"]
+	f := &DeviceFilter{Groups: r.URL.Query()["group"], Tags: r.URL.Query()["tag"]}
+	if !f.IsEmpty() {
+		if td.directory == nil {
+			writeError(w, http.StatusBadRequest, "groups and tags aren't available")
+			return
+		}
+		devices = td.directory.Expand(devices, f)
+		if len(devices) == 0 {
+			// nothing matched, which isn't the same as asking for everything
+			td.writeTrips(w, format, []Trip_Schema{})
+			return
+		}
+	}
+	trips, err := td.store.QueryTrips(devices, after, before)
+	if err != nil {
+		td.logger.Error("failed to query trips", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query trips")
+		return
+	}
+	td.writeTrips(w, format, trips)
+}
+
+// write trips as json or as a csv download
+func (td *TripDetector) writeTrips(w http.ResponseWriter, format string, trips []Trip_Schema) {
+	if format == "json" {
+		writeJSON(w, http.StatusOK, trips)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"trips.csv\"")
+	w.WriteHeader(http.StatusOK)
+	err := writeTripsCsv(w, trips)
+	if err != nil {
+		td.logger.Error("failed to write trips csv", zap.Error(err))
+	}
+}
+
+// write trips as csv with a header row
+func writeTripsCsv(w io.Writer, trips []Trip_Schema) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"deviceId", "startTime", "endTime", "durationSeconds", "distanceMeters", "maxSpeed",
+		"startLatitude", "startLongitude", "endLatitude", "endLongitude", "endReason", "inProgress",
+	})
+	if err != nil {
+		return err
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, trip := range trips {
+		err = cw.Write([]string{
+			trip.DeviceId,
+			trip.StartTime.Format(time.RFC3339),
+			trip.EndTime.Format(time.RFC3339),
+			f(trip.DurationSeconds),
+			strconv.FormatFloat(trip.DistanceMeters, 'f', 1, 64),
+			f(trip.MaxSpeed),
+			f(trip.Start.Lat),
+			f(trip.Start.Lon),
+			f(trip.End.Lat),
+			f(trip.End.Lon),
+			trip.EndReason,
+			strconv.FormatBool(trip.InProgress),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// insert or replace a trip
+func (dbc *DBConnection) UpsertTrip(trip *Trip_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("trips")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": trip.Id}, trip, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete a trip, returning whether it existed
+func (dbc *DBConnection) DeleteTrip(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("trips")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// get the trips of the devices, or every device if nil, starting between the times, oldest first
+func (dbc *DBConnection) QueryTrips(devices []string, after time.Time, before time.Time) ([]Trip_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("trips")
+
+	filter := bson.M{"startTime": bson.M{"$gte": after, "$lt": before}}
+	if devices != nil {
+		filter["deviceId"] = bson.M{"$in": devices}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "startTime", Value: 1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying trips: %v", err)
+	}
+	trips := make([]Trip_Schema, 0)
+	err = cursor.All(context.Background(), &trips)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding trips: %v", err)
+	}
+	return trips, nil
+}
+
+// get the trips still in progress
+func (dbc *DBConnection) QueryOpenTrips() ([]Trip_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("trips")
+	cursor, err := coll.Find(ctx, bson.M{"inProgress": true})
+	if err != nil {
+		return nil, fmt.Errorf("error querying open trips: %v", err)
+	}
+	trips := make([]Trip_Schema, 0)
+	err = cursor.All(ctx, &trips)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding open trips: %v", err)
+	}
+	return trips, nil
+}
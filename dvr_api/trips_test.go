@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory TripStore
+type memTripStore struct {
+	lock  sync.Mutex
+	trips map[string]Trip_Schema
+}
+
+func (m *memTripStore) UpsertTrip(trip *Trip_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.trips[trip.Id] = *trip
+	return nil
+}
+
+func (m *memTripStore) DeleteTrip(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.trips[id]
+	delete(m.trips, id)
+	return ok, nil
+}
+
+func (m *memTripStore) QueryTrips(devices []string, after time.Time, before time.Time) ([]Trip_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	trips := make([]Trip_Schema, 0)
+	for _, trip := range m.trips {
+		if devices != nil && !containsString(devices, trip.DeviceId) {
+			continue
+		}
+		if !trip.StartTime.Before(after) && trip.StartTime.Before(before) {
+			trips = append(trips, trip)
+		}
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].StartTime.Before(trips[j].StartTime) })
+	return trips, nil
+}
+
+func (m *memTripStore) QueryOpenTrips() ([]Trip_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	trips := make([]Trip_Schema, 0)
+	for _, trip := range m.trips {
+		if trip.InProgress {
+			trips = append(trips, trip)
+		}
+	}
+	return trips, nil
+}
+
+func newTestTripDetector(t *testing.T, store *memTripStore) (*TripDetector, *[]DeviceEvent) {
+	events := make([]DeviceEvent, 0)
+	td, err := NewTripDetector(zap.NewNop(), store, func(e *DeviceEvent) error {
+		events = append(events, *e)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return td, &events
+}
+
+func TestTripDetector(t *testing.T) {
+	store := &memTripStore{trips: make(map[string]Trip_Schema)}
+	td, events := newTestTripDetector(t, store)
+	start := time.Date(2024, 8, 17, 9, 0, 0, 0, time.UTC)
+
+	// drive north about 111m a minute, every 30 seconds
+	lat := 0.0
+	fix := func(offset time.Duration, speed float64) {
+		pos := &Position_Schema{DeviceId: "123", FixTime: start.Add(offset), RecvdTime: start.Add(offset), Valid: true, Latitude: lat, Speed: speed}
+		err := td.ProcessPosition(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fix(0, 0) // parked
+	fix(30*time.Second, 0)
+	for i := 2; i <= 20; i++ {
+		lat += 0.0005
+		fix(time.Duration(i)*30*time.Second, 40)
+	}
+	// stop at 10:00 and stay there
+	for i := 21; i <= 28; i++ {
+		fix(time.Duration(i)*30*time.Second, 0)
+	}
+
+	trips, _ := store.QueryTrips(nil, start, start.Add(time.Hour))
+	if len(trips) != 1 {
+		t.Fatalf("expected 1 trip, got %v", len(trips))
+	}
+	trip := trips[0]
+	if trip.InProgress || trip.EndReason != TRIP_END_STOPPED {
+		t.Errorf("expected the trip to have ended on a stop, got %+v", trip)
+	}
+	// it moved off from the fix at 0:30 and stopped at 10:30
+	if !trip.StartTime.Equal(start.Add(30*time.Second)) || !trip.EndTime.Equal(start.Add(21*30*time.Second)) {
+		t.Errorf("expected 09:00:30 to 09:10:30, got %v to %v", trip.StartTime, trip.EndTime)
+	}
+	if trip.DurationSeconds != 600 {
+		t.Errorf("expected 600s, got %v", trip.DurationSeconds)
+	}
+	want := distanceMeters(0, 0, lat, 0)
+	if trip.DistanceMeters < want-1 || trip.DistanceMeters > want+1 {
+		t.Errorf("expected %.0fm, got %.0fm", want, trip.DistanceMeters)
+	}
+	if trip.MaxSpeed != 40 || trip.Start.Lat != 0 || trip.End.Lat != lat {
+		t.Errorf("unexpected trip: %+v", trip)
+	}
+	if len(*events) != 1 || (*events)[0].Event != EVENT_TRIP {
+		t.Errorf("expected one trip event, got %v", len(*events))
+	}
+}
+
+func TestTripDetector_InProgress(t *testing.T) {
+	store := &memTripStore{trips: make(map[string]Trip_Schema)}
+	td, events := newTestTripDetector(t, store)
+	start := time.Date(2024, 8, 17, 9, 0, 0, 0, time.UTC)
+	fix := func(devId string, offset time.Duration, lat float64, speed float64) {
+		td.ProcessPosition(&Position_Schema{DeviceId: devId, FixTime: start.Add(offset), RecvdTime: start.Add(offset), Valid: true, Latitude: lat, Speed: speed})
+	}
+
+	// drift at the lights isn't a trip
+	fix("456", 0, 0, 6)
+	fix("456", time.Minute, 0.0001, 0)
+	fix("456", 5*time.Minute, 0.0001, 0)
+
+	// a trip in progress is saved once it's long enough, and picked up again after a restart
+	fix("123", 0, 0, 30)
+	fix("123", time.Minute, 0.002, 30)
+	td.apply(td.check(start.Add(time.Minute)))
+	trips, _ := store.QueryOpenTrips()
+	if len(trips) != 1 || trips[0].DeviceId != "123" {
+		t.Fatalf("expected 123's trip to be saved in progress, got %+v", trips)
+	}
+	if len(*events) != 1 {
+		t.Errorf("expected an event for the trip starting, got %v", len(*events))
+	}
+
+	td, events = newTestTripDetector(t, store)
+	fix("123", 2*time.Minute, 0.004, 30)
+	devId := "123"
+	td.ProcessMessage(&MessageWrapper{"$IGN;123;20240817-090230;OFF", &devId, start, DirectionFromDevice, 0})
+	trips, _ = store.QueryTrips(nil, start, start.Add(time.Hour))
+	if len(trips) != 1 {
+		t.Fatalf("expected 1 trip, got %+v", trips)
+	}
+	if trips[0].InProgress || trips[0].EndReason != TRIP_END_IGNITION || trips[0].MaxSpeed != 30 {
+		t.Errorf("expected the ignition to end the trip, got %+v", trips[0])
+	}
+	want := distanceMeters(0, 0, 0.004, 0)
+	if trips[0].DistanceMeters < want-1 || trips[0].DistanceMeters > want+1 {
+		t.Errorf("expected the trip to carry on after the restart, %.0fm, got %.0fm", want, trips[0].DistanceMeters)
+	}
+
+	// the fixes stopping ends a trip too. It moves off from where the ignition went off.
+	fix("123", 10*time.Minute, 0.004, 30)
+	fix("123", 11*time.Minute, 0.010, 30)
+	td.apply(td.check(start.Add(30 * time.Minute)))
+	trips, _ = store.QueryTrips([]string{"123"}, start.Add(time.Minute), start.Add(time.Hour))
+	if len(trips) != 1 || trips[0].EndReason != TRIP_END_NO_FIXES || !trips[0].EndTime.Equal(start.Add(11*time.Minute)) {
+		t.Errorf("expected a trip ended by missing fixes at 09:11, got %+v", trips)
+	}
+
+	var buf bytes.Buffer
+	err := writeTripsCsv(&buf, trips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 || records[0][0] != "deviceId" || records[1][0] != "123" {
+		t.Errorf("unexpected csv: %v %v", records, err)
+	}
+	if !strings.HasPrefix(records[1][1], "2024-08-17T09:02:00") || records[1][10] != TRIP_END_NO_FIXES {
+		t.Errorf("unexpected csv row: %v", records[1])
+	}
+}
+
+func TestTripDetector_StaleSnapshot(t *testing.T) {
+	store := &memTripStore{trips: make(map[string]Trip_Schema)}
+	td, _ := newTestTripDetector(t, store)
+	start := time.Now()
+	td.ProcessPosition(&Position_Schema{DeviceId: "123", FixTime: start, RecvdTime: start, Valid: true, Speed: 30})
+	td.ProcessPosition(&Position_Schema{DeviceId: "123", FixTime: start.Add(time.Minute), RecvdTime: start, Valid: true, Latitude: 0.002, Speed: 30})
+
+	// the timer takes a snapshot of the trip, then the ignition ends it before the snapshot is saved
+	snapshot := td.check(start.Add(time.Minute))
+	devId := "123"
+	td.ProcessMessage(&MessageWrapper{"$IGN;123;20240817-090230;OFF", &devId, start, DirectionFromDevice, 0})
+	td.apply(snapshot)
+
+	trips, _ := store.QueryTrips(nil, start.Add(-time.Hour), start.Add(time.Hour))
+	if len(trips) != 1 || trips[0].InProgress {
+		t.Errorf("expected the ended trip to stay ended, got %+v", trips)
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+UPLOADS
+Where footage from devices lands. A device (or whatever uploads for it) creates an upload, linked to
+the video job it's for, then sends the file in as many chunks as it likes, each starting at the
+offset the last one ended. An interrupted upload is resumed by asking for the offset and carrying on
+from there. Once all the bytes are in, the file becomes a clip on local disk, the video job is
+completed, and the clip is served back over http with range requests.
+~~~~~~~~~~~~~~~
+*/
+
+// upload statuses
+const (
+	UPLOAD_IN_PROGRESS string = "inProgress" // waiting for more bytes
+	UPLOAD_COMPLETE    string = "complete"   // all in, see the clip
+)
+
+// limits and headers
+const (
+	UPLOAD_MAX_SIZE      int64  = 4 << 30         // largest file we take, 4GB
+	UPLOAD_OFFSET_HEADER string = "Upload-Offset" // where a chunk starts, and in responses, how much we have
+)
+
+// why a chunk was refused
+var (
+	errUploadOffset   = errors.New("chunk doesn't start where the upload is up to")
+	errUploadTooLarge = errors.New("chunk goes past the size of the upload")
+	errUploadComplete = errors.New("upload is already complete")
+	errUploadRequest  = errors.New("invalid upload request")
+)
+
+// an upload in progress or finished, stored in mongodb and sent to API clients
+type Upload_Schema struct {
+	Id          string    `bson:"_id" json:"id"`
+	DeviceId    string    `bson:"deviceId" json:"deviceId"`
+	JobId       string    `bson:"jobId,omitempty" json:"jobId,omitempty"` // the video job it's footage for
+	FileName    string    `bson:"fileName" json:"fileName"`
+	ContentType string    `bson:"contentType" json:"contentType"`
+	Size        int64     `bson:"size" json:"size"`
+	Offset      int64     `bson:"offset" json:"offset"` // bytes received so far
+	Status      string    `bson:"status" json:"status"`
+	CreatedTime time.Time `bson:"createdTime" json:"createdTime"`
+	UpdatedTime time.Time `bson:"updatedTime" json:"updatedTime"`
+	ClipId      string    `bson:"clipId,omitempty" json:"clipId,omitempty"` // set once complete
+}
+
+// a request to start an upload, sent by devices or API clients
+type UploadRequest struct {
+	JobId       string `json:"jobId"`    // the video job the footage is for, optional
+	DeviceId    string `json:"deviceId"` // taken from the job if there is one
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"` // application/octet-stream if not set
+	Size        int64  `json:"size"`
+}
+
+// a finished file on disk, stored in mongodb and sent to API clients
+type Clip_Schema struct {
+	Id            string     `bson:"_id" json:"id"`
+	DeviceId      string     `bson:"deviceId" json:"deviceId"`
+	JobId         string     `bson:"jobId,omitempty" json:"jobId,omitempty"`
+	UploadId      string     `bson:"uploadId" json:"uploadId"`
+	FileName      string     `bson:"fileName" json:"fileName"`
+	ContentType   string     `bson:"contentType" json:"contentType"`
+	Size          int64      `bson:"size" json:"size"`
+	Camera        int        `bson:"camera,omitempty" json:"camera,omitempty"`               // from the video job
+	Start         *time.Time `bson:"start,omitempty" json:"start,omitempty"`                 // from the video job
+	LengthSeconds int        `bson:"lengthSeconds,omitempty" json:"lengthSeconds,omitempty"` // from the video job
+	Time          time.Time  `bson:"time" json:"time"`                                       // when the upload finished
+	File          string     `bson:"file" json:"-"`                                          // name of the file in the clips directory
+	Pinned        bool       `bson:"pinned" json:"pinned"`                                   // kept whatever the retention policy says, see clip_storage.go
+	PinReason     string     `bson:"pinReason,omitempty" json:"pinReason,omitempty"`         // e.g. the alert it's evidence for
+}
+
+// where uploads and clips are kept, the DBConnection outside of tests
+type UploadStore interface {
+	UpsertUpload(upload *Upload_Schema) error
+	GetUpload(id string) (*Upload_Schema, error)
+	UpsertClip(clip *Clip_Schema) error
+	GetClip(id string) (*Clip_Schema, error)
+	GetClipByUpload(uploadId string) (*Clip_Schema, error)
+	QueryClips(devId string, jobId string, after time.Time, before time.Time) ([]Clip_Schema, error)
+}
+
+// check the request, filling in defaults
+func (req *UploadRequest) Validate() error {
+	if req.DeviceId == "" {
+		return fmt.Errorf("deviceId or jobId must be set")
+	}
+	if req.Size <= 0 || req.Size > UPLOAD_MAX_SIZE {
+		return fmt.Errorf("size must be between 1 and %v bytes", UPLOAD_MAX_SIZE)
+	}
+	req.FileName = filepath.Base(strings.TrimSpace(req.FileName))
+	if req.FileName == "." || req.FileName == string(filepath.Separator) {
+		req.FileName = ""
+	}
+	if req.FileName == "" {
+		return fmt.Errorf("fileName can't be empty")
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+	return nil
+}
+
+// takes uploads and keeps the clips
+type UploadReceiver struct {
+	// internal
+	locks     map[string]*uploadLock // upload id against a lock so chunks of one upload go in one at a time
+	locksLock sync.Mutex
+
+	// injected
+	logger *zap.Logger
+	store  UploadStore
+	dir    string     // clips go here, uploads in progress in its partial directory
+	videos *VideoJobs // the jobs uploads are linked to
+}
+
+// constructor, makes the directories if they're not there
+func NewUploadReceiver(logger *zap.Logger, store UploadStore, dir string, videos *VideoJobs) (*UploadReceiver, error) {
+	err := os.MkdirAll(filepath.Join(dir, "partial"), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating clip directory: %v", err)
+	}
+	ur := &UploadReceiver{
+		locks:  make(map[string]*uploadLock),
+		logger: logger,
+		store:  store,
+		dir:    dir,
+		videos: videos,
+	}
+	return ur, nil
+}
+
+// where an upload's bytes are kept until it's complete
+func (ur *UploadReceiver) partialPath(id string) string {
+	return filepath.Join(ur.dir, "partial", id)
+}
+
+// an upload's lock and how many chunks are holding or waiting for it
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+// take an upload's lock. It's forgotten once nothing's using it, so abandoned uploads don't keep one.
+func (ur *UploadReceiver) lockUpload(id string) *uploadLock {
+	ur.locksLock.Lock()
+	lock, ok := ur.locks[id]
+	if !ok {
+		lock = &uploadLock{}
+		ur.locks[id] = lock
+	}
+	lock.users++
+	ur.locksLock.Unlock()
+	lock.Lock()
+	return lock
+}
+
+// release an upload's lock from lockUpload
+func (ur *UploadReceiver) unlockUpload(id string, lock *uploadLock) {
+	lock.Unlock()
+	ur.locksLock.Lock()
+	defer ur.locksLock.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(ur.locks, id)
+	}
+}
+
+// start an upload. Problems with the request are errUploadRequest errors.
+func (ur *UploadReceiver) Create(req *UploadRequest) (*Upload_Schema, error) {
+	if req.JobId != "" {
+		job, err := ur.videos.Get(req.JobId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting video job: %v", err)
+		}
+		if job == nil {
+			return nil, fmt.Errorf("%w: no such video job", errUploadRequest)
+		}
+		if req.DeviceId != "" && req.DeviceId != job.DeviceId {
+			return nil, fmt.Errorf("%w: video job is for device %v", errUploadRequest, job.DeviceId)
+		}
+		req.DeviceId = job.DeviceId
+	}
+	err := req.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUploadRequest, err)
+	}
+
+	now := time.Now()
+	upload := &Upload_Schema{
+		Id:          uuid.New().String(),
+		DeviceId:    req.DeviceId,
+		JobId:       req.JobId,
+		FileName:    req.FileName,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Status:      UPLOAD_IN_PROGRESS,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	f, err := os.Create(ur.partialPath(upload.Id))
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload file: %v", err)
+	}
+	f.Close()
+	err = ur.store.UpsertUpload(upload)
+	if err != nil {
+		return nil, fmt.Errorf("error storing upload: %v", err)
+	}
+	return upload, nil
+}
+
+// write a chunk starting at offset. Returns the upload as it now stands, nil if there's no such
+// upload. Refused chunks return one of the errUpload errors with the upload, so the sender can
+// see where to carry on from.
+func (ur *UploadReceiver) Append(id string, offset int64, chunk io.Reader) (*Upload_Schema, error) {
+	lock := ur.lockUpload(id)
+	defer ur.unlockUpload(id, lock)
+
+	upload, err := ur.store.GetUpload(id)
+	if err != nil || upload == nil {
+		return nil, err
+	}
+	if upload.Status == UPLOAD_COMPLETE {
+		return upload, errUploadComplete
+	}
+
+	// the file is the truth on how much we have, the stored offset may be behind if we went down
+	// mid chunk
+	f, err := os.OpenFile(ur.partialPath(id), os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return ur.recoverComplete(upload, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening upload file: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading upload file: %v", err)
+	}
+	upload.Offset = info.Size()
+	if offset != upload.Offset {
+		return upload, errUploadOffset
+	}
+
+	// take up to the size, and one more byte to tell if there's too much
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("error seeking upload file: %v", err)
+	}
+	written, copyErr := io.Copy(f, io.LimitReader(chunk, upload.Size-offset+1))
+	if offset+written > upload.Size {
+		f.Truncate(offset)
+		return upload, errUploadTooLarge
+	}
+	upload.Offset = offset + written
+	upload.UpdatedTime = time.Now()
+
+	// an interrupted chunk keeps what arrived, the sender resumes from there
+	if copyErr != nil {
+		ur.logger.Debug("upload chunk interrupted", zap.String("uploadId", id), zap.Error(copyErr))
+	}
+	if offset == 0 && written > 0 && upload.JobId != "" {
+		ur.advanceJob(upload.JobId, VIDEO_UPLOADING)
+	}
+	if upload.Offset == upload.Size {
+		f.Close()
+		err = ur.complete(upload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ur.store.UpsertUpload(upload)
+	if err != nil {
+		return nil, fmt.Errorf("error storing upload: %v", err)
+	}
+	return upload, copyErr
+}
+
+// an upload whose file has gone may have been made into a clip without the upload being stored as
+// complete. If so it's stored now, otherwise it's the error opening the file. Upload lock must be held.
+func (ur *UploadReceiver) recoverComplete(upload *Upload_Schema, openErr error) (*Upload_Schema, error) {
+	clip, err := ur.store.GetClipByUpload(upload.Id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting clip for upload: %v", err)
+	}
+	if clip == nil {
+		return nil, fmt.Errorf("error opening upload file: %v", openErr)
+	}
+	upload.Status = UPLOAD_COMPLETE
+	upload.ClipId = clip.Id
+	upload.Offset = upload.Size
+	upload.UpdatedTime = clip.Time
+	err = ur.store.UpsertUpload(upload)
+	if err != nil {
+		return nil, fmt.Errorf("error storing upload: %v", err)
+	}
+	return upload, errUploadComplete
+}
+
+// turn a finished upload into a clip. Upload lock must be held.
+func (ur *UploadReceiver) complete(upload *Upload_Schema) error {
+	clip := &Clip_Schema{
+		Id:          uuid.New().String(),
+		DeviceId:    upload.DeviceId,
+		JobId:       upload.JobId,
+		UploadId:    upload.Id,
+		FileName:    upload.FileName,
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+		Time:        upload.UpdatedTime,
+	}
+	clip.File = clip.Id + filepath.Ext(upload.FileName)
+	if upload.JobId != "" {
+		job, err := ur.videos.Get(upload.JobId)
+		if err == nil && job != nil {
+			clip.Camera = job.Camera
+			clip.Start = job.Start
+			clip.LengthSeconds = job.LengthSeconds
+		}
+	}
+	clipPath := filepath.Join(ur.dir, clip.File)
+	err := os.Rename(ur.partialPath(upload.Id), clipPath)
+	if err != nil {
+		return fmt.Errorf("error moving upload to clips: %v", err)
+	}
+	err = ur.store.UpsertClip(clip)
+	if err != nil {
+		// put it back, an empty chunk at the end tries completing it again
+		if renameErr := os.Rename(clipPath, ur.partialPath(upload.Id)); renameErr != nil {
+			ur.logger.Error("error moving clip back to partial", zap.String("uploadId", upload.Id), zap.Error(renameErr))
+		}
+		return fmt.Errorf("error storing clip: %v", err)
+	}
+	upload.Status = UPLOAD_COMPLETE
+	upload.ClipId = clip.Id
+	if upload.JobId != "" {
+		ur.advanceJob(upload.JobId, VIDEO_COMPLETE)
+	}
+	return nil
+}
+
+// move the video job an upload is for along. The upload doesn't fail if this does.
+func (ur *UploadReceiver) advanceJob(jobId string, state string) {
+	_, _, err := ur.videos.Advance(jobId, state, time.Now(), "")
+	if err != nil {
+		ur.logger.Error("error advancing video job", zap.String("jobId", jobId), zap.Error(err))
+	}
+}
+
+// add the upload and clip endpoints to the http server
+func (ur *UploadReceiver) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("POST /uploads", ur.handleCreate)
+	svr.HandleFunc("GET /uploads/{id}", ur.handleGetUpload)
+	svr.HandleFunc("PATCH /uploads/{id}", ur.handleAppend)
+	svr.HandleFunc("GET /clips", ur.handleListClips)
+	svr.HandleFunc("GET /clips/{id}", ur.handleGetClip)
+	svr.HandleFunc("GET /clips/{id}/content", ur.handleClipContent)
+}
+
+// POST /uploads
+func (ur *UploadReceiver) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid upload json: %v", err))
+		return
+	}
+	upload, err := ur.Create(&req)
+	if errors.Is(err, errUploadRequest) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		ur.logger.Error("failed to create upload", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	w.Header().Set(UPLOAD_OFFSET_HEADER, "0")
+	writeJSON(w, http.StatusCreated, upload)
+}
+
+// GET or HEAD /uploads/{id}, the Upload-Offset header says where to resume from
+func (ur *UploadReceiver) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := ur.store.GetUpload(r.PathValue("id"))
+	if err != nil {
+		ur.logger.Error("failed to get upload", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to get upload")
+		return
+	}
+	if upload == nil {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if upload.Status == UPLOAD_IN_PROGRESS {
+		if info, err := os.Stat(ur.partialPath(upload.Id)); err == nil {
+			upload.Offset = info.Size()
+		}
+	}
+	w.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(upload.Offset, 10))
+	writeJSON(w, http.StatusOK, upload)
+}
+
+// PATCH /uploads/{id}, the body is a chunk starting at the Upload-Offset header
+func (ur *UploadReceiver) handleAppend(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get(UPLOAD_OFFSET_HEADER), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v header must be a byte offset", UPLOAD_OFFSET_HEADER))
+		return
+	}
+	upload, err := ur.Append(r.PathValue("id"), offset, r.Body)
+	if upload == nil && err == nil {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if upload != nil {
+		w.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(upload.Offset, 10))
+	}
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, upload)
+	case errors.Is(err, errUploadOffset), errors.Is(err, errUploadComplete):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errUploadTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case upload != nil:
+		// the chunk was cut short, the offset says how much of it we kept
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("chunk interrupted: %v", err))
+	default:
+		ur.logger.Error("failed to write upload chunk", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to write upload chunk")
+	}
+}
+
+// GET /clips?device=&job=&after=&before=, newest first
+func (ur *UploadReceiver) handleListClips(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	clips, err := ur.store.QueryClips(r.URL.Query().Get("device"), r.URL.Query().Get("job"), after, before)
+	if err != nil {
+		ur.logger.Error("failed to query clips", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query clips")
+		return
+	}
+	writeJSON(w, http.StatusOK, clips)
+}
+
+// look up the clip in the path, writing an error response if there isn't one
+func (ur *UploadReceiver) pathClip(w http.ResponseWriter, r *http.Request) *Clip_Schema {
+	clip, err := ur.store.GetClip(r.PathValue("id"))
+	if err != nil {
+		ur.logger.Error("failed to get clip", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to get clip")
+		return nil
+	}
+	if clip == nil {
+		writeError(w, http.StatusNotFound, "no such clip")
+	}
+	return clip
+}
+
+// GET /clips/{id}
+func (ur *UploadReceiver) handleGetClip(w http.ResponseWriter, r *http.Request) {
+	if clip := ur.pathClip(w, r); clip != nil {
+		writeJSON(w, http.StatusOK, clip)
+	}
+}
+
+// GET /clips/{id}/content, supports range requests
+func (ur *UploadReceiver) handleClipContent(w http.ResponseWriter, r *http.Request) {
+	clip := ur.pathClip(w, r)
+	if clip == nil {
+		return
+	}
+	f, err := os.Open(filepath.Join(ur.dir, clip.File))
+	if err != nil {
+		ur.logger.Error("failed to open clip", zap.String("clipId", clip.Id), zap.Error(err))
+		writeError(w, http.StatusNotFound, "clip file is missing")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", clip.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", clip.FileName))
+	http.ServeContent(w, r, clip.FileName, clip.Time, f)
+}
+
+// insert or replace an upload
+func (dbc *DBConnection) UpsertUpload(upload *Upload_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("uploads")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": upload.Id}, upload, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get one upload, nil if there's no such upload
+func (dbc *DBConnection) GetUpload(id string) (*Upload_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("uploads")
+	var upload Upload_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&upload)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// delete an upload, returns false if there was no such upload
+func (dbc *DBConnection) DeleteUpload(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("uploads")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// insert or replace a clip
+func (dbc *DBConnection) UpsertClip(clip *Clip_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("clips")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": clip.Id}, clip, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get one clip, nil if there's no such clip
+func (dbc *DBConnection) GetClip(id string) (*Clip_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("clips")
+	var clip Clip_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&clip)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clip, nil
+}
+
+// get the clip made from an upload, nil if there isn't one
+func (dbc *DBConnection) GetClipByUpload(uploadId string) (*Clip_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("clips")
+	var clip Clip_Schema
+	err := coll.FindOne(ctx, bson.M{"uploadId": uploadId}).Decode(&clip)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clip, nil
+}
+
+// get the clips finished between the times, newest first. Every device's and job's if they're empty.
+func (dbc *DBConnection) QueryClips(devId string, jobId string, after time.Time, before time.Time) ([]Clip_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("clips")
+
+	filter := bson.M{"time": bson.M{"$gte": after, "$lte": before}}
+	if devId != "" {
+		filter["deviceId"] = devId
+	}
+	if jobId != "" {
+		filter["jobId"] = jobId
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying clips: %v", err)
+	}
+	clips := make([]Clip_Schema, 0)
+	err = cursor.All(context.Background(), &clips)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding clips: %v", err)
+	}
+	return clips, nil
+}
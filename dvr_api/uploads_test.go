@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory UploadStore
+type memUploadStore struct {
+	lock    sync.Mutex
+	uploads map[string]Upload_Schema
+	clips   map[string]Clip_Schema
+}
+
+func (m *memUploadStore) UpsertUpload(upload *Upload_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.uploads[upload.Id] = *upload
+	return nil
+}
+
+func (m *memUploadStore) GetUpload(id string) (*Upload_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	upload, ok := m.uploads[id]
+	if !ok {
+		return nil, nil
+	}
+	return &upload, nil
+}
+
+func (m *memUploadStore) UpsertClip(clip *Clip_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clips[clip.Id] = *clip
+	return nil
+}
+
+func (m *memUploadStore) GetClip(id string) (*Clip_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	clip, ok := m.clips[id]
+	if !ok {
+		return nil, nil
+	}
+	return &clip, nil
+}
+
+func (m *memUploadStore) GetClipByUpload(uploadId string) (*Clip_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, clip := range m.clips {
+		if clip.UploadId == uploadId {
+			return &clip, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memUploadStore) QueryClips(devId string, jobId string, after time.Time, before time.Time) ([]Clip_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	clips := make([]Clip_Schema, 0)
+	for _, clip := range m.clips {
+		if (devId == "" || clip.DeviceId == devId) && (jobId == "" || clip.JobId == jobId) {
+			clips = append(clips, clip)
+		}
+	}
+	return clips, nil
+}
+
+// send a request through the receiver's routes
+func uploadRequest(t *testing.T, mux *http.ServeMux, method string, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUploadReceiver(t *testing.T) {
+	vj, _ := newTestVideoJobs(t)
+	vj.ProcessSend(videoMsg("$VIDEO;123456;all;4;20231003-164514;5", "client", time.Now()))
+	job := vj.active["123456"][0]
+
+	store := &memUploadStore{uploads: make(map[string]Upload_Schema), clips: make(map[string]Clip_Schema)}
+	ur, err := NewUploadReceiver(zap.NewNop(), store, t.TempDir(), vj)
+	if err != nil {
+		t.Fatalf("new upload receiver: %v", err)
+	}
+	svr := &httpSvr{mux: http.NewServeMux()}
+	ur.RegisterRoutes(svr)
+
+	// start it
+	content := "0123456789abcdefghij"
+	rec := uploadRequest(t, svr.mux, "POST", "/uploads", `{"jobId":"`+job.Id+`","fileName":"../cam4.mp4","contentType":"video/mp4","size":`+strconv.Itoa(len(content))+`}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %v %v", rec.Code, rec.Body)
+	}
+	var upload Upload_Schema
+	json.Unmarshal(rec.Body.Bytes(), &upload)
+	if upload.DeviceId != "123456" || upload.FileName != "cam4.mp4" {
+		t.Fatalf("upload %+v", upload)
+	}
+	path := "/uploads/" + upload.Id
+
+	// first chunk, then one that doesn't carry on from it
+	rec = uploadRequest(t, svr.mux, "PATCH", path, content[:8], map[string]string{UPLOAD_OFFSET_HEADER: "0"})
+	if rec.Code != http.StatusOK || rec.Header().Get(UPLOAD_OFFSET_HEADER) != "8" {
+		t.Fatalf("first chunk: %v %v", rec.Code, rec.Body)
+	}
+	if job.State != VIDEO_UPLOADING {
+		t.Errorf("job is %v after the first chunk", job.State)
+	}
+	rec = uploadRequest(t, svr.mux, "PATCH", path, content[4:], map[string]string{UPLOAD_OFFSET_HEADER: "4"})
+	if rec.Code != http.StatusConflict || rec.Header().Get(UPLOAD_OFFSET_HEADER) != "8" {
+		t.Fatalf("overlapping chunk: %v %v", rec.Code, rec.Body)
+	}
+
+	// ask where to resume, send too much, then the rest
+	rec = uploadRequest(t, svr.mux, "HEAD", path, "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get(UPLOAD_OFFSET_HEADER) != "8" {
+		t.Fatalf("resume offset: %v %v", rec.Code, rec.Header())
+	}
+	rec = uploadRequest(t, svr.mux, "PATCH", path, content[8:]+"extra", map[string]string{UPLOAD_OFFSET_HEADER: "8"})
+	if rec.Code != http.StatusRequestEntityTooLarge || rec.Header().Get(UPLOAD_OFFSET_HEADER) != "8" {
+		t.Fatalf("oversized chunk: %v %v", rec.Code, rec.Body)
+	}
+	rec = uploadRequest(t, svr.mux, "PATCH", path, content[8:], map[string]string{UPLOAD_OFFSET_HEADER: "8"})
+	json.Unmarshal(rec.Body.Bytes(), &upload)
+	if rec.Code != http.StatusOK || upload.Status != UPLOAD_COMPLETE || upload.ClipId == "" {
+		t.Fatalf("last chunk: %v %v", rec.Code, rec.Body)
+	}
+	got, _ := vj.Get(job.Id)
+	if got.State != VIDEO_COMPLETE {
+		t.Errorf("job is %v after the upload", got.State)
+	}
+	rec = uploadRequest(t, svr.mux, "PATCH", path, "x", map[string]string{UPLOAD_OFFSET_HEADER: "20"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("chunk after completion: %v", rec.Code)
+	}
+
+	// the clip, whole and in part
+	clip, _ := store.GetClip(upload.ClipId)
+	if clip.Camera != 4 || clip.LengthSeconds != 5 || clip.JobId != job.Id {
+		t.Errorf("clip %+v", clip)
+	}
+	rec = uploadRequest(t, svr.mux, "GET", "/clips/"+clip.Id+"/content", "", nil)
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusOK || string(body) != content || rec.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("clip content: %v %q", rec.Code, body)
+	}
+	rec = uploadRequest(t, svr.mux, "GET", "/clips/"+clip.Id+"/content", "", map[string]string{"Range": "bytes=10-14"})
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusPartialContent || string(body) != "abcde" {
+		t.Errorf("clip range: %v %q", rec.Code, body)
+	}
+	if len(ur.locks) != 0 {
+		t.Errorf("%v upload locks left over", len(ur.locks))
+	}
+
+	// bad requests are the client's fault
+	rec = uploadRequest(t, svr.mux, "POST", "/uploads", `{"jobId":"nope","fileName":"a.mp4","size":10}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("create for a missing job: %v", rec.Code)
+	}
+}
+
+// fails to store clips until told otherwise
+type failingClipStore struct {
+	*memUploadStore
+	fail bool
+}
+
+func (m *failingClipStore) UpsertClip(clip *Clip_Schema) error {
+	if m.fail {
+		return fmt.Errorf("database unavailable")
+	}
+	return m.memUploadStore.UpsertClip(clip)
+}
+
+func TestUploadReceiver_ClipStoreFails(t *testing.T) {
+	vj, _ := newTestVideoJobs(t)
+	store := &failingClipStore{&memUploadStore{uploads: make(map[string]Upload_Schema), clips: make(map[string]Clip_Schema)}, true}
+	ur, _ := NewUploadReceiver(zap.NewNop(), store, t.TempDir(), vj)
+	upload, err := ur.Create(&UploadRequest{DeviceId: "123456", FileName: "a.mp4", Size: 4})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// the file goes back to partial so completing can be tried again
+	_, err = ur.Append(upload.Id, 0, strings.NewReader("abcd"))
+	if err == nil {
+		t.Fatal("append succeeded without storing the clip")
+	}
+	if _, err := os.Stat(ur.partialPath(upload.Id)); err != nil {
+		t.Fatalf("partial file gone: %v", err)
+	}
+	store.fail = false
+	got, err := ur.Append(upload.Id, 4, strings.NewReader(""))
+	if err != nil || got.Status != UPLOAD_COMPLETE {
+		t.Fatalf("retry: %+v, %v", got, err)
+	}
+}
+
+// stores uploads until told to fail
+type failingUploadStore struct {
+	*memUploadStore
+	fail bool
+}
+
+func (m *failingUploadStore) UpsertUpload(upload *Upload_Schema) error {
+	if m.fail {
+		return fmt.Errorf("database unavailable")
+	}
+	return m.memUploadStore.UpsertUpload(upload)
+}
+
+func TestUploadReceiver_UploadStoreFails(t *testing.T) {
+	vj, _ := newTestVideoJobs(t)
+	store := &failingUploadStore{&memUploadStore{uploads: make(map[string]Upload_Schema), clips: make(map[string]Clip_Schema)}, false}
+	ur, _ := NewUploadReceiver(zap.NewNop(), store, t.TempDir(), vj)
+	upload, err := ur.Create(&UploadRequest{DeviceId: "123456", FileName: "a.mp4", Size: 4})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// the clip's made, but the upload isn't stored as complete
+	store.fail = true
+	if _, err := ur.Append(upload.Id, 0, strings.NewReader("abcd")); err == nil {
+		t.Fatal("append succeeded without storing the upload")
+	}
+	store.fail = false
+
+	// so resuming finds the clip and finishes it off
+	got, err := ur.Append(upload.Id, 4, strings.NewReader(""))
+	if err != errUploadComplete || got.Status != UPLOAD_COMPLETE || got.ClipId == "" || got.Offset != 4 {
+		t.Fatalf("resume: %+v, %v", got, err)
+	}
+	stored, _ := store.GetUpload(upload.Id)
+	if stored.Status != UPLOAD_COMPLETE || stored.ClipId != got.ClipId {
+		t.Errorf("expected the upload stored as complete, got %+v", stored)
+	}
+}
+
+func TestUploadRequestValidate(t *testing.T) {
+	bad := []UploadRequest{
+		{FileName: "a.mp4", Size: 10},
+		{DeviceId: "123456", FileName: "a.mp4"},
+		{DeviceId: "123456", FileName: "a.mp4", Size: UPLOAD_MAX_SIZE + 1},
+		{DeviceId: "123456", FileName: " ", Size: 10},
+		{DeviceId: "123456", FileName: "/", Size: 10},
+	}
+	for i, req := range bad {
+		if err := req.Validate(); err == nil {
+			t.Errorf("bad request %v validated", i)
+		}
+	}
+}
@@ -157,3 +157,27 @@ func getIdFromMessage(message *string, id *string) error {
 	}
 	return fmt.Errorf("couldn't extract id from: %v", message)
 }
+
+// get the command from msg format: $COMMAND;1234;xXxXxXxXxX;<CR>, returned without the '$'
+func getCommandFromMessage(message string) string {
+	cmd, _, _ := strings.Cut(strings.TrimSpace(message), ";")
+	return strings.TrimPrefix(cmd, "$")
+}
+
+// placeholder in a command that's replaced with the id of each device it's sent to
+const DEVICE_ID_PLACEHOLDER string = "{deviceId}"
+
+// fill in a command for one device
+func renderForDevice(command string, devId string) string {
+	return strings.ReplaceAll(command, DEVICE_ID_PLACEHOLDER, devId)
+}
+
+// is s in the list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+VIDEO JOBS
+Every $VIDEO request that goes out to a device becomes a job, moved through its states by the
+device's replies and timed out if the device goes quiet. Devices reply to video requests in the
+format:
+$VIDEO;[DeviceID];[time];[status];[detail, optional]<CR>
+ex: $VIDEO;123456;20240817-123504;UPLOADING\r
+Replies don't say which request they're for, so a reply moves the device's oldest job that it can
+move forward.
+~~~~~~~~~~~~~~~
+*/
+
+// states of a video job, in the order they normally happen
+const (
+	VIDEO_REQUESTED    string = "requested"    // sent to the device
+	VIDEO_ACKNOWLEDGED string = "acknowledged" // the device has accepted the request
+	VIDEO_UPLOADING    string = "uploading"    // the device is uploading the footage
+	VIDEO_COMPLETE     string = "complete"     // the footage has arrived
+	VIDEO_FAILED       string = "failed"       // the device couldn't get the footage, see the error
+	VIDEO_TIMED_OUT    string = "timedOut"     // the device went quiet
+)
+
+// how far along each state is. A reply can only move a job forward.
+var VIDEO_STATE_ORDER = map[string]int{
+	VIDEO_REQUESTED:    0,
+	VIDEO_ACKNOWLEDGED: 1,
+	VIDEO_UPLOADING:    2,
+	VIDEO_COMPLETE:     3,
+	VIDEO_FAILED:       3,
+	VIDEO_TIMED_OUT:    3,
+}
+
+// the statuses devices reply with and the states they move a job to
+var VIDEO_REPLY_STATES = map[string]string{
+	"OK":        VIDEO_ACKNOWLEDGED,
+	"ACK":       VIDEO_ACKNOWLEDGED,
+	"UPLOADING": VIDEO_UPLOADING,
+	"DONE":      VIDEO_COMPLETE,
+	"COMPLETE":  VIDEO_COMPLETE,
+	"FAIL":      VIDEO_FAILED,
+	"FAILED":    VIDEO_FAILED,
+	"ERROR":     VIDEO_FAILED,
+	"NOVIDEO":   VIDEO_FAILED,
+}
+
+// how long a job can sit in a state before it's timed out
+const (
+	VIDEO_ACK_TIMEOUT      time.Duration = 2 * time.Minute  // for the device to acknowledge the request
+	VIDEO_UPLOAD_TIMEOUT   time.Duration = 30 * time.Minute // for the device to start and then finish the upload
+	VIDEO_TIMEOUT_INTERVAL time.Duration = 5 * time.Second  // how often we look for jobs that have timed out
+)
+
+// one change of state
+type VideoJobTransition_Schema struct {
+	State   string    `bson:"state" json:"state"`
+	Time    time.Time `bson:"time" json:"time"`
+	Message string    `bson:"message,omitempty" json:"message,omitempty"` // the reply that caused it, if any
+}
+
+// a video request and what's happened to it, stored in mongodb and sent to API clients
+type VideoJob_Schema struct {
+	Id            string                      `bson:"_id" json:"id"`
+	DeviceId      string                      `bson:"deviceId" json:"deviceId"`
+	Message       string                      `bson:"message" json:"message"`
+	Camera        int                         `bson:"camera" json:"camera"`
+	Start         *time.Time                  `bson:"start,omitempty" json:"start,omitempty"` // in the device's clock
+	LengthSeconds int                         `bson:"lengthSeconds" json:"lengthSeconds"`
+	RequestedBy   string                      `bson:"requestedBy" json:"requestedBy"` // id of the client, job or command that sent it
+	RequestTime   time.Time                   `bson:"requestTime" json:"requestTime"`
+	State         string                      `bson:"state" json:"state"`
+	StateTime     time.Time                   `bson:"stateTime" json:"stateTime"`
+	Deadline      *time.Time                  `bson:"deadline,omitempty" json:"deadline,omitempty"` // timed out if still in this state by then
+	Error         string                      `bson:"error,omitempty" json:"error,omitempty"`
+	History       []VideoJobTransition_Schema `bson:"history" json:"history"`
+}
+
+// is the job finished with
+func (j *VideoJob_Schema) IsDone() bool {
+	return j.State == VIDEO_COMPLETE || j.State == VIDEO_FAILED || j.State == VIDEO_TIMED_OUT
+}
+
+// what to look for in the stored jobs
+type VideoJobQuery struct {
+	DeviceId string   // every device's if empty
+	States   []string // any state if empty
+	After    time.Time
+	Before   time.Time
+}
+
+// where jobs are kept, the DBConnection outside of tests
+type VideoJobStore interface {
+	UpsertVideoJob(job *VideoJob_Schema) error
+	GetVideoJob(id string) (*VideoJob_Schema, error)
+	QueryVideoJobs(q *VideoJobQuery) ([]VideoJob_Schema, error)
+}
+
+// is this a video request or reply
+func isVideoMessage(message string) bool {
+	return getCommandFromMessage(message) == "VIDEO"
+}
+
+// fill in what we can from a video request: $VIDEO;[DeviceID];[type];[camera];[start];[time length]
+func parseVideoRequest(job *VideoJob_Schema) {
+	fields := strings.Split(strings.TrimSpace(job.Message), ";")
+	if len(fields) < 6 {
+		return
+	}
+	job.Camera, _ = strconv.Atoi(fields[3])
+	if start, err := time.Parse(DEVICE_TIME_FORMAT, fields[4]); err == nil {
+		job.Start = &start
+	}
+	job.LengthSeconds, _ = strconv.Atoi(fields[5])
+}
+
+// get the state a video reply moves a job to and the detail after it. Empty if it isn't one we know.
+func parseVideoReply(message string) (string, string) {
+	fields := strings.Split(strings.TrimSpace(message), ";")
+	if len(fields) < 4 {
+		return "", ""
+	}
+	state := VIDEO_REPLY_STATES[strings.ToUpper(fields[3])]
+	return state, strings.Join(fields[4:], ";")
+}
+
+// how long a job has in a state, 0 if it's done
+func videoStateTimeout(state string) time.Duration {
+	switch state {
+	case VIDEO_REQUESTED:
+		return VIDEO_ACK_TIMEOUT
+	case VIDEO_ACKNOWLEDGED, VIDEO_UPLOADING:
+		return VIDEO_UPLOAD_TIMEOUT
+	}
+	return 0
+}
+
+// copy a job so it can be handed out while the original changes
+func copyVideoJob(job *VideoJob_Schema) *VideoJob_Schema {
+	c := *job
+	c.History = append([]VideoJobTransition_Schema{}, job.History...)
+	return &c
+}
+
+// tracks video requests
+type VideoJobs struct {
+	// internal
+	active map[string][]*VideoJob_Schema // device id against its unfinished jobs, oldest first
+	lock   sync.Mutex                    // jobs start from sends on many goroutines, move on replies and the timer
+
+	// injected
+	logger       *zap.Logger
+	store        VideoJobStore
+	publishEvent PublishEventFunction
+}
+
+// constructor, picks up the jobs that were unfinished when we last stopped
+func NewVideoJobs(logger *zap.Logger, store VideoJobStore, publishEvent PublishEventFunction) (*VideoJobs, error) {
+	vj := &VideoJobs{
+		active:       make(map[string][]*VideoJob_Schema),
+		logger:       logger,
+		store:        store,
+		publishEvent: publishEvent,
+	}
+	jobs, err := store.QueryVideoJobs(&VideoJobQuery{States: []string{VIDEO_REQUESTED, VIDEO_ACKNOWLEDGED, VIDEO_UPLOADING}, Before: time.Now()})
+	if err != nil {
+		return nil, fmt.Errorf("error loading video jobs: %v", err)
+	}
+	// they come newest first
+	for i := len(jobs) - 1; i >= 0; i-- {
+		vj.active[jobs[i].DeviceId] = append(vj.active[jobs[i].DeviceId], &jobs[i])
+	}
+	return vj, nil
+}
+
+// start a job for each video request written to a device, meant to be registered as a send hook
+func (vj *VideoJobs) ProcessSend(msgWrap *MessageWrapper) error {
+	if !isVideoMessage(msgWrap.message) {
+		return nil
+	}
+	var devId string
+	err := getIdFromMessage(&msgWrap.message, &devId)
+	if err != nil {
+		return fmt.Errorf("couldn't parse device id from %v", msgWrap.message)
+	}
+	job := &VideoJob_Schema{
+		Id:          uuid.New().String(),
+		DeviceId:    devId,
+		Message:     msgWrap.message,
+		RequestTime: msgWrap.recvdTime,
+		History:     make([]VideoJobTransition_Schema, 0),
+	}
+	if msgWrap.clientId != nil {
+		job.RequestedBy = *msgWrap.clientId
+	}
+	parseVideoRequest(job)
+
+	vj.lock.Lock()
+	vj.active[devId] = append(vj.active[devId], job)
+	changed := vj.transition(job, VIDEO_REQUESTED, msgWrap.recvdTime, "", "")
+	vj.lock.Unlock()
+	return vj.save(changed)
+}
+
+// move a job on with a device's reply, meant to be registered as a message hook
+func (vj *VideoJobs) ProcessMessage(msgWrap *MessageWrapper) error {
+	if !isVideoMessage(msgWrap.message) {
+		return nil
+	}
+	state, detail := parseVideoReply(msgWrap.message)
+	if state == "" {
+		vj.logger.Debug("unrecognised video reply", zap.String("message", msgWrap.message))
+		return nil
+	}
+	errMsg := ""
+	if state == VIDEO_FAILED {
+		errMsg = detail
+	}
+
+	vj.lock.Lock()
+	var changed *VideoJob_Schema
+	for _, job := range vj.active[*msgWrap.clientId] {
+		if VIDEO_STATE_ORDER[job.State] < VIDEO_STATE_ORDER[state] {
+			changed = vj.transition(job, state, msgWrap.recvdTime, msgWrap.message, errMsg)
+			break
+		}
+	}
+	vj.lock.Unlock()
+	if changed == nil {
+		return nil
+	}
+	return vj.save(changed)
+}
+
+// move a job to a state, e.g. complete when its upload arrives. Returns the job as it now stands, nil
+// if there's no such job, and false if it can't move there (it's done or past that state).
+func (vj *VideoJobs) Advance(id string, state string, t time.Time, errMsg string) (*VideoJob_Schema, bool, error) {
+	vj.lock.Lock()
+	for _, jobs := range vj.active {
+		for _, job := range jobs {
+			if job.Id != id {
+				continue
+			}
+			if VIDEO_STATE_ORDER[job.State] >= VIDEO_STATE_ORDER[state] {
+				current := copyVideoJob(job)
+				vj.lock.Unlock()
+				return current, false, nil
+			}
+			changed := vj.transition(job, state, t, "", errMsg)
+			vj.lock.Unlock()
+			err := vj.save(changed)
+			return changed, err == nil, err
+		}
+	}
+	vj.lock.Unlock()
+	job, err := vj.store.GetVideoJob(id)
+	return job, false, err
+}
+
+// move a job to a state and stop tracking it once it's done. Lock must be held. Returns a copy of the
+// job to save once the lock's released.
+func (vj *VideoJobs) transition(job *VideoJob_Schema, state string, t time.Time, message string, errMsg string) *VideoJob_Schema {
+	job.State = state
+	job.StateTime = t
+	job.Error = errMsg
+	job.Deadline = nil
+	if timeout := videoStateTimeout(state); timeout > 0 {
+		deadline := t.Add(timeout)
+		job.Deadline = &deadline
+	}
+	job.History = append(job.History, VideoJobTransition_Schema{state, t, message})
+
+	if job.IsDone() {
+		jobs := vj.active[job.DeviceId]
+		for i := range jobs {
+			if jobs[i] == job {
+				vj.active[job.DeviceId] = append(jobs[:i:i], jobs[i+1:]...)
+				break
+			}
+		}
+		if len(vj.active[job.DeviceId]) == 0 {
+			delete(vj.active, job.DeviceId)
+		}
+	}
+
+	return copyVideoJob(job)
+}
+
+// store and publish a job that's changed state. Lock mustn't be held, the store is slow.
+func (vj *VideoJobs) save(job *VideoJob_Schema) error {
+	err := vj.store.UpsertVideoJob(job)
+	if err != nil {
+		return fmt.Errorf("error storing video job: %v", err)
+	}
+	err = vj.publishEvent(&DeviceEvent{EVENT_VIDEO, job.DeviceId, job.StateTime, copyVideoJob(job)})
+	if err != nil {
+		return fmt.Errorf("error publishing video job: %v", err)
+	}
+	return nil
+}
+
+// time out jobs as their deadlines pass, blocking until the context is done
+func (vj *VideoJobs) Run(ctx context.Context) {
+	ticker := time.NewTicker(VIDEO_TIMEOUT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			vj.expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// time out the jobs whose deadline has passed
+func (vj *VideoJobs) expire(now time.Time) {
+	vj.lock.Lock()
+	expired := make([]*VideoJob_Schema, 0)
+	for _, jobs := range vj.active {
+		for _, job := range jobs {
+			if job.Deadline != nil && !now.Before(*job.Deadline) {
+				expired = append(expired, job)
+			}
+		}
+	}
+	changed := make([]*VideoJob_Schema, len(expired))
+	for i, job := range expired {
+		changed[i] = vj.transition(job, VIDEO_TIMED_OUT, now, "", fmt.Sprintf("no reply while %v", job.State))
+	}
+	vj.lock.Unlock()
+
+	for _, job := range changed {
+		err := vj.save(job)
+		if err != nil {
+			vj.logger.Error("error timing out video job", zap.String("jobId", job.Id), zap.Error(err))
+		}
+	}
+}
+
+// get one job, nil if there's no such job
+func (vj *VideoJobs) Get(id string) (*VideoJob_Schema, error) {
+	return vj.store.GetVideoJob(id)
+}
+
+// add the video job endpoints to the http server
+func (vj *VideoJobs) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /videos", vj.handleList)
+	svr.HandleFunc("GET /videos/{id}", vj.handleGet)
+}
+
+// GET /videos?device=&state=&after=&before=, state can be repeated. Newest first.
+func (vj *VideoJobs) handleList(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q := VideoJobQuery{DeviceId: r.URL.Query().Get("device"), States: r.URL.Query()["state"], After: after, Before: before}
+	for _, state := range q.States {
+		if _, ok := VIDEO_STATE_ORDER[state]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown state %q", state))
+			return
+		}
+	}
+	jobs, err := vj.store.QueryVideoJobs(&q)
+	if err != nil {
+		vj.logger.Error("failed to query video jobs", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query video jobs")
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// GET /videos/{id}
+func (vj *VideoJobs) handleGet(w http.ResponseWriter, r *http.Request) {
+	job, err := vj.Get(r.PathValue("id"))
+	if err != nil {
+		vj.logger.Error("failed to get video job", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to get video job")
+		return
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, "no such video job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// insert or replace a video job
+func (dbc *DBConnection) UpsertVideoJob(job *VideoJob_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("video_jobs")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": job.Id}, job, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get one video job, nil if there's no such job
+func (dbc *DBConnection) GetVideoJob(id string) (*VideoJob_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("video_jobs")
+	var job VideoJob_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// get the video jobs requested between the times, newest first
+func (dbc *DBConnection) QueryVideoJobs(q *VideoJobQuery) ([]VideoJob_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("video_jobs")
+
+	filter := bson.M{"requestTime": bson.M{"$gte": q.After, "$lte": q.Before}}
+	if q.DeviceId != "" {
+		filter["deviceId"] = q.DeviceId
+	}
+	if len(q.States) > 0 {
+		filter["state"] = bson.M{"$in": q.States}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "requestTime", Value: -1}})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying video jobs: %v", err)
+	}
+	jobs := make([]VideoJob_Schema, 0)
+	err = cursor.All(context.Background(), &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding video jobs: %v", err)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory VideoJobStore
+type memVideoJobStore struct {
+	lock sync.Mutex
+	jobs map[string]VideoJob_Schema
+}
+
+func (m *memVideoJobStore) UpsertVideoJob(job *VideoJob_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.jobs[job.Id] = *copyVideoJob(job)
+	return nil
+}
+
+func (m *memVideoJobStore) GetVideoJob(id string) (*VideoJob_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (m *memVideoJobStore) QueryVideoJobs(q *VideoJobQuery) ([]VideoJob_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jobs := make([]VideoJob_Schema, 0)
+	for _, job := range m.jobs {
+		if (q.DeviceId == "" || job.DeviceId == q.DeviceId) && (len(q.States) == 0 || containsString(q.States, job.State)) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].RequestTime.After(jobs[j].RequestTime) })
+	return jobs, nil
+}
+
+func newTestVideoJobs(t *testing.T) (*VideoJobs, *[]DeviceEvent) {
+	events := make([]DeviceEvent, 0)
+	publish := func(event *DeviceEvent) error {
+		events = append(events, *event)
+		return nil
+	}
+	vj, err := NewVideoJobs(zap.NewNop(), &memVideoJobStore{jobs: make(map[string]VideoJob_Schema)}, publish)
+	if err != nil {
+		t.Fatalf("new video jobs: %v", err)
+	}
+	return vj, &events
+}
+
+func videoMsg(message string, devId string, t time.Time) *MessageWrapper {
+	return &MessageWrapper{message, &devId, t, DirectionFromDevice, 0}
+}
+
+func TestVideoJobs_Lifecycle(t *testing.T) {
+	vj, events := newTestVideoJobs(t)
+	now := time.Date(2024, 8, 17, 12, 0, 0, 0, time.UTC)
+
+	vj.ProcessSend(videoMsg("$VIDEO;123456;all;4;20231003-164514;5", "client", now))
+	vj.ProcessSend(videoMsg("$VIDEO;123456;all;2;20231003-170000;10", "client", now.Add(time.Second)))
+	vj.ProcessSend(videoMsg("$STATUS;123456", "client", now))
+	jobs := vj.active["123456"]
+	if len(jobs) != 2 || jobs[0].Camera != 4 || jobs[0].LengthSeconds != 5 || jobs[0].Start == nil {
+		t.Fatalf("jobs not started as expected: %+v", jobs)
+	}
+	first, second := jobs[0], jobs[1]
+
+	// replies move the oldest job that can move, so the second ack goes to the second job
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120001;OK", "123456", now.Add(2*time.Second)))
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120002;OK", "123456", now.Add(3*time.Second)))
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120003;UPLOADING", "123456", now.Add(4*time.Second)))
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120004;pokpok", "123456", now.Add(5*time.Second)))
+	if first.State != VIDEO_UPLOADING || second.State != VIDEO_ACKNOWLEDGED {
+		t.Fatalf("states %v and %v", first.State, second.State)
+	}
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120005;DONE", "123456", now.Add(6*time.Second)))
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120006;NOVIDEO;no footage for that time", "123456", now.Add(7*time.Second)))
+	if len(vj.active) != 0 {
+		t.Fatalf("jobs still active: %+v", vj.active)
+	}
+
+	got, _ := vj.store.GetVideoJob(first.Id)
+	states := make([]string, 0)
+	for _, h := range got.History {
+		states = append(states, h.State)
+	}
+	if got.State != VIDEO_COMPLETE || len(states) != 4 || states[0] != VIDEO_REQUESTED || states[3] != VIDEO_COMPLETE {
+		t.Errorf("first job %+v, history %v", got, states)
+	}
+	got, _ = vj.store.GetVideoJob(second.Id)
+	if got.State != VIDEO_FAILED || got.Error != "no footage for that time" || got.Deadline != nil {
+		t.Errorf("second job %+v", got)
+	}
+	if len(*events) != 7 || (*events)[0].Event != EVENT_VIDEO {
+		t.Errorf("%v events published", len(*events))
+	}
+}
+
+func TestVideoJobs_TimeoutAndAdvance(t *testing.T) {
+	vj, _ := newTestVideoJobs(t)
+	now := time.Now()
+	vj.ProcessSend(videoMsg("$VIDEO;123456;all;4;20231003-164514;5", "client", now))
+	vj.ProcessSend(videoMsg("$VIDEO;654321;all;4;20231003-164514;5", "client", now))
+	quiet, uploading := vj.active["123456"][0], vj.active["654321"][0]
+	vj.ProcessMessage(videoMsg("$VIDEO;654321;20240817-120001;UPLOADING", "654321", now))
+
+	// the one nobody acked times out, the uploading one has longer
+	vj.expire(now.Add(VIDEO_ACK_TIMEOUT))
+	got, _ := vj.store.GetVideoJob(quiet.Id)
+	if got.State != VIDEO_TIMED_OUT {
+		t.Errorf("quiet job is %v", got.State)
+	}
+	if uploading.State != VIDEO_UPLOADING {
+		t.Errorf("uploading job is %v", uploading.State)
+	}
+
+	// the upload arriving completes it, and it can't go backwards after
+	job, ok, err := vj.Advance(uploading.Id, VIDEO_COMPLETE, now.Add(time.Minute), "")
+	if err != nil || !ok || job.State != VIDEO_COMPLETE {
+		t.Fatalf("advance: %+v, %v, %v", job, ok, err)
+	}
+	job, ok, _ = vj.Advance(uploading.Id, VIDEO_UPLOADING, now.Add(time.Minute), "")
+	if ok || job == nil || job.State != VIDEO_COMPLETE {
+		t.Errorf("advanced a finished job: %+v", job)
+	}
+	if job, ok, _ := vj.Advance("nope", VIDEO_COMPLETE, now, ""); ok || job != nil {
+		t.Errorf("advanced a job that doesn't exist")
+	}
+}
+
+func TestVideoJobs_SavesWithoutLock(t *testing.T) {
+	var vj *VideoJobs
+	locked := false
+	publish := func(event *DeviceEvent) error {
+		// someone else can get at the jobs while this one's being saved
+		if vj.lock.TryLock() {
+			vj.lock.Unlock()
+		} else {
+			locked = true
+		}
+		return nil
+	}
+	vj, _ = NewVideoJobs(zap.NewNop(), &memVideoJobStore{jobs: make(map[string]VideoJob_Schema)}, publish)
+	now := time.Now()
+	vj.ProcessSend(videoMsg("$VIDEO;123456;all;4;20231003-164514;5", "client", now))
+	vj.ProcessMessage(videoMsg("$VIDEO;123456;20240817-120001;OK", "123456", now))
+	vj.expire(now.Add(time.Hour))
+	if locked {
+		t.Error("video job published with the lock held")
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+WEBHOOKS
+POST device events to the urls registered over the http api. The body is the event as JSON, the same
+as the websocket api sends, signed with the webhook's secret:
+X-Dvr-Timestamp: unix seconds the delivery was signed at
+X-Dvr-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+A delivery that doesn't get a 2xx is retried with exponential backoff, and once out of attempts it's
+put in the dead letter store where it can be retried by hand. On shutdown whatever is still queued
+or waiting to be retried is dead lettered too.
+~~~~~~~~~~~~~~~
+*/
+
+// defaults for the dispatcher
+const (
+	WEBHOOK_WORKERS      int           = 4                // deliveries in flight at once
+	WEBHOOK_QUEUE_SIZE   int           = 1000             // deliveries waiting for a worker
+	WEBHOOK_MAX_ATTEMPTS int           = 6                // attempts before a delivery is dead lettered
+	WEBHOOK_BASE_DELAY   time.Duration = 2 * time.Second  // wait before the first retry, doubled each retry after
+	WEBHOOK_MAX_DELAY    time.Duration = 5 * time.Minute  // longest wait between retries
+	WEBHOOK_TIMEOUT      time.Duration = 10 * time.Second // how long a receiver gets to respond
+)
+
+// a webhook subscription, stored in mongodb and sent to/received from API clients. The secret is
+// never sent back out.
+type Webhook_Schema struct {
+	Id      string   `bson:"_id" json:"id"`
+	Url     string   `bson:"url" json:"url"`
+	Events  []string `bson:"events" json:"events"`   // event types to deliver, see the EVENT_ constants
+	Devices []string `bson:"devices" json:"devices"` // devices to deliver events for, empty for all of them
+	Secret  string   `bson:"secret" json:"secret,omitempty"`
+	Enabled bool     `bson:"enabled" json:"enabled"`
+}
+
+// one attempt at delivering an event to a webhook, the delivery log
+type WebhookAttempt_Schema struct {
+	DeliveryId string    `bson:"deliveryId" json:"deliveryId"`
+	WebhookId  string    `bson:"webhookId" json:"webhookId"`
+	Event      string    `bson:"event" json:"event"`
+	DeviceId   string    `bson:"deviceId" json:"deviceId"`
+	Attempt    int       `bson:"attempt" json:"attempt"`
+	Time       time.Time `bson:"time" json:"time"`
+	StatusCode int       `bson:"statusCode,omitempty" json:"statusCode,omitempty"` // 0 if we didn't get a response
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	Success    bool      `bson:"success" json:"success"`
+}
+
+// a delivery we gave up on
+type WebhookDeadLetter_Schema struct {
+	Id        string    `bson:"_id" json:"id"` // the delivery id
+	WebhookId string    `bson:"webhookId" json:"webhookId"`
+	Event     string    `bson:"event" json:"event"`
+	DeviceId  string    `bson:"deviceId" json:"deviceId"`
+	Body      string    `bson:"body" json:"body"`
+	Attempts  int       `bson:"attempts" json:"attempts"`
+	LastError string    `bson:"lastError" json:"lastError"`
+	Time      time.Time `bson:"time" json:"time"`
+}
+
+// where the dispatcher keeps its webhooks and records deliveries, the DBConnection outside of tests
+type WebhookStore interface {
+	QueryWebhooks() ([]Webhook_Schema, error)
+	UpsertWebhook(hook *Webhook_Schema) error
+	DeleteWebhook(id string) (bool, error)
+	RecordWebhookAttempt(attempt *WebhookAttempt_Schema) error
+	QueryWebhookAttempts(webhookId string, after time.Time, before time.Time) ([]WebhookAttempt_Schema, error)
+	RecordWebhookDeadLetter(dead *WebhookDeadLetter_Schema) error
+	QueryWebhookDeadLetters() ([]WebhookDeadLetter_Schema, error)
+	GetWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error)
+	TakeWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error)
+}
+
+// check the webhook is something we can deliver to
+func (h *Webhook_Schema) Validate() error {
+	u, err := url.Parse(h.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("events must list at least one event type")
+	}
+	return nil
+}
+
+// does the webhook want this event
+func (h *Webhook_Schema) Wants(event *DeviceEvent) bool {
+	if !h.Enabled {
+		return false
+	}
+	wanted := false
+	for _, e := range h.Events {
+		if e == event.Event {
+			wanted = true
+			break
+		}
+	}
+	if !wanted || len(h.Devices) == 0 {
+		return wanted
+	}
+	for _, d := range h.Devices {
+		if d == event.DeviceId {
+			return true
+		}
+	}
+	return false
+}
+
+// sign a body the way receivers are told to check it
+func signWebhookBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// one event on its way to one webhook
+type webhookDelivery struct {
+	id       string
+	hook     Webhook_Schema
+	event    string
+	deviceId string
+	body     []byte
+	attempt  int // attempts made so far
+}
+
+// delivers events to webhooks
+type WebhookDispatcher struct {
+	// internal
+	hooks    map[string]*Webhook_Schema       // webhook id against webhook
+	queue    chan *webhookDelivery            // deliveries waiting for a worker
+	retries  map[*webhookDelivery]*time.Timer // deliveries waiting to be retried
+	stopping bool                             // Drain has been called, everything goes to the dead letter store
+	client   *http.Client
+	lock     sync.Mutex // events come from several goroutines, changes from the http server
+
+	// retry policy
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+
+	// injected
+	logger *zap.Logger
+	store  WebhookStore
+}
+
+// constructor, loads the webhooks already defined
+func NewWebhookDispatcher(logger *zap.Logger, store WebhookStore) (*WebhookDispatcher, error) {
+	wd := &WebhookDispatcher{
+		hooks:       make(map[string]*Webhook_Schema),
+		queue:       make(chan *webhookDelivery, WEBHOOK_QUEUE_SIZE),
+		retries:     make(map[*webhookDelivery]*time.Timer),
+		client:      &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		maxAttempts: WEBHOOK_MAX_ATTEMPTS,
+		baseDelay:   WEBHOOK_BASE_DELAY,
+		maxDelay:    WEBHOOK_MAX_DELAY,
+		logger:      logger,
+		store:       store,
+	}
+	hooks, err := store.QueryWebhooks()
+	if err != nil {
+		return nil, fmt.Errorf("error loading webhooks: %v", err)
+	}
+	for i := range hooks {
+		wd.hooks[hooks[i].Id] = &hooks[i]
+	}
+	return wd, nil
+}
+
+// deliver events until the context is done, blocking until the workers have finished the attempts
+// they're making. What's left is dead lettered by Drain.
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case d := <-wd.queue:
+					wd.attempt(d)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// dead letter the deliveries that are queued or waiting to be retried, and any that come after. Call
+// once Run has returned, before the database is disconnected.
+func (wd *WebhookDispatcher) Drain() {
+	wd.lock.Lock()
+	wd.stopping = true
+	pending := make([]*webhookDelivery, 0)
+	for d, timer := range wd.retries {
+		// if it's already fired it'll be dead lettered by enqueue
+		if timer.Stop() {
+			pending = append(pending, d)
+		}
+		delete(wd.retries, d)
+	}
+	for len(wd.queue) > 0 {
+		pending = append(pending, <-wd.queue)
+	}
+	wd.lock.Unlock()
+
+	for _, d := range pending {
+		wd.deadLetter(d, "shut down before it was delivered")
+	}
+}
+
+// queue an event for every webhook that wants it, meant to be used as a PublishEventFunction
+func (wd *WebhookDispatcher) Notify(event *DeviceEvent) error {
+	wd.lock.Lock()
+	hooks := make([]Webhook_Schema, 0)
+	for _, hook := range wd.hooks {
+		if hook.Wants(event) {
+			hooks = append(hooks, *hook)
+		}
+	}
+	wd.lock.Unlock()
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event for webhooks: %v", err)
+	}
+	for _, hook := range hooks {
+		wd.enqueue(&webhookDelivery{
+			id:       uuid.New().String(),
+			hook:     hook,
+			event:    event.Event,
+			deviceId: event.DeviceId,
+			body:     body,
+		})
+	}
+	return nil
+}
+
+// put a delivery on the queue without blocking the caller. If the queue is full the delivery is
+// dead lettered straight away so the event isn't lost.
+func (wd *WebhookDispatcher) enqueue(d *webhookDelivery) {
+	wd.lock.Lock()
+	if wd.stopping {
+		wd.lock.Unlock()
+		wd.deadLetter(d, "shut down before it was delivered")
+		return
+	}
+	select {
+	case wd.queue <- d:
+		wd.lock.Unlock()
+	default:
+		wd.lock.Unlock()
+		wd.deadLetter(d, "webhook queue full")
+	}
+}
+
+// make one attempt at a delivery, scheduling a retry or dead lettering it if it fails
+func (wd *WebhookDispatcher) attempt(d *webhookDelivery) {
+	d.attempt++
+	status, err := wd.post(d)
+	record := WebhookAttempt_Schema{
+		DeliveryId: d.id,
+		WebhookId:  d.hook.Id,
+		Event:      d.event,
+		DeviceId:   d.deviceId,
+		Attempt:    d.attempt,
+		Time:       time.Now(),
+		StatusCode: status,
+		Success:    err == nil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if recErr := wd.store.RecordWebhookAttempt(&record); recErr != nil {
+		wd.logger.Error("error recording webhook attempt", zap.Error(recErr))
+	}
+	if err == nil {
+		return
+	}
+
+	if d.attempt >= wd.maxAttempts {
+		wd.deadLetter(d, err.Error())
+		return
+	}
+	delay := wd.backoff(d.attempt)
+	wd.logger.Debug("webhook delivery failed, retrying", zap.String("webhookId", d.hook.Id), zap.Int("attempt", d.attempt), zap.Duration("delay", delay), zap.Error(err))
+	wd.lock.Lock()
+	if wd.stopping {
+		wd.lock.Unlock()
+		wd.deadLetter(d, err.Error())
+		return
+	}
+	wd.retries[d] = time.AfterFunc(delay, func() {
+		wd.lock.Lock()
+		delete(wd.retries, d)
+		wd.lock.Unlock()
+		wd.enqueue(d)
+	})
+	wd.lock.Unlock()
+}
+
+// how long to wait before the retry following the given attempt
+func (wd *WebhookDispatcher) backoff(attempt int) time.Duration {
+	delay := wd.baseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= wd.maxDelay {
+			return wd.maxDelay
+		}
+	}
+	return delay
+}
+
+// POST the delivery to the webhook, an error for anything but a 2xx
+func (wd *WebhookDispatcher) post(d *webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.hook.Url, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dvr-Event", d.event)
+	req.Header.Set("X-Dvr-Delivery", d.id)
+	req.Header.Set("X-Dvr-Timestamp", timestamp)
+	req.Header.Set("X-Dvr-Signature", signWebhookBody(d.hook.Secret, timestamp, d.body))
+
+	res, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded %v", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// give up on a delivery
+func (wd *WebhookDispatcher) deadLetter(d *webhookDelivery, lastError string) {
+	dead := WebhookDeadLetter_Schema{
+		Id:        d.id,
+		WebhookId: d.hook.Id,
+		Event:     d.event,
+		DeviceId:  d.deviceId,
+		Body:      string(d.body),
+		Attempts:  d.attempt,
+		LastError: lastError,
+		Time:      time.Now(),
+	}
+	err := wd.store.RecordWebhookDeadLetter(&dead)
+	if err != nil {
+		wd.logger.Error("error recording webhook dead letter, delivery lost", zap.String("deliveryId", d.id), zap.Error(err))
+		return
+	}
+	wd.logger.Warn("webhook delivery dead lettered", zap.String("webhookId", d.hook.Id), zap.String("deliveryId", d.id), zap.String("lastError", lastError))
+}
+
+// take a delivery out of the dead letter store and try it again from the first attempt.
+// Returns false if there's no such dead letter or its webhook has since been deleted.
+// The dead letter is left where it is if its webhook is gone.
+func (wd *WebhookDispatcher) RetryDeadLetter(id string) (bool, error) {
+	dead, err := wd.store.GetWebhookDeadLetter(id)
+	if err != nil || dead == nil {
+		return false, err
+	}
+	hook, ok := wd.GetWebhook(dead.WebhookId)
+	if !ok {
+		return false, nil
+	}
+	// someone else may have retried it since we looked
+	dead, err = wd.store.TakeWebhookDeadLetter(id)
+	if err != nil || dead == nil {
+		return false, err
+	}
+	wd.enqueue(&webhookDelivery{
+		id:       dead.Id,
+		hook:     hook,
+		event:    dead.Event,
+		deviceId: dead.DeviceId,
+		body:     []byte(dead.Body),
+	})
+	return true, nil
+}
+
+// add or replace a webhook
+func (wd *WebhookDispatcher) PutWebhook(hook *Webhook_Schema) error {
+	err := wd.store.UpsertWebhook(hook)
+	if err != nil {
+		return err
+	}
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	wd.hooks[hook.Id] = hook
+	return nil
+}
+
+// remove a webhook, returns false if there was no such webhook
+func (wd *WebhookDispatcher) DeleteWebhook(id string) (bool, error) {
+	deleted, err := wd.store.DeleteWebhook(id)
+	if err != nil {
+		return false, err
+	}
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	delete(wd.hooks, id)
+	return deleted, nil
+}
+
+// list the webhooks
+func (wd *WebhookDispatcher) GetWebhooks() []Webhook_Schema {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	hooks := make([]Webhook_Schema, 0, len(wd.hooks))
+	for _, hook := range wd.hooks {
+		hooks = append(hooks, *hook)
+	}
+	return hooks
+}
+
+// get one webhook
+func (wd *WebhookDispatcher) GetWebhook(id string) (Webhook_Schema, bool) {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	hook, ok := wd.hooks[id]
+	if !ok {
+		return Webhook_Schema{}, false
+	}
+	return *hook, true
+}
+
+// add the webhook endpoints to the http server
+func (wd *WebhookDispatcher) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /webhooks", wd.handleList)
+	svr.HandleFunc("POST /webhooks", wd.handleCreate)
+	svr.HandleFunc("GET /webhooks/{id}", wd.handleGet)
+	svr.HandleFunc("PUT /webhooks/{id}", wd.handleUpdate)
+	svr.HandleFunc("DELETE /webhooks/{id}", wd.handleDelete)
+	svr.HandleFunc("GET /webhooks/{id}/deliveries", wd.handleGetDeliveries)
+	svr.HandleFunc("GET /webhooks/deadletters", wd.handleGetDeadLetters)
+	svr.HandleFunc("POST /webhooks/deadletters/{id}/retry", wd.handleRetryDeadLetter)
+}
+
+// GET /webhooks
+func (wd *WebhookDispatcher) handleList(w http.ResponseWriter, r *http.Request) {
+	hooks := wd.GetWebhooks()
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// GET /webhooks/{id}
+func (wd *WebhookDispatcher) handleGet(w http.ResponseWriter, r *http.Request) {
+	hook, ok := wd.GetWebhook(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such webhook")
+		return
+	}
+	hook.Secret = ""
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// POST /webhooks
+func (wd *WebhookDispatcher) handleCreate(w http.ResponseWriter, r *http.Request) {
+	wd.handlePut(w, r, uuid.New().String(), http.StatusCreated)
+}
+
+// PUT /webhooks/{id}
+func (wd *WebhookDispatcher) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := wd.GetWebhook(id); !ok {
+		writeError(w, http.StatusNotFound, "no such webhook")
+		return
+	}
+	wd.handlePut(w, r, id, http.StatusOK)
+}
+
+// read, validate and store a webhook from the request body
+func (wd *WebhookDispatcher) handlePut(w http.ResponseWriter, r *http.Request, id string, status int) {
+	// webhooks are enabled unless they say otherwise
+	hook := Webhook_Schema{Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid webhook json: %v", err))
+		return
+	}
+	hook.Id = id
+	// an update that leaves out the secret keeps the one it had
+	if existing, ok := wd.GetWebhook(id); ok && hook.Secret == "" {
+		hook.Secret = existing.Secret
+	}
+	if hook.Devices == nil {
+		hook.Devices = []string{}
+	}
+	err = hook.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = wd.PutWebhook(&hook)
+	if err != nil {
+		wd.logger.Error("failed to store webhook", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to store webhook")
+		return
+	}
+	res := hook
+	res.Secret = ""
+	writeJSON(w, status, res)
+}
+
+// DELETE /webhooks/{id}
+func (wd *WebhookDispatcher) handleDelete(w http.ResponseWriter, r *http.Request) {
+	deleted, err := wd.DeleteWebhook(r.PathValue("id"))
+	if err != nil {
+		wd.logger.Error("failed to delete webhook", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "no such webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /webhooks/{id}/deliveries?after=&before=
+func (wd *WebhookDispatcher) handleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	after, before, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	attempts, err := wd.store.QueryWebhookAttempts(r.PathValue("id"), after, before)
+	if err != nil {
+		wd.logger.Error("failed to query webhook deliveries", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query webhook deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+// GET /webhooks/deadletters
+func (wd *WebhookDispatcher) handleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	dead, err := wd.store.QueryWebhookDeadLetters()
+	if err != nil {
+		wd.logger.Error("failed to query webhook dead letters", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to query webhook dead letters")
+		return
+	}
+	writeJSON(w, http.StatusOK, dead)
+}
+
+// POST /webhooks/deadletters/{id}/retry
+func (wd *WebhookDispatcher) handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ok, err := wd.RetryDeadLetter(r.PathValue("id"))
+	if err != nil {
+		wd.logger.Error("failed to retry webhook dead letter", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to retry webhook dead letter")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such dead letter, or its webhook was deleted")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// get every webhook
+func (dbc *DBConnection) QueryWebhooks() ([]Webhook_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhooks")
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhooks: %v", err)
+	}
+	hooks := make([]Webhook_Schema, 0)
+	err = cursor.All(ctx, &hooks)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return hooks, nil
+}
+
+// insert or replace a webhook
+func (dbc *DBConnection) UpsertWebhook(hook *Webhook_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhooks")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": hook.Id}, hook, options.Replace().SetUpsert(true))
+	return err
+}
+
+// delete a webhook, returns false if there was nothing to delete
+func (dbc *DBConnection) DeleteWebhook(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhooks")
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// insert a delivery attempt into the delivery log
+func (dbc *DBConnection) RecordWebhookAttempt(attempt *WebhookAttempt_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deliveries")
+	_, err := coll.InsertOne(ctx, attempt)
+	return err
+}
+
+// get the delivery attempts for a webhook between the two times, newest first
+func (dbc *DBConnection) QueryWebhookAttempts(webhookId string, after time.Time, before time.Time) ([]WebhookAttempt_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deliveries")
+
+	filter := bson.M{
+		"webhookId": webhookId,
+		"time": bson.M{
+			"$gte": after,
+			"$lt":  before,
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetProjection(bson.M{"_id": 0})
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhook deliveries: %v", err)
+	}
+	attempts := make([]WebhookAttempt_Schema, 0)
+	err = cursor.All(context.Background(), &attempts)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding webhook deliveries: %v", err)
+	}
+	return attempts, nil
+}
+
+// insert a dead letter
+func (dbc *DBConnection) RecordWebhookDeadLetter(dead *WebhookDeadLetter_Schema) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deadletters")
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": dead.Id}, dead, options.Replace().SetUpsert(true))
+	return err
+}
+
+// get every dead letter, newest first
+func (dbc *DBConnection) QueryWebhookDeadLetters() ([]WebhookDeadLetter_Schema, error) {
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deadletters")
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := coll.Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhook dead letters: %v", err)
+	}
+	dead := make([]WebhookDeadLetter_Schema, 0)
+	err = cursor.All(context.Background(), &dead)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding webhook dead letters: %v", err)
+	}
+	return dead, nil
+}
+
+// a dead letter, nil if there's no such dead letter
+func (dbc *DBConnection) GetWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deadletters")
+	var dead WebhookDeadLetter_Schema
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&dead)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dead, nil
+}
+
+// remove a dead letter and return it, nil if there's no such dead letter
+func (dbc *DBConnection) TakeWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("webhook_deadletters")
+	var dead WebhookDeadLetter_Schema
+	err := coll.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&dead)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dead, nil
+}
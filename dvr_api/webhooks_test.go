@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// in memory WebhookStore
+type memWebhookStore struct {
+	lock     sync.Mutex
+	hooks    map[string]Webhook_Schema
+	attempts []WebhookAttempt_Schema
+	dead     map[string]WebhookDeadLetter_Schema
+}
+
+func newMemWebhookStore() *memWebhookStore {
+	return &memWebhookStore{hooks: make(map[string]Webhook_Schema), dead: make(map[string]WebhookDeadLetter_Schema)}
+}
+
+func (m *memWebhookStore) QueryWebhooks() ([]Webhook_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	hooks := make([]Webhook_Schema, 0)
+	for _, h := range m.hooks {
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+func (m *memWebhookStore) UpsertWebhook(hook *Webhook_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hooks[hook.Id] = *hook
+	return nil
+}
+
+func (m *memWebhookStore) DeleteWebhook(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.hooks[id]
+	delete(m.hooks, id)
+	return ok, nil
+}
+
+func (m *memWebhookStore) RecordWebhookAttempt(attempt *WebhookAttempt_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.attempts = append(m.attempts, *attempt)
+	return nil
+}
+
+func (m *memWebhookStore) QueryWebhookAttempts(webhookId string, after time.Time, before time.Time) ([]WebhookAttempt_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]WebhookAttempt_Schema{}, m.attempts...), nil
+}
+
+func (m *memWebhookStore) RecordWebhookDeadLetter(dead *WebhookDeadLetter_Schema) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dead[dead.Id] = *dead
+	return nil
+}
+
+func (m *memWebhookStore) QueryWebhookDeadLetters() ([]WebhookDeadLetter_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dead := make([]WebhookDeadLetter_Schema, 0)
+	for _, d := range m.dead {
+		dead = append(dead, d)
+	}
+	return dead, nil
+}
+
+func (m *memWebhookStore) GetWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, ok := m.dead[id]
+	if !ok {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+func (m *memWebhookStore) TakeWebhookDeadLetter(id string) (*WebhookDeadLetter_Schema, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, ok := m.dead[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.dead, id)
+	return &d, nil
+}
+
+// dispatcher with fast retries, delivering to url until the test is done
+func newTestWebhookDispatcher(t *testing.T, store *memWebhookStore, url string) *WebhookDispatcher {
+	wd := newStoppedWebhookDispatcher(t, store, url)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go wd.Run(ctx)
+	return wd
+}
+
+// the same without starting it
+func newStoppedWebhookDispatcher(t *testing.T, store *memWebhookStore, url string) *WebhookDispatcher {
+	wd, err := NewWebhookDispatcher(zap.NewNop(), store)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher: %v", err)
+	}
+	wd.baseDelay = 5 * time.Millisecond
+	wd.maxDelay = 20 * time.Millisecond
+	wd.maxAttempts = 3
+	err = wd.PutWebhook(&Webhook_Schema{Id: "hook", Url: url, Events: []string{EVENT_ALERT}, Secret: "shh", Enabled: true})
+	if err != nil {
+		t.Fatalf("PutWebhook: %v", err)
+	}
+	return wd
+}
+
+// wait for cond to be true or fail the test
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhook_SignedDeliveryWithRetry(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	var received DeviceEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		// fail the first attempt to exercise the retry
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sig := signWebhookBody("shh", r.Header.Get("X-Dvr-Timestamp"), body); sig != r.Header.Get("X-Dvr-Signature") {
+			t.Errorf("bad signature %q, expected %q", r.Header.Get("X-Dvr-Signature"), sig)
+		}
+		if r.Header.Get("X-Dvr-Event") != EVENT_ALERT {
+			t.Errorf("unexpected event header %q", r.Header.Get("X-Dvr-Event"))
+		}
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := newMemWebhookStore()
+	wd := newTestWebhookDispatcher(t, store, receiver.URL)
+
+	// positions aren't wanted by the hook, alerts are
+	wd.Notify(&DeviceEvent{EVENT_POSITION, "123456", time.Now(), &Position_Schema{}})
+	wd.Notify(&DeviceEvent{EVENT_ALERT, "123456", time.Now(), &Alert_Schema{Id: "a1"}})
+
+	waitFor(t, "two delivery attempts", func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return len(store.attempts) == 2
+	})
+	if store.attempts[0].Success || store.attempts[0].StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("first attempt should have failed with 503: %+v", store.attempts[0])
+	}
+	if !store.attempts[1].Success || store.attempts[1].Attempt != 2 {
+		t.Errorf("second attempt should have succeeded: %+v", store.attempts[1])
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if received.Event != EVENT_ALERT || received.DeviceId != "123456" {
+		t.Errorf("unexpected event received: %+v", received)
+	}
+}
+
+func TestWebhook_DeadLetter(t *testing.T) {
+	var lock sync.Mutex
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	store := newMemWebhookStore()
+	wd := newTestWebhookDispatcher(t, store, receiver.URL)
+	wd.Notify(&DeviceEvent{EVENT_ALERT, "123456", time.Now(), &Alert_Schema{Id: "a1"}})
+
+	// every attempt fails, so it ends up dead lettered
+	waitFor(t, "dead letter", func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return len(store.dead) == 1
+	})
+	dead, _ := store.QueryWebhookDeadLetters()
+	if dead[0].Attempts != 3 || dead[0].WebhookId != "hook" {
+		t.Errorf("unexpected dead letter: %+v", dead[0])
+	}
+
+	// retried by hand once the receiver is fixed
+	lock.Lock()
+	fail = false
+	lock.Unlock()
+	ok, err := wd.RetryDeadLetter(dead[0].Id)
+	if !ok || err != nil {
+		t.Fatalf("RetryDeadLetter = %v, %v", ok, err)
+	}
+	waitFor(t, "successful retry", func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		last := store.attempts[len(store.attempts)-1]
+		return len(store.dead) == 0 && last.Success && last.DeliveryId == dead[0].Id
+	})
+}
+
+func TestWebhook_RetryDeadLetterForDeletedWebhook(t *testing.T) {
+	store := newMemWebhookStore()
+	wd := newTestWebhookDispatcher(t, store, "http://127.0.0.1:1")
+	store.RecordWebhookDeadLetter(&WebhookDeadLetter_Schema{Id: "d1", WebhookId: "gone"})
+
+	// the webhook's gone, so nothing to retry and the dead letter stays
+	ok, err := wd.RetryDeadLetter("d1")
+	if ok || err != nil {
+		t.Fatalf("RetryDeadLetter = %v, %v", ok, err)
+	}
+	if dead, _ := store.GetWebhookDeadLetter("d1"); dead == nil {
+		t.Error("dead letter was consumed")
+	}
+}
+
+func TestWebhook_UpdateKeepsSecret(t *testing.T) {
+	store := newMemWebhookStore()
+	wd := newTestWebhookDispatcher(t, store, "http://127.0.0.1:1")
+
+	// the update leaves out the secret
+	r := httptest.NewRequest(http.MethodPut, "/webhooks/hook", strings.NewReader(`{"url":"http://127.0.0.1:2","events":["alert"]}`))
+	r.SetPathValue("id", "hook")
+	w := httptest.NewRecorder()
+	wd.handleUpdate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v: %v", w.Code, w.Body.String())
+	}
+	hook, _ := wd.GetWebhook("hook")
+	if hook.Secret != "shh" || hook.Url != "http://127.0.0.1:2" {
+		t.Errorf("unexpected webhook after update: %+v", hook)
+	}
+}
+
+func TestWebhook_Backoff(t *testing.T) {
+	wd := &WebhookDispatcher{baseDelay: time.Second, maxDelay: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range want {
+		if got := wd.backoff(i + 1); got != d {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, d)
+		}
+	}
+}
+
+func TestWebhook_DrainDeadLetters(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	store := newMemWebhookStore()
+	wd := newStoppedWebhookDispatcher(t, store, receiver.URL)
+	wd.baseDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		wd.Run(ctx)
+		close(stopped)
+	}()
+
+	// one waiting on its retry when we stop, one still queued after
+	wd.Notify(&DeviceEvent{EVENT_ALERT, "123456", time.Now(), &Alert_Schema{Id: "a1"}})
+	waitFor(t, "the first attempt", func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return len(store.attempts) == 1
+	})
+	cancel()
+	<-stopped
+	wd.Notify(&DeviceEvent{EVENT_ALERT, "123456", time.Now(), &Alert_Schema{Id: "a2"}})
+	wd.Drain()
+
+	// and anything after is dead lettered straight away
+	wd.Notify(&DeviceEvent{EVENT_ALERT, "123456", time.Now(), &Alert_Schema{Id: "a3"}})
+	dead, _ := store.QueryWebhookDeadLetters()
+	attempts := make(map[int]int)
+	for _, d := range dead {
+		attempts[d.Attempts]++
+	}
+	if len(dead) != 3 || attempts[1] != 1 || attempts[0] != 2 {
+		t.Errorf("expected 3 dead letters, 1 after an attempt, got %+v", dead)
+	}
+	if len(wd.retries) != 0 || len(store.attempts) != 1 {
+		t.Errorf("expected no retries left and no more attempts, got %v and %v", len(wd.retries), len(store.attempts))
+	}
+}
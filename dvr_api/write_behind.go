@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.uber.org/zap"
+)
+
+/*
+~~~~~~~~~~~~~~~
+WRITE BEHIND
+Messages and positions are queued here and written to the database in batches by one goroutine, so
+the message handler can publish straight away instead of waiting on a round trip per message. A
+batch is written when it's full or every WRITE_FLUSH_INTERVAL. Each device's messages go in as one
+$push, in the order they came in. A failed write is retried with backoff before anything newer is
+written, and given up on after WRITE_MAX_ATTEMPTS. Writes are at least once, a write that timed out
+after it went through gets written again.
+
+With a spill buffer, what's given up on is spilled to disk instead of dropped, and so is everything
+after it until the spill has been replayed, oldest first, so history stays in order. Replaying is
+tried every SPILL_REPLAY_INTERVAL. On shutdown there's no time to back off, so what's queued is tried
+once and spilled if it fails.
+
+Only lost connections and timeouts are retried or spilled. A write the database refuses, e.g. one that
+fails validation, would be refused again, so it's dropped with a log line.
+
+The queue is bounded. When it's full, queueing blocks until the writer catches up rather than losing
+messages.
+~~~~~~~~~~~~~~~
+*/
+
+const (
+	WRITE_BATCH_SIZE      int           = 500                    // most writes in one batch
+	WRITE_FLUSH_INTERVAL  time.Duration = 200 * time.Millisecond // longest a write waits for its batch to fill
+	WRITE_MAX_ATTEMPTS    int           = 5                      // tries at a batch before it's dropped
+	WRITE_RETRY_BACKOFF   time.Duration = time.Second            // wait after the first failure, doubling after each one
+	SPILL_REPLAY_INTERVAL time.Duration = 5 * time.Second        // how often we try to replay the spill buffer while the database is down
+)
+
+// one message or position waiting to be written
+type pendingWrite struct {
+	msg    *MessageWrapper
+	pos    *Position_Schema
+	queued time.Time
+}
+
+// how the writer is doing, sent to API clients
+type WriteStats_Response struct {
+	QueueDepth    int       `json:"queueDepth"` // waiting to be written, including the batch being written
+	QueueCapacity int       `json:"queueCapacity"`
+	LagSeconds    float64   `json:"lagSeconds"` // how long the oldest write has been waiting, spilled or queued, 0 if none are
+	Written       int64     `json:"written"`
+	Batches       int64     `json:"batches"`
+	Retries       int64     `json:"retries"`
+	Dropped       int64     `json:"dropped"` // refused by the database, or given up on and couldn't be spilled
+	Blocked       int64     `json:"blocked"` // times queueing had to wait for room
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+
+	// spill buffer, nil without one
+	Spilling bool                 `json:"spilling"` // writes are going to disk until the spill is replayed
+	Spilled  int64                `json:"spilled"`
+	Replayed int64                `json:"replayed"`
+	Spill    *SpillStats_Response `json:"spill,omitempty"`
+}
+
+// where batches are written, the DBConnection outside of tests. Each returns the indexes of the ones
+// that weren't written, all of them if it can't tell.
+type WriteBehindStore interface {
+	RecordMessages(msgs []*MessageWrapper) ([]int, error)
+	RecordPositions(positions []*Position_Schema) ([]int, error)
+}
+
+// batches writes off the hot path
+type WriteBehind struct {
+	// internal
+	queue    []pendingWrite
+	inFlight []pendingWrite // the batch being written
+	notFull  *sync.Cond     // signalled when there's room in the queue
+	wake     chan struct{}  // tells the writer a batch is ready
+	stats    WriteStats_Response
+	backoff  time.Duration // WRITE_RETRY_BACKOFF, shorter in tests
+	spill    *SpillBuffer  // where writes go while the database is down, nil to drop them
+	spilling bool          // there's something in the spill, so everything goes there until it's replayed
+	replayed time.Time     // when we last tried replaying
+	lock     sync.Mutex
+
+	// injected
+	logger   *zap.Logger
+	store    WriteBehindStore
+	capacity int
+}
+
+// constructor
+func NewWriteBehind(logger *zap.Logger, store WriteBehindStore, capacity int) (*WriteBehind, error) {
+	if capacity < WRITE_BATCH_SIZE {
+		return nil, fmt.Errorf("write queue capacity must be at least the batch size, %v", WRITE_BATCH_SIZE)
+	}
+	wb := &WriteBehind{
+		queue:    make([]pendingWrite, 0, capacity),
+		wake:     make(chan struct{}, 1),
+		backoff:  WRITE_RETRY_BACKOFF,
+		logger:   logger,
+		store:    store,
+		capacity: capacity,
+	}
+	wb.notFull = sync.NewCond(&wb.lock)
+	wb.stats.QueueCapacity = capacity
+	return wb, nil
+}
+
+// spill what can't be written to disk rather than dropping it. Picks up anything spilled before a
+// restart. Call before Run.
+func (wb *WriteBehind) SetSpill(spill *SpillBuffer) {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	wb.spill = spill
+	wb.spilling = !spill.IsEmpty()
+}
+
+// queue a message to be recorded, blocking while the queue is full
+func (wb *WriteBehind) RecordMessage(msgWrap *MessageWrapper) error {
+	var devId string
+	err := getIdFromMessage(&msgWrap.message, &devId)
+	if err != nil {
+		return fmt.Errorf("couldn't parse device id from message: %v", msgWrap.message)
+	}
+	// copy it, the caller's free to reuse theirs
+	msg := *msgWrap
+	wb.enqueue(pendingWrite{msg: &msg})
+	return nil
+}
+
+// queue a position to be recorded, blocking while the queue is full
+func (wb *WriteBehind) RecordPosition(pos *Position_Schema) error {
+	p := *pos
+	wb.enqueue(pendingWrite{pos: &p})
+	return nil
+}
+
+func (wb *WriteBehind) enqueue(pw pendingWrite) {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	if len(wb.queue) >= wb.capacity {
+		wb.stats.Blocked++
+		for len(wb.queue) >= wb.capacity {
+			wb.notFull.Wait()
+		}
+	}
+	pw.queued = time.Now()
+	wb.queue = append(wb.queue, pw)
+	if len(wb.queue) >= WRITE_BATCH_SIZE {
+		select {
+		case wb.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take the next batch off the queue, nil if it's empty
+func (wb *WriteBehind) nextBatch() []pendingWrite {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	n := min(len(wb.queue), WRITE_BATCH_SIZE)
+	if n == 0 {
+		return nil
+	}
+	wb.inFlight = append([]pendingWrite{}, wb.queue[:n]...)
+	wb.queue = append(wb.queue[:0], wb.queue[n:]...)
+	wb.notFull.Broadcast()
+	return wb.inFlight
+}
+
+// write what's queued, blocking until the queue is empty
+func (wb *WriteBehind) Flush() {
+	wb.flush(WRITE_MAX_ATTEMPTS)
+}
+
+// write what's queued, giving up on a batch after the attempts given
+func (wb *WriteBehind) flush(attempts int) {
+	for batch := wb.nextBatch(); batch != nil; batch = wb.nextBatch() {
+		wb.lock.Lock()
+		spilling := wb.spilling
+		wb.lock.Unlock()
+		if spilling {
+			wb.spillBatch(batch)
+		} else {
+			wb.writeBatch(batch, attempts)
+		}
+	}
+}
+
+// put a batch in the spill buffer, or drop it if there isn't room
+func (wb *WriteBehind) spillBatch(batch []pendingWrite) {
+	err := wb.spill.Append(batch)
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	wb.inFlight = nil
+	if err != nil {
+		wb.stats.Dropped += int64(len(batch))
+		wb.stats.LastError = fmt.Sprintf("error spilling writes: %v", err)
+		wb.stats.LastErrorTime = time.Now()
+		wb.logger.Error("dropped writes that couldn't be spilled", zap.Int("dropped", len(batch)), zap.Error(err))
+		return
+	}
+	wb.stats.Spilled += int64(len(batch))
+}
+
+// write the oldest spilled segment, keeping what doesn't go in for next time. Stops spilling once
+// there's nothing left.
+func (wb *WriteBehind) replay(now time.Time) error {
+	wb.lock.Lock()
+	if !wb.spilling || now.Sub(wb.replayed) < SPILL_REPLAY_INTERVAL {
+		wb.lock.Unlock()
+		return nil
+	}
+	wb.replayed = now
+	wb.lock.Unlock()
+
+	name, spilled, err := wb.spill.Oldest()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		wb.lock.Lock()
+		wb.spilling = false
+		wb.replayed = time.Time{}
+		wb.lock.Unlock()
+		wb.logger.Info("spill buffer replayed, writing to the database again")
+		return nil
+	}
+
+	var writeErr error
+	remaining := spilled
+	for len(remaining) > 0 {
+		n := min(len(remaining), WRITE_BATCH_SIZE)
+		failed, dropped, err := wb.write(remaining[:n])
+		wb.lock.Lock()
+		wb.stats.Replayed += int64(n - len(failed) - dropped)
+		wb.lock.Unlock()
+		if err != nil {
+			writeErr = err
+			remaining = append(failed, remaining[n:]...)
+			break
+		}
+		remaining = remaining[n:]
+	}
+	err = wb.spill.Replace(name, remaining)
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error replaying spill: %v", writeErr)
+	}
+
+	// straight on to the next segment
+	wb.lock.Lock()
+	wb.replayed = time.Time{}
+	wb.lock.Unlock()
+	return nil
+}
+
+// write a batch, retrying what fails until it's been tried the attempts given
+func (wb *WriteBehind) writeBatch(batch []pendingWrite, attempts int) {
+	backoff := wb.backoff
+	for attempt := 1; ; attempt++ {
+		failed, dropped, err := wb.write(batch)
+		wb.lock.Lock()
+		wb.stats.Written += int64(len(batch) - len(failed) - dropped)
+		if attempt == 1 {
+			wb.stats.Batches++
+		}
+		if err == nil {
+			wb.inFlight = nil
+			wb.lock.Unlock()
+			return
+		}
+		wb.stats.LastError = err.Error()
+		wb.stats.LastErrorTime = time.Now()
+		if attempt >= attempts {
+			if wb.spill != nil {
+				// everything goes to the spill from here until it's replayed
+				wb.spilling = true
+				wb.replayed = time.Now()
+				wb.lock.Unlock()
+				wb.logger.Error("gave up writing to the database, spilling to disk", zap.Int("spilled", len(failed)), zap.Error(err))
+				wb.spillBatch(failed)
+				return
+			}
+			wb.stats.Dropped += int64(len(failed))
+			wb.inFlight = nil
+			wb.lock.Unlock()
+			wb.logger.Error("gave up writing to the database", zap.Int("dropped", len(failed)), zap.Error(err))
+			return
+		}
+		wb.stats.Retries++
+		batch = failed
+		wb.inFlight = failed
+		wb.lock.Unlock()
+
+		wb.logger.Warn("error writing to the database, retrying", zap.Int("failed", len(failed)), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// write the messages and positions in a batch, returning the ones that weren't written and should be
+// tried again, and how many were refused and dropped
+func (wb *WriteBehind) write(batch []pendingWrite) ([]pendingWrite, int, error) {
+	msgs := make([]*MessageWrapper, 0, len(batch))
+	msgIdx := make([]int, 0, len(batch))
+	positions := make([]*Position_Schema, 0)
+	posIdx := make([]int, 0)
+	for i, pw := range batch {
+		if pw.msg != nil {
+			msgs = append(msgs, pw.msg)
+			msgIdx = append(msgIdx, i)
+		} else {
+			positions = append(positions, pw.pos)
+			posIdx = append(posIdx, i)
+		}
+	}
+
+	failed := make([]pendingWrite, 0)
+	dropped := 0
+	var errs []error
+	// what wasn't written goes back to be retried, unless it was refused
+	sortFailures := func(what string, notWritten []int, idx []int, err error) {
+		if err == nil {
+			return
+		}
+		failures := make([]pendingWrite, len(notWritten))
+		for i, n := range notWritten {
+			failures[i] = batch[idx[n]]
+		}
+		transient := isTransientWriteError(err)
+		err = fmt.Errorf("error recording %v: %v", what, err)
+		if transient {
+			failed = append(failed, failures...)
+			errs = append(errs, err)
+			return
+		}
+		wb.drop(failures, err)
+		dropped += len(failures)
+	}
+	if len(msgs) > 0 {
+		notWritten, err := wb.store.RecordMessages(msgs)
+		sortFailures("messages", notWritten, msgIdx, err)
+	}
+	if len(positions) > 0 {
+		notWritten, err := wb.store.RecordPositions(positions)
+		sortFailures("positions", notWritten, posIdx, err)
+	}
+	return failed, dropped, errors.Join(errs...)
+}
+
+// give up on writes the database refused
+func (wb *WriteBehind) drop(failures []pendingWrite, err error) {
+	wb.lock.Lock()
+	wb.stats.Dropped += int64(len(failures))
+	wb.stats.LastError = err.Error()
+	wb.stats.LastErrorTime = time.Now()
+	wb.lock.Unlock()
+	wb.logger.Error("dropped writes the database refused", zap.Int("dropped", len(failures)), zap.Error(err))
+}
+
+// is a failed write worth trying again. Lost connections and timeouts are, a write the database
+// refused, or a message we couldn't make sense of, isn't.
+func isTransientWriteError(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if isTransientWriteError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError != nil {
+		return true
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) ||
+		errors.As(err, &topology.ServerSelectionError{}) || errors.Is(err, mongo.ErrClientDisconnected)
+}
+
+// write batches as they fill or every interval, blocking. Once the context is done what's queued is
+// written, or spilled, before returning. There's no time for backoff then, so each write is tried
+// once and spilled if it fails.
+func (wb *WriteBehind) Run(ctx context.Context) {
+	ticker := time.NewTicker(WRITE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wb.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			wb.flush(1)
+			return
+		}
+		// the spill is older than anything queued, so it goes first
+		err := wb.replay(time.Now())
+		if err != nil {
+			wb.lock.Lock()
+			wb.stats.LastError = err.Error()
+			wb.stats.LastErrorTime = time.Now()
+			wb.lock.Unlock()
+			wb.logger.Warn("error replaying spilled writes", zap.Error(err))
+		}
+		wb.Flush()
+	}
+}
+
+// how the writer is doing
+func (wb *WriteBehind) Stats(now time.Time) WriteStats_Response {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	stats := wb.stats
+	stats.QueueDepth = len(wb.queue) + len(wb.inFlight)
+	oldest := time.Time{}
+	if len(wb.inFlight) > 0 {
+		oldest = wb.inFlight[0].queued
+	} else if len(wb.queue) > 0 {
+		oldest = wb.queue[0].queued
+	}
+	if !oldest.IsZero() {
+		stats.LagSeconds = now.Sub(oldest).Seconds()
+	}
+	stats.Spilling = wb.spilling
+	if wb.spill != nil {
+		spill := wb.spill.Stats()
+		stats.Spill = &spill
+		// what's on disk is older than anything queued
+		if !spill.Oldest.IsZero() {
+			stats.LagSeconds = now.Sub(spill.Oldest).Seconds()
+		}
+	}
+	return stats
+}
+
+// add the writer's endpoints to the http server
+func (wb *WriteBehind) RegisterRoutes(svr *httpSvr) {
+	svr.HandleFunc("GET /writes/status", wb.handleStatus)
+}
+
+// GET /writes/status
+func (wb *WriteBehind) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, wb.Stats(time.Now()))
+}
+
+// the indexes a bulk write didn't manage, all of them if it's not a bulk write error
+func bulkWriteFailures(err error, n int) []int {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 && bwe.WriteConcernError == nil {
+		failed := make([]int, len(bwe.WriteErrors))
+		for i, we := range bwe.WriteErrors {
+			failed[i] = we.Index
+		}
+		return failed
+	}
+	failed := make([]int, n)
+	for i := range failed {
+		failed[i] = i
+	}
+	return failed
+}
+
+// push a batch of messages onto their devices' history, one update per device. Returns the indexes of
+// the messages that weren't written, a message without a device id doesn't stop the rest going in.
+func (dbc *DBConnection) RecordMessages(msgs []*MessageWrapper) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("devices")
+
+	// group by device, keeping the order they came in
+	devices := make([]string, 0)
+	byDevice := make(map[string][]int)
+	failed := make([]int, 0)
+	var errs []error
+	for i, msg := range msgs {
+		var devId string
+		err := getIdFromMessage(&msg.message, &devId)
+		if err != nil {
+			failed = append(failed, i)
+			errs = append(errs, fmt.Errorf("couldn't parse device id from message: %v", msg.message))
+			continue
+		}
+		if _, ok := byDevice[devId]; !ok {
+			devices = append(devices, devId)
+		}
+		byDevice[devId] = append(byDevice[devId], i)
+	}
+
+	models := make([]mongo.WriteModel, len(devices))
+	for i, devId := range devices {
+		history := make([]DeviceMessage_Schema, len(byDevice[devId]))
+		for j, idx := range byDevice[devId] {
+			packetTime, _ := getDateFromMessage(msgs[idx].message)
+			history[j] = DeviceMessage_Schema{
+				RecvdTime:  msgs[idx].recvdTime,
+				PacketTime: packetTime,
+				Message:    msgs[idx].message,
+				Direction:  msgs[idx].direction,
+			}
+		}
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"DeviceId": devId}).
+			SetUpdate(bson.M{"$push": bson.M{"MsgHistory": bson.M{"$each": history}}}).
+			SetUpsert(true)
+	}
+
+	if len(models) > 0 {
+		_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			for _, i := range bulkWriteFailures(err, len(models)) {
+				failed = append(failed, byDevice[devices[i]]...)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	sort.Ints(failed)
+	return failed, errors.Join(errs...)
+}
+
+// insert a batch of positions. Returns the indexes of the positions that weren't written.
+func (dbc *DBConnection) RecordPositions(positions []*Position_Schema) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coll := dbc.client.Database(dbc.dbName).Collection("positions")
+	docs := make([]interface{}, len(positions))
+	for i, pos := range positions {
+		docs[i] = pos
+	}
+	_, err := coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		return bulkWriteFailures(err, len(docs)), err
+	}
+	return nil, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// in memory WriteBehindStore, losing the connection for the first failures writes of messages and
+// refusing messages in refuse
+type memWriteBehindStore struct {
+	lock      sync.Mutex
+	messages  []string
+	positions []Position_Schema
+	failures  int
+	refuse    map[string]bool
+	calls     int
+}
+
+func (m *memWriteBehindStore) RecordMessages(msgs []*MessageWrapper) ([]int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls++
+	if len(m.refuse) > 0 {
+		// the rest go in, as an unordered bulk write would
+		bwe := mongo.BulkWriteException{}
+		for i, msg := range msgs {
+			if m.refuse[msg.message] {
+				bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: 121, Message: "document failed validation"}})
+			} else {
+				m.messages = append(m.messages, msg.message)
+			}
+		}
+		if len(bwe.WriteErrors) > 0 {
+			return bulkWriteFailures(bwe, len(msgs)), bwe
+		}
+		return nil, nil
+	}
+	if m.failures > 0 {
+		m.failures--
+		// the first half go in, as a bulk write that half fails would
+		failed := make([]int, 0)
+		for i, msg := range msgs {
+			if i < len(msgs)/2 {
+				m.messages = append(m.messages, msg.message)
+			} else {
+				failed = append(failed, i)
+			}
+		}
+		return failed, mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+	}
+	for _, msg := range msgs {
+		m.messages = append(m.messages, msg.message)
+	}
+	return nil, nil
+}
+
+func (m *memWriteBehindStore) RecordPositions(positions []*Position_Schema) ([]int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, pos := range positions {
+		m.positions = append(m.positions, *pos)
+	}
+	return nil, nil
+}
+
+func newTestWriteBehind(t *testing.T, store *memWriteBehindStore, capacity int) *WriteBehind {
+	wb, err := NewWriteBehind(zap.NewNop(), store, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.backoff = time.Millisecond
+	return wb
+}
+
+func TestWriteBehind_Flush(t *testing.T) {
+	store := &memWriteBehindStore{failures: 1}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE*2)
+
+	devId := "123"
+	n := WRITE_BATCH_SIZE + 10
+	for i := 0; i < n; i++ {
+		err := wb.RecordMessage(&MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wb.RecordPosition(&Position_Schema{DeviceId: "123"})
+	if err := wb.RecordMessage(&MessageWrapper{"$GPS;no id", &devId, time.Now(), DirectionFromDevice, 0}); err == nil {
+		t.Errorf("expected a message without a device id to be refused")
+	}
+
+	stats := wb.Stats(time.Now().Add(time.Second))
+	if stats.QueueDepth != n+1 || stats.LagSeconds < 1 {
+		t.Errorf("expected %v queued a second behind, got %+v", n+1, stats)
+	}
+
+	wb.Flush()
+	stats = wb.Stats(time.Now())
+	if stats.QueueDepth != 0 || stats.LagSeconds != 0 {
+		t.Errorf("expected an empty queue, got %+v", stats)
+	}
+	if len(store.messages) != n || len(store.positions) != 1 {
+		t.Fatalf("expected %v messages and 1 position, got %v and %v", n, len(store.messages), len(store.positions))
+	}
+	// the retry goes in before anything newer
+	for i, msg := range store.messages {
+		if msg != fmt.Sprintf("$GPS;123;%v", i) {
+			t.Fatalf("messages out of order at %v: %v", i, msg)
+		}
+	}
+	if stats.Written != int64(n+1) || stats.Batches != 2 || stats.Retries != 1 || stats.Dropped != 0 || stats.LastError == "" {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestWriteBehind_GiveUp(t *testing.T) {
+	store := &memWriteBehindStore{failures: WRITE_MAX_ATTEMPTS}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+
+	devId := "123"
+	for i := 0; i < 4; i++ {
+		wb.RecordMessage(&MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	wb.Flush()
+	stats := wb.Stats(time.Now())
+	// 2 go in first time, then 1 of the 2 left, then none of the last one
+	if store.calls != WRITE_MAX_ATTEMPTS || stats.Written != 3 || stats.Dropped != 1 {
+		t.Errorf("expected %v attempts, 3 written and 1 dropped, got %v and %+v", WRITE_MAX_ATTEMPTS, store.calls, stats)
+	}
+}
+
+func TestWriteBehind_Refused(t *testing.T) {
+	store := &memWriteBehindStore{refuse: map[string]bool{"$GPS;123;1": true}}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+	spill, err := NewSpillBuffer(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.SetSpill(spill)
+
+	// a refused write isn't retried or spilled, it would only be refused again
+	devId := "123"
+	for i := 0; i < 3; i++ {
+		wb.RecordMessage(&MessageWrapper{fmt.Sprintf("$GPS;123;%v", i), &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	wb.Flush()
+	stats := wb.Stats(time.Now())
+	if store.calls != 1 || stats.Written != 2 || stats.Dropped != 1 || stats.Retries != 0 || stats.Spilling || !spill.IsEmpty() {
+		t.Errorf("expected 1 attempt, 2 written and 1 dropped, got %v and %+v", store.calls, stats)
+	}
+}
+
+func TestWriteBehind_Blocks(t *testing.T) {
+	store := &memWriteBehindStore{}
+	wb := newTestWriteBehind(t, store, WRITE_BATCH_SIZE)
+
+	devId := "123"
+	for i := 0; i < WRITE_BATCH_SIZE; i++ {
+		wb.RecordMessage(&MessageWrapper{"$GPS;123", &devId, time.Now(), DirectionFromDevice, 0})
+	}
+	done := make(chan struct{})
+	go func() {
+		wb.RecordMessage(&MessageWrapper{"$GPS;123", &devId, time.Now(), DirectionFromDevice, 0})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected queueing to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	wb.Flush()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected queueing to carry on once there's room")
+	}
+	if wb.Stats(time.Now()).Blocked != 1 {
+		t.Errorf("expected the block to be counted")
+	}
+}
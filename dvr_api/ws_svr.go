@@ -12,20 +12,41 @@ import (
 	"nhooyr.io/websocket/wsjson"
 )
 
+// a connected api client, and the version of the api it speaks
+type wsClient struct {
+	conn       *websocket.Conn
+	apiVersion int
+}
+
+// subprotocols a client can request, one per api version
+const (
+	WS_SUBPROTOCOL_V1 string = "dvr_api"
+	WS_SUBPROTOCOL_V2 string = "dvr_api.v2"
+)
+
 type WebSockSvr struct {
 	logger              *zap.Logger
-	endpoint            string                     // IP + port, ex: "192.168.1.77:9047"
-	capacity            int                        // num of connections
-	sockOpBufSize       int                        // how much memory do we give each connection to perform send/recv operations
-	sockOpBufStack      Stack[*[]byte]             // memory region we give each conn to so send/recv
-	svrMsgBufSize       int                        // how many messages can we queue on the server at once
-	svrMsgBufChan       chan MessageWrapper        // chahnel we use to queue messages
-	svrSubReqBufChan    chan SubReqWrapper         // channel we use to queue subscription requests
-	connIndex           Dictionary[websocket.Conn] // index the connection objects against the ids of the clients represented thusly
-	getConnectedDevices func() []string            // function to retreive an index of connected devices
+	endpoint            string                   // IP + port, ex: "192.168.1.77:9047"
+	capacity            int                      // num of connections
+	sockOpBufSize       int                      // how much memory do we give each connection to perform send/recv operations
+	sockOpBufStack      Stack[*[]byte]           // memory region we give each conn to so send/recv
+	svrMsgBufSize       int                      // how many messages can we queue on the server at once
+	svrMsgQueue         *MsgQueue                // queue we put messages on
+	svrSubReqBufChan    chan SubReqWrapper       // channel we use to queue subscription requests
+	connIndex           Dictionary[wsClient]     // index the connection objects against the ids of the clients represented thusly
+	getConnectedDevices func() []string          // function to retreive an index of connected devices
+	queue               *CommandQueue            // commands waiting for devices to connect, nil if there's no queue
+	directory           *DeviceDirectory         // resolves groups and tags in requests, nil if not set
+	conns               connSet[*websocket.Conn] // open websocket connections
 }
 
-func NewWebSockSvr(logger *zap.Logger, endpoint string, capacity int, bufSize int, svrMsgBufSize int, getConnectedDevices func() []string) (*WebSockSvr, error) {
+func NewWebSockSvr(logger *zap.Logger, endpoint string, capacity int, bufSize int, svrMsgBufSize int, overloadPolicy OverloadPolicy, getConnectedDevices func() []string) (*WebSockSvr, error) {
+	// queue between the connections and the message handler
+	queue, err := NewMsgQueue("clients", svrMsgBufSize, overloadPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	// create the struct
 	svr := WebSockSvr{
 		logger,
@@ -34,10 +55,13 @@ func NewWebSockSvr(logger *zap.Logger, endpoint string, capacity int, bufSize in
 		bufSize,
 		Stack[*[]byte]{},
 		svrMsgBufSize,
-		make(chan MessageWrapper),
+		queue,
 		make(chan SubReqWrapper),
-		Dictionary[websocket.Conn]{},
-		getConnectedDevices}
+		Dictionary[wsClient]{},
+		getConnectedDevices,
+		nil,
+		nil,
+		connSet[*websocket.Conn]{}}
 
 	// init things that need initing
 	svr.sockOpBufStack.Init()
@@ -51,6 +75,16 @@ func NewWebSockSvr(logger *zap.Logger, endpoint string, capacity int, bufSize in
 	return &svr, nil
 }
 
+// let clients list and cancel queued commands. Call before Run.
+func (s *WebSockSvr) SetCommandQueue(queue *CommandQueue) {
+	s.queue = queue
+}
+
+// let clients pick devices by group and tag. Call before Run.
+func (s *WebSockSvr) SetDirectory(directory *DeviceDirectory) {
+	s.directory = directory
+}
+
 // create and store our buffers
 func (s *WebSockSvr) Init() error {
 	for i := 0; i < s.capacity; i++ {
@@ -60,8 +94,8 @@ func (s *WebSockSvr) Init() error {
 	return nil
 }
 
-// run the server
-func (s *WebSockSvr) Run() {
+// run the server, blocking until the context is done and every client has been closed
+func (s *WebSockSvr) Run(ctx context.Context) {
 	// listen tcp
 	l, err := net.Listen("tcp", s.endpoint)
 	if err != nil {
@@ -74,10 +108,26 @@ func (s *WebSockSvr) Run() {
 	httpSvr := &http.Server{
 		Handler: s,
 	}
+
+	// stop accepting when we're told to. Websockets aren't waited for by Shutdown, they're ours to close.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		err := httpSvr.Shutdown(context.Background())
+		if err != nil {
+			s.logger.Error("error stopping websocket server", zap.Error(err))
+		}
+		s.conns.CloseAll(func(c *websocket.Conn) {
+			c.Close(websocket.StatusGoingAway, "server shutting down")
+		})
+	}()
 	err = httpSvr.Serve(l)
-	if err != nil {
+	if err != http.ErrServerClosed {
 		s.logger.Fatal("error serving websocket server: %v", zap.Error(err))
 	}
+	<-stopped
+	s.logger.Info("websocket server stopped")
 }
 
 // func called for each connection to handle the websocket connection request, calls and blocks on connHandler
@@ -85,9 +135,9 @@ func (s *WebSockSvr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// accept wenbsocket connection
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		Subprotocols:       []string{"dvr_api"},
-		OriginPatterns:     []string{"*"}, // Accept all origins for simplicity; customize as needed
-		InsecureSkipVerify: true,          // Not recommended for production, remove this line in a real application
+		Subprotocols:       []string{WS_SUBPROTOCOL_V2, WS_SUBPROTOCOL_V1}, // prefer the newest the client offers
+		OriginPatterns:     []string{"*"},                                  // Accept all origins for simplicity; customize as needed
+		InsecureSkipVerify: true,                                           // Not recommended for production, remove this line in a real application
 	})
 
 	// handle err
@@ -97,15 +147,26 @@ func (s *WebSockSvr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	s.logger.Info("connection accepted on api svr...")
 
-	// don't really need this but why not
-	if c.Subprotocol() != "dvr_api" {
-		s.logger.Debug("declined connection because subprotocol != dvr_api")
+	// the subprotocol the client picked tells us which version of the api it speaks
+	var apiVersion int
+	switch c.Subprotocol() {
+	case WS_SUBPROTOCOL_V1:
+		apiVersion = API_V1
+	case WS_SUBPROTOCOL_V2:
+		apiVersion = API_V2
+	default:
+		s.logger.Debug("declined connection because subprotocol isn't a dvr_api version")
 		c.Close(websocket.StatusPolicyViolation, "client must speak the dvr_api subprotocol")
 		return
 	}
 
-	// handle connection
-	err = s.connHandler(c)
+	// handle connection, unless we're shutting down
+	if !s.conns.Add(c) {
+		c.Close(websocket.StatusGoingAway, "server shutting down")
+		return
+	}
+	defer s.conns.Done(c)
+	err = s.connHandler(c, apiVersion)
 	if err != nil {
 		s.logger.Error("error in connection handler func: %v", zap.Error(err))
 	}
@@ -124,7 +185,7 @@ func (s *WebSockSvr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
  */
 
 // handle one connection.
-func (s *WebSockSvr) connHandler(conn *websocket.Conn) error {
+func (s *WebSockSvr) connHandler(conn *websocket.Conn, apiVersion int) error {
 
 	// req = reusable holder for string, gen id as an arbitrary number
 	var req ApiReq_WS
@@ -133,8 +194,10 @@ func (s *WebSockSvr) connHandler(conn *websocket.Conn) error {
 	var subscriptions []string
 
 	// add to connection index, defer the removal from the connection index
-	s.connIndex.Add(id, *conn)
+	s.connIndex.Add(id, wsClient{conn, apiVersion})
 	defer s.connIndex.Delete(id)
+	s.svrMsgQueue.Connect(id)
+	defer s.svrMsgQueue.Disconnect(id)
 
 	// connection loop
 	for {
@@ -148,19 +211,115 @@ func (s *WebSockSvr) connHandler(conn *websocket.Conn) error {
 
 		// if they have send a request for the connected devices list then oblige
 		if req.GetConnectedDevices {
-			res = ApiRes_WS{s.getConnectedDevices()}
+			connected := s.getConnectedDevices()
+			if s.directory != nil {
+				connected = s.directory.Filter(connected, req.ConnectedDevicesFilter)
+			}
+			res = ApiRes_WS{connected}
 			wsjson.Write(context.TODO(), conn, &res)
 		}
 
+		// the devices in the groups/with the tags asked for are subscribed to as they are now
+		newSubscriptions := req.Subscriptions
+		if s.directory != nil {
+			newSubscriptions = s.directory.Expand(req.Subscriptions, req.SubscriptionFilter)
+		}
+
 		// register the subscription request
-		s.svrSubReqBufChan <- SubReqWrapper{clientId: &id, newDevlist: req.Subscriptions, oldDevlist: subscriptions}
-		subscriptions = make([]string, len(req.Subscriptions))
-		copy(subscriptions, req.Subscriptions)
+		s.svrSubReqBufChan <- SubReqWrapper{clientId: &id, newDevlist: newSubscriptions, oldDevlist: subscriptions}
+		subscriptions = make([]string, len(newSubscriptions))
+		copy(subscriptions, newSubscriptions)
+
+		// cancel queued commands and send queues if they asked
+		if s.queue != nil && (len(req.CancelQueued) > 0 || len(req.GetQueue) > 0) {
+			s.queueRequest(conn, &req)
+		}
+
+		// how long to queue the messages for if their device isn't connected, 0 to not queue them
+		var queueTtl time.Duration
+		if req.QueueIfOffline {
+			queueTtl = CMD_QUEUE_DEFAULT_TTL
+			if req.QueueTtlSeconds > 0 {
+				queueTtl = time.Duration(req.QueueTtlSeconds) * time.Second
+			}
+		}
 
 		// todo pass the array instead of the induvidual message
 		for _, val := range req.Messages {
-			s.svrMsgBufChan <- MessageWrapper{val, &id, time.Now()}
+			err = s.queueMessage(MessageWrapper{val, &id, time.Now(), DirectionToDevice, queueTtl})
+			if err != nil {
+				break
+			}
+		}
+
+		// render the structured commands, telling the client about the ones that don't validate
+		if err == nil && len(req.Commands) > 0 {
+			err = s.commandRequest(conn, &req, &id, queueTtl)
+		}
+		if err == errSourceOverloaded {
+			s.logger.Warn("disconnecting api client sending too fast", zap.String("id", id))
+			conn.Close(websocket.StatusPolicyViolation, "sending messages too fast")
+			return nil
 		}
 		req = ApiReq_WS{}
 	}
 }
+
+// put a message from a client on the queue. Only errors if the client should be disconnected.
+func (s *WebSockSvr) queueMessage(msgWrap MessageWrapper) error {
+	err := s.svrMsgQueue.Push(*msgWrap.clientId, msgWrap)
+	if err == errMsgDropped {
+		s.logger.Debug("dropped message from api client", zap.String("id", *msgWrap.clientId))
+		return nil
+	}
+	return err
+}
+
+// render and send structured commands. A command's own queueTtlSeconds overrides the request's.
+// Only errors if the client should be disconnected.
+func (s *WebSockSvr) commandRequest(conn *websocket.Conn, req *ApiReq_WS, id *string, queueTtl time.Duration) error {
+	res := ApiCommandRes_WS{make([]CommandError_Response, 0)}
+	for i := range req.Commands {
+		message, err := renderCommand(&req.Commands[i])
+		if err != nil {
+			res.CommandErrors = append(res.CommandErrors, CommandError_Response{i, err.Error()})
+			continue
+		}
+		ttl := queueTtl
+		if req.Commands[i].QueueTtlSeconds > 0 {
+			ttl = time.Duration(req.Commands[i].QueueTtlSeconds) * time.Second
+		}
+		err = s.queueMessage(MessageWrapper{message, id, time.Now(), DirectionToDevice, ttl})
+		if err != nil {
+			return err
+		}
+	}
+	if len(res.CommandErrors) > 0 {
+		wsjson.Write(context.TODO(), conn, &res)
+	}
+	return nil
+}
+
+// cancel the queued commands asked for then send the queues asked for, which show the cancelled
+// commands' new status
+func (s *WebSockSvr) queueRequest(conn *websocket.Conn, req *ApiReq_WS) {
+	for _, cmdId := range req.CancelQueued {
+		_, _, err := s.queue.Cancel(cmdId)
+		if err != nil {
+			s.logger.Error("error cancelling queued command", zap.String("cmdId", cmdId), zap.Error(err))
+		}
+	}
+	if len(req.GetQueue) == 0 {
+		return
+	}
+	res := ApiQueueRes_WS{make([]QueuedCommand_Schema, 0)}
+	for _, devId := range req.GetQueue {
+		cmds, err := s.queue.GetQueue(devId, false)
+		if err != nil {
+			s.logger.Error("error getting queued commands", zap.String("devId", devId), zap.Error(err))
+			continue
+		}
+		res.QueuedCommands = append(res.QueuedCommands, cmds...)
+	}
+	wsjson.Write(context.TODO(), conn, &res)
+}